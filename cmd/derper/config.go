@@ -0,0 +1,392 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"inet.af/netaddr"
+	"tailscale.com/atomicfile"
+	"tailscale.com/derp"
+	"tailscale.com/tsweb"
+	"tailscale.com/types/key"
+)
+
+// config is the format of derper's config file (-c).
+//
+// Only PrivateKey is required. A config file holding just a new
+// PrivateKey is written if there isn't one. Every other setting
+// defaults to the value of its flag.
+//
+// On SIGHUP, derper rereads the file and applies changes to
+// Mesh.With, Admission and DebugAccessCIDRs while running. Changes
+// to the other settings need a restart.
+type config struct {
+	PrivateKey wgcfg.PrivateKey
+
+	// Addr is the address to serve DERP on (-a).
+	Addr string `json:",omitempty"`
+	// HTTPAddr is the address to serve plain HTTP on when
+	// serving LetsEncrypt certs, for ACME challenges and
+	// redirects to HTTPS. It defaults to ":80".
+	HTTPAddr string `json:",omitempty"`
+	// STUNAddr, if non-empty, is the UDP address to serve
+	// STUN on. -stun sets it to ":3478".
+	STUNAddr string `json:",omitempty"`
+
+	TLS       *tlsConfig       `json:",omitempty"`
+	Mesh      *meshConfig      `json:",omitempty"`
+	Admission *admissionConfig `json:",omitempty"`
+
+	// DebugAccessCIDRs are networks whose hosts may use the
+	// /debug/ handlers, in addition to localhost and Tailscale IPs.
+	DebugAccessCIDRs []string `json:",omitempty"`
+}
+
+// tlsConfig is how derper gets its TLS certificate.
+type tlsConfig struct {
+	// Mode is "letsencrypt" to get certs from LetsEncrypt,
+	// "manual" to load them from CertFile and KeyFile, or "none"
+	// to serve plain HTTP (-certmode). If empty, it's
+	// "letsencrypt" if Addr's port is 443, and "none" otherwise.
+	Mode string `json:",omitempty"`
+	// Hostname is the server's host name, for LetsEncrypt
+	// (-hostname).
+	Hostname string `json:",omitempty"`
+	// CertDir is the directory LetsEncrypt certs are stored in
+	// (-certdir).
+	CertDir string `json:",omitempty"`
+	// CertFile and KeyFile are the certificate and key files for
+	// Mode "manual". They default to Hostname plus ".crt" and
+	// ".key" in CertDir.
+	CertFile string `json:",omitempty"`
+	KeyFile  string `json:",omitempty"`
+}
+
+// meshConfig is the DERP region's mesh membership.
+type meshConfig struct {
+	// PSKFile is the file holding the mesh pre-shared key
+	// (-mesh-psk-file).
+	PSKFile string `json:",omitempty"`
+	// With is the host names of the servers to mesh with
+	// (-mesh-with). It may include this server's own.
+	With []string `json:",omitempty"`
+}
+
+// admissionConfig is which clients may use the server, and how much.
+type admissionConfig struct {
+	// VerifyClientsFile is an allowlist file of client keys
+	// (-verify-clients-file).
+	VerifyClientsFile string `json:",omitempty"`
+	// VerifyClientURL is the URL of a policy service that
+	// admits clients (-verify-client-url).
+	VerifyClientURL string `json:",omitempty"`
+	// PacketsPerSecond and BytesPerSecond limit how fast each
+	// client may send (-client-packet-rate, -client-byte-rate).
+	PacketsPerSecond float64 `json:",omitempty"`
+	BytesPerSecond   float64 `json:",omitempty"`
+}
+
+func loadConfig() config {
+	if *dev {
+		cfg := config{PrivateKey: mustNewKey()}
+		cfg.setDefaults()
+		return cfg
+	}
+	if *configPath == "" {
+		log.Fatalf("derper: -c <config path> not specified")
+	}
+	cfg, err := readConfig(*configPath)
+	switch {
+	case os.IsNotExist(err):
+		cfg = writeNewConfig()
+	case err != nil:
+		log.Fatalf("derper: config: %v", err)
+	}
+	cfg.setDefaults()
+	if err := cfg.check(); err != nil {
+		log.Fatalf("derper: config: %v", err)
+	}
+	return cfg
+}
+
+// readConfig reads the config file at path, without defaults.
+func readConfig(path string) (config, error) {
+	var cfg config
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+func mustNewKey() wgcfg.PrivateKey {
+	key, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+func writeNewConfig() config {
+	key := mustNewKey()
+	if err := os.MkdirAll(filepath.Dir(*configPath), 0777); err != nil {
+		log.Fatal(err)
+	}
+	cfg := config{
+		PrivateKey: key,
+	}
+	b, err := json.MarshalIndent(cfg, "", "\t")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := atomicfile.WriteFile(*configPath, b, 0666); err != nil {
+		log.Fatal(err)
+	}
+	return cfg
+}
+
+// setDefaults fills in the settings cfg doesn't have from the flags.
+func (cfg *config) setDefaults() {
+	setString := func(v *string, def string) {
+		if *v == "" {
+			*v = def
+		}
+	}
+	setString(&cfg.Addr, *addr)
+	setString(&cfg.HTTPAddr, ":80")
+	if *runSTUN {
+		setString(&cfg.STUNAddr, ":3478")
+	}
+
+	if cfg.TLS == nil {
+		cfg.TLS = new(tlsConfig)
+	}
+	setString(&cfg.TLS.Mode, *certMode)
+	if cfg.TLS.Mode == "" {
+		if tsweb.IsProd443(cfg.Addr) {
+			cfg.TLS.Mode = "letsencrypt"
+		} else {
+			cfg.TLS.Mode = "none"
+		}
+	}
+	setString(&cfg.TLS.Hostname, *hostname)
+	setString(&cfg.TLS.CertDir, *certDir)
+	setString(&cfg.TLS.CertFile, filepath.Join(cfg.TLS.CertDir, cfg.TLS.Hostname+".crt"))
+	setString(&cfg.TLS.KeyFile, filepath.Join(cfg.TLS.CertDir, cfg.TLS.Hostname+".key"))
+
+	if cfg.Mesh == nil {
+		cfg.Mesh = new(meshConfig)
+	}
+	setString(&cfg.Mesh.PSKFile, *meshPSKFile)
+	if cfg.Mesh.With == nil && *meshWith != "" {
+		cfg.Mesh.With = strings.Split(*meshWith, ",")
+	}
+
+	if cfg.Admission == nil {
+		cfg.Admission = new(admissionConfig)
+	}
+	setString(&cfg.Admission.VerifyClientsFile, *verifyClientsFile)
+	setString(&cfg.Admission.VerifyClientURL, *verifyClientURL)
+	if cfg.Admission.PacketsPerSecond == 0 {
+		cfg.Admission.PacketsPerSecond = *clientPacketRate
+	}
+	if cfg.Admission.BytesPerSecond == 0 {
+		cfg.Admission.BytesPerSecond = *clientByteRate
+	}
+}
+
+// check reports whether cfg, with defaults set, is valid.
+func (cfg *config) check() error {
+	switch cfg.TLS.Mode {
+	case "letsencrypt":
+		if cfg.TLS.CertDir == "" {
+			return errors.New("TLS mode letsencrypt requires a cert dir")
+		}
+	case "manual", "none":
+	default:
+		return fmt.Errorf("unknown TLS mode %q", cfg.TLS.Mode)
+	}
+	if len(cfg.Mesh.With) > 0 && cfg.Mesh.PSKFile == "" {
+		return errors.New("meshing requires a mesh PSK file")
+	}
+	if _, err := cfg.debugAccessNets(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// debugAccessNets parses cfg.DebugAccessCIDRs.
+func (cfg *config) debugAccessNets() ([]netaddr.IPPrefix, error) {
+	var nets []netaddr.IPPrefix
+	for _, s := range cfg.DebugAccessCIDRs {
+		n, err := netaddr.ParseIPPrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("debug access CIDR: %v", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// restartNeeded returns the names of the settings that differ between
+// cfg and old that can't be changed without restarting.
+func (cfg *config) restartNeeded(old *config) []string {
+	var names []string
+	if cfg.PrivateKey != old.PrivateKey {
+		names = append(names, "PrivateKey")
+	}
+	if cfg.Addr != old.Addr {
+		names = append(names, "Addr")
+	}
+	if cfg.HTTPAddr != old.HTTPAddr {
+		names = append(names, "HTTPAddr")
+	}
+	if cfg.STUNAddr != old.STUNAddr {
+		names = append(names, "STUNAddr")
+	}
+	if !reflect.DeepEqual(cfg.TLS, old.TLS) {
+		names = append(names, "TLS")
+	}
+	if cfg.Mesh.PSKFile != old.Mesh.PSKFile {
+		names = append(names, "Mesh.PSKFile")
+	}
+	return names
+}
+
+// derper is the running server, with the settings it can change
+// without restarting.
+type derper struct {
+	s    *derp.Server
+	mesh *mesh
+
+	mu         sync.Mutex
+	cfg        config // as last applied
+	verifiers  []derp.VerifyClientFunc
+	verifyDesc string
+}
+
+// apply applies the settings in cfg that can change while running.
+func (d *derper) apply(cfg config) error {
+	verifiers, verifyDesc, err := newVerifiers(cfg.Admission)
+	if err != nil {
+		return err
+	}
+	nets, err := cfg.debugAccessNets()
+	if err != nil {
+		return err
+	}
+	if err := d.mesh.setHosts(cfg.Mesh.With); err != nil {
+		return err
+	}
+	d.s.SetRateLimit(derp.RateLimit{
+		PacketsPerSecond: cfg.Admission.PacketsPerSecond,
+		BytesPerSecond:   cfg.Admission.BytesPerSecond,
+	})
+	tsweb.SetAllowDebugAccessNets(nets)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if verifyDesc != d.verifyDesc {
+		log.Printf("derper: verifying clients with %s", verifyDesc)
+	}
+	d.cfg = cfg
+	d.verifiers = verifiers
+	d.verifyDesc = verifyDesc
+	return nil
+}
+
+// current returns the config last applied, and a description of how
+// clients are verified.
+func (d *derper) current() (cfg config, verifyDesc string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cfg, d.verifyDesc
+}
+
+// reload rereads the config file and applies it.
+func (d *derper) reload() error {
+	cfg, err := readConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	cfg.setDefaults()
+	if err := cfg.check(); err != nil {
+		return err
+	}
+	old, _ := d.current()
+	if names := cfg.restartNeeded(&old); len(names) > 0 {
+		log.Printf("derper: config changes to %s need a restart to take effect", strings.Join(names, ", "))
+	}
+	return d.apply(cfg)
+}
+
+// reloadOnSIGHUP reloads the config file whenever derper gets a SIGHUP.
+func (d *derper) reloadOnSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if *dev || *configPath == "" {
+			log.Printf("derper: got SIGHUP, but there's no config file to reload")
+			continue
+		}
+		log.Printf("derper: got SIGHUP; reloading %s", *configPath)
+		if err := d.reload(); err != nil {
+			log.Printf("derper: reloading config: %v", err)
+		}
+	}
+}
+
+// verifyClient is the server's derp.VerifyClientFunc. It admits the
+// clients allowed by all of the current verifiers.
+func (d *derper) verifyClient(clientKey key.Public, remoteAddr string) error {
+	d.mu.Lock()
+	verifiers := d.verifiers
+	d.mu.Unlock()
+	for _, verify := range verifiers {
+		if err := verify(clientKey, remoteAddr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newVerifiers returns the client verifiers ac asks for, and a
+// description of them for logs and the debug page.
+func newVerifiers(ac *admissionConfig) ([]derp.VerifyClientFunc, string, error) {
+	var verifiers []derp.VerifyClientFunc
+	var desc []string
+	if ac.VerifyClientsFile != "" {
+		al, err := derp.NewAllowlist(ac.VerifyClientsFile)
+		if err != nil {
+			return nil, "", err
+		}
+		verifiers = append(verifiers, al.Verify)
+		desc = append(desc, fmt.Sprintf("allowlist of %d keys in %s", al.Len(), ac.VerifyClientsFile))
+	}
+	if ac.VerifyClientURL != "" {
+		verifiers = append(verifiers, derp.HTTPVerifier(ac.VerifyClientURL))
+		desc = append(desc, "policy service at "+ac.VerifyClientURL)
+	}
+	if len(verifiers) == 0 {
+		return nil, "none", nil
+	}
+	return verifiers, strings.Join(desc, "; "), nil
+}
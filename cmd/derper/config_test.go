@@ -0,0 +1,100 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "derper-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "derper.json")
+	const contents = `{
+	"Addr": ":8443",
+	"TLS": {"Mode": "manual", "Hostname": "derp.example.com", "CertDir": "/etc/derp"},
+	"Mesh": {"PSKFile": "/etc/derp/mesh.key", "With": ["derp1.example.com", "derp2.example.com"]},
+	"Admission": {"PacketsPerSecond": 1000},
+	"DebugAccessCIDRs": ["10.0.0.0/8"]
+}`
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := readConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.setDefaults()
+	if err := cfg.check(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":8443" {
+		t.Errorf("Addr = %q; want :8443", cfg.Addr)
+	}
+	if cfg.HTTPAddr != ":80" {
+		t.Errorf("HTTPAddr = %q; want default :80", cfg.HTTPAddr)
+	}
+	if want := "/etc/derp/derp.example.com.crt"; cfg.TLS.CertFile != want {
+		t.Errorf("TLS.CertFile = %q; want %q", cfg.TLS.CertFile, want)
+	}
+	if want := []string{"derp1.example.com", "derp2.example.com"}; !reflect.DeepEqual(cfg.Mesh.With, want) {
+		t.Errorf("Mesh.With = %q; want %q", cfg.Mesh.With, want)
+	}
+	if cfg.Admission.PacketsPerSecond != 1000 {
+		t.Errorf("Admission.PacketsPerSecond = %v; want 1000", cfg.Admission.PacketsPerSecond)
+	}
+	if nets, err := cfg.debugAccessNets(); err != nil || len(nets) != 1 {
+		t.Errorf("debugAccessNets = %v, %v; want one network", nets, err)
+	}
+}
+
+func TestConfigCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    config
+		wantOK bool
+	}{
+		{"defaults", config{}, true},
+		{"bad_tls_mode", config{TLS: &tlsConfig{Mode: "sometimes"}}, false},
+		{"mesh_without_psk", config{Mesh: &meshConfig{With: []string{"derp1.example.com"}}}, *meshPSKFile != ""},
+		{"bad_cidr", config{DebugAccessCIDRs: []string{"10.0.0.0/33"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.setDefaults()
+			err := tt.cfg.check()
+			if (err == nil) != tt.wantOK {
+				t.Errorf("check = %v; want ok=%v", err, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRestartNeeded(t *testing.T) {
+	var old config
+	old.setDefaults()
+
+	cfg := old
+	cfg.Mesh = &meshConfig{PSKFile: old.Mesh.PSKFile, With: []string{"derp1.example.com"}}
+	cfg.Admission = &admissionConfig{PacketsPerSecond: 10}
+	cfg.DebugAccessCIDRs = []string{"10.0.0.0/8"}
+	if got := cfg.restartNeeded(&old); len(got) != 0 {
+		t.Errorf("live changes need restart of %q", got)
+	}
+
+	cfg.Addr = ":1234"
+	cfg.TLS = &tlsConfig{Mode: "manual"}
+	if got, want := cfg.restartNeeded(&old), []string{"Addr", "TLS"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("restartNeeded = %q; want %q", got, want)
+	}
+}
@@ -7,11 +7,11 @@ package main // import "tailscale.com/cmd/derper"
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"expvar"
 	"flag"
 	"fmt"
+	"html"
 	"io"
 	"io/ioutil"
 	"log"
@@ -23,9 +23,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/tailscale/wireguard-go/wgcfg"
 	"golang.org/x/crypto/acme/autocert"
-	"tailscale.com/atomicfile"
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/logpolicy"
@@ -40,66 +38,20 @@ var (
 	dev           = flag.Bool("dev", false, "run in localhost development mode")
 	addr          = flag.String("a", ":443", "server address")
 	configPath    = flag.String("c", "", "config file path")
-	certDir       = flag.String("certdir", tsweb.DefaultCertDir("derper-certs"), "directory to store LetsEncrypt certs, if addr's port is :443")
-	hostname      = flag.String("hostname", "derp.tailscale.com", "LetsEncrypt host name, if addr's port is :443")
+	certDir       = flag.String("certdir", tsweb.DefaultCertDir("derper-certs"), "directory to store LetsEncrypt certs in, or to find manual certs in")
+	hostname      = flag.String("hostname", "derp.tailscale.com", "LetsEncrypt host name, or base name of manual cert files")
 	logCollection = flag.String("logcollection", "", "If non-empty, logtail collection to log to")
 	runSTUN       = flag.Bool("stun", false, "also run a STUN server")
+	certMode      = flag.String("certmode", "", `how to get TLS certs: "letsencrypt", "manual" to use <hostname>.crt and <hostname>.key in the certdir, or "none"; if empty, "letsencrypt" if addr's port is :443 and "none" otherwise`)
 	meshPSKFile   = flag.String("mesh-psk-file", defaultMeshPSKFile(), "if non-empty, path to file containing the mesh pre-shared key file. It should contain some hex string; whitespace is trimmed.")
 	meshWith      = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list")
-)
-
-type config struct {
-	PrivateKey wgcfg.PrivateKey
-}
-
-func loadConfig() config {
-	if *dev {
-		return config{PrivateKey: mustNewKey()}
-	}
-	if *configPath == "" {
-		log.Fatalf("derper: -c <config path> not specified")
-	}
-	b, err := ioutil.ReadFile(*configPath)
-	switch {
-	case os.IsNotExist(err):
-		return writeNewConfig()
-	case err != nil:
-		log.Fatal(err)
-		panic("unreachable")
-	default:
-		var cfg config
-		if err := json.Unmarshal(b, &cfg); err != nil {
-			log.Fatalf("derper: config: %v", err)
-		}
-		return cfg
-	}
-}
 
-func mustNewKey() wgcfg.PrivateKey {
-	key, err := wgcfg.NewPrivateKey()
-	if err != nil {
-		log.Fatal(err)
-	}
-	return key
-}
+	verifyClientsFile = flag.String("verify-clients-file", "", "if non-empty, path to a file of node public keys allowed to use this server, one per line as 64 hex digits or nodekey:hex")
+	verifyClientURL   = flag.String("verify-client-url", "", "if non-empty, URL of a local policy service to POST each client's key and address to; only clients it answers with a 2xx status may use this server")
 
-func writeNewConfig() config {
-	key := mustNewKey()
-	if err := os.MkdirAll(filepath.Dir(*configPath), 0777); err != nil {
-		log.Fatal(err)
-	}
-	cfg := config{
-		PrivateKey: key,
-	}
-	b, err := json.MarshalIndent(cfg, "", "\t")
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err := atomicfile.WriteFile(*configPath, b, 0666); err != nil {
-		log.Fatal(err)
-	}
-	return cfg
-}
+	clientPacketRate = flag.Float64("client-packet-rate", 0, "if non-zero, maximum packets per second each client may send; excess packets are dropped")
+	clientByteRate   = flag.Float64("client-byte-rate", 0, "if non-zero, maximum bytes per second each client may send; excess packets are dropped")
+)
 
 func main() {
 	flag.Parse()
@@ -119,29 +71,30 @@ func main() {
 
 	cfg := loadConfig()
 
-	letsEncrypt := tsweb.IsProd443(*addr)
-
 	s := derp.NewServer(key.Private(cfg.PrivateKey), log.Printf)
 
-	if *meshPSKFile != "" {
-		b, err := ioutil.ReadFile(*meshPSKFile)
+	if cfg.Mesh.PSKFile != "" {
+		b, err := ioutil.ReadFile(cfg.Mesh.PSKFile)
 		if err != nil {
 			log.Fatal(err)
 		}
 		key := strings.TrimSpace(string(b))
 		if matched, _ := regexp.MatchString(`(?i)^[0-9a-f]{64,}$`, key); !matched {
-			log.Fatalf("key in %s must contain 64+ hex digits", *meshPSKFile)
+			log.Fatalf("key in %s must contain 64+ hex digits", cfg.Mesh.PSKFile)
 		}
 		s.SetMeshKey(key)
 		log.Printf("DERP mesh key configured")
 	}
-	if err := startMesh(s); err != nil {
-		log.Fatalf("startMesh: %v", err)
+	d := &derper{s: s, mesh: newMesh(s), verifyDesc: "none"}
+	s.SetVerifyClient(d.verifyClient)
+	if err := d.apply(cfg); err != nil {
+		log.Fatalf("derper: %v", err)
 	}
+	go d.reloadOnSIGHUP()
 	expvar.Publish("derp", s.ExpVar())
 
 	// Create our own mux so we don't expose /debug/ stuff to the world.
-	mux := tsweb.NewMux(debugHandler(s))
+	mux := tsweb.NewMux(debugHandler(d))
 	mux.Handle("/derp", derphttp.Handler(s))
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -160,33 +113,31 @@ func main() {
 		}
 	}))
 
-	if *runSTUN {
-		go serveSTUN()
+	if cfg.STUNAddr != "" {
+		go serveSTUN(cfg.STUNAddr)
 	}
 
 	httpsrv := &http.Server{
-		Addr:    *addr,
+		Addr:    cfg.Addr,
 		Handler: mux,
 	}
 
 	var err error
-	if letsEncrypt {
-		if *certDir == "" {
-			log.Fatalf("missing required --certdir flag")
-		}
-		log.Printf("derper: serving on %s with TLS", *addr)
+	switch cfg.TLS.Mode {
+	case "letsencrypt":
+		log.Printf("derper: serving on %s with TLS", cfg.Addr)
 		certManager := &autocert.Manager{
 			Prompt:     autocert.AcceptTOS,
-			HostPolicy: autocert.HostWhitelist(*hostname),
-			Cache:      autocert.DirCache(*certDir),
+			HostPolicy: autocert.HostWhitelist(cfg.TLS.Hostname),
+			Cache:      autocert.DirCache(cfg.TLS.CertDir),
 		}
-		if *hostname == "derp.tailscale.com" {
+		if cfg.TLS.Hostname == "derp.tailscale.com" {
 			certManager.HostPolicy = prodAutocertHostPolicy
 			certManager.Email = "security@tailscale.com"
 		}
 		httpsrv.TLSConfig = certManager.TLSConfig()
 		go func() {
-			err := http.ListenAndServe(":80", certManager.HTTPHandler(tsweb.Port80Handler{Main: mux}))
+			err := http.ListenAndServe(cfg.HTTPAddr, certManager.HTTPHandler(tsweb.Port80Handler{Main: mux}))
 			if err != nil {
 				if err != http.ErrServerClosed {
 					log.Fatal(err)
@@ -194,8 +145,11 @@ func main() {
 			}
 		}()
 		err = httpsrv.ListenAndServeTLS("", "")
-	} else {
-		log.Printf("derper: serving on %s", *addr)
+	case "manual":
+		log.Printf("derper: serving on %s with TLS cert %s", cfg.Addr, cfg.TLS.CertFile)
+		err = httpsrv.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	default:
+		log.Printf("derper: serving on %s", cfg.Addr)
 		err = httpsrv.ListenAndServe()
 	}
 	if err != nil && err != http.ErrServerClosed {
@@ -203,8 +157,13 @@ func main() {
 	}
 }
 
-func debugHandler(s *derp.Server) http.Handler {
+func debugHandler(d *derper) http.Handler {
+	s := d.s
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/debug/drain" {
+			serveDrain(s, w, r)
+			return
+		}
 		if r.RequestURI == "/debug/check" {
 			err := s.ConsistencyCheck()
 			if err != nil {
@@ -219,9 +178,13 @@ func debugHandler(s *derp.Server) http.Handler {
 <h1>DERP debug</h1>
 <ul>
 `)
-		f("<li><b>Hostname:</b> %v</li>\n", *hostname)
+		cfg, verifyDesc := d.current()
+		f("<li><b>Hostname:</b> %v</li>\n", html.EscapeString(cfg.TLS.Hostname))
 		f("<li><b>Uptime:</b> %v</li>\n", tsweb.Uptime())
 		f("<li><b>Mesh Key:</b> %v</li>\n", s.HasMeshKey())
+		f("<li><b>Mesh peers:</b> %v</li>\n", html.EscapeString(strings.Join(d.mesh.hosts(), ", ")))
+		f("<li><b>Client verification:</b> %v</li>\n", html.EscapeString(verifyDesc))
+		f("<li><b>Draining:</b> %v</li>\n", s.IsDraining())
 		f("<li><b>Version:</b> %v</li>\n", version.LONG)
 
 		f(`<li><a href="/debug/vars">/debug/vars</a> (Go)</li>
@@ -230,14 +193,54 @@ func debugHandler(s *derp.Server) http.Handler {
    <li><a href="/debug/pprof/goroutine?debug=1">/debug/pprof/goroutine</a> (collapsed)</li>
    <li><a href="/debug/pprof/goroutine?debug=2">/debug/pprof/goroutine</a> (full)</li>
    <li><a href="/debug/check">/debug/check</a> internal consistency check</li>
+   <li>POST to /debug/drain?in=5s&amp;spread=10s to drain clients before a restart</li>
 <ul>
 </html>
 `)
 	})
 }
 
-func serveSTUN() {
-	pc, err := net.ListenPacket("udp", ":3478")
+const (
+	defaultDrainReconnectIn = 5 * time.Second
+	defaultDrainSpread      = 10 * time.Second
+)
+
+// serveDrain handles a request to drain the server ahead of a
+// restart. Its optional "in" and "spread" parameters are the minimum
+// reconnect delay to give clients and the range of random delay to
+// add to it, as Go durations.
+func serveDrain(s *derp.Server, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	durParam := func(name string, def time.Duration) (time.Duration, error) {
+		v := r.FormValue(name)
+		if v == "" {
+			return def, nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("bad %q duration %q", name, v)
+		}
+		return d, nil
+	}
+	in, err := durParam("in", defaultDrainReconnectIn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	spread, err := durParam("spread", defaultDrainSpread)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.Drain(in, spread)
+	fmt.Fprintf(w, "draining; clients reconnect in %v+%v\n", in, spread)
+}
+
+func serveSTUN(addr string) {
+	pc, err := net.ListenPacket("udp", addr)
 	if err != nil {
 		log.Fatalf("failed to open STUN listener: %v", err)
 	}
@@ -8,7 +8,9 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
+	"sync"
 
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
@@ -16,30 +18,80 @@ import (
 	"tailscale.com/types/logger"
 )
 
-func startMesh(s *derp.Server) error {
-	if *meshWith == "" {
-		return nil
+// mesh is the set of DERP servers s is meshed with.
+type mesh struct {
+	s *derp.Server
+
+	mu    sync.Mutex
+	peers map[string]*derphttp.Client // by host name
+}
+
+func newMesh(s *derp.Server) *mesh {
+	return &mesh{
+		s:     s,
+		peers: map[string]*derphttp.Client{},
 	}
-	if !s.HasMeshKey() {
-		return errors.New("--mesh-with requires --mesh-psk-file")
+}
+
+// setHosts makes the mesh peers the servers with the given host
+// names, connecting to new ones and disconnecting from those no
+// longer listed.
+func (m *mesh) setHosts(hosts []string) error {
+	if len(hosts) > 0 && !m.s.HasMeshKey() {
+		return errors.New("meshing requires a mesh PSK file")
 	}
-	for _, host := range strings.Split(*meshWith, ",") {
-		if err := startMeshWithHost(s, host); err != nil {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	want := map[string]bool{}
+	for _, host := range hosts {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		want[host] = true
+		if _, ok := m.peers[host]; ok {
+			continue
+		}
+		c, err := startMeshWithHost(m.s, host)
+		if err != nil {
 			return err
 		}
+		m.peers[host] = c
+	}
+	for host, c := range m.peers {
+		if !want[host] {
+			// Closing c ends its watch loop, which removes
+			// its packet forwarders from s.
+			log.Printf("derper: no longer meshing with %q", host)
+			c.Close()
+			delete(m.peers, host)
+		}
 	}
 	return nil
 }
 
-func startMeshWithHost(s *derp.Server, host string) error {
+// hosts returns the host names of the mesh peers, sorted.
+func (m *mesh) hosts() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var hosts []string
+	for host := range m.peers {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func startMeshWithHost(s *derp.Server, host string) (*derphttp.Client, error) {
 	logf := logger.WithPrefix(log.Printf, fmt.Sprintf("mesh(%q): ", host))
 	c, err := derphttp.NewClient(s.PrivateKey(), "https://"+host+"/derp", logf)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	c.MeshKey = s.MeshKey()
 	add := func(k key.Public) { s.AddPacketForwarder(k, c) }
 	remove := func(k key.Public) { s.RemovePacketForwarder(k, c) }
 	go c.RunWatchConnectionLoop(s.PublicKey(), add, remove)
-	return nil
+	return c, nil
 }
@@ -19,6 +19,7 @@ import (
 
 	"github.com/peterbourgon/ff/v2/ffcli"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
 )
@@ -31,7 +32,7 @@ func ActLikeCLI() bool {
 		return false
 	}
 	switch os.Args[1] {
-	case "up", "status", "netcheck", "version",
+	case "up", "down", "logout", "ip", "ping", "status", "netcheck", "version",
 		"-V", "--version", "-h", "--help":
 		return true
 	}
@@ -57,6 +58,10 @@ change in the future.
 `),
 		Subcommands: []*ffcli.Command{
 			upCmd,
+			downCmd,
+			logoutCmd,
+			ipCmd,
+			pingCmd,
 			netcheckCmd,
 			statusCmd,
 			versionCmd,
@@ -121,3 +126,42 @@ func pump(ctx context.Context, bc *ipn.BackendClient, conn net.Conn) {
 		bc.GotNotifyMsg(msg)
 	}
 }
+
+// statusAfter connects to tailscaled, calls fn (if non-nil) to send
+// commands with bc, and then returns the backend's status. Because
+// the backend processes a connection's commands in order, the
+// returned status reflects the effect of the commands sent by fn.
+func statusAfter(ctx context.Context, fn func(bc *ipn.BackendClient)) (*ipnstate.Status, error) {
+	c, bc, ctx, cancel := connect(ctx)
+	defer cancel()
+
+	if fn == nil {
+		// Read-only; tolerate a different tailscaled version.
+		bc.AllowVersionSkew = true
+	}
+
+	ch := make(chan *ipnstate.Status, 1)
+	bc.SetNotifyCallback(func(n ipn.Notify) {
+		if n.ErrMessage != nil {
+			log.Fatal(*n.ErrMessage)
+		}
+		if n.Status != nil {
+			select {
+			case ch <- n.Status:
+			default:
+			}
+		}
+	})
+	go pump(ctx, bc, c)
+
+	if fn != nil {
+		fn(bc)
+	}
+	bc.RequestStatus()
+	select {
+	case st := <-ch:
+		return st, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/ipn"
+)
+
+var downCmd = &ffcli.Command{
+	Name:       "down",
+	ShortUsage: "down",
+	ShortHelp:  "Disconnect from Tailscale",
+
+	LongHelp: strings.TrimSpace(`
+"tailscale down" disconnects this machine from your Tailscale network.
+The machine stays logged in; use "tailscale up" to reconnect.
+`),
+	Exec: runDown,
+}
+
+func runDown(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		log.Fatalf("too many non-flag arguments: %q", args)
+	}
+
+	st, err := statusAfter(ctx, func(bc *ipn.BackendClient) {
+		bc.SetWantRunning(false)
+	})
+	if err != nil {
+		return err
+	}
+	switch st.BackendState {
+	case ipn.Starting.String(), ipn.Running.String():
+		return fmt.Errorf("failed to stop; state is still %s", st.BackendState)
+	}
+	return nil
+}
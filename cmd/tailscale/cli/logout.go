@@ -0,0 +1,37 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/ipn"
+)
+
+var logoutCmd = &ffcli.Command{
+	Name:       "logout",
+	ShortUsage: "logout",
+	ShortHelp:  "Disconnect from Tailscale and log out",
+
+	LongHelp: strings.TrimSpace(`
+"tailscale logout" disconnects this machine from your Tailscale network
+and forgets its login. Use "tailscale up" to log in again.
+`),
+	Exec: runLogout,
+}
+
+func runLogout(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		log.Fatalf("too many non-flag arguments: %q", args)
+	}
+
+	_, err := statusAfter(ctx, func(bc *ipn.BackendClient) {
+		bc.Logout()
+	})
+	return err
+}
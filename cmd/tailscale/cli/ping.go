@@ -0,0 +1,168 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/ff/v2/ffcli"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+)
+
+var pingCmd = &ffcli.Command{
+	Name:       "ping",
+	ShortUsage: "ping <hostname-or-IP>",
+	ShortHelp:  "Ping a host at the Tailscale layer, see how it routed",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale ping' command pings a peer node at the Tailscale layer
+and reports which route it took for each response. The first ping or
+so will likely go over DERP (Tailscale's TCP relay protocol) while NAT
+traversal finds a direct path through.
+
+If 'tailscale ping' works but a normal ping does not, that means one
+side's operating system firewall is blocking packets; 'tailscale ping'
+does not inject packets into either side's TUN devices.
+
+By default, 'tailscale ping' stops after 10 pings or once a direct
+(non-DERP) path has been established, whichever comes first.
+
+The provided hostname must resolve to or be a Tailscale IP
+(e.g. 100.x.y.z) or a subnet IP advertised by a Tailscale
+relay node.
+
+`),
+	Exec: runPing,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("ping", flag.ExitOnError)
+		fs.BoolVar(&pingArgs.verbose, "verbose", false, "verbose output")
+		fs.BoolVar(&pingArgs.untilDirect, "until-direct", true, "stop once a direct path is established")
+		fs.IntVar(&pingArgs.num, "c", 10, "max number of pings to send")
+		fs.DurationVar(&pingArgs.timeout, "timeout", 5*time.Second, "timeout before giving up on a ping")
+		return fs
+	})(),
+}
+
+var pingArgs struct {
+	num         int
+	untilDirect bool
+	verbose     bool
+	timeout     time.Duration
+}
+
+func runPing(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: ping <hostname-or-IP>")
+	}
+	hostOrIP := args[0]
+
+	c, bc, ctx, cancel := connect(ctx)
+	defer cancel()
+
+	// Ping only reads state; tolerate a different tailscaled version.
+	bc.AllowVersionSkew = true
+
+	stc := make(chan *ipnstate.Status, 1)
+	prc := make(chan *ipnstate.PingResult, 1)
+	bc.SetNotifyCallback(func(n ipn.Notify) {
+		if n.ErrMessage != nil {
+			log.Fatal(*n.ErrMessage)
+		}
+		if n.Status != nil {
+			select {
+			case stc <- n.Status:
+			default:
+			}
+		}
+		if pr := n.PingResult; pr != nil && pr.IP != "" {
+			select {
+			case prc <- pr:
+			default:
+			}
+		}
+	})
+	go pump(ctx, bc, c)
+
+	ip, err := resolvePingTarget(ctx, bc, stc, hostOrIP)
+	if err != nil {
+		return err
+	}
+	if pingArgs.verbose && ip != hostOrIP {
+		log.Printf("lookup %q => %q", hostOrIP, ip)
+	}
+
+	n := 0
+	anyPong := false
+	for {
+		n++
+		bc.Ping(ip)
+		timer := time.NewTimer(pingArgs.timeout)
+		select {
+		case <-timer.C:
+			fmt.Printf("timeout waiting for ping reply\n")
+		case pr := <-prc:
+			timer.Stop()
+			if pr.Err != "" {
+				return errors.New(pr.Err)
+			}
+			latency := time.Duration(pr.LatencySeconds * float64(time.Second)).Round(time.Millisecond)
+			via := pr.Endpoint
+			if pr.DERPRegionID != 0 {
+				via = fmt.Sprintf("DERP(%s)", pr.DERPRegionCode)
+			}
+			anyPong = true
+			fmt.Printf("pong from %s (%s) via %v in %v\n", pr.NodeName, pr.NodeIP, via, latency)
+			if pr.Endpoint != "" && pingArgs.untilDirect {
+				return nil
+			}
+			time.Sleep(time.Second)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if n == pingArgs.num {
+			if !anyPong {
+				return errors.New("no reply")
+			}
+			if pingArgs.untilDirect {
+				return errors.New("direct connection not established")
+			}
+			return nil
+		}
+	}
+}
+
+// resolvePingTarget returns the IP address to ping for hostOrIP,
+// which is either an IP address or the hostname of a peer in the
+// backend's current status.
+func resolvePingTarget(ctx context.Context, bc *ipn.BackendClient, stc <-chan *ipnstate.Status, hostOrIP string) (string, error) {
+	if ip := net.ParseIP(hostOrIP); ip != nil {
+		return ip.String(), nil
+	}
+	bc.RequestStatus()
+	var st *ipnstate.Status
+	select {
+	case st = <-stc:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	for _, k := range st.Peers() {
+		ps := st.Peer[k]
+		if strings.EqualFold(hostOrIP, ps.HostName) || strings.EqualFold(hostOrIP, ps.SimpleHostName()) {
+			if ps.TailAddr == "" {
+				return "", fmt.Errorf("peer %q has no Tailscale IP", hostOrIP)
+			}
+			return ps.TailAddr, nil
+		}
+	}
+	return "", fmt.Errorf("no peer found with hostname %q", hostOrIP)
+}
@@ -25,7 +25,7 @@ import (
 
 var statusCmd = &ffcli.Command{
 	Name:       "status",
-	ShortUsage: "status [-active] [-web] [-json]",
+	ShortUsage: "status [-active] [-web] [-json] [-filter]",
 	ShortHelp:  "Show state of tailscaled and its connections",
 	Exec:       runStatus,
 	FlagSet: (func() *flag.FlagSet {
@@ -33,6 +33,7 @@ var statusCmd = &ffcli.Command{
 		fs.BoolVar(&statusArgs.json, "json", false, "output in JSON format (WARNING: format subject to change)")
 		fs.BoolVar(&statusArgs.web, "web", false, "run webserver with HTML showing status")
 		fs.BoolVar(&statusArgs.active, "active", false, "filter output to only peers with active sessions (not applicable to web mode)")
+		fs.BoolVar(&statusArgs.filter, "filter", false, "show recent packet filter decisions instead of peers (not applicable to web mode)")
 		fs.StringVar(&statusArgs.listen, "listen", "127.0.0.1:8384", "listen address; use port 0 for automatic")
 		fs.BoolVar(&statusArgs.browser, "browser", true, "Open a browser in web mode")
 		return fs
@@ -45,6 +46,7 @@ var statusArgs struct {
 	listen  string // in web mode, webserver address to listen on, empty means auto
 	browser bool   // in web mode, whether to open browser
 	active  bool   // in CLI mode, filter output to only peers with active sessions
+	filter  bool   // in CLI mode, show packet filter decisions instead of peers
 }
 
 func runStatus(ctx context.Context, args []string) error {
@@ -127,6 +129,17 @@ func runStatus(ctx context.Context, args []string) error {
 
 	var buf bytes.Buffer
 	f := func(format string, a ...interface{}) { fmt.Fprintf(&buf, format, a...) }
+	if statusArgs.filter {
+		if len(st.FilterDecisions) == 0 {
+			fmt.Println("No packet filter decisions recorded.")
+			return nil
+		}
+		for _, d := range st.FilterDecisions {
+			f("%v\n", d)
+		}
+		os.Stdout.Write(buf.Bytes())
+		return nil
+	}
 	for _, peer := range st.Peers() {
 		ps := st.Peer[peer]
 		active := peerActive(ps)
@@ -11,13 +11,16 @@ package main // import "tailscale.com/cmd/tailscaled"
 
 import (
 	"context"
+	"expvar"
 	"log"
 	"net/http"
 	"net/http/pprof"
+	"net/url"
 	"os"
 	"os/signal"
 	"runtime"
 	"runtime/debug"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -25,6 +28,7 @@ import (
 	"github.com/pborman/getopt/v2"
 	"tailscale.com/ipn/ipnserver"
 	"tailscale.com/logpolicy"
+	"tailscale.com/net/tshttpproxy"
 	"tailscale.com/paths"
 	"tailscale.com/types/logger"
 	"tailscale.com/wgengine"
@@ -60,6 +64,7 @@ var args struct {
 	port       uint16
 	statepath  string
 	socketpath string
+	httpProxy  string
 }
 
 func main() {
@@ -84,6 +89,7 @@ func main() {
 	getopt.FlagLong(&args.port, "port", 'p', "WireGuard port (0=autoselect)")
 	getopt.FlagLong(&args.statepath, "state", 0, "path of state file")
 	getopt.FlagLong(&args.socketpath, "socket", 's', "path of the service unix socket")
+	getopt.FlagLong(&args.httpProxy, "http-proxy", 0, "URL of an HTTP proxy (http://[user:pass@]host:port) for control, DERP and log traffic; overrides HTTPS_PROXY")
 
 	err := fixconsole.FixConsoleIfNeeded()
 	if err != nil {
@@ -103,6 +109,14 @@ func main() {
 		log.Fatalf("--socket is required")
 	}
 
+	if args.httpProxy != "" {
+		u, err := url.Parse(args.httpProxy)
+		if err != nil || u.Scheme != "http" || u.Host == "" {
+			log.Fatalf("--http-proxy must be an http:// URL; got %q", args.httpProxy)
+		}
+		tshttpproxy.SetProxy(u)
+	}
+
 	if err := run(); err != nil {
 		// No need to log; the func already did
 		os.Exit(1)
@@ -146,6 +160,18 @@ func run() error {
 	}
 	e = wgengine.NewWatchdog(e)
 
+	// Publish the per-rule accept counters of whichever packet
+	// filter the engine has in use.
+	expvar.Publish("counter_filter_accepts_by_rule", expvar.Func(func() interface{} {
+		accepts := map[string]int64{}
+		if filt := e.GetFilter(); filt != nil {
+			for i, n := range filt.RuleAccepts() {
+				accepts[strconv.Itoa(i)] = n
+			}
+		}
+		return accepts
+	}))
+
 	ctx, cancel := context.WithCancel(context.Background())
 	// Exit gracefully by cancelling the ipnserver context in most common cases:
 	// interrupted from the TTY or killed by a service manager.
@@ -191,6 +217,7 @@ func newDebugMux() *http.ServeMux {
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
 	return mux
 }
 
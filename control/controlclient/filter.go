@@ -7,29 +7,48 @@ package controlclient
 import (
 	"fmt"
 	"net"
+
 	"tailscale.com/tailcfg"
 	"tailscale.com/wgengine/filter"
+	"tailscale.com/wgengine/packet"
 )
 
-func parseIP(host string, defaultBits int) (filter.Net, error) {
+// parseIP parses host as an IPv4 or IPv6 address with a prefix
+// length of bits, or a negative bits for a single host. The wildcard
+// "*" matches all addresses of both families, so it yields both an
+// IPv4 and an IPv6 net.
+func parseIP(host string, bits int) (nets []filter.Net, nets6 []filter.Net6, err error) {
 	ip := net.ParseIP(host)
 	if ip != nil && ip.IsUnspecified() {
 		// For clarity, reject 0.0.0.0 as an input
-		return filter.NetNone, fmt.Errorf("ports=%#v: to allow all IP addresses, use *:port, not 0.0.0.0:port", host)
+		return nil, nil, fmt.Errorf("ports=%#v: to allow all IP addresses, use *:port, not 0.0.0.0:port", host)
 	} else if ip == nil && host == "*" {
 		// User explicitly requested wildcard dst ip
-		return filter.NetAny, nil
+		return []filter.Net{filter.NetAny}, []filter.Net6{filter.NetAny6}, nil
+	} else if ip == nil {
+		return nil, nil, fmt.Errorf("ports=%#v: invalid IP address", host)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		if bits < 0 {
+			bits = 32
+		}
+		if bits > 32 {
+			return nil, nil, fmt.Errorf("ports=%#v: invalid IPv4 prefix length %d", host, bits)
+		}
+		return []filter.Net{{
+			IP:   filter.NewIP(ip4),
+			Mask: filter.Netmask(bits),
+		}}, nil, nil
 	} else {
-		if ip != nil {
-			ip = ip.To4()
+		if bits < 0 {
+			bits = 128
 		}
-		if ip == nil || len(ip) != 4 {
-			return filter.NetNone, fmt.Errorf("ports=%#v: invalid IPv4 address", host)
+		if bits > 128 {
+			return nil, nil, fmt.Errorf("ports=%#v: invalid IPv6 prefix length %d", host, bits)
 		}
-		return filter.Net{
-			IP:   filter.NewIP(ip),
-			Mask: filter.Netmask(defaultBits),
-		}, nil
+		return nil, []filter.Net6{{
+			IP:   filter.NewIP6(ip),
+			Mask: filter.Netmask6(bits),
+		}}, nil
 	}
 }
 
@@ -43,35 +62,67 @@ func (c *Direct) parsePacketFilter(pf []tailcfg.FilterRule) filter.Matches {
 		m := filter.Match{}
 
 		for i, s := range r.SrcIPs {
-			bits := 32
+			bits := -1 // all bits
 			if len(r.SrcBits) > i {
 				bits = r.SrcBits[i]
 			}
-			net, err := parseIP(s, bits)
-			if err != nil && erracc == nil {
-				erracc = err
+			nets, nets6, err := parseIP(s, bits)
+			if err != nil {
+				if erracc == nil {
+					erracc = err
+				}
 				continue
 			}
-			m.Srcs = append(m.Srcs, net)
+			m.Srcs = append(m.Srcs, nets...)
+			m.Srcs6 = append(m.Srcs6, nets6...)
 		}
 
 		for _, d := range r.DstPorts {
-			bits := 32
+			bits := -1 // all bits
 			if d.Bits != nil {
 				bits = *d.Bits
 			}
-			net, err := parseIP(d.IP, bits)
-			if err != nil && erracc == nil {
-				erracc = err
+			nets, nets6, err := parseIP(d.IP, bits)
+			if err != nil {
+				if erracc == nil {
+					erracc = err
+				}
+				continue
+			}
+			ports := filter.PortRange{
+				First: d.Ports.First,
+				Last:  d.Ports.Last,
+			}
+			for _, net := range nets {
+				m.Dsts = append(m.Dsts, filter.NetPortRange{Net: net, Ports: ports})
+			}
+			for _, net := range nets6 {
+				m.Dsts6 = append(m.Dsts6, filter.NetPortRange6{Net: net, Ports: ports})
+			}
+		}
+
+		for _, p := range r.IPProto {
+			if p <= 0 || p > 255 {
+				if erracc == nil {
+					erracc = fmt.Errorf("proto=%d: invalid IP protocol number", p)
+				}
 				continue
 			}
-			m.Dsts = append(m.Dsts, filter.NetPortRange{
-				Net: net,
-				Ports: filter.PortRange{
-					First: d.Ports.First,
-					Last:  d.Ports.Last,
-				},
-			})
+			m.IPProto = append(m.IPProto, packet.IPProto(p))
+		}
+		if len(r.IPProto) > 0 && len(m.IPProto) == 0 {
+			// Every protocol was invalid; an empty list would
+			// mean the default protocols, so drop the rule.
+			continue
+		}
+
+		for _, t := range r.ICMPTypes {
+			it := filter.ICMPType{Type: t.Type, AnyCode: true}
+			if t.Code != nil {
+				it.Code = *t.Code
+				it.AnyCode = false
+			}
+			m.ICMPTypes = append(m.ICMPTypes, it)
 		}
 
 		mm = append(mm, m)
@@ -0,0 +1,72 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controlclient
+
+import (
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestParsePacketFilter(t *testing.T) {
+	bits64 := 64
+	code0 := uint8(0)
+	c := &Direct{logf: t.Logf}
+	mm := c.parsePacketFilter([]tailcfg.FilterRule{
+		{
+			SrcIPs: []string{"100.64.0.1", "fd7a::1"},
+			DstPorts: []tailcfg.NetPortRange{
+				{IP: "fd7a:0:0:1::", Bits: &bits64, Ports: tailcfg.PortRange{First: 22, Last: 22}},
+				{IP: "100.64.0.2", Ports: tailcfg.PortRange{First: 80, Last: 80}},
+			},
+		},
+		{
+			SrcIPs:   []string{"*"},
+			DstPorts: []tailcfg.NetPortRange{{IP: "*", Ports: tailcfg.PortRange{First: 443, Last: 443}}},
+		},
+		{
+			SrcIPs:   []string{"not-an-ip"},
+			DstPorts: []tailcfg.NetPortRange{{IP: "::", Ports: tailcfg.PortRange{First: 1, Last: 1}}},
+		},
+		{
+			SrcIPs:    []string{"100.64.0.1"},
+			DstPorts:  []tailcfg.NetPortRange{{IP: "100.64.0.2", Ports: tailcfg.PortRangeAny}},
+			IPProto:   []int{1, 132},
+			ICMPTypes: []tailcfg.ICMPTypeCode{{Type: 8}, {Type: 0, Code: &code0}},
+		},
+		{
+			SrcIPs:   []string{"*"},
+			DstPorts: []tailcfg.NetPortRange{{IP: "*", Ports: tailcfg.PortRangeAny}},
+			IPProto:  []int{256},
+		},
+	})
+	if len(mm) != 4 {
+		t.Fatalf("got %d matches; want 4", len(mm))
+	}
+
+	const want0 = "[100.64.0.1,fd7a::1]=>[100.64.0.2:80,[fd7a:0:0:1::/64]:22]"
+	if got := mm[0].String(); got != want0 {
+		t.Errorf("match 0 = %q; want %q", got, want0)
+	}
+	if got := mm[0].Srcs6[0].Bits(); got != 128 {
+		t.Errorf("IPv6 source bits = %d; want 128", got)
+	}
+
+	// The wildcard applies to both address families.
+	const want1 = "[*,*]=>[*:443,*:443]"
+	if got := mm[1].String(); got != want1 {
+		t.Errorf("match 1 = %q; want %q", got, want1)
+	}
+
+	// Invalid addresses are skipped.
+	if m := mm[2]; len(m.Srcs)+len(m.Srcs6)+len(m.Dsts)+len(m.Dsts6) != 0 {
+		t.Errorf("match 2 = %v; want empty", m)
+	}
+
+	const want3 = "100.64.0.1=>100.64.0.2:* proto=ICMP,SCTP icmp=8/*,0/0"
+	if got := mm[3].String(); got != want3 {
+		t.Errorf("match 3 = %q; want %q", got, want3)
+	}
+}
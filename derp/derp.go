@@ -42,10 +42,12 @@ const (
 // protocolVersion is bumped whenever there's a wire-incompatible change.
 //   * version 1 (zero on wire): consistent box headers, in use by employee dev nodes a bit
 //   * version 2: received packets have src addrs in frameRecvPacket at beginning
-const protocolVersion = 2
+//   * version 3: framePing and framePong
+const protocolVersion = 3
 
 const (
 	protocolSrcAddrs = 2 // protocol version at which client expects src addresses
+	protocolPing     = 3 // protocol version at which both sides answer framePing
 )
 
 // frameType is the one byte frame type at the beginning of the frame
@@ -63,9 +65,15 @@ Login:
 * server sends frameServerInfo
 
 Steady state:
-* server occasionally sends frameKeepAlive
+* server occasionally sends framePing (or frameKeepAlive, before protocolPing)
+  and hangs up if the client doesn't answer with framePong in time
 * client sends frameSendPacket
 * server then sends frameRecvPacket to recipient
+* client may also send framePing, which the server answers with framePong
+
+Restart:
+* server sends frameRestarting to each client
+* client hangs up and reconnects after the delay in the frame
 */
 const (
 	frameServerKey     = frameType(0x01) // 8B magic + 32B public key + (0+ bytes future use)
@@ -74,7 +82,7 @@ const (
 	frameSendPacket    = frameType(0x04) // 32B dest pub key + packet bytes
 	frameForwardPacket = frameType(0x0a) // 32B src pub key + 32B dst pub key + packet bytes
 	frameRecvPacket    = frameType(0x05) // v0/1: packet bytes, v2: 32B src pub key + packet bytes
-	frameKeepAlive     = frameType(0x06) // no payload, no-op (to be replaced with ping/pong)
+	frameKeepAlive     = frameType(0x06) // no payload, no-op (see framePing for liveness checks)
 	frameNotePreferred = frameType(0x07) // 1 byte payload: 0x01 or 0x00 for whether this is client's home node
 
 	// framePeerGone is sent from server to client to signal that
@@ -101,8 +109,51 @@ const (
 	// connection. (To be used for cluster load balancing
 	// purposes, when clients end up on a non-ideal node)
 	frameClosePeer = frameType(0x11) // 32B pub key of peer to close.
+
+	// framePing is sent by either side to check that the
+	// connection is alive and measure its round-trip time. The
+	// other side replies with a framePong echoing the payload.
+	// Only sent to peers speaking protocolPing or later.
+	framePing = frameType(0x12) // 8 byte ping payload, to be echoed back in framePong
+	framePong = frameType(0x13) // 8 byte payload, the contents of the ping being replied to
+
+	// frameRestarting is sent from server to client when the
+	// server is about to restart (see Server.Drain). The client
+	// should disconnect and wait the given delay before
+	// reconnecting. Older clients ignore it.
+	frameRestarting = frameType(0x14) // uint32 BE: milliseconds to wait before reconnecting
 )
 
+// frameNames are the names of the frame types, as used in metrics.
+var frameNames = map[frameType]string{
+	frameServerKey:     "server_key",
+	frameClientInfo:    "client_info",
+	frameServerInfo:    "server_info",
+	frameSendPacket:    "send_packet",
+	frameForwardPacket: "forward_packet",
+	frameRecvPacket:    "recv_packet",
+	frameKeepAlive:     "keep_alive",
+	frameNotePreferred: "note_preferred",
+	framePeerGone:      "peer_gone",
+	framePeerPresent:   "peer_present",
+	frameWatchConns:    "watch_conns",
+	frameClosePeer:     "close_peer",
+	framePing:          "ping",
+	framePong:          "pong",
+	frameRestarting:    "restarting",
+}
+
+// frameName returns the name of t for metrics, or "unknown".
+func frameName(t frameType) string {
+	if name, ok := frameNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// pingLen is the length of the payload of framePing and framePong.
+const pingLen = 8
+
 var bin = binary.BigEndian
 
 func writeUint32(bw *bufio.Writer, v uint32) error {
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/nacl/box"
@@ -33,6 +34,8 @@ type Client struct {
 	wmu sync.Mutex // hold while writing to bw
 	bw  *bufio.Writer
 
+	sendingPong int32 // atomic; 1 while a goroutine writes a pong to a server ping
+
 	// Owned by Recv:
 	peeked  int   // bytes to discard on next Recv
 	readErr error // sticky read error
@@ -287,6 +290,40 @@ func (c *Client) ClosePeer(target key.Public) error {
 	return writeFrame(c.bw, frameClosePeer, target[:])
 }
 
+// CanPing reports whether the server answers pings sent with SendPing.
+func (c *Client) CanPing() bool { return c.protoVersion >= protocolPing }
+
+// SendPing sends a ping to the server, which replies with a
+// PongMessage echoing data. It is an error if !CanPing.
+func (c *Client) SendPing(data [pingLen]byte) error {
+	if !c.CanPing() {
+		return fmt.Errorf("derp.SendPing: server protocol version %d doesn't support pings", c.protoVersion)
+	}
+	return c.sendPingOrPong(framePing, data)
+}
+
+func (c *Client) sendPingOrPong(t frameType, data [pingLen]byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return writeFrame(c.bw, t, data[:])
+}
+
+// sendPong replies to a server ping in the background, so a
+// blocked write doesn't hold up Recv. Like the server, it drops
+// pings that arrive while a reply is still being written; the
+// server will ping again.
+func (c *Client) sendPong(data [pingLen]byte) {
+	if !atomic.CompareAndSwapInt32(&c.sendingPong, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&c.sendingPong, 0)
+		if err := c.sendPingOrPong(framePong, data); err != nil {
+			c.logf("error sending pong to DERP server: %v", err)
+		}
+	}()
+}
+
 // ReceivedMessage represents a type returned by Client.Recv. Unless
 // otherwise documented, the returned message aliases the byte slice
 // provided to Recv and thus the message is only as good as that
@@ -318,6 +355,21 @@ type PeerPresentMessage key.Public
 
 func (PeerPresentMessage) msg() {}
 
+// ServerRestartingMessage is a ReceivedMessage that indicates that
+// the server is about to restart. The client should disconnect and
+// wait ReconnectIn before connecting again.
+type ServerRestartingMessage struct {
+	ReconnectIn time.Duration
+}
+
+func (ServerRestartingMessage) msg() {}
+
+// PongMessage is a ReceivedMessage that is the server's reply to a
+// ping sent with Client.SendPing. It contains the ping's data.
+type PongMessage [pingLen]byte
+
+func (PongMessage) msg() {}
+
 // Recv reads a message from the DERP server.
 //
 // The returned message may alias memory owned by the Client; it
@@ -383,9 +435,28 @@ func (c *Client) recvTimeout(timeout time.Duration) (m ReceivedMessage, err erro
 		default:
 			continue
 		case frameKeepAlive:
-			// TODO: eventually we'll have server->client pings that
-			// require ack pongs.
+			// A no-op; the server predates framePing or isn't
+			// checking on us.
+			continue
+
+		case framePing:
+			if n < pingLen {
+				c.logf("[unexpected] dropping short ping frame from DERP server")
+				continue
+			}
+			var data [pingLen]byte
+			copy(data[:], b[:pingLen])
+			c.sendPong(data)
 			continue
+
+		case framePong:
+			if n < pingLen {
+				c.logf("[unexpected] dropping short pong frame from DERP server")
+				continue
+			}
+			var pm PongMessage
+			copy(pm[:], b[:pingLen])
+			return pm, nil
 		case framePeerGone:
 			if n < keyLen {
 				c.logf("[unexpected] dropping short peerGone frame from DERP server")
@@ -404,6 +475,14 @@ func (c *Client) recvTimeout(timeout time.Duration) (m ReceivedMessage, err erro
 			copy(pg[:], b[:keyLen])
 			return pg, nil
 
+		case frameRestarting:
+			if n < 4 {
+				c.logf("[unexpected] dropping short restarting frame from DERP server")
+				continue
+			}
+			ms := bin.Uint32(b[:4])
+			return ServerRestartingMessage{ReconnectIn: time.Duration(ms) * time.Millisecond}, nil
+
 		case frameRecvPacket:
 			var rp ReceivedPacket
 			if c.protoVersion < protocolSrcAddrs {
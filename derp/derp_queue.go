@@ -0,0 +1,126 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derp
+
+import (
+	"sync"
+
+	"tailscale.com/types/key"
+)
+
+// sendQueue is the queue of packets waiting to be written to a
+// client. It keeps a queue per sender and dequeues from them in
+// round-robin order, so that one sender can't starve the others of
+// the client's bandwidth.
+//
+// It holds at most perClientSendQueueDepth packets in total. When it
+// is full, the oldest packet of the sender with the most packets
+// queued is dropped to make room.
+type sendQueue struct {
+	// ready has a value in it when the queue may be non-empty.
+	ready chan struct{}
+
+	mu     sync.Mutex
+	n      int                  // total packets queued
+	queues map[key.Public][]pkt // sender => its queued packets, oldest first; never empty
+	order  []key.Public         // senders with queued packets, in round-robin order from head
+	head   int                  // index of the next sender in order
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{
+		ready:  make(chan struct{}, 1),
+		queues: map[key.Public][]pkt{},
+	}
+}
+
+// enqueue adds p, sent by sender, to the queue. It reports whether
+// a packet had to be dropped to make room for it.
+func (q *sendQueue) enqueue(sender key.Public, p pkt) (droppedHead bool) {
+	q.mu.Lock()
+	if q.n >= perClientSendQueueDepth {
+		// Punish whoever is hogging the queue, preferring the new
+		// packet's sender in a tie.
+		victim, most := sender, len(q.queues[sender])
+		for k, pp := range q.queues {
+			if len(pp) > most {
+				victim, most = k, len(pp)
+			}
+		}
+		q.dropHeadLocked(victim)
+		droppedHead = true
+	}
+	if len(q.queues[sender]) == 0 {
+		q.order = append(q.order, sender)
+	}
+	q.queues[sender] = append(q.queues[sender], p)
+	q.n++
+	q.mu.Unlock()
+
+	q.signal()
+	return droppedHead
+}
+
+// dequeue removes and returns the next packet to send, taking from
+// each sender in turn. It reports false if the queue is empty.
+func (q *sendQueue) dequeue() (p pkt, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.n == 0 {
+		return pkt{}, false
+	}
+	sender := q.order[q.head]
+	q.order[q.head] = key.Public{}
+	q.head++
+	if q.head >= len(q.order)/2 {
+		// Reclaim the consumed front of order. That copies no
+		// more senders than were dequeued since the last time,
+		// so dequeue stays O(1) amortized.
+		n := copy(q.order, q.order[q.head:])
+		q.order = q.order[:n]
+		q.head = 0
+	}
+	pp := q.queues[sender]
+	p = pp[0]
+	pp[0] = pkt{}
+	if pp = pp[1:]; len(pp) == 0 {
+		delete(q.queues, sender)
+	} else {
+		q.queues[sender] = pp
+		q.order = append(q.order, sender)
+	}
+	q.n--
+	if q.n > 0 {
+		q.signal()
+	}
+	return p, true
+}
+
+// dropHeadLocked drops the oldest packet queued by sender,
+// which must have one.
+func (q *sendQueue) dropHeadLocked(sender key.Public) {
+	pp := q.queues[sender]
+	pp[0] = pkt{}
+	if pp = pp[1:]; len(pp) > 0 {
+		q.queues[sender] = pp
+	} else {
+		delete(q.queues, sender)
+		for i := q.head; i < len(q.order); i++ {
+			if q.order[i] == sender {
+				q.order = append(q.order[:i], q.order[i+1:]...)
+				break
+			}
+		}
+	}
+	q.n--
+}
+
+// signal notes that the queue may be non-empty, without blocking.
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
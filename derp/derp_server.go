@@ -17,6 +17,7 @@ import (
 	"io"
 	"io/ioutil"
 	"math/big"
+	"math/rand"
 	"os"
 	"runtime"
 	"strconv"
@@ -26,6 +27,7 @@ import (
 
 	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
 	"tailscale.com/metrics"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
@@ -37,6 +39,7 @@ var debug, _ = strconv.ParseBool(os.Getenv("DERP_DEBUG_LOGS"))
 const (
 	perClientSendQueueDepth = 32 // packets buffered for sending
 	writeTimeout            = 2 * time.Second
+	serverPingTimeout       = 30 * time.Second // how long clients have to answer our pings
 )
 
 const host64bit = (^uint(0) >> 32) & 1 // 1 on 64-bit, 0 on 32-bit
@@ -58,6 +61,9 @@ type Server struct {
 	memSys0    uint64 // runtime.MemStats.Sys at start (or early-ish)
 	meshKey    string
 
+	keepAliveInterval time.Duration // if non-zero, overrides keepAlive; for tests
+	pingTimeout       time.Duration // if non-zero, overrides serverPingTimeout; for tests
+
 	// Counters:
 	_                        [pad32bit]byte
 	packetsSent, bytesSent   expvar.Int
@@ -68,16 +74,25 @@ type Server struct {
 	packetsDroppedFwdUnknown *expvar.Int // unknown dst pubkey on forward
 	packetsDroppedGone       *expvar.Int // dst conn shutting down
 	packetsDroppedQueueHead  *expvar.Int // queue full, drop head packet
-	packetsDroppedQueueTail  *expvar.Int // queue full, drop tail packet
+	packetsDroppedQueueTail  *expvar.Int // queue full, drop tail packet; kept for dashboards, as sendQueue drops heads
 	packetsDroppedWrite      *expvar.Int // error writing to dst conn
+	packetsDroppedPktRate    *expvar.Int // sender over its packet rate limit
+	packetsDroppedByteRate   *expvar.Int // sender over its byte rate limit
 	_                        [pad32bit]byte
 	packetsForwardedOut      expvar.Int
 	packetsForwardedIn       expvar.Int
 	peerGoneFrames           expvar.Int // number of peer gone frames sent
+	restartingFrames         expvar.Int // number of restarting frames sent
+	gotPing                  expvar.Int // number of ping frames from clients
+	sentPong                 expvar.Int // number of pong frames sent to clients
+	sentPing                 expvar.Int // number of ping frames sent to clients
+	gotPong                  expvar.Int // number of pong frames from clients
+	pingTimeouts             expvar.Int // clients disconnected for not answering a ping
 	accepts                  expvar.Int
 	curClients               expvar.Int
 	curHomeClients           expvar.Int // ones with preferred
 	clientsReplaced          expvar.Int
+	clientsRejected          expvar.Int // by verify
 	unknownFrames            expvar.Int
 	homeMovesIn              expvar.Int // established clients announce home server moves in
 	homeMovesOut             expvar.Int // established clients announce home server moves out
@@ -85,8 +100,25 @@ type Server struct {
 	multiForwarderDeleted    expvar.Int
 	removePktForwardOther    expvar.Int
 
+	// Metrics that aren't plain counters.
+	framesRecv       metrics.LabelMap   // frames read from clients after login, by type
+	framesSent       metrics.LabelMap   // frames written to clients after login, by type
+	framesRecvByType [256]*expvar.Int   // framesRecv's counters, indexed by frameType
+	framesSentByType [256]*expvar.Int   // framesSent's counters, indexed by frameType
+	queueDelay       *metrics.Histogram // seconds packets waited in client send queues
+	connectedClients *metrics.Histogram // number of local clients, sampled every statsSampleInterval
+	meshForwarders   *metrics.Histogram // number of clients reached via mesh peers, sampled likewise
+
+	done       chan struct{} // closed by Close
+	sampleDone chan struct{} // closed when sampleLoop returns, if it was started
+
 	mu          sync.Mutex
 	closed      bool
+	sampling    bool                   // whether sampleLoop was started
+	draining    bool                   // whether Drain was called
+	reconnectIn time.Duration          // with draining, minimum reconnect delay to send clients
+	spread      time.Duration          // with draining, range of random delay added to reconnectIn
+	drainTimer  *time.Timer            // with draining, closes the connections clients didn't
 	netConns    map[Conn]chan struct{} // chan is closed when conn closes
 	clients     map[key.Public]*sclient
 	clientsEver map[key.Public]bool // never deleted from, for stats; fine for now
@@ -102,6 +134,126 @@ type Server struct {
 	// because it includes intra-region forwarded packets as the
 	// src.
 	sentTo map[key.Public]map[key.Public]int64 // src => dst => dst's latest sclient.connNum
+
+	// verify decides which clients may use the server, or is nil
+	// to admit all of them. It's down here, rather than with meshKey,
+	// to keep the counters above aligned on 32-bit machines.
+	verify VerifyClientFunc
+
+	// rateLimit is the limit on how fast each client may send, and
+	// limiters enforce it per client key, so that reconnecting
+	// doesn't escape it. Both are guarded by mu.
+	rateLimit RateLimit
+	limiters  map[key.Public]*clientLimiters
+}
+
+// RateLimit limits how fast each client may send packets through a
+// Server. Packets over the limit are dropped. Zero values mean no limit.
+//
+// Mesh peers, which forward packets on behalf of many clients,
+// are not limited.
+type RateLimit struct {
+	PacketsPerSecond float64
+	// PacketBurst is the number of packets a client may send at once.
+	// If zero, it's one second's worth.
+	PacketBurst int
+
+	BytesPerSecond float64
+	// ByteBurst is the number of bytes a client may send at once.
+	// If zero, it's one second's worth. It's never less than
+	// MaxPacketSize.
+	ByteBurst int
+}
+
+// newLimiters returns the token buckets that enforce rl for one
+// client. Either is nil if that rate is unlimited.
+func (rl RateLimit) newLimiters() (packets, bytes *rate.Limiter) {
+	if rl.PacketsPerSecond > 0 {
+		burst := rl.PacketBurst
+		if burst <= 0 {
+			burst = int(rl.PacketsPerSecond)
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		packets = rate.NewLimiter(rate.Limit(rl.PacketsPerSecond), burst)
+	}
+	if rl.BytesPerSecond > 0 {
+		burst := rl.ByteBurst
+		if burst <= 0 {
+			burst = int(rl.BytesPerSecond)
+		}
+		if burst < MaxPacketSize {
+			burst = MaxPacketSize
+		}
+		bytes = rate.NewLimiter(rate.Limit(rl.BytesPerSecond), burst)
+	}
+	return packets, bytes
+}
+
+// clientLimiters are the rate limiters of one client key. They
+// outlive the key's connections until they'd have refilled anyway.
+type clientLimiters struct {
+	packets, bytes *rate.Limiter // either is nil if unlimited
+	conns          int           // connections using them
+	expire         *time.Timer   // while conns is zero, forgets them
+}
+
+// refillTime returns how long it takes l's token buckets to fill up
+// from empty.
+func (l *clientLimiters) refillTime() time.Duration {
+	var d time.Duration
+	for _, lim := range []*rate.Limiter{l.packets, l.bytes} {
+		if lim == nil {
+			continue
+		}
+		if ld := time.Duration(float64(lim.Burst()) / float64(lim.Limit()) * float64(time.Second)); ld > d {
+			d = ld
+		}
+	}
+	return d
+}
+
+// acquireLimitersLocked returns the rate limiters for a new
+// connection from k, or nil if clients aren't limited.
+//
+// s.mu must be held.
+func (s *Server) acquireLimitersLocked(k key.Public) *clientLimiters {
+	l := s.limiters[k]
+	if l == nil {
+		packets, bytes := s.rateLimit.newLimiters()
+		if packets == nil && bytes == nil {
+			return nil
+		}
+		l = &clientLimiters{packets: packets, bytes: bytes}
+		if s.limiters == nil {
+			s.limiters = map[key.Public]*clientLimiters{}
+		}
+		s.limiters[k] = l
+	}
+	if l.expire != nil {
+		l.expire.Stop()
+		l.expire = nil
+	}
+	l.conns++
+	return l
+}
+
+// releaseLimitersLocked notes that a connection from k that used l
+// has closed.
+//
+// s.mu must be held.
+func (s *Server) releaseLimitersLocked(k key.Public, l *clientLimiters) {
+	if l.conns--; l.conns > 0 || s.limiters[k] != l {
+		return
+	}
+	l.expire = time.AfterFunc(l.refillTime(), func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.limiters[k] == l && l.conns == 0 {
+			delete(s.limiters, k)
+		}
+	})
 }
 
 // PacketForwarder is something that can forward packets.
@@ -137,6 +289,11 @@ func NewServer(privateKey key.Private, logf logger.Logf) *Server {
 		publicKey:            privateKey.Public(),
 		logf:                 logf,
 		packetsDroppedReason: metrics.LabelMap{Label: "reason"},
+		framesRecv:           metrics.LabelMap{Label: "type"},
+		framesSent:           metrics.LabelMap{Label: "type"},
+		queueDelay:           metrics.NewHistogram(metrics.ExponentialBuckets(0.0001, 2, 16)), // 100µs to ~3.3s
+		connectedClients:     metrics.NewHistogram(metrics.ExponentialBuckets(1, 2, 17)),      // 1 to 64Ki
+		meshForwarders:       metrics.NewHistogram(metrics.ExponentialBuckets(1, 2, 17)),
 		clients:              map[key.Public]*sclient{},
 		clientsEver:          map[key.Public]bool{},
 		clientsMesh:          map[key.Public]PacketForwarder{},
@@ -144,6 +301,8 @@ func NewServer(privateKey key.Private, logf logger.Logf) *Server {
 		memSys0:              ms.Sys,
 		watchers:             map[*sclient]bool{},
 		sentTo:               map[key.Public]map[key.Public]int64{},
+		done:                 make(chan struct{}),
+		sampleDone:           make(chan struct{}),
 	}
 	s.packetsDroppedUnknown = s.packetsDroppedReason.Get("unknown_dest")
 	s.packetsDroppedFwdUnknown = s.packetsDroppedReason.Get("unknown_dest_on_fwd")
@@ -151,9 +310,63 @@ func NewServer(privateKey key.Private, logf logger.Logf) *Server {
 	s.packetsDroppedQueueHead = s.packetsDroppedReason.Get("queue_head")
 	s.packetsDroppedQueueTail = s.packetsDroppedReason.Get("queue_tail")
 	s.packetsDroppedWrite = s.packetsDroppedReason.Get("write_error")
+	s.packetsDroppedPktRate = s.packetsDroppedReason.Get("throttled_packets")
+	s.packetsDroppedByteRate = s.packetsDroppedReason.Get("throttled_bytes")
+	for t := range s.framesRecvByType {
+		name := frameName(frameType(t))
+		s.framesRecvByType[t] = s.framesRecv.Get(name)
+		s.framesSentByType[t] = s.framesSent.Get(name)
+	}
 	return s
 }
 
+// statsSampleInterval is how often the server samples its client
+// counts into histograms.
+const statsSampleInterval = 10 * time.Second
+
+// startSampling starts sampleLoop, if it isn't running yet. It's
+// started once the metrics are exported, as nobody sees the samples
+// otherwise.
+func (s *Server) startSampling() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sampling || s.closed {
+		return
+	}
+	s.sampling = true
+	go s.sampleLoop()
+}
+
+// sampleLoop periodically records the number of connected clients
+// and of clients reached via mesh peers, until s is closed.
+func (s *Server) sampleLoop() {
+	defer close(s.sampleDone)
+	t := time.NewTicker(statsSampleInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+			s.sampleStats()
+		}
+	}
+}
+
+func (s *Server) sampleStats() {
+	s.mu.Lock()
+	clients := len(s.clients)
+	var forwarded int
+	for _, fwd := range s.clientsMesh {
+		if fwd != nil {
+			forwarded++
+		}
+	}
+	s.mu.Unlock()
+	s.connectedClients.Observe(float64(clients))
+	s.meshForwarders.Observe(float64(forwarded))
+}
+
 // SetMesh sets the pre-shared key that regional DERP servers used to mesh
 // amongst themselves.
 //
@@ -162,6 +375,26 @@ func (s *Server) SetMeshKey(v string) {
 	s.meshKey = v
 }
 
+// SetVerifyClient sets the function that decides which clients may
+// use the server. By default, all clients are admitted.
+//
+// It must be called before serving begins.
+func (s *Server) SetVerifyClient(f VerifyClientFunc) {
+	s.verify = f
+}
+
+// SetRateLimit sets the limit on how fast each client may send.
+// By default, clients are not limited.
+//
+// It may be called while serving, but only applies to clients that
+// connect afterwards.
+func (s *Server) SetRateLimit(rl RateLimit) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rateLimit = rl
+	s.limiters = nil
+}
+
 // HasMeshKey reports whether the server is configured with a mesh key.
 func (s *Server) HasMeshKey() bool { return s.meshKey != "" }
 
@@ -179,10 +412,21 @@ func (s *Server) Close() error {
 	s.mu.Lock()
 	wasClosed := s.closed
 	s.closed = true
+	sampling := s.sampling
 	s.mu.Unlock()
 	if wasClosed {
 		return nil
 	}
+	close(s.done)
+	if sampling {
+		<-s.sampleDone
+	}
+
+	s.mu.Lock()
+	if s.drainTimer != nil {
+		s.drainTimer.Stop()
+	}
+	s.mu.Unlock()
 
 	var closedChs []chan struct{}
 
@@ -200,6 +444,53 @@ func (s *Server) Close() error {
 	return nil
 }
 
+// Drain starts draining the server ahead of a restart. Every client
+// is told that the server is restarting and to reconnect after a
+// delay. The delays are spread randomly between reconnectIn and
+// reconnectIn+spread, so that the clients don't all come back at once.
+// New connections are refused from then on.
+//
+// Clients hang up on their own once told; any connection still open
+// after reconnectIn+spread is closed. Draining can't be undone.
+func (s *Server) Drain(reconnectIn, spread time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining || s.closed {
+		return
+	}
+	s.draining = true
+	s.reconnectIn = reconnectIn
+	s.spread = spread
+	s.logf("derp: draining %d clients; reconnect in %v+%v", len(s.clients), reconnectIn, spread)
+	for _, c := range s.clients {
+		c.requestRestartingLocked()
+	}
+	s.drainTimer = time.AfterFunc(reconnectIn+spread, s.closeDrainedConns)
+}
+
+// closeDrainedConns closes the connections left open at the end of a
+// drain.
+func (s *Server) closeDrainedConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	if len(s.netConns) > 0 {
+		s.logf("derp: drain done; closing %d remaining connections", len(s.netConns))
+	}
+	for nc := range s.netConns {
+		nc.Close()
+	}
+}
+
+// IsDraining reports whether Drain has been called.
+func (s *Server) IsDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
 func (s *Server) isClosed() bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -213,10 +504,17 @@ func (s *Server) isClosed() bool {
 // on its own.
 //
 // Accept closes nc.
+//
+// Once the server is draining, Accept closes nc right away.
 func (s *Server) Accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string) {
 	closed := make(chan struct{})
 
 	s.mu.Lock()
+	if s.draining {
+		s.mu.Unlock()
+		nc.Close()
+		return
+	}
 	s.accepts.Add(1)             // while holding s.mu for connNum read on next line
 	connNum := s.accepts.Value() // expvar sadly doesn't return new value on Add(1)
 	s.netConns[nc] = closed
@@ -256,6 +554,10 @@ func (s *Server) registerClient(c *sclient) {
 	}
 	s.curClients.Add(1)
 	s.broadcastPeerStateChangeLocked(c.key, true)
+	if s.draining {
+		// Accepted just before Drain started.
+		c.requestRestartingLocked()
+	}
 }
 
 // broadcastPeerStateChangeLocked enqueues a message to all watchers
@@ -287,6 +589,9 @@ func (s *Server) unregisterClient(c *sclient) {
 	if c.canMesh {
 		delete(s.watchers, c)
 	}
+	if c.limiters != nil {
+		s.releaseLimitersLocked(c.key, c.limiters)
+	}
 
 	s.curClients.Add(-1)
 	if c.preferred {
@@ -351,7 +656,8 @@ func (s *Server) accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string, connN
 	if err != nil {
 		return fmt.Errorf("receive client key: %v", err)
 	}
-	if err := s.verifyClient(clientKey, clientInfo); err != nil {
+	if err := s.verifyClient(clientKey, clientInfo, remoteAddr); err != nil {
+		s.clientsRejected.Add(1)
 		return fmt.Errorf("client %x rejected: %v", clientKey, err)
 	}
 
@@ -372,12 +678,22 @@ func (s *Server) accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string, connN
 		done:        ctx.Done(),
 		remoteAddr:  remoteAddr,
 		connectedAt: time.Now(),
-		sendQueue:   make(chan pkt, perClientSendQueueDepth),
+		sendQueue:   newSendQueue(),
 		peerGone:    make(chan key.Public),
+		sendPongCh:  make(chan [pingLen]byte, 1),
+		gotPongCh:   make(chan [pingLen]byte, 1),
+		restarting:  make(chan time.Duration, 1),
 		canMesh:     clientInfo.MeshKey != "" && clientInfo.MeshKey == s.meshKey,
 	}
 	if c.canMesh {
 		c.meshUpdate = make(chan struct{})
+	} else {
+		s.mu.Lock()
+		c.limiters = s.acquireLimitersLocked(c.key)
+		s.mu.Unlock()
+		if c.limiters != nil {
+			c.packetLimiter, c.byteLimiter = c.limiters.packets, c.limiters.bytes
+		}
 	}
 	if clientInfo != nil {
 		c.info = *clientInfo
@@ -421,6 +737,7 @@ func (c *sclient) run(ctx context.Context) error {
 			}
 			return fmt.Errorf("client %x: readFrameHeader: %w", c.key, err)
 		}
+		c.s.framesRecvByType[ft].Add(1)
 		switch ft {
 		case frameNotePreferred:
 			err = c.handleFrameNotePreferred(ft, fl)
@@ -432,6 +749,10 @@ func (c *sclient) run(ctx context.Context) error {
 			err = c.handleFrameWatchConns(ft, fl)
 		case frameClosePeer:
 			err = c.handleFrameClosePeer(ft, fl)
+		case framePing:
+			err = c.handleFramePing(ft, fl)
+		case framePong:
+			err = c.handleFramePong(ft, fl)
 		default:
 			err = c.handleUnknownFrame(ft, fl)
 		}
@@ -525,12 +846,63 @@ func (c *sclient) handleFrameForwardPacket(ft frameType, fl uint32) error {
 		return nil
 	}
 
-	return c.sendPkt(dst, pkt{
+	return c.sendPkt(dst, srcKey, pkt{
 		bs:  contents,
 		src: srcKey,
 	})
 }
 
+// handleFramePing reads a ping frame from the client and
+// schedules a pong in reply.
+func (c *sclient) handleFramePing(ft frameType, fl uint32) error {
+	c.s.gotPing.Add(1)
+	if fl < pingLen {
+		return fmt.Errorf("short ping: %v", fl)
+	}
+	var data [pingLen]byte
+	if _, err := io.ReadFull(c.br, data[:]); err != nil {
+		return err
+	}
+	// Allow for future extensions to the ping payload.
+	if extra := int64(fl) - pingLen; extra > 0 {
+		if _, err := io.CopyN(ioutil.Discard, c.br, extra); err != nil {
+			return err
+		}
+	}
+	select {
+	case c.sendPongCh <- data:
+	default:
+		// A pong is already pending. Drop this one; the client
+		// will ping again.
+	}
+	return nil
+}
+
+// handleFramePong reads a pong frame from the client and hands
+// it to the sender, which is waiting for it.
+func (c *sclient) handleFramePong(ft frameType, fl uint32) error {
+	c.s.gotPong.Add(1)
+	if fl < pingLen {
+		return fmt.Errorf("short pong: %v", fl)
+	}
+	var data [pingLen]byte
+	if _, err := io.ReadFull(c.br, data[:]); err != nil {
+		return err
+	}
+	if extra := int64(fl) - pingLen; extra > 0 {
+		if _, err := io.CopyN(ioutil.Discard, c.br, extra); err != nil {
+			return err
+		}
+	}
+	select {
+	case c.gotPongCh <- data:
+	default:
+		// The sender hasn't taken the last one yet, so this
+		// one is unsolicited.
+	}
+	return nil
+}
+
 // notePeerSendLocked records that src sent to dst.  We keep track of
 // that so when src disconnects, we can tell dst (if it's still
 // around) that src is gone (a peerGone frame).
@@ -551,6 +923,9 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	if err != nil {
 		return fmt.Errorf("client %x: recvPacket: %v", c.key, err)
 	}
+	if !c.allowSend(len(contents)) {
+		return nil
+	}
 
 	var fwd PacketForwarder
 	s.mu.Lock()
@@ -585,53 +960,98 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	if dst.info.Version >= protocolSrcAddrs {
 		p.src = c.key
 	}
-	return c.sendPkt(dst, p)
+	return c.sendPkt(dst, c.key, p)
+}
+
+// allowSend reports whether the client may send a packet of n bytes
+// under the server's rate limit, counting the drop if not. A dropped
+// packet uses up neither limit.
+func (c *sclient) allowSend(n int) bool {
+	s := c.s
+	now := time.Now()
+	var throttled *expvar.Int
+	pr, pok := reserve(c.packetLimiter, now, 1)
+	br, bok := reserve(c.byteLimiter, now, n)
+	switch {
+	case !pok:
+		throttled = s.packetsDroppedPktRate
+	case !bok:
+		throttled = s.packetsDroppedByteRate
+	default:
+		return true
+	}
+	if pr != nil {
+		pr.CancelAt(now)
+	}
+	if br != nil {
+		br.CancelAt(now)
+	}
+	s.packetsDropped.Add(1)
+	throttled.Add(1)
+	if debug {
+		c.logf("dropping packet over rate limit")
+	}
+	return false
 }
 
-func (c *sclient) sendPkt(dst *sclient, p pkt) error {
+// reserve takes n tokens from lim, if it has them now, returning the
+// reservation so that it can be canceled. A nil lim always has them.
+func reserve(lim *rate.Limiter, now time.Time, n int) (r *rate.Reservation, ok bool) {
+	if lim == nil {
+		return nil, true
+	}
+	r = lim.ReserveN(now, n)
+	if !r.OK() || r.DelayFrom(now) > 0 {
+		r.CancelAt(now)
+		return nil, false
+	}
+	return r, true
+}
+
+// sendPkt queues p, from sender, to be sent to dst. The sender is
+// usually c's key, but c may be a mesh peer forwarding packets on
+// behalf of others.
+func (c *sclient) sendPkt(dst *sclient, sender key.Public, p pkt) error {
 	s := c.s
 	dstKey := dst.key
 
-	// Attempt to queue for sending up to 3 times. On each attempt, if
-	// the queue is full, try to drop from queue head to prioritize
-	// fresher packets.
-	for attempt := 0; attempt < 3; attempt++ {
-		select {
-		case <-dst.done:
-			s.packetsDropped.Add(1)
-			s.packetsDroppedGone.Add(1)
-			if debug {
-				c.logf("dropping packet for shutdown client %x", dstKey)
-			}
-			return nil
-		default:
+	select {
+	case <-dst.done:
+		s.packetsDropped.Add(1)
+		s.packetsDroppedGone.Add(1)
+		if debug {
+			c.logf("dropping packet for shutdown client %x", dstKey)
 		}
-		select {
-		case dst.sendQueue <- p:
-			return nil
-		default:
+		return nil
+	default:
+	}
+	p.enqueuedAt = time.Now()
+	if dst.sendQueue.enqueue(sender, p) {
+		s.packetsDropped.Add(1)
+		s.packetsDroppedQueueHead.Add(1)
+		if debug {
+			c.logf("dropping packet from client %x queue head", dstKey)
 		}
+	}
+	return nil
+}
 
-		select {
-		case <-dst.sendQueue:
-			s.packetsDropped.Add(1)
-			s.packetsDroppedQueueHead.Add(1)
-			if debug {
-				c.logf("dropping packet from client %x queue head", dstKey)
-			}
-		default:
-		}
+// requestRestartingLocked requests that a restarting frame be written
+// to the client, with a reconnect delay picked from the server's
+// drain settings.
+//
+// s.mu must be held.
+func (c *sclient) requestRestartingLocked() {
+	s := c.s
+	d := s.reconnectIn
+	if s.spread > 0 {
+		d += time.Duration(rand.Int63n(int64(s.spread)))
 	}
-	// Failed to make room for packet. This can happen in a heavily
-	// contended queue with racing writers. Give up and tail-drop in
-	// this case to keep reader unblocked.
-	s.packetsDropped.Add(1)
-	s.packetsDroppedQueueTail.Add(1)
-	if debug {
-		c.logf("dropping packet from client %x queue tail", dstKey)
+	select {
+	case c.restarting <- d:
+	default:
+		// Already requested.
 	}
-
-	return nil
 }
 
 // requestPeerGoneWrite sends a request to write a "peer gone" frame
@@ -654,10 +1074,16 @@ func (c *sclient) requestMeshUpdate() {
 	}
 }
 
-func (s *Server) verifyClient(clientKey key.Public, info *clientInfo) error {
-	// TODO(crawshaw): implement policy constraints on who can use the DERP server
+func (s *Server) verifyClient(clientKey key.Public, info *clientInfo, remoteAddr string) error {
+	if info.MeshKey != "" && info.MeshKey == s.meshKey {
+		// Other servers in the region are always welcome.
+		return nil
+	}
+	if s.verify == nil {
+		return nil
+	}
 	// TODO(bradfitz): ... and at what rate.
-	return nil
+	return s.verify(clientKey, remoteAddr)
 }
 
 func (s *Server) sendServerKey(bw *bufio.Writer) error {
@@ -791,20 +1217,29 @@ type sclient struct {
 	key        key.Public
 	info       clientInfo
 	logf       logger.Logf
-	done       <-chan struct{} // closed when connection closes
-	remoteAddr string          // usually ip:port from net.Conn.RemoteAddr().String()
-	sendQueue  chan pkt        // packets queued to this client; never closed
-	peerGone   chan key.Public // write request that a previous sender has disconnected (not used by mesh peers)
-	meshUpdate chan struct{}   // write request to write peerStateChange
-	canMesh    bool            // clientInfo had correct mesh token for inter-region routing
+	done       <-chan struct{}    // closed when connection closes
+	remoteAddr string             // usually ip:port from net.Conn.RemoteAddr().String()
+	sendQueue  *sendQueue         // packets queued to this client
+	peerGone   chan key.Public    // write request that a previous sender has disconnected (not used by mesh peers)
+	sendPongCh chan [pingLen]byte // pong replies to write; buffered 1
+	gotPongCh  chan [pingLen]byte // pongs read, for the sender to match to its ping; buffered 1
+	restarting chan time.Duration // write request for a restarting frame with this delay; buffered 1
+	meshUpdate chan struct{}      // write request to write peerStateChange
+	canMesh    bool               // clientInfo had correct mesh token for inter-region routing
 
 	// Owned by run, not thread-safe.
-	br          *bufio.Reader
-	connectedAt time.Time
-	preferred   bool
+	br            *bufio.Reader
+	connectedAt   time.Time
+	preferred     bool
+	limiters      *clientLimiters // shared with c.key's other connections; nil if unlimited
+	packetLimiter *rate.Limiter   // or nil if unlimited
+	byteLimiter   *rate.Limiter   // or nil if unlimited
 
 	// Owned by sender, not thread-safe.
-	bw *bufio.Writer
+	bw           *bufio.Writer
+	pingData     [pingLen]byte    // payload of the unanswered ping
+	pingTimer    *time.Timer      // fires when the unanswered ping times out
+	pingTimeoutC <-chan time.Time // pingTimer.C while a ping is unanswered, else nil
 
 	// Guarded by s.mu
 	//
@@ -831,7 +1266,9 @@ type pkt struct {
 	// The memory is owned by pkt.
 	bs []byte
 
-	// TODO(danderson): enqueue time, to measure queue latency?
+	// enqueuedAt is when the packet was added to the send queue,
+	// to measure queue latency.
+	enqueuedAt time.Time
 }
 
 func (c *sclient) setPreferred(v bool) {
@@ -867,27 +1304,32 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 
 		// Drain the send queue to count dropped packets
 		for {
-			select {
-			case <-c.sendQueue:
-				c.s.packetsDropped.Add(1)
-				c.s.packetsDroppedGone.Add(1)
-				if debug {
-					c.logf("dropping packet for shutdown %x", c.key)
-				}
-			default:
+			if _, ok := c.sendQueue.dequeue(); !ok {
 				return
 			}
+			c.s.packetsDropped.Add(1)
+			c.s.packetsDroppedGone.Add(1)
+			if debug {
+				c.logf("dropping packet for shutdown %x", c.key)
+			}
 		}
 	}()
 
-	jitterMs, err := crand.Int(crand.Reader, big.NewInt(5000))
+	interval := keepAlive
+	if c.s.keepAliveInterval != 0 {
+		interval = c.s.keepAliveInterval
+	}
+	jitter, err := crand.Int(crand.Reader, big.NewInt(int64(interval/12)))
 	if err != nil {
 		panic(err)
 	}
-	jitter := time.Duration(jitterMs.Int64()) * time.Millisecond
-	keepAliveTick := time.NewTicker(keepAlive + jitter)
+	keepAliveTick := time.NewTicker(interval + time.Duration(jitter.Int64()))
 	defer keepAliveTick.Stop()
 
+	c.pingTimer = time.NewTimer(0)
+	c.pingTimer.Stop()
+	defer c.pingTimer.Stop()
+
 	var werr error // last write error
 	for {
 		if werr != nil {
@@ -904,12 +1346,24 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case <-c.meshUpdate:
 			werr = c.sendMeshUpdates()
 			continue
-		case msg := <-c.sendQueue:
-			werr = c.sendPacket(msg.src, msg.bs)
+		case <-c.sendQueue.ready:
+			werr = c.sendQueuedPacket()
+			continue
+		case data := <-c.sendPongCh:
+			werr = c.sendPong(data)
+			continue
+		case d := <-c.restarting:
+			werr = c.sendRestarting(d)
 			continue
 		case <-keepAliveTick.C:
-			werr = c.sendKeepAlive()
+			werr = c.sendPingOrKeepAlive()
 			continue
+		case data := <-c.gotPongCh:
+			c.notePong(data)
+			continue
+		case <-c.pingTimeoutC:
+			c.s.pingTimeouts.Add(1)
+			return errors.New("no pong in reply to ping")
 		default:
 			// Flush any writes from the 3 sends above, or from
 			// the blocking loop below.
@@ -927,10 +1381,19 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case <-c.meshUpdate:
 			werr = c.sendMeshUpdates()
 			continue
-		case msg := <-c.sendQueue:
-			werr = c.sendPacket(msg.src, msg.bs)
+		case <-c.sendQueue.ready:
+			werr = c.sendQueuedPacket()
+		case data := <-c.sendPongCh:
+			werr = c.sendPong(data)
+		case d := <-c.restarting:
+			werr = c.sendRestarting(d)
 		case <-keepAliveTick.C:
-			werr = c.sendKeepAlive()
+			werr = c.sendPingOrKeepAlive()
+		case data := <-c.gotPongCh:
+			c.notePong(data)
+		case <-c.pingTimeoutC:
+			c.s.pingTimeouts.Add(1)
+			return errors.New("no pong in reply to ping")
 		}
 	}
 }
@@ -939,17 +1402,94 @@ func (c *sclient) setWriteDeadline() {
 	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
 }
 
+// sendQueuedPacket sends the next packet in the send queue, if any,
+// without flushing.
+func (c *sclient) sendQueuedPacket() error {
+	msg, ok := c.sendQueue.dequeue()
+	if !ok {
+		return nil
+	}
+	c.s.queueDelay.Observe(time.Since(msg.enqueuedAt).Seconds())
+	return c.sendPacket(msg.src, msg.bs)
+}
+
+// writeFrameHeader writes a frame header to the client, counting
+// the frame by type.
+func (c *sclient) writeFrameHeader(t frameType, frameLen uint32) error {
+	c.s.framesSentByType[t].Add(1)
+	return writeFrameHeader(c.bw, t, frameLen)
+}
+
 // sendKeepAlive sends a keep-alive frame, without flushing.
 func (c *sclient) sendKeepAlive() error {
 	c.setWriteDeadline()
-	return writeFrameHeader(c.bw, frameKeepAlive, 0)
+	return c.writeFrameHeader(frameKeepAlive, 0)
+}
+
+// sendPingOrKeepAlive sends a ping to clients that answer them,
+// and a keep-alive frame to the rest, without flushing. If the
+// last ping is still unanswered, it sends nothing.
+func (c *sclient) sendPingOrKeepAlive() error {
+	if c.info.Version < protocolPing {
+		return c.sendKeepAlive()
+	}
+	if c.pingTimeoutC != nil {
+		return nil
+	}
+	if _, err := crand.Read(c.pingData[:]); err != nil {
+		return err
+	}
+	timeout := serverPingTimeout
+	if c.s.pingTimeout != 0 {
+		timeout = c.s.pingTimeout
+	}
+	c.pingTimer.Reset(timeout)
+	c.pingTimeoutC = c.pingTimer.C
+
+	c.s.sentPing.Add(1)
+	c.setWriteDeadline()
+	if err := c.writeFrameHeader(framePing, pingLen); err != nil {
+		return err
+	}
+	_, err := c.bw.Write(c.pingData[:])
+	return err
+}
+
+// notePong stops the ping timeout if data answers the
+// unanswered ping.
+func (c *sclient) notePong(data [pingLen]byte) {
+	if c.pingTimeoutC != nil && data == c.pingData {
+		c.pingTimer.Stop()
+		c.pingTimeoutC = nil
+	}
+}
+
+// sendPong sends a pong reply, without flushing.
+func (c *sclient) sendPong(data [pingLen]byte) error {
+	c.s.sentPong.Add(1)
+	c.setWriteDeadline()
+	if err := c.writeFrameHeader(framePong, pingLen); err != nil {
+		return err
+	}
+	_, err := c.bw.Write(data[:])
+	return err
+}
+
+// sendRestarting sends a restarting frame, without flushing.
+func (c *sclient) sendRestarting(reconnectIn time.Duration) error {
+	c.s.restartingFrames.Add(1)
+	c.setWriteDeadline()
+	if err := c.writeFrameHeader(frameRestarting, 4); err != nil {
+		return err
+	}
+	return writeUint32(c.bw, uint32(reconnectIn/time.Millisecond))
 }
 
 // sendPeerGone sends a peerGone frame, without flushing.
 func (c *sclient) sendPeerGone(peer key.Public) error {
 	c.s.peerGoneFrames.Add(1)
 	c.setWriteDeadline()
-	if err := writeFrameHeader(c.bw, framePeerGone, keyLen); err != nil {
+	if err := c.writeFrameHeader(framePeerGone, keyLen); err != nil {
 		return err
 	}
 	_, err := c.bw.Write(peer[:])
@@ -959,7 +1499,7 @@ func (c *sclient) sendPeerGone(peer key.Public) error {
 // sendPeerPresent sends a peerPresent frame, without flushing.
 func (c *sclient) sendPeerPresent(peer key.Public) error {
 	c.setWriteDeadline()
-	if err := writeFrameHeader(c.bw, framePeerPresent, keyLen); err != nil {
+	if err := c.writeFrameHeader(framePeerPresent, keyLen); err != nil {
 		return err
 	}
 	_, err := c.bw.Write(peer[:])
@@ -1036,7 +1576,7 @@ func (c *sclient) sendPacket(srcKey key.Public, contents []byte) (err error) {
 	if withKey {
 		pktLen += len(srcKey)
 	}
-	if err = writeFrameHeader(c.bw, frameRecvPacket, uint32(pktLen)); err != nil {
+	if err = c.writeFrameHeader(frameRecvPacket, uint32(pktLen)); err != nil {
 		return err
 	}
 	if withKey {
@@ -1166,6 +1706,7 @@ func (s *Server) expVarFunc(f func() interface{}) expvar.Func {
 
 // ExpVar returns an expvar variable suitable for registering with expvar.Publish.
 func (s *Server) ExpVar() expvar.Var {
+	s.startSampling()
 	m := new(metrics.Set)
 	m.Set("counter_unique_clients_ever", s.expVarFunc(func() interface{} { return len(s.clientsEver) }))
 	m.Set("gauge_memstats_sys0", expvar.Func(func() interface{} { return int64(s.memSys0) }))
@@ -1177,6 +1718,7 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("gauge_clients_remote", expvar.Func(func() interface{} { return len(s.clientsMesh) - len(s.clients) }))
 	m.Set("accepts", &s.accepts)
 	m.Set("clients_replaced", &s.clientsReplaced)
+	m.Set("clients_rejected", &s.clientsRejected)
 	m.Set("bytes_received", &s.bytesRecv)
 	m.Set("bytes_sent", &s.bytesSent)
 	m.Set("packets_dropped", &s.packetsDropped)
@@ -1187,11 +1729,22 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("home_moves_in", &s.homeMovesIn)
 	m.Set("home_moves_out", &s.homeMovesOut)
 	m.Set("peer_gone_frames", &s.peerGoneFrames)
+	m.Set("restarting_frames", &s.restartingFrames)
+	m.Set("got_ping", &s.gotPing)
+	m.Set("sent_pong", &s.sentPong)
+	m.Set("sent_ping", &s.sentPing)
+	m.Set("got_pong", &s.gotPong)
+	m.Set("ping_timeouts", &s.pingTimeouts)
 	m.Set("packets_forwarded_out", &s.packetsForwardedOut)
 	m.Set("packets_forwarded_in", &s.packetsForwardedIn)
 	m.Set("multiforwarder_created", &s.multiForwarderCreated)
 	m.Set("multiforwarder_deleted", &s.multiForwarderDeleted)
 	m.Set("packet_forwarder_delete_other_value", &s.removePktForwardOther)
+	m.Set("counter_frames_received", &s.framesRecv)
+	m.Set("counter_frames_sent", &s.framesSent)
+	m.Set("queue_delay_seconds", s.queueDelay)
+	m.Set("connected_clients", s.connectedClients)
+	m.Set("mesh_forwarders", s.meshForwarders)
 	var expvarVersion expvar.String
 	expvarVersion.Set(version.LONG)
 	m.Set("version", &expvarVersion)
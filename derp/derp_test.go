@@ -8,17 +8,22 @@ import (
 	"bufio"
 	"context"
 	crand "crypto/rand"
+	"encoding/json"
 	"errors"
 	"expvar"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	"tailscale.com/net/nettest"
+	"tailscale.com/tstest"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 )
@@ -742,3 +747,357 @@ func TestForwarderRegistration(t *testing.T) {
 		u1: testFwd(3),
 	})
 }
+
+func TestParseAllowlist(t *testing.T) {
+	k1, k2 := pubAll(1), pubAll(2)
+	in := fmt.Sprintf("# comment\n\n%x\n  nodekey:%x  \n", k1[:], k2[:])
+	keys, err := parseAllowlist(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[key.Public]bool{k1: true, k2: true}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got %v; want %v", keys, want)
+	}
+
+	if _, err := parseAllowlist(strings.NewReader("nodekey:xyz\n")); err == nil {
+		t.Error("bad key parsed without error")
+	}
+}
+
+func TestVerifyClient(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+
+	allowed := newPrivateKey(t)
+	ts.s.SetVerifyClient(func(k key.Public, remoteAddr string) error {
+		if k != allowed.Public() {
+			return errors.New("not allowed")
+		}
+		return nil
+	})
+
+	connect := func(priv key.Private, opts ...ClientOpt) error {
+		nc, err := net.Dial("tcp", ts.ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer nc.Close()
+		brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+		_, err = NewClient(priv, nc, brw, t.Logf, opts...)
+		return err
+	}
+
+	if err := connect(allowed); err != nil {
+		t.Errorf("allowed client: %v", err)
+	}
+	if err := connect(newPrivateKey(t)); err == nil {
+		t.Error("disallowed client connected")
+	}
+	// Mesh peers don't need to be allowed.
+	if err := connect(newPrivateKey(t), MeshKey("mesh-key")); err != nil {
+		t.Errorf("mesh peer: %v", err)
+	}
+	if got := ts.s.clientsRejected.Value(); got != 1 {
+		t.Errorf("clientsRejected = %d; want 1", got)
+	}
+}
+
+func TestHTTPVerifier(t *testing.T) {
+	allowed := pubAll(1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req verifyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		if req.Source != "1.2.3.4:5678" {
+			http.Error(w, "bad source "+req.Source, 400)
+			return
+		}
+		if req.NodePublic != fmt.Sprintf("nodekey:%x", allowed[:]) {
+			http.Error(w, "go away", 403)
+			return
+		}
+	}))
+	defer srv.Close()
+
+	verify := HTTPVerifier(srv.URL)
+	if err := verify(allowed, "1.2.3.4:5678"); err != nil {
+		t.Errorf("allowed key: %v", err)
+	}
+	if err := verify(pubAll(2), "1.2.3.4:5678"); err == nil || !strings.Contains(err.Error(), "go away") {
+		t.Errorf("disallowed key: err = %v; want rejection", err)
+	}
+
+	srv.Close()
+	if err := verify(allowed, "1.2.3.4:5678"); err == nil {
+		t.Error("unreachable service admitted client")
+	}
+}
+
+func TestSendQueueFair(t *testing.T) {
+	q := newSendQueue()
+	noisy, quiet1, quiet2 := pubAll(1), pubAll(2), pubAll(3)
+	pktFrom := func(sender key.Public, n int) pkt {
+		return pkt{src: sender, bs: []byte{byte(n)}}
+	}
+
+	for i := 0; i < perClientSendQueueDepth; i++ {
+		if q.enqueue(noisy, pktFrom(noisy, i)) {
+			t.Fatalf("dropped packet %d before queue was full", i)
+		}
+	}
+	// The queue is full, so the noisy sender loses its oldest packets
+	// to make room for the others.
+	if !q.enqueue(quiet1, pktFrom(quiet1, 0)) {
+		t.Error("full queue didn't drop")
+	}
+	if !q.enqueue(quiet2, pktFrom(quiet2, 0)) {
+		t.Error("full queue didn't drop")
+	}
+
+	var got []string
+	for i := 0; i < 5; i++ {
+		p, ok := q.dequeue()
+		if !ok {
+			t.Fatal("queue unexpectedly empty")
+		}
+		got = append(got, fmt.Sprintf("%d/%d", p.src[0], p.bs[0]))
+	}
+	want := []string{"1/2", "2/0", "3/0", "1/3", "1/4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dequeued %q; want %q", got, want)
+	}
+
+	n := 0
+	for {
+		if _, ok := q.dequeue(); !ok {
+			break
+		}
+		n++
+	}
+	if want := perClientSendQueueDepth - 5; n != want {
+		t.Errorf("%d packets left in queue; want %d", n, want)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := NewServer(newPrivateKey(t), t.Logf)
+	c := &sclient{s: s, logf: t.Logf}
+	c.packetLimiter, c.byteLimiter = RateLimit{PacketsPerSecond: 0.001, PacketBurst: 3}.newLimiters()
+	if c.byteLimiter != nil {
+		t.Error("byte limiter without byte limit")
+	}
+	for i := 0; i < 3; i++ {
+		if !c.allowSend(100) {
+			t.Fatalf("packet %d throttled within burst", i)
+		}
+	}
+	if c.allowSend(100) {
+		t.Error("packet over burst allowed")
+	}
+	if got := s.packetsDroppedPktRate.Value(); got != 1 {
+		t.Errorf("packet rate drops = %d; want 1", got)
+	}
+
+	c = &sclient{s: s, logf: t.Logf}
+	c.packetLimiter, c.byteLimiter = RateLimit{BytesPerSecond: 1}.newLimiters()
+	if c.packetLimiter != nil {
+		t.Error("packet limiter without packet limit")
+	}
+	// The burst allows at least one maximum sized packet.
+	if !c.allowSend(MaxPacketSize) {
+		t.Error("max size packet throttled")
+	}
+	if c.allowSend(100) {
+		t.Error("packet over byte limit allowed")
+	}
+	if got := s.packetsDroppedByteRate.Value(); got != 1 {
+		t.Errorf("byte rate drops = %d; want 1", got)
+	}
+	if got := s.packetsDropped.Value(); got != 2 {
+		t.Errorf("packetsDropped = %d; want 2", got)
+	}
+}
+
+func TestRateLimitBoth(t *testing.T) {
+	s := NewServer(newPrivateKey(t), t.Logf)
+	c := &sclient{s: s, logf: t.Logf}
+	c.packetLimiter, c.byteLimiter = RateLimit{
+		PacketsPerSecond: 0.001,
+		PacketBurst:      2,
+		BytesPerSecond:   0.001,
+		ByteBurst:        MaxPacketSize,
+	}.newLimiters()
+
+	if !c.allowSend(MaxPacketSize) {
+		t.Fatal("first packet throttled")
+	}
+	// Over the byte limit, so it mustn't use up the last packet token.
+	if c.allowSend(100) {
+		t.Fatal("packet over byte limit allowed")
+	}
+	if !c.allowSend(0) {
+		t.Error("packet within both limits throttled")
+	}
+}
+
+func TestRateLimitReconnect(t *testing.T) {
+	s := NewServer(newPrivateKey(t), t.Logf)
+	s.SetRateLimit(RateLimit{PacketsPerSecond: 0.001, PacketBurst: 1})
+	k := newPrivateKey(t).Public()
+
+	s.mu.Lock()
+	l1 := s.acquireLimitersLocked(k)
+	s.releaseLimitersLocked(k, l1)
+	l2 := s.acquireLimitersLocked(k)
+	s.mu.Unlock()
+	if l1 != l2 {
+		t.Error("reconnecting client got new rate limiters")
+	}
+}
+
+func TestPing(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+
+	c := newRegularClient(t, ts, "c")
+	if !c.c.CanPing() {
+		t.Fatal("CanPing = false")
+	}
+	data := [pingLen]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	if err := c.c.SendPing(data); err != nil {
+		t.Fatal(err)
+	}
+	m, err := c.c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pm, ok := m.(PongMessage); !ok || pm != PongMessage(data) {
+		t.Errorf("got %#v; want PongMessage %v", m, data)
+	}
+	if got := ts.s.gotPing.Value(); got != 1 {
+		t.Errorf("gotPing = %d; want 1", got)
+	}
+}
+
+func TestServerPing(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+	ts.s.keepAliveInterval = 20 * time.Millisecond
+	ts.s.pingTimeout = 200 * time.Millisecond
+
+	// c1 reads, and so answers pings; c2 never does.
+	c1 := newRegularClient(t, ts, "c1")
+	c2 := newRegularClient(t, ts, "c2")
+	go func() {
+		for {
+			if _, err := c1.c.Recv(); err != nil {
+				return
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ts.s.pingTimeouts.Value() == 0 || ts.s.curClients.Value() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("pingTimeouts = %d, curClients = %d; want 1, 1", ts.s.pingTimeouts.Value(), ts.s.curClients.Value())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := ts.s.pingTimeouts.Value(); got != 1 {
+		t.Errorf("pingTimeouts = %d; want 1", got)
+	}
+	if ts.s.gotPong.Value() == 0 {
+		t.Error("gotPong = 0; want c1's pongs")
+	}
+	if _, err := c2.c.Recv(); err == nil {
+		t.Error("c2 still connected after not answering ping")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+
+	c1 := newRegularClient(t, ts, "c1")
+	ts.s.Drain(100*time.Millisecond, 0)
+	if !ts.s.IsDraining() {
+		t.Error("IsDraining = false after Drain")
+	}
+	m, err := c1.c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ServerRestartingMessage{ReconnectIn: 100 * time.Millisecond}); m != want {
+		t.Errorf("got %#v; want %#v", m, want)
+	}
+	if got := ts.s.restartingFrames.Value(); got != 1 {
+		t.Errorf("restartingFrames = %d; want 1", got)
+	}
+
+	// Clients connecting while draining are turned away.
+	nc, err := net.Dial("tcp", ts.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	brw := bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))
+	if _, err := NewClient(newPrivateKey(t), nc, brw, t.Logf); err == nil {
+		t.Error("NewClient succeeded while draining")
+	}
+
+	// c1 didn't hang up when told, so the server does once the drain
+	// is over.
+	var ne net.Error
+	if _, err := c1.c.recvTimeout(5 * time.Second); err == nil || errors.As(err, &ne) && ne.Timeout() {
+		t.Errorf("Recv after drain = %v; want connection closed", err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close(t)
+
+	c1 := newRegularClient(t, ts, "c1")
+	c2 := newRegularClient(t, ts, "c2")
+	if err := c1.c.Send(c2.pub, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	m, err := c2.c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.(ReceivedPacket); !ok {
+		t.Fatalf("got %#v; want ReceivedPacket", m)
+	}
+
+	s := ts.s
+	if got := s.framesRecv.Get("send_packet").Value(); got != 1 {
+		t.Errorf("send_packet frames received = %d; want 1", got)
+	}
+	if got := s.framesSent.Get("recv_packet").Value(); got != 1 {
+		t.Errorf("recv_packet frames sent = %d; want 1", got)
+	}
+	if _, cumulative, _ := s.queueDelay.Snapshot(); cumulative[len(cumulative)-1] != 1 {
+		t.Errorf("queue delay observations = %d; want 1", cumulative[len(cumulative)-1])
+	}
+
+	s.sampleStats()
+	bounds, cumulative, sum := s.connectedClients.Snapshot()
+	if sum != 2 || cumulative[len(cumulative)-1] != 1 {
+		t.Errorf("connected clients sum = %v, count = %d; want one sample of 2", sum, cumulative[len(cumulative)-1])
+	}
+	if bounds[0] != 1 || cumulative[0] != 0 || cumulative[1] != 1 {
+		t.Errorf("connected clients buckets = %v %v", bounds, cumulative)
+	}
+}
+
+func TestCloseStopsGoroutines(t *testing.T) {
+	rc := tstest.NewResourceCheck()
+	defer rc.Assert(t)
+
+	s := NewServer(newPrivateKey(t), t.Logf)
+	s.ExpVar() // starts sampling
+	s.Close()
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go4.org/mem"
+	"tailscale.com/types/key"
+)
+
+// VerifyClientFunc decides whether a client may use a Server.
+//
+// It is called once per connection, after the client has proven that
+// it holds the private key for clientKey, with the remote address of
+// the connection. It returns a non-nil error to reject the client.
+// Mesh peers presenting the server's mesh key are not subject to it.
+type VerifyClientFunc func(clientKey key.Public, remoteAddr string) error
+
+// Allowlist admits only the clients whose public keys are listed in
+// a file. Its Verify method is a VerifyClientFunc.
+//
+// The file has one key per line, either as 64 hex digits or with a
+// "nodekey:" prefix, as shown by the Tailscale admin panel. Blank
+// lines and lines starting with '#' are ignored.
+type Allowlist struct {
+	path string
+
+	mu   sync.Mutex
+	keys map[key.Public]bool
+}
+
+// NewAllowlist returns an Allowlist of the keys in the file at path.
+func NewAllowlist(path string) (*Allowlist, error) {
+	a := &Allowlist{path: path}
+	if err := a.Load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Load (re)reads the allowlist file. If it fails,
+// the previously loaded keys remain in effect.
+func (a *Allowlist) Load() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	keys, err := parseAllowlist(f)
+	if err != nil {
+		return fmt.Errorf("%s: %v", a.path, err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys = keys
+	return nil
+}
+
+// Len returns the number of keys in the allowlist.
+func (a *Allowlist) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.keys)
+}
+
+// Verify rejects clientKey unless it is in the allowlist.
+func (a *Allowlist) Verify(clientKey key.Public, remoteAddr string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.keys[clientKey] {
+		return errors.New("not in allowlist")
+	}
+	return nil
+}
+
+func parseAllowlist(r io.Reader) (map[key.Public]bool, error) {
+	keys := map[key.Public]bool{}
+	bs := bufio.NewScanner(r)
+	for n := 1; bs.Scan(); n++ {
+		line := strings.TrimSpace(bs.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, err := key.NewPublicFromHexMem(mem.S(strings.TrimPrefix(line, "nodekey:")))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		keys[k] = true
+	}
+	return keys, bs.Err()
+}
+
+// verifyHTTPTimeout bounds how long HTTPVerifier waits for
+// the policy service.
+const verifyHTTPTimeout = 5 * time.Second
+
+// verifyRequest is the JSON body HTTPVerifier POSTs to the policy service.
+type verifyRequest struct {
+	NodePublic string // client's public key, as "nodekey:" and 64 hex digits
+	Source     string // remote address of the client's connection
+}
+
+// HTTPVerifier returns a VerifyClientFunc that asks the policy service
+// at url about each client. It POSTs a JSON object with the client's
+// NodePublic key and Source address, and admits the client only if
+// the service replies with a 2xx status. Any other status, or failing
+// to reach the service, rejects the client.
+func HTTPVerifier(url string) VerifyClientFunc {
+	hc := &http.Client{Timeout: verifyHTTPTimeout}
+	return func(clientKey key.Public, remoteAddr string) error {
+		body, err := json.Marshal(verifyRequest{
+			NodePublic: fmt.Sprintf("nodekey:%x", clientKey[:]),
+			Source:     remoteAddr,
+		})
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), verifyHTTPTimeout)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := hc.Do(req)
+		if err != nil {
+			return fmt.Errorf("policy service: %v", err)
+		}
+		defer res.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 256))
+		if res.StatusCode/100 != 2 {
+			return fmt.Errorf("policy service: %v: %s", res.Status, bytes.TrimSpace(msg))
+		}
+		return nil
+	}
+}
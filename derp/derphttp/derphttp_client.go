@@ -12,7 +12,9 @@ package derphttp
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	crand "crypto/rand"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -24,11 +26,13 @@ import (
 	"sync"
 	"time"
 
+	"golang.org/x/net/websocket"
 	"inet.af/netaddr"
 	"tailscale.com/derp"
 	"tailscale.com/net/dnscache"
 	"tailscale.com/net/netns"
 	"tailscale.com/net/tlsdial"
+	"tailscale.com/net/tshttpproxy"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
@@ -45,6 +49,16 @@ type Client struct {
 	DNSCache  *dnscache.Resolver // optional; nil means no caching
 	MeshKey   string             // optional; for trusted clients
 
+	// ForceWebSocket, if true, makes the client always carry DERP
+	// over a WebSocket. Otherwise it only does so once the server
+	// (or a proxy in front of it) refuses the DERP upgrade.
+	ForceWebSocket bool
+
+	// DialContext optionally specifies how to dial the server's TCP
+	// connection, instead of the system dialer and any HTTP proxy.
+	// It's meant for tests, such as with tstest/natlab.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
 	privateKey key.Private
 	logf       logger.Logf
 
@@ -62,8 +76,32 @@ type Client struct {
 	client       *derp.Client
 	connGen      int // incremented once per new connection; valid values are >0
 	serverPubKey key.Public
+	reconnectAt  time.Time // if in the future, when the restarting server said to come back
+
+	// webSocketFallback is the host, if any, whose DERP upgrade
+	// was refused and which a WebSocket worked for instead. Later
+	// connections to it go straight to WebSocket; a connection to
+	// another host tries the DERP upgrade first again.
+	webSocketFallback string
+
+	// Pinging the server, to measure the RTT and notice dead connections:
+	pingGen  int           // connGen that pingLoop is running for, if any
+	pingData [8]byte       // payload of the outstanding ping
+	pingSent time.Time     // when the outstanding ping was sent
+	pongc    chan struct{} // closed when the outstanding ping is answered; nil if none
+	rtt      time.Duration // latest RTT to the server; zero if unknown
+
+	pingInterval time.Duration // if non-zero, overrides defaultPingInterval; for tests
 }
 
+// defaultPingInterval is how often a Client pings the server while
+// connected, and pingTimeout is how long it waits for the server to
+// answer before giving up on the connection and reconnecting.
+const (
+	defaultPingInterval = 20 * time.Second
+	pingTimeout         = 10 * time.Second
+)
+
 // NewRegionClient returns a new DERP-over-HTTP client. It connects lazily.
 // To trigger a connection, use Connect.
 func NewRegionClient(privateKey key.Private, logf logger.Logf, getRegion func() *tailcfg.DERPRegion) *Client {
@@ -158,6 +196,20 @@ func (c *Client) tlsServerName(node *tailcfg.DERPNode) string {
 	return node.HostName
 }
 
+// firstHost returns the host that connect dials first: c.url's, or
+// the first of reg's nodes that serves DERP.
+func (c *Client) firstHost(reg *tailcfg.DERPRegion) string {
+	if c.url != nil {
+		return c.url.Host
+	}
+	for _, n := range reg.Nodes {
+		if !n.STUNOnly {
+			return n.HostName
+		}
+	}
+	return ""
+}
+
 func (c *Client) urlString(node *tailcfg.DERPNode) string {
 	if c.url != nil {
 		return c.url.String()
@@ -174,6 +226,9 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 	if c.client != nil {
 		return c.client, c.connGen, nil
 	}
+	if wait := time.Until(c.reconnectAt); wait > 0 {
+		return nil, 0, fmt.Errorf("%s: server restarting; reconnecting in %v", caller, wait.Round(time.Millisecond))
+	}
 
 	// timeout is the fallback maximum time (if ctx doesn't limit
 	// it further) to do all of: DNS + TCP + TLS + HTTP Upgrade +
@@ -202,30 +257,70 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 		}
 	}
 
-	var tcpConn net.Conn
+	host := c.firstHost(reg)
+	webSocket := c.ForceWebSocket || (host != "" && host == c.webSocketFallback)
+	tcpConn, derpClient, err := c.dialDERP(ctx, caller, reg, webSocket)
+	if errors.Is(err, errUpgradeRefused) && !webSocket {
+		// Something between us and the server, such as a
+		// strict HTTP proxy, doesn't allow the DERP upgrade.
+		// Try disguising ourselves as a WebSocket.
+		c.logf("%s: %v; retrying with WebSocket", caller, err)
+		tcpConn, derpClient, err = c.dialDERP(ctx, caller, reg, true)
+		if err == nil {
+			c.webSocketFallback = host
+		}
+	} else if err == nil && !webSocket {
+		// The DERP upgrade works for this host, so any
+		// fallback was for a different one. Forget it.
+		c.webSocketFallback = ""
+	}
+	if err == nil && c.preferred {
+		if err = derpClient.NotePreferred(true); err != nil {
+			go tcpConn.Close()
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("%v: %v", ctx.Err(), err)
+		}
+		return nil, 0, fmt.Errorf("%s connect to %v: %v", caller, c.targetString(reg), err)
+	}
+
+	c.serverPubKey = derpClient.ServerPublicKey()
+	c.client = derpClient
+	c.netConn = tcpConn
+	c.connGen++
+	return c.client, c.connGen, nil
+}
+
+// errUpgradeRefused is returned (wrapped) by dialDERP when the HTTP
+// server doesn't switch to DERP in response to the upgrade request.
+var errUpgradeRefused = errors.New("DERP upgrade refused")
 
+// dialDERP dials the server and does the HTTP upgrade, using a
+// WebSocket if webSocket is set, and then the DERP handshake.
+// reg is nil when using c.url to dial.
+func (c *Client) dialDERP(ctx context.Context, caller string, reg *tailcfg.DERPRegion, webSocket bool) (tcpConn net.Conn, derpClient *derp.Client, err error) {
 	defer func() {
-		if err != nil {
-			if ctx.Err() != nil {
-				err = fmt.Errorf("%v: %v", ctx.Err(), err)
-			}
-			err = fmt.Errorf("%s connect to %v: %v", caller, c.targetString(reg), err)
-			if tcpConn != nil {
-				go tcpConn.Close()
-			}
+		if err != nil && tcpConn != nil {
+			go tcpConn.Close()
 		}
 	}()
 
+	via := ""
+	if webSocket {
+		via = " via WebSocket"
+	}
 	var node *tailcfg.DERPNode // nil when using c.url to dial
 	if c.url != nil {
-		c.logf("%s: connecting to %v", caller, c.url)
+		c.logf("%s: connecting to %v%s", caller, c.url, via)
 		tcpConn, err = c.dialURL(ctx)
 	} else {
-		c.logf("%s: connecting to derp-%d (%v)", caller, reg.RegionID, reg.RegionCode)
+		c.logf("%s: connecting to derp-%d (%v)%s", caller, reg.RegionID, reg.RegionCode, via)
 		tcpConn, node, err = c.dialRegion(ctx, reg)
 	}
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, err
 	}
 
 	// Now that we have a TCP connection, force close it if the
@@ -241,7 +336,7 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 			case <-done:
 				// Normal path. Upgrade occurred in time.
 				// But the ctx.Done() is also done because
-				// the "defer cancel()" above scheduled
+				// the "defer cancel()" in connect scheduled
 				// before this goroutine.
 			default:
 				// The TLS or HTTP or DERP exchanges didn't complete
@@ -259,57 +354,88 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 		httpConn = tcpConn
 	}
 
+	if webSocket {
+		ws, err := c.dialWebSocket(httpConn, node)
+		if err != nil {
+			return tcpConn, nil, err
+		}
+		brw := bufio.NewReadWriter(bufio.NewReader(ws), bufio.NewWriter(ws))
+		derpClient, err = derp.NewClient(c.privateKey, ws, brw, c.logf, derp.MeshKey(c.MeshKey))
+		return tcpConn, derpClient, err
+	}
+
 	brw := bufio.NewReadWriter(bufio.NewReader(httpConn), bufio.NewWriter(httpConn))
 
 	req, err := http.NewRequest("GET", c.urlString(node), nil)
 	if err != nil {
-		return nil, 0, err
+		return tcpConn, nil, err
 	}
 	req.Header.Set("Upgrade", "DERP")
 	req.Header.Set("Connection", "Upgrade")
 
 	if err := req.Write(brw); err != nil {
-		return nil, 0, err
+		return tcpConn, nil, err
 	}
 	if err := brw.Flush(); err != nil {
-		return nil, 0, err
+		return tcpConn, nil, err
 	}
 
 	resp, err := http.ReadResponse(brw.Reader, req)
 	if err != nil {
-		return nil, 0, err
+		return tcpConn, nil, err
 	}
 	if resp.StatusCode != http.StatusSwitchingProtocols {
-		b, _ := ioutil.ReadAll(resp.Body)
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
 		resp.Body.Close()
-		return nil, 0, fmt.Errorf("GET failed: %v: %s", err, b)
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			// The server is draining, which a WebSocket won't help with.
+			return tcpConn, nil, fmt.Errorf("GET failed: %v: %s", resp.Status, bytes.TrimSpace(b))
+		}
+		return tcpConn, nil, fmt.Errorf("%w: GET failed: %v: %s", errUpgradeRefused, resp.Status, bytes.TrimSpace(b))
 	}
 
-	derpClient, err := derp.NewClient(c.privateKey, httpConn, brw, c.logf, derp.MeshKey(c.MeshKey))
+	derpClient, err = derp.NewClient(c.privateKey, httpConn, brw, c.logf, derp.MeshKey(c.MeshKey))
+	return tcpConn, derpClient, err
+}
+
+// dialWebSocket does a WebSocket handshake over httpConn, returning
+// a connection that carries DERP in binary messages.
+func (c *Client) dialWebSocket(httpConn net.Conn, node *tailcfg.DERPNode) (*websocket.Conn, error) {
+	origin := c.urlString(node)
+	u, err := url.Parse(origin)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
-	if c.preferred {
-		if err := derpClient.NotePreferred(true); err != nil {
-			go httpConn.Close()
-			return nil, 0, err
-		}
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
 	}
-
-	c.serverPubKey = derpClient.ServerPublicKey()
-	c.client = derpClient
-	c.netConn = tcpConn
-	c.connGen++
-	return c.client, c.connGen, nil
+	config, err := websocket.NewConfig(u.String(), origin)
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = []string{webSocketProtocol}
+	ws, err := websocket.NewClient(config, httpConn)
+	if err != nil {
+		return nil, fmt.Errorf("WebSocket handshake: %v", err)
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
 }
 
 func (c *Client) dialURL(ctx context.Context) (net.Conn, error) {
 	host := c.url.Hostname()
 	hostOrIP := host
+	port := urlPort(c.url)
+
+	if c.DialContext != nil {
+		return c.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	}
 
 	dialer := netns.NewDialer()
 
-	if c.DNSCache != nil {
+	if c.DNSCache != nil && !useProxy(net.JoinHostPort(host, port)) {
 		ip, err := c.DNSCache.LookupIP(ctx, host)
 		if err == nil {
 			hostOrIP = ip.String()
@@ -321,7 +447,7 @@ func (c *Client) dialURL(ctx context.Context) (net.Conn, error) {
 		}
 	}
 
-	tcpConn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(hostOrIP, urlPort(c.url)))
+	tcpConn, err := tshttpproxy.NewDialer(dialer).DialContext(ctx, "tcp", net.JoinHostPort(hostOrIP, port))
 	if err != nil {
 		return nil, fmt.Errorf("dial of %v: %v", host, err)
 	}
@@ -396,7 +522,17 @@ func (c *Client) DialRegionTLS(ctx context.Context, reg *tailcfg.DERPRegion) (tl
 }
 
 func (c *Client) dialContext(ctx context.Context, proto, addr string) (net.Conn, error) {
-	return netns.NewDialer().DialContext(ctx, proto, addr)
+	if c.DialContext != nil {
+		return c.DialContext(ctx, proto, addr)
+	}
+	return tshttpproxy.NewDialer(netns.NewDialer()).DialContext(ctx, proto, addr)
+}
+
+// useProxy reports whether connections to addr go through an HTTP
+// proxy, which then does the DNS lookup for us.
+func useProxy(addr string) bool {
+	proxyURL, _ := tshttpproxy.ProxyURL(&url.URL{Scheme: "https", Host: addr})
+	return proxyURL != nil
 }
 
 // shouldDialProto reports whether an explicitly provided IPv4 or IPv6
@@ -428,6 +564,16 @@ func (c *Client) dialNode(ctx context.Context, n *tailcfg.DERPNode) (net.Conn, e
 	ctx, cancel := context.WithTimeout(ctx, dialNodeTimeout)
 	defer cancel()
 
+	port := "443"
+	if n.DERPTestPort != 0 {
+		port = fmt.Sprint(n.DERPTestPort)
+	}
+	if addr := net.JoinHostPort(n.HostName, port); useProxy(addr) {
+		// There's no racing IPv4 and IPv6 through a proxy,
+		// and it may only allow connecting to names anyway.
+		return c.dialContext(ctx, "tcp", addr)
+	}
+
 	nwait := 0
 	startDial := func(dstPrimary, proto string) {
 		nwait++
@@ -436,10 +582,6 @@ func (c *Client) dialNode(ctx context.Context, n *tailcfg.DERPNode) (net.Conn, e
 			if dst == "" {
 				dst = n.HostName
 			}
-			port := "443"
-			if n.DERPTestPort != 0 {
-				port = fmt.Sprint(n.DERPTestPort)
-			}
 			c, err := c.dialContext(ctx, proto, net.JoinHostPort(dst, port))
 			select {
 			case resc <- res{c, err}:
@@ -561,16 +703,156 @@ func (c *Client) Recv() (derp.ReceivedMessage, error) {
 
 // RecvDetail is like Recv, but additional returns the connection generation on each message.
 // The connGen value is incremented every time the derphttp.Client reconnects to the server.
+//
+// If the server says it's restarting, RecvDetail returns a
+// derp.ServerRestartingMessage and disconnects. The next call waits
+// until the server said to reconnect before doing so.
 func (c *Client) RecvDetail() (m derp.ReceivedMessage, connGen int, err error) {
+	if err := c.waitReconnect(); err != nil {
+		return nil, 0, err
+	}
 	client, connGen, err := c.connect(context.TODO(), "derphttp.Client.Recv")
 	if err != nil {
 		return nil, 0, err
 	}
-	m, err = client.Recv()
-	if err != nil {
-		c.closeForReconnect(client)
+	c.startPinging(client, connGen)
+	for {
+		m, err = client.Recv()
+		if err != nil {
+			c.closeForReconnect(client)
+			return m, connGen, err
+		}
+		switch m := m.(type) {
+		case derp.PongMessage:
+			c.notePong(m)
+			continue
+		case derp.ServerRestartingMessage:
+			c.logf("derphttp.Client: server restarting; reconnecting in %v", m.ReconnectIn)
+			c.mu.Lock()
+			c.reconnectAt = time.Now().Add(m.ReconnectIn)
+			c.mu.Unlock()
+			c.closeForReconnect(client)
+		}
+		return m, connGen, nil
+	}
+}
+
+// waitReconnect waits until the time a restarting server said to
+// reconnect, if any.
+func (c *Client) waitReconnect() error {
+	c.mu.Lock()
+	wait := time.Until(c.reconnectAt)
+	c.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-c.ctx.Done():
+		return ErrClientClosed
+	}
+}
+
+// RTT returns the latest round-trip time to the server, measured by
+// pinging it, or zero if it isn't known. The server is only pinged
+// while the Client is receiving.
+func (c *Client) RTT() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rtt
+}
+
+// startPinging starts a pingLoop for client, the connection with
+// generation connGen, unless one's already running or the server
+// doesn't support pings.
+//
+// Pinging only starts once someone calls Recv, as that's what
+// reads the pongs.
+func (c *Client) startPinging(client *derp.Client, connGen int) {
+	if !client.CanPing() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pingGen == connGen {
+		return
+	}
+	c.pingGen = connGen
+	go c.pingLoop(client)
+}
+
+// pingLoop pings the server every pingInterval for as long as client
+// is the current connection, closing it if the server stops answering.
+func (c *Client) pingLoop(client *derp.Client) {
+	interval := c.pingInterval
+	if interval == 0 {
+		interval = defaultPingInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c.mu.Lock()
+		current := c.client == client
+		c.mu.Unlock()
+		if !current {
+			return
+		}
+		if err := c.ping(client); err != nil {
+			c.logf("derphttp.Client: %v; reconnecting", err)
+			c.closeForReconnect(client)
+			return
+		}
+	}
+}
+
+// ping pings the server over client and waits up to pingTimeout
+// for the pong.
+func (c *Client) ping(client *derp.Client) error {
+	var data [8]byte
+	if _, err := crand.Read(data[:]); err != nil {
+		return err
+	}
+	pongc := make(chan struct{})
+	c.mu.Lock()
+	c.pingData = data
+	c.pingSent = time.Now()
+	c.pongc = pongc
+	c.mu.Unlock()
+
+	if err := client.SendPing(data); err != nil {
+		return err
+	}
+	timer := time.NewTimer(pingTimeout)
+	defer timer.Stop()
+	select {
+	case <-pongc:
+		return nil
+	case <-c.ctx.Done():
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("no pong from server in %v", pingTimeout)
+	}
+}
+
+// notePong handles a pong from the server, updating the RTT if it
+// answers the outstanding ping.
+func (c *Client) notePong(pm derp.PongMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pongc == nil || [8]byte(pm) != c.pingData {
+		return
 	}
-	return m, connGen, err
+	c.rtt = time.Since(c.pingSent)
+	close(c.pongc)
+	c.pongc = nil
 }
 
 // Close closes the client. It will not automatically reconnect after
@@ -611,6 +893,7 @@ func (c *Client) closeForReconnect(brokenClient *derp.Client) {
 		c.netConn = nil
 	}
 	c.client = nil
+	c.rtt = 0
 }
 
 var ErrClientClosed = errors.New("derphttp.Client closed")
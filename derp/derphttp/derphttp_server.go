@@ -5,14 +5,28 @@
 package derphttp
 
 import (
+	"bufio"
 	"log"
 	"net/http"
+	"strings"
 
+	"golang.org/x/net/websocket"
 	"tailscale.com/derp"
 )
 
+// webSocketProtocol is the WebSocket subprotocol name for DERP.
+const webSocketProtocol = "derp"
+
 func Handler(s *derp.Server) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.IsDraining() {
+			http.Error(w, "DERP server is restarting", http.StatusServiceUnavailable)
+			return
+		}
+		if isWebSocketUpgrade(r) {
+			serveWebSocket(s, w, r)
+			return
+		}
 		if p := r.Header.Get("Upgrade"); p != "WebSocket" && p != "DERP" {
 			http.Error(w, "DERP requires connection upgrade", http.StatusUpgradeRequired)
 			return
@@ -35,3 +49,40 @@ func Handler(s *derp.Server) http.Handler {
 		s.Accept(netConn, conn, netConn.RemoteAddr().String())
 	})
 }
+
+// isWebSocketUpgrade reports whether r is a real WebSocket handshake,
+// as opposed to the legacy "Upgrade: WebSocket" header that old
+// clients sent before speaking DERP directly on the hijacked
+// connection.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		r.Header.Get("Sec-WebSocket-Key") != ""
+}
+
+// serveWebSocket serves DERP over WebSocket binary messages, for
+// clients behind proxies that only let WebSocket upgrades through.
+func serveWebSocket(s *derp.Server, w http.ResponseWriter, r *http.Request) {
+	if _, ok := w.(http.Hijacker); !ok {
+		http.Error(w, "HTTP does not support general TCP support", 500)
+		return
+	}
+	websocket.Server{
+		// DERP clients aren't browsers, so there's no Origin to
+		// check; clients are authenticated by the DERP handshake.
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			protos := config.Protocol
+			config.Protocol = nil
+			for _, p := range protos {
+				if p == webSocketProtocol {
+					config.Protocol = []string{webSocketProtocol}
+				}
+			}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			brw := bufio.NewReadWriter(bufio.NewReader(ws), bufio.NewWriter(ws))
+			s.Accept(ws, brw, r.RemoteAddr)
+		},
+	}.ServeHTTP(w, r)
+}
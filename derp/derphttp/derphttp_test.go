@@ -10,7 +10,9 @@ import (
 	"crypto/tls"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -148,3 +150,177 @@ func TestSendRecv(t *testing.T) {
 	recvNothing(1)
 
 }
+
+// newTestServer returns a DERP server serving over HTTP, and a
+// Client of it.
+func newTestServer(t *testing.T) (*derp.Server, *Client, func()) {
+	t.Helper()
+	var serverPrivateKey, clientPrivateKey key.Private
+	if _, err := crand.Read(serverPrivateKey[:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := crand.Read(clientPrivateKey[:]); err != nil {
+		t.Fatal(err)
+	}
+	s := derp.NewServer(serverPrivateKey, t.Logf)
+
+	ln, err := net.Listen("tcp4", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpsrv := &http.Server{Handler: Handler(s)}
+	go httpsrv.Serve(ln)
+
+	c, err := NewClient(clientPrivateKey, "http://"+ln.Addr().String(), t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, c, func() {
+		c.Close()
+		httpsrv.Close()
+		s.Close()
+	}
+}
+
+func TestPingRTT(t *testing.T) {
+	_, c, cleanup := newTestServer(t)
+	defer cleanup()
+	c.pingInterval = 10 * time.Millisecond
+	go func() {
+		for {
+			m, err := c.Recv()
+			if err != nil {
+				return
+			}
+			if _, ok := m.(derp.PongMessage); ok {
+				t.Errorf("Recv returned a pong")
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no RTT measured")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerRestarting(t *testing.T) {
+	s, c, cleanup := newTestServer(t)
+	defer cleanup()
+
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	const reconnectIn = 200 * time.Millisecond
+	s.Drain(reconnectIn, 0)
+
+	m, err := c.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.(derp.ServerRestartingMessage); !ok {
+		t.Fatalf("got %#v; want ServerRestartingMessage", m)
+	}
+	if err := c.Send(key.Public{}, []byte("hi")); err == nil {
+		t.Error("Send succeeded while server restarting")
+	}
+
+	// The next Recv reconnects only once the server said to, and the
+	// still draining server turns it away.
+	start := time.Now()
+	if _, err := c.Recv(); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Recv after restart = %v; want 503 error", err)
+	}
+	if d := time.Since(start); d < reconnectIn {
+		t.Errorf("reconnected after %v; want at least %v", d, reconnectIn)
+	}
+}
+
+func TestWebSocketFallback(t *testing.T) {
+	var serverPrivateKey key.Private
+	if _, err := crand.Read(serverPrivateKey[:]); err != nil {
+		t.Fatal(err)
+	}
+	s := derp.NewServer(serverPrivateKey, t.Logf)
+	defer s.Close()
+
+	// Act like a proxy that only lets WebSocket upgrades through,
+	// while refuse is set.
+	h := Handler(s)
+	ln, err := net.Listen("tcp4", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refuse := int32(1)
+	var derpUpgrades int32
+	httpsrv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "DERP" {
+			if atomic.LoadInt32(&refuse) != 0 {
+				http.Error(w, "upgrade not allowed", http.StatusForbidden)
+				return
+			}
+			atomic.AddInt32(&derpUpgrades, 1)
+		}
+		h.ServeHTTP(w, r)
+	})}
+	go httpsrv.Serve(ln)
+	defer httpsrv.Close()
+
+	newClient := func() *Client {
+		var priv key.Private
+		if _, err := crand.Read(priv[:]); err != nil {
+			t.Fatal(err)
+		}
+		c, err := NewClient(priv, "http://"+ln.Addr().String(), t.Logf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Connect(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	c1 := newClient()
+	defer c1.Close()
+	c2 := newClient()
+	defer c2.Close()
+	if got, want := c1.webSocketFallback, ln.Addr().String(); got != want {
+		t.Errorf("webSocketFallback = %q; want %q", got, want)
+	}
+
+	msg := []byte("hello over websocket")
+	if err := c1.Send(c2.privateKey.Public(), msg); err != nil {
+		t.Fatal(err)
+	}
+	m, err := c2.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, ok := m.(derp.ReceivedPacket)
+	if !ok || string(rp.Data) != string(msg) {
+		t.Errorf("got %#v; want packet %q", m, msg)
+	}
+
+	// If the DERP node changes to one that allows the upgrade,
+	// the client goes back to using it.
+	atomic.StoreInt32(&refuse, 0)
+	c1.mu.Lock()
+	c1.webSocketFallback = "derp-old.example.com"
+	client := c1.client
+	c1.mu.Unlock()
+	c1.closeForReconnect(client)
+	if err := c1.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&derpUpgrades); got != 1 {
+		t.Errorf("DERP upgrades = %d; want 1", got)
+	}
+	c1.mu.Lock()
+	defer c1.mu.Unlock()
+	if c1.webSocketFallback != "" {
+		t.Errorf("webSocketFallback = %q after DERP upgrade; want empty", c1.webSocketFallback)
+	}
+}
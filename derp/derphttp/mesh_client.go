@@ -12,7 +12,7 @@ import (
 	"tailscale.com/types/key"
 )
 
-// RunWatchConnectionLoop loops forever, sending WatchConnectionChanges and subscribing to
+// RunWatchConnectionLoop loops until c is closed, sending WatchConnectionChanges and subscribing to
 // connection changes.
 //
 // If the server's public key is ignoreServerKey, RunWatchConnectionLoop returns.
@@ -79,8 +79,13 @@ func (c *Client) RunWatchConnectionLoop(ignoreServerKey key.Public, add, remove
 		}
 	}
 
+watch:
 	for {
 		err := c.WatchConnectionChanges()
+		if err == ErrClientClosed {
+			clear()
+			return
+		}
 		if err != nil {
 			clear()
 			logf("WatchConnectionChanges: %v", err)
@@ -109,6 +114,17 @@ func (c *Client) RunWatchConnectionLoop(ignoreServerKey key.Public, add, remove
 				updatePeer(key.Public(m), true)
 			case derp.PeerGoneMessage:
 				updatePeer(key.Public(m), false)
+			case derp.ServerRestartingMessage:
+				// The connection is gone. Watch again once
+				// the server is back.
+				clear()
+				t := time.NewTimer(m.ReconnectIn)
+				select {
+				case <-t.C:
+				case <-c.ctx.Done():
+					t.Stop()
+				}
+				continue watch
 			default:
 				continue
 			}
@@ -79,6 +79,15 @@ func (b *FakeBackend) SetPrefs(new *Prefs) {
 	}
 }
 
+func (b *FakeBackend) SetWantRunning(v bool) {
+	if v && !b.live {
+		b.newState(Starting)
+		b.newState(Running)
+	} else if !v && b.live {
+		b.newState(Stopped)
+	}
+}
+
 func (b *FakeBackend) RequestEngineStatus() {
 	b.notify(Notify{Engine: &EngineStatus{}})
 }
@@ -87,6 +96,10 @@ func (b *FakeBackend) RequestStatus() {
 	b.notify(Notify{Status: &ipnstate.Status{}})
 }
 
+func (b *FakeBackend) Ping(ip string) {
+	b.notify(Notify{PingResult: &ipnstate.PingResult{IP: ip}})
+}
+
 func (b *FakeBackend) FakeExpireAfter(x time.Duration) {
 	b.notify(Notify{NetMap: &controlclient.NetworkMap{}})
 }
@@ -237,6 +237,12 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 			// TODO(bradfitz): add LogID and opts to st?
 			st.WriteHTML(w)
 		})
+		opts.DebugMux.HandleFunc("/debug/filter", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			for _, d := range b.Status().FilterDecisions {
+				fmt.Fprintln(w, d)
+			}
+		})
 	}
 
 	server.bs = ipn.NewBackendServer(logf, b, server.writeToClients)
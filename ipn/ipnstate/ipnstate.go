@@ -29,6 +29,49 @@ type Status struct {
 	TailscaleIPs []netaddr.IP // Tailscale IP(s) assigned to this node
 	Peer         map[key.Public]*PeerStatus
 	User         map[tailcfg.UserID]tailcfg.UserProfile
+
+	// FilterDecisions are the packet filter's most recent
+	// recorded verdicts, oldest first.
+	FilterDecisions []FilterDecision `json:",omitempty"`
+
+	// DERP is the status of this node's connections to DERP
+	// regions, ordered by region ID.
+	DERP []DERPStatus `json:",omitempty"`
+}
+
+// DERPStatus is the status of a connection to a DERP region.
+type DERPStatus struct {
+	RegionID   int
+	RegionCode string
+	Home       bool      // whether it's this node's home region
+	Created    time.Time // when the connection was first needed
+
+	// LatencySeconds is the latest round-trip time to the
+	// region's DERP server, or zero if it isn't known.
+	LatencySeconds float64 `json:",omitempty"`
+}
+
+// FilterDecision is a packet filter verdict on a packet.
+type FilterDecision struct {
+	Time      time.Time
+	Direction string // "in" or "out"
+	Proto     string // "TCP", "UDP", etc
+	Src       netaddr.IPPort
+	Dst       netaddr.IPPort
+	Verdict   string // "Accept" or "Drop"
+	Reason    string
+	// Rule is the index of the packet filter rule that
+	// accepted the packet, or -1 if none did.
+	Rule     int
+	RuleText string `json:",omitempty"`
+}
+
+func (d FilterDecision) String() string {
+	s := fmt.Sprintf("%s %-3s %-6s %v > %v %s (%s)", d.Time.Format("15:04:05.000"), d.Direction, d.Proto, d.Src, d.Dst, d.Verdict, d.Reason)
+	if d.Rule >= 0 {
+		s += fmt.Sprintf(" rule #%d %s", d.Rule, d.RuleText)
+	}
+	return s
 }
 
 func (s *Status) Peers() []key.Public {
@@ -95,6 +138,17 @@ func (sb *StatusBuilder) Status() *Status {
 	return &sb.st
 }
 
+// SetBackendState sets the status's BackendState.
+func (sb *StatusBuilder) SetBackendState(v string) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: SetBackendState after Locked")
+		return
+	}
+	sb.st.BackendState = v
+}
+
 // AddUser adds a user profile to the status.
 func (sb *StatusBuilder) AddUser(id tailcfg.UserID, up tailcfg.UserProfile) {
 	sb.mu.Lock()
@@ -201,6 +255,47 @@ func (sb *StatusBuilder) AddPeer(peer key.Public, st *PeerStatus) {
 	}
 }
 
+// AddFilterDecision adds a packet filter decision to the status.
+func (sb *StatusBuilder) AddFilterDecision(d FilterDecision) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: AddFilterDecision after Locked")
+		return
+	}
+
+	sb.st.FilterDecisions = append(sb.st.FilterDecisions, d)
+}
+
+// AddDERP adds the status of a DERP connection to the status.
+func (sb *StatusBuilder) AddDERP(ds DERPStatus) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	if sb.locked {
+		log.Printf("[unexpected] ipnstate: AddDERP after Locked")
+		return
+	}
+
+	sb.st.DERP = append(sb.st.DERP, ds)
+}
+
+// PingResult contains response information for the "tailscale ping"
+// subcommand, saying how Tailscale can reach a Tailscale IP or
+// subnet-routed IP.
+type PingResult struct {
+	IP       string // ping destination
+	NodeIP   string // Tailscale IP of node handling IP (different for subnet routers)
+	NodeName string // DNS name base or (possibly not unique) hostname
+
+	Err            string
+	LatencySeconds float64
+
+	Endpoint string // ip:port if direct UDP was used
+
+	DERPRegionID   int    // non-zero if DERP was used
+	DERPRegionCode string // three-letter airport/region code if DERP was used
+}
+
 type StatusUpdater interface {
 	UpdateStatus(*StatusBuilder)
 }
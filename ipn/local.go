@@ -8,6 +8,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
+	"reflect"
 	"strings"
 	"sync"
 	"time"
@@ -144,6 +146,8 @@ func (b *LocalBackend) UpdateStatus(sb *ipnstate.StatusBuilder) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
+	sb.SetBackendState(b.state.String())
+
 	// TODO: hostinfo, and its networkinfo
 	// TODO: EngineStatus copy (and deprecate it?)
 	if b.netMap != nil {
@@ -470,15 +474,15 @@ func (b *LocalBackend) updateFilter(netMap *controlclient.NetworkMap, prefs *Pre
 		return
 	}
 
-	localNets := wgCIDRsToFilter(netMap.Addresses, advRoutes)
+	localNets, localNets6 := wgCIDRsToFilter(netMap.Addresses, advRoutes)
 
 	if shieldsUp {
 		b.logf("netmap packet filter: (shields up)")
 		var prevFilter *filter.Filter // don't reuse old filter state
-		b.e.SetFilter(filter.New(filter.Matches{}, localNets, prevFilter, b.logf))
+		b.e.SetFilter(filter.New(filter.Matches{}, localNets, localNets6, prevFilter, b.logf))
 	} else {
 		b.logf("netmap packet filter: %v", packetFilter)
-		b.e.SetFilter(filter.New(packetFilter, localNets, b.e.GetFilter(), b.logf))
+		b.e.SetFilter(filter.New(packetFilter, localNets, localNets6, b.e.GetFilter(), b.logf))
 	}
 }
 
@@ -495,8 +499,11 @@ func dnsCIDRsEqual(newAddr, oldAddr []wgcfg.CIDR) bool {
 }
 
 // dnsMapsEqual determines whether the new and the old network map
-// induce the same DNS map. It does so without allocating memory,
-// at the expense of giving false negatives if peers are reordered.
+// induce the same DNS map. It gives false negatives if peers, extra
+// records or services are reordered, which only costs a needless
+// DNS map update. Names and addresses are compared without
+// allocating; the DNS routes, extra records and services are
+// compared with reflect.DeepEqual, which may allocate.
 func dnsMapsEqual(new, old *controlclient.NetworkMap) bool {
 	if (old == nil) != (new == nil) {
 		return false
@@ -515,6 +522,15 @@ func dnsMapsEqual(new, old *controlclient.NetworkMap) bool {
 	if !dnsCIDRsEqual(new.Addresses, old.Addresses) {
 		return false
 	}
+	if !reflect.DeepEqual(new.DNS.Routes, old.DNS.Routes) {
+		return false
+	}
+	if !reflect.DeepEqual(new.DNS.ExtraRecords, old.DNS.ExtraRecords) {
+		return false
+	}
+	if !reflect.DeepEqual(new.Hostinfo.Services, old.Hostinfo.Services) {
+		return false
+	}
 
 	for i, newPeer := range new.Peers {
 		oldPeer := old.Peers[i]
@@ -524,6 +540,9 @@ func dnsMapsEqual(new, old *controlclient.NetworkMap) bool {
 		if !dnsCIDRsEqual(newPeer.Addresses, oldPeer.Addresses) {
 			return false
 		}
+		if !reflect.DeepEqual(newPeer.Hostinfo.Services, oldPeer.Hostinfo.Services) {
+			return false
+		}
 	}
 
 	return true
@@ -545,16 +564,114 @@ func (b *LocalBackend) updateDNSMap(netMap *controlclient.NetworkMap) {
 		nameToIP[name] = netaddr.IPFrom16(addrs[0].IP.Addr)
 	}
 
+	srv := make(map[string][]tsdns.SRV)
 	for _, peer := range netMap.Peers {
 		set(peer.Name, peer.Addresses)
+		addServiceRecords(srv, peer.Name, peer.Hostinfo.Services)
 	}
 	set(netMap.Name, netMap.Addresses)
+	addServiceRecords(srv, netMap.Name, netMap.Hostinfo.Services)
+
+	cname := make(map[string]string)
+	txt := make(map[string][]string)
+	for _, rec := range netMap.DNS.ExtraRecords {
+		switch strings.ToUpper(rec.Type) {
+		case "CNAME":
+			cname[rec.Name] = rec.Value
+		case "TXT":
+			txt[rec.Name] = append(txt[rec.Name], rec.Value)
+		case "SRV":
+			var r tsdns.SRV
+			_, err := fmt.Sscanf(rec.Value, "%d %d %d %s", &r.Priority, &r.Weight, &r.Port, &r.Target)
+			if err != nil {
+				b.logf("dns map: bad SRV record %q for %s: %v", rec.Value, rec.Name, err)
+				continue
+			}
+			srv[rec.Name] = append(srv[rec.Name], r)
+		default:
+			b.logf("dns map: unsupported record type %q for %s", rec.Type, rec.Name)
+		}
+	}
 
-	dnsMap := tsdns.NewMap(nameToIP)
+	var routes map[string][]string
+	for suffix, ips := range netMap.DNS.Routes {
+		if routes == nil {
+			routes = make(map[string][]string)
+		}
+		for _, ip := range ips {
+			routes[suffix] = append(routes[suffix], net.JoinHostPort(ip.String(), "53"))
+		}
+	}
+
+	dnsMap := tsdns.NewMapFromConfig(tsdns.MapConfig{
+		NameToIP: nameToIP,
+		Routes:   routes,
+		CNAME:    cname,
+		TXT:      txt,
+		SRV:      srv,
+	})
 	// map diff will be logged in tsdns.Resolver.SetMap.
 	b.e.SetDNSMap(dnsMap)
 }
 
+// wellKnownServices are the service names, as used in SRV record names,
+// of common TCP ports that may show up in Hostinfo.Services.
+var wellKnownServices = map[uint16]string{
+	21:   "ftp",
+	22:   "ssh",
+	23:   "telnet",
+	25:   "smtp",
+	53:   "domain",
+	80:   "http",
+	443:  "https",
+	445:  "smb",
+	3389: "rdp",
+	5900: "vnc",
+}
+
+// addServiceRecords adds SRV records to srv for the services a host advertises,
+// named like _ssh._tcp.host.domain.
+// Services on well-known ports are named after the protocol; others after
+// the process listening on them, so _postgres._tcp for a postgres process.
+func addServiceRecords(srv map[string][]tsdns.SRV, host string, services []tailcfg.Service) {
+	if host == "" {
+		return
+	}
+	for _, s := range services {
+		if s.Proto != tailcfg.TCP && s.Proto != tailcfg.UDP {
+			continue
+		}
+		name := wellKnownServices[s.Port]
+		if name == "" || s.Proto != tailcfg.TCP {
+			name = serviceLabel(s.Description)
+		}
+		if name == "" {
+			continue
+		}
+		key := fmt.Sprintf("_%s._%s.%s", name, s.Proto, host)
+		srv[key] = append(srv[key], tsdns.SRV{Port: s.Port, Target: host})
+	}
+}
+
+// serviceLabel returns a process name reduced to a valid DNS label,
+// or the empty string if nothing is left of it.
+func serviceLabel(process string) string {
+	label := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', '0' <= r && r <= '9', r == '-':
+			return r
+		case 'A' <= r && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return -1
+	}, process)
+	label = strings.Trim(label, "-")
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	return label
+}
+
 // readPoller is a goroutine that receives service lists from
 // b.portpoll and propagates them into the controlclient's HostInfo.
 func (b *LocalBackend) readPoller() {
@@ -723,6 +840,18 @@ func (b *LocalBackend) StartLoginInteractive() {
 	}
 }
 
+// Ping implements Backend.
+func (b *LocalBackend) Ping(ipStr string) {
+	ip, err := netaddr.ParseIP(ipStr)
+	if err != nil {
+		b.logf("ignoring Ping request to invalid IP %q", ipStr)
+		return
+	}
+	b.e.Ping(ip, func(pr *ipnstate.PingResult) {
+		b.send(Notify{PingResult: pr})
+	})
+}
+
 // FakeExpireAfter implements Backend.
 func (b *LocalBackend) FakeExpireAfter(x time.Duration) {
 	b.logf("FakeExpireAfter: %v", x)
@@ -791,7 +920,15 @@ func (b *LocalBackend) SetPrefs(new *Prefs) {
 	}
 
 	b.mu.Lock()
+	b.setPrefsLockedOnEntry(new)
+}
 
+// setPrefsLockedOnEntry is the body of SetPrefs, for callers that
+// need to read the prefs and set new ones in the same critical
+// section.
+//
+// b.mu must be held on entry. It is released before returning.
+func (b *LocalBackend) setPrefsLockedOnEntry(new *Prefs) {
 	netMap := b.netMap
 	stateKey := b.stateKey
 
@@ -841,6 +978,25 @@ func (b *LocalBackend) SetPrefs(new *Prefs) {
 	b.send(Notify{Prefs: new})
 }
 
+// SetWantRunning sets the WantRunning preference, leaving the other
+// preferences unchanged. Implements Backend.
+func (b *LocalBackend) SetWantRunning(wantRunning bool) {
+	b.mu.Lock()
+	if b.prefs == nil {
+		b.mu.Unlock()
+		b.logf("SetWantRunning(%v): backend not started; ignoring", wantRunning)
+		return
+	}
+	if b.prefs.WantRunning == wantRunning {
+		b.mu.Unlock()
+		return
+	}
+	new := b.prefs.Clone()
+	new.WantRunning = wantRunning
+	b.logf("SetWantRunning: %v", wantRunning)
+	b.setPrefsLockedOnEntry(new)
+}
+
 // doSetHostinfoFilterServices calls SetHostinfo on the controlclient,
 // possibly after mangling the given hostinfo.
 //
@@ -1016,11 +1172,16 @@ func routerConfig(cfg *wgcfg.Config, prefs *Prefs) *router.Config {
 }
 
 // wgCIDRsToFilter converts lists of wgcfg.CIDR into a single list of
-// filter.Net.
-func wgCIDRsToFilter(cidrLists ...[]wgcfg.CIDR) (ret []filter.Net) {
+// filter.Net for the IPv4 CIDRs and one of filter.Net6 for the IPv6
+// CIDRs.
+func wgCIDRsToFilter(cidrLists ...[]wgcfg.CIDR) (ret []filter.Net, ret6 []filter.Net6) {
 	for _, cidrs := range cidrLists {
 		for _, cidr := range cidrs {
 			if !cidr.IP.Is4() {
+				ret6 = append(ret6, filter.Net6{
+					IP:   filter.NewIP6(cidr.IP.IP()),
+					Mask: filter.Netmask6(int(cidr.Mask)),
+				})
 				continue
 			}
 			ret = append(ret, filter.Net{
@@ -1029,7 +1190,7 @@ func wgCIDRsToFilter(cidrLists ...[]wgcfg.CIDR) (ret []filter.Net) {
 			})
 		}
 	}
-	return ret
+	return ret, ret6
 }
 
 func wgCIDRToNetaddr(cidrs []wgcfg.CIDR) (ret []netaddr.IPPrefix) {
@@ -0,0 +1,93 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipn
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest/controltest"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/tsdns"
+)
+
+func TestAddServiceRecords(t *testing.T) {
+	srv := make(map[string][]tsdns.SRV)
+	addServiceRecords(srv, "host.user.ts.net", []tailcfg.Service{
+		{Proto: tailcfg.TCP, Port: 22, Description: "sshd"},
+		{Proto: tailcfg.TCP, Port: 5432, Description: "postgres"},
+		{Proto: tailcfg.UDP, Port: 53, Description: "Acme_DNS.exe"},
+		{Proto: tailcfg.TCP, Port: 9999, Description: "???"},
+		{Proto: "peerapi", Port: 1234, Description: "x"},
+	})
+	want := map[string][]tsdns.SRV{
+		"_ssh._tcp.host.user.ts.net":        {{Port: 22, Target: "host.user.ts.net"}},
+		"_postgres._tcp.host.user.ts.net":   {{Port: 5432, Target: "host.user.ts.net"}},
+		"_acmednsexe._udp.host.user.ts.net": {{Port: 53, Target: "host.user.ts.net"}},
+	}
+	if !reflect.DeepEqual(srv, want) {
+		t.Errorf("got %v; want %v", srv, want)
+	}
+}
+
+func TestLoginAgainstFakeControl(t *testing.T) {
+	control := &controltest.Server{Logf: logger.WithPrefix(t.Logf, "fake control: ")}
+	ts := httptest.NewServer(control)
+	defer ts.Close()
+	peer := &tailcfg.Node{Key: tailcfg.NodeKey{1: 1}, Name: "peer"}
+	control.AddNode(peer)
+
+	e, err := wgengine.NewFakeUserspaceEngine(t.Logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	b, err := NewLocalBackend(t.Logf, "test-backend", &MemoryStore{}, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Shutdown()
+
+	netMaps := make(chan *controlclient.NetworkMap, 1)
+	prefs := NewPrefs()
+	prefs.ControlURL = ts.URL
+	err = b.Start(Options{
+		Prefs:          prefs,
+		HTTPTestClient: ts.Client(),
+		Notify: func(n Notify) {
+			if n.NetMap == nil {
+				return
+			}
+			select {
+			case netMaps <- n.NetMap:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nm *controlclient.NetworkMap
+	select {
+	case nm = <-netMaps:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for netmap")
+	}
+	if control.Node(nm.NodeKey) == nil {
+		t.Errorf("netmap for node %v, which isn't registered with control", nm.NodeKey.ShortString())
+	}
+	if nm.MachineStatus != tailcfg.MachineAuthorized {
+		t.Errorf("MachineStatus = %v; want authorized", nm.MachineStatus)
+	}
+	if len(nm.Peers) != 1 || nm.Peers[0].Key != peer.Key {
+		t.Errorf("Peers = %v; want just %v", nm.Peers, peer.Key.ShortString())
+	}
+}
@@ -184,4 +184,10 @@ func TestClientServer(t *testing.T) {
 		TokenType:   GoogleIDTokenType,
 	})
 	flushUntil(Running)
+
+	bc.SetWantRunning(false)
+	flushUntil(Stopped)
+
+	bc.SetWantRunning(true)
+	flushUntil(Running)
 }
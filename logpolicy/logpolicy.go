@@ -31,6 +31,7 @@ import (
 	"tailscale.com/logtail/filch"
 	"tailscale.com/net/netns"
 	"tailscale.com/net/tlsdial"
+	"tailscale.com/net/tshttpproxy"
 	"tailscale.com/smallzstd"
 	"tailscale.com/types/logger"
 	"tailscale.com/version"
@@ -424,6 +425,9 @@ func newLogtailTransport(host string) *http.Transport {
 	// will never be any body to decompress:
 	tr.DisableCompression = true
 
+	// Go through the HTTP proxy, if any, like control and DERP traffic.
+	tr.Proxy = tshttpproxy.Proxy
+
 	// Log whenever we dial:
 	tr.DialContext = func(ctx context.Context, netw, addr string) (net.Conn, error) {
 		nd := netns.FromDialer(&net.Dialer{
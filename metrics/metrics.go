@@ -6,7 +6,15 @@
 // Tailscale for monitoring.
 package metrics
 
-import "expvar"
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
 
 // Set is a string-to-Var map variable that satisfies the expvar.Var
 // interface.
@@ -47,3 +55,100 @@ func (m *LabelMap) GetFloat(key string) *expvar.Float {
 	m.AddFloat(key, 0.0)
 	return m.Map.Get(key).(*expvar.Float)
 }
+
+// Histogram is a distribution of observed values that satisfies the
+// expvar.Var interface.
+//
+// It counts observations into buckets with fixed upper bounds, and is
+// mapped by tsweb's Prometheus exporter as a Prometheus histogram.
+type Histogram struct {
+	bounds []float64 // bucket upper bounds, ascending; +Inf is implicit
+
+	mu     sync.Mutex
+	counts []uint64 // non-cumulative; len(bounds)+1, last is the +Inf bucket
+	sum    float64
+}
+
+// NewHistogram returns a new Histogram with buckets at the given upper
+// bounds. Values larger than the last bound land in an implicit +Inf
+// bucket.
+func NewHistogram(bounds []float64) *Histogram {
+	bounds = append([]float64(nil), bounds...)
+	sort.Float64s(bounds)
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+// ExponentialBuckets returns n bucket upper bounds, the first being
+// start and each subsequent one factor times the previous.
+func ExponentialBuckets(start, factor float64, n int) []float64 {
+	bounds := make([]float64, n)
+	for i := range bounds {
+		bounds[i] = start
+		start *= factor
+	}
+	return bounds
+}
+
+// Observe adds v to the histogram.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += v
+}
+
+// Snapshot returns the histogram's bucket upper bounds, the
+// cumulative number of observations less than or equal to each, and
+// the sum of all observations. The final element of cumulative is
+// the total number of observations, for the implicit +Inf bucket.
+func (h *Histogram) Snapshot() (bounds []float64, cumulative []uint64, sum float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	cumulative = make([]uint64, len(h.counts))
+	var n uint64
+	for i, c := range h.counts {
+		n += c
+		cumulative[i] = n
+	}
+	return h.bounds, cumulative, h.sum
+}
+
+// String implements the expvar.Var interface, returning the
+// histogram as a JSON object of cumulative bucket counts keyed by
+// upper bound, plus the sum and count of observations.
+func (h *Histogram) String() string {
+	bounds, cumulative, sum := h.Snapshot()
+	var sb strings.Builder
+	sb.WriteString(`{"buckets": {`)
+	for i, c := range cumulative {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		le := "+Inf"
+		if i < len(bounds) {
+			le = formatFloat(bounds[i])
+		}
+		fmt.Fprintf(&sb, "%q: %d", le, c)
+	}
+	fmt.Fprintf(&sb, `}, "sum": %s, "count": %d}`, jsonFloat(sum), cumulative[len(cumulative)-1])
+	return sb.String()
+}
+
+// formatFloat formats f in the shortest form that represents it
+// exactly.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// jsonFloat formats f as a JSON value. JSON has no representation of
+// infinities or NaN, so those become strings.
+func jsonFloat(f float64) string {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return strconv.Quote(formatFloat(f))
+	}
+	return formatFloat(f)
+}
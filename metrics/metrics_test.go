@@ -0,0 +1,42 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram(ExponentialBuckets(1, 10, 3))
+	for _, v := range []float64{0.5, 1, 5, 50, 500} {
+		h.Observe(v)
+	}
+
+	bounds, cumulative, sum := h.Snapshot()
+	if want := []float64{1, 10, 100}; !reflect.DeepEqual(bounds, want) {
+		t.Errorf("bounds = %v; want %v", bounds, want)
+	}
+	if want := []uint64{2, 3, 4, 5}; !reflect.DeepEqual(cumulative, want) {
+		t.Errorf("cumulative = %v; want %v", cumulative, want)
+	}
+	if sum != 556.5 {
+		t.Errorf("sum = %v; want 556.5", sum)
+	}
+
+	var got struct {
+		Buckets map[string]uint64
+		Sum     float64
+		Count   uint64
+	}
+	if err := json.Unmarshal([]byte(h.String()), &got); err != nil {
+		t.Fatalf("String() = %s: %v", h.String(), err)
+	}
+	wantBuckets := map[string]uint64{"1": 2, "10": 3, "100": 4, "+Inf": 5}
+	if !reflect.DeepEqual(got.Buckets, wantBuckets) || got.Sum != 556.5 || got.Count != 5 {
+		t.Errorf("String() = %s", h.String())
+	}
+}
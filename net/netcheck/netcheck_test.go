@@ -21,6 +21,8 @@ import (
 	"tailscale.com/net/stun"
 	"tailscale.com/net/stun/stuntest"
 	"tailscale.com/tailcfg"
+	"tailscale.com/tstest/natlab"
+	"tailscale.com/types/opt"
 )
 
 func TestHairpinSTUN(t *testing.T) {
@@ -109,6 +111,156 @@ func TestWorksWhenUDPBlocked(t *testing.T) {
 	}
 }
 
+// natTest is a configuration of the NAT in front of the netcheck
+// client in TestNATs, and what netcheck should make of it.
+type natTest struct {
+	name string
+	nat  *natlab.SNAT44 // nil for no NAT
+
+	wantMappingVaries  bool
+	wantHairPinning    bool
+	wantPreservedPorts bool // whether the global port is the local port
+}
+
+func TestNATs(t *testing.T) {
+	tests := []natTest{
+		{
+			name:               "no_nat",
+			wantHairPinning:    true, // trivially: the packet goes to ourselves
+			wantPreservedPorts: true,
+		},
+		{
+			name: "endpoint_independent",
+			nat:  &natlab.SNAT44{Type: natlab.EndpointIndependentNAT},
+		},
+		{
+			name:            "endpoint_independent_hairpin",
+			nat:             &natlab.SNAT44{Type: natlab.EndpointIndependentNAT, Hairpin: true},
+			wantHairPinning: true,
+		},
+		{
+			name:               "endpoint_independent_preserve_ports",
+			nat:                &natlab.SNAT44{Type: natlab.EndpointIndependentNAT, PreservePorts: true},
+			wantPreservedPorts: true,
+		},
+		{
+			name:              "address_dependent",
+			nat:               &natlab.SNAT44{Type: natlab.AddressDependentNAT},
+			wantMappingVaries: true,
+		},
+		{
+			name:              "address_and_port_dependent",
+			nat:               &natlab.SNAT44{Type: natlab.AddressAndPortDependentNAT},
+			wantMappingVaries: true,
+		},
+		{
+			name:              "address_and_port_dependent_hairpin",
+			nat:               &natlab.SNAT44{Type: natlab.AddressAndPortDependentNAT, Hairpin: true},
+			wantMappingVaries: true,
+			wantHairPinning:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testNAT(t, tt)
+		})
+	}
+}
+
+func testNAT(t *testing.T, tt natTest) {
+	internet := natlab.NewInternet()
+	lan := &natlab.Network{
+		Name:    "lan",
+		Prefix4: mustPrefix("192.168.0.0/24"),
+	}
+
+	// Two STUN servers on different IPs, so netcheck can tell
+	// whether mappings vary by destination IP.
+	var stunAddrs []string
+	for _, name := range []string{"stun1", "stun2"} {
+		m := &natlab.Machine{Name: name}
+		s, err := natlab.ServeSTUN(m, m.Attach("eth0", internet).V4())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		stunAddrs = append(stunAddrs, s.Addr().String())
+	}
+
+	client := &natlab.Machine{Name: "client"}
+	var nat *natlab.Machine
+	var clientIP, wanIP netaddr.IP
+	if tt.nat == nil {
+		clientIP = client.Attach("eth0", internet).V4()
+		wanIP = clientIP
+	} else {
+		nat = &natlab.Machine{Name: "nat"}
+		wan := nat.Attach("wan", internet)
+		lan.SetDefaultGateway(nat.Attach("lan", lan))
+		clientIP = client.Attach("eth0", lan).V4()
+		wanIP = wan.V4()
+		tt.nat.Machine = nat
+		tt.nat.ExternalInterface = wan
+		nat.PacketHandler = tt.nat
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pc, err := client.ListenPacket(ctx, "udp4", net.JoinHostPort(clientIP.String(), "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := pc.LocalAddr().(*net.UDPAddr).Port
+	if nat != nil && !tt.nat.PreservePorts {
+		// Hold the client's port on the NAT's WAN IP, so the NAT
+		// can't pick the same port for its mapping by chance.
+		hold, err := nat.ListenPacket(ctx, "udp4", net.JoinHostPort(wanIP.String(), strconv.Itoa(local)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer hold.Close()
+	}
+	c := &Client{
+		Logf:           t.Logf,
+		GetSTUNConn4:   func() STUNConn { return pc },
+		PacketListener: client,
+	}
+	go c.readPackets(ctx, pc)
+
+	r, err := c.GetReport(ctx, stuntest.DERPMapOf(stunAddrs...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.UDP {
+		t.Fatal("want UDP")
+	}
+	if got, want := r.MappingVariesByDestIP, opt.Bool(strconv.FormatBool(tt.wantMappingVaries)); got != want {
+		t.Errorf("MappingVariesByDestIP = %q; want %q", got, want)
+	}
+	if got, want := r.HairPinning, opt.Bool(strconv.FormatBool(tt.wantHairPinning)); got != want {
+		t.Errorf("HairPinning = %q; want %q", got, want)
+	}
+
+	global, err := netaddr.ParseIPPort(r.GlobalV4)
+	if err != nil {
+		t.Fatalf("bad GlobalV4 %q: %v", r.GlobalV4, err)
+	}
+	if global.IP != wanIP {
+		t.Errorf("GlobalV4 = %v; want IP %v", global, wanIP)
+	}
+	if got := int(global.Port) == local; got != tt.wantPreservedPorts {
+		t.Errorf("GlobalV4 = %v, local port %d: port preserved = %v; want %v", global, local, got, tt.wantPreservedPorts)
+	}
+}
+
+func mustPrefix(s string) netaddr.IPPrefix {
+	ipp, err := netaddr.ParseIPPrefix(s)
+	if err != nil {
+		panic(err)
+	}
+	return ipp
+}
+
 func TestAddReportHistoryAndSetPreferredDERP(t *testing.T) {
 	// report returns a *Report from (DERP host, time.Duration)+ pairs.
 	report := func(a ...interface{}) *Report {
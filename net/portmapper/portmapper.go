@@ -0,0 +1,522 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package portmapper asks the local router to map a UDP port to the
+// outside world, using whichever of PCP, NAT-PMP and UPnP IGD it
+// supports.
+package portmapper
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/interfaces"
+	"tailscale.com/net/netns"
+	"tailscale.com/types/logger"
+)
+
+// ErrNoPortMappingServices is returned by CreateOrGetMapping when
+// the router doesn't answer any of the supported protocols.
+var ErrNoPortMappingServices = errors.New("no port mapping services were found")
+
+// ErrGatewayNotFound is returned by CreateOrGetMapping when the
+// local router can't be found.
+var ErrGatewayNotFound = errors.New("failed to look up gateway address")
+
+const (
+	pxpPort  = 5351 // PCP and NAT-PMP, on the router
+	ssdpPort = 1900 // UPnP discovery, on the router
+
+	// mappingLifetime is the lifetime we ask for. The mapping is
+	// renewed once half of it has passed.
+	mappingLifetime = 2 * time.Hour
+
+	// pxpTimeout is how long to wait for the router to answer
+	// a PCP or NAT-PMP request.
+	pxpTimeout = 250 * time.Millisecond
+
+	// renewTimeout bounds a renewal made by the renewal timer, and
+	// renewRetry is how soon a failed one is tried again.
+	renewTimeout = 10 * time.Second
+	renewRetry   = time.Minute
+)
+
+// Client maps a local UDP port to an external one on the local
+// router, and keeps the mapping alive.
+//
+// The mapping is made lazily, by CreateOrGetMapping, and then renewed
+// on a timer as its lifetime runs out.
+type Client struct {
+	logf     logger.Logf
+	onChange func() // if non-nil, called when a renewal changes the external address
+
+	// ipAndGateway returns the router's address and ours on the
+	// router's network. It's a field for tests.
+	ipAndGateway func() (gw, myIP netaddr.IP, ok bool)
+
+	testPxPPort  uint16 // if non-zero, the PCP/NAT-PMP port to use; for tests
+	testSSDPPort uint16 // if non-zero, the UPnP discovery port to use; for tests
+
+	// createMu serializes CreateOrGetMapping, which talks to the
+	// router without holding mu, so only one mapping is made at a
+	// time. If both are held, createMu is acquired first.
+	createMu sync.Mutex
+
+	mu         sync.Mutex // guards the fields below; never held during I/O
+	localPort  uint16
+	mapping    *mapping    // current mapping, or nil
+	renewTimer *time.Timer // renews mapping; nil if none was ever made
+	closed     bool
+}
+
+// mapping is a port mapping made on the router.
+type mapping struct {
+	proto      string // "pcp", "pmp" or "upnp"
+	gw, myIP   netaddr.IP
+	localPort  uint16
+	external   netaddr.IPPort
+	renewAfter time.Time
+	goodUntil  time.Time
+
+	nonce [12]byte     // for PCP
+	upnp  *upnpService // for UPnP
+}
+
+// NewClient returns a new Client. It does nothing until SetLocalPort
+// and CreateOrGetMapping are called.
+//
+// onChange, if non-nil, is called in its own goroutine whenever
+// renewing the mapping on the timer changes its external address or
+// loses it.
+func NewClient(logf logger.Logf, onChange func()) *Client {
+	return &Client{
+		logf:         logger.WithPrefix(logf, "portmapper: "),
+		onChange:     onChange,
+		ipAndGateway: interfaces.LikelyHomeRouterIP,
+	}
+}
+
+// SetLocalPort sets the local UDP port to map. If it differs from
+// the port currently mapped, the old mapping is released.
+func (c *Client) SetLocalPort(port uint16) {
+	c.mu.Lock()
+	if c.localPort == port {
+		c.mu.Unlock()
+		return
+	}
+	c.localPort = port
+	m := c.takeMappingLocked()
+	c.mu.Unlock()
+	c.release(m)
+}
+
+// Close releases the current mapping, if any. No new mappings are
+// made after Close.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	m := c.takeMappingLocked()
+	c.mu.Unlock()
+	c.release(m)
+	return nil
+}
+
+// HaveMapping reports whether there's a current mapping.
+func (c *Client) HaveMapping() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mapping != nil && time.Now().Before(c.mapping.goodUntil)
+}
+
+// takeMappingLocked removes and returns the current mapping, which
+// the caller must release once it has unlocked c.mu.
+func (c *Client) takeMappingLocked() *mapping {
+	m := c.mapping
+	c.mapping = nil
+	if c.renewTimer != nil {
+		c.renewTimer.Stop()
+	}
+	return m
+}
+
+// scheduleRenewLocked arranges for the current mapping to be renewed
+// after d.
+//
+// c.mu must be held.
+func (c *Client) scheduleRenewLocked(d time.Duration) {
+	if c.renewTimer == nil {
+		c.renewTimer = time.AfterFunc(d, c.renewMapping)
+		return
+	}
+	c.renewTimer.Stop()
+	c.renewTimer.Reset(d)
+}
+
+// renewMapping renews the current mapping, if any, when the renewal
+// timer fires.
+func (c *Client) renewMapping() {
+	c.mu.Lock()
+	old := c.mapping
+	c.mu.Unlock()
+	if old == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), renewTimeout)
+	defer cancel()
+	ext, err := c.CreateOrGetMapping(ctx)
+	if err == errStale {
+		return
+	}
+	if err != nil {
+		c.logf("renewing mapping of %v: %v", old.external, err)
+	}
+
+	c.mu.Lock()
+	if c.mapping == old && !c.closed {
+		// Renewing failed, but the old mapping is still good
+		// for a while.
+		c.scheduleRenewLocked(renewRetry)
+	}
+	c.mu.Unlock()
+	if ext != old.external && c.onChange != nil {
+		go c.onChange()
+	}
+}
+
+// release deletes m from the router. A nil m releases nothing.
+//
+// c.mu must not be held.
+func (c *Client) release(m *mapping) {
+	if m == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var err error
+	switch m.proto {
+	case "pcp":
+		_, err = c.pcpMap(ctx, m.gw, m.myIP, m.localPort, m.external.Port, 0, m.nonce)
+	case "pmp":
+		_, err = c.pmpMap(ctx, m.gw, m.localPort, 0, 0)
+	case "upnp":
+		err = m.upnp.deletePortMapping(ctx, m.external.Port)
+	}
+	if err != nil {
+		c.logf("releasing %s mapping of %v: %v", m.proto, m.external, err)
+	}
+}
+
+// errStale is returned by CreateOrGetMapping when the local port
+// changes, or the Client is closed, while it's making a mapping.
+var errStale = errors.New("local port changed or client closed while mapping")
+
+// setMapping makes m, a mapping of localPort, the current mapping.
+// If the local port changed or c was closed in the
+// meantime, it releases m instead and returns errStale.
+func (c *Client) setMapping(m *mapping, localPort uint16) error {
+	c.mu.Lock()
+	stale := c.closed || c.localPort != localPort
+	if !stale {
+		c.mapping = m
+		c.scheduleRenewLocked(time.Until(m.renewAfter))
+	}
+	c.mu.Unlock()
+	if stale {
+		c.release(m)
+		return errStale
+	}
+	return nil
+}
+
+// CreateOrGetMapping returns the external address of the local port
+// set with SetLocalPort, mapping it on the router or renewing the
+// mapping as necessary.
+func (c *Client) CreateOrGetMapping(ctx context.Context) (external netaddr.IPPort, err error) {
+	c.createMu.Lock()
+	defer c.createMu.Unlock()
+
+	c.mu.Lock()
+	closed, localPort, old := c.closed, c.localPort, c.mapping
+	c.mu.Unlock()
+	if closed {
+		return netaddr.IPPort{}, errors.New("client closed")
+	}
+	if localPort == 0 {
+		return netaddr.IPPort{}, errors.New("no local port to map")
+	}
+	now := time.Now()
+	if old != nil && now.Before(old.renewAfter) {
+		return old.external, nil
+	}
+
+	gw, myIP, ok := c.ipAndGateway()
+	if !ok {
+		return netaddr.IPPort{}, ErrGatewayNotFound
+	}
+	if old != nil && (old.gw != gw || old.myIP != myIP) {
+		// We're on a different network now.
+		c.mu.Lock()
+		current := c.mapping == old
+		if current {
+			c.mapping = nil
+		}
+		c.mu.Unlock()
+		if current {
+			c.release(old)
+		}
+		old = nil
+	}
+
+	if old != nil {
+		m, err := c.mapWith(ctx, old.proto, gw, myIP, localPort, old)
+		if err == nil {
+			if err := c.setMapping(m, localPort); err != nil {
+				return netaddr.IPPort{}, err
+			}
+			return m.external, nil
+		}
+		if now.Before(old.goodUntil) {
+			c.logf("renewing %s mapping: %v", old.proto, err)
+			return old.external, nil
+		}
+		c.mu.Lock()
+		if c.mapping == old {
+			c.mapping = nil
+		}
+		c.mu.Unlock()
+	}
+
+	var errs []string
+	for _, proto := range []string{"pcp", "pmp", "upnp"} {
+		m, err := c.mapWith(ctx, proto, gw, myIP, localPort, nil)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", proto, err))
+			continue
+		}
+		if err := c.setMapping(m, localPort); err != nil {
+			return netaddr.IPPort{}, err
+		}
+		c.logf("mapped %v to %v with %s", localPort, m.external, proto)
+		return m.external, nil
+	}
+	if debug {
+		c.logf("no mapping: %v", errs)
+	}
+	return netaddr.IPPort{}, ErrNoPortMappingServices
+}
+
+// debug is whether to log why each protocol failed.
+const debug = false
+
+// mapWith maps localPort with proto, renewing old if non-nil.
+func (c *Client) mapWith(ctx context.Context, proto string, gw, myIP netaddr.IP, localPort uint16, old *mapping) (*mapping, error) {
+	m := &mapping{
+		proto:     proto,
+		gw:        gw,
+		myIP:      myIP,
+		localPort: localPort,
+	}
+	lifetime := mappingLifetime
+	wantPort := localPort
+	if old != nil {
+		wantPort = old.external.Port
+		m.nonce = old.nonce
+		m.upnp = old.upnp
+	}
+	var err error
+	switch proto {
+	case "pcp":
+		if old == nil {
+			crand.Read(m.nonce[:])
+		}
+		var res pxpResult
+		res, err = c.pcpMap(ctx, gw, myIP, localPort, wantPort, lifetime, m.nonce)
+		m.external, lifetime = res.external, res.lifetime
+	case "pmp":
+		var res pxpResult
+		res, err = c.pmpMap(ctx, gw, localPort, wantPort, lifetime)
+		m.external, lifetime = res.external, res.lifetime
+	case "upnp":
+		if m.upnp == nil {
+			m.upnp, err = c.discoverUPnP(ctx, gw)
+			if err != nil {
+				return nil, err
+			}
+		}
+		m.external, lifetime, err = m.upnp.addPortMapping(ctx, myIP, localPort, wantPort, lifetime)
+	default:
+		panic("unknown protocol " + proto)
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if lifetime == 0 {
+		// Permanent (UPnP only). Still check on it every so often.
+		lifetime = mappingLifetime
+	}
+	m.renewAfter = now.Add(lifetime / 2)
+	m.goodUntil = now.Add(lifetime)
+	return m, nil
+}
+
+// pxpResult is the router's answer to a PCP or NAT-PMP map request.
+type pxpResult struct {
+	external netaddr.IPPort
+	lifetime time.Duration
+}
+
+func (c *Client) pxpAddr(gw netaddr.IP) *net.UDPAddr {
+	port := uint16(pxpPort)
+	if c.testPxPPort != 0 {
+		port = c.testPxPPort
+	}
+	return &net.UDPAddr{IP: gw.IPAddr().IP, Port: int(port)}
+}
+
+// pxpExchange sends req to the router's PCP/NAT-PMP port and returns
+// the first reply for which ok returns true.
+func (c *Client) pxpExchange(ctx context.Context, gw netaddr.IP, req []byte, ok func([]byte) bool) ([]byte, error) {
+	uc, err := netns.Listener().ListenPacket(ctx, "udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer uc.Close()
+	deadline := time.Now().Add(pxpTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	uc.SetReadDeadline(deadline)
+
+	dst := c.pxpAddr(gw)
+	if _, err := uc.WriteTo(req, dst); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, src, err := uc.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		if src.(*net.UDPAddr).IP.Equal(dst.IP) && ok(buf[:n]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// NAT-PMP (RFC 6886) constants.
+const (
+	pmpVersion         = 0
+	pmpOpExternalAddr  = 0
+	pmpOpMapUDP        = 1
+	pmpOpReply         = 0x80 // OR'd into the opcode of replies
+	pmpResultSuccess   = 0
+	pmpMapRequestLen   = 12
+	pmpMapResponseLen  = 16
+	pmpAddrResponseLen = 12
+)
+
+// pmpMap asks the router with NAT-PMP to map localPort to
+// externalPort (a preference only) for lifetime. A zero lifetime
+// deletes the mapping.
+func (c *Client) pmpMap(ctx context.Context, gw netaddr.IP, localPort, externalPort uint16, lifetime time.Duration) (pxpResult, error) {
+	var res pxpResult
+
+	var ip netaddr.IP
+	if lifetime > 0 {
+		// NAT-PMP only says which port was mapped, so ask for
+		// the external address separately.
+		b, err := c.pxpExchange(ctx, gw, []byte{pmpVersion, pmpOpExternalAddr}, func(b []byte) bool {
+			return len(b) >= pmpAddrResponseLen && b[0] == pmpVersion && b[1] == pmpOpReply|pmpOpExternalAddr
+		})
+		if err != nil {
+			return res, err
+		}
+		if code := binary.BigEndian.Uint16(b[2:4]); code != pmpResultSuccess {
+			return res, fmt.Errorf("NAT-PMP external address request failed with result code %d", code)
+		}
+		ip = netaddr.IPv4(b[8], b[9], b[10], b[11])
+	}
+
+	b, err := c.pxpExchange(ctx, gw, pmpMapRequest(localPort, externalPort, lifetime), func(b []byte) bool {
+		return len(b) >= pmpMapResponseLen && b[0] == pmpVersion && b[1] == pmpOpReply|pmpOpMapUDP &&
+			binary.BigEndian.Uint16(b[8:10]) == localPort
+	})
+	if err != nil {
+		return res, err
+	}
+	if code := binary.BigEndian.Uint16(b[2:4]); code != pmpResultSuccess {
+		return res, fmt.Errorf("NAT-PMP map request failed with result code %d", code)
+	}
+	res.external = netaddr.IPPort{IP: ip, Port: binary.BigEndian.Uint16(b[10:12])}
+	res.lifetime = time.Duration(binary.BigEndian.Uint32(b[12:16])) * time.Second
+	return res, nil
+}
+
+func pmpMapRequest(localPort, externalPort uint16, lifetime time.Duration) []byte {
+	b := make([]byte, pmpMapRequestLen)
+	b[0] = pmpVersion
+	b[1] = pmpOpMapUDP
+	binary.BigEndian.PutUint16(b[4:6], localPort)
+	binary.BigEndian.PutUint16(b[6:8], externalPort)
+	binary.BigEndian.PutUint32(b[8:12], uint32(lifetime/time.Second))
+	return b
+}
+
+// PCP (RFC 6887) constants.
+const (
+	pcpVersion       = 2
+	pcpOpMap         = 1
+	pcpOpReply       = 0x80 // OR'd into the opcode of replies
+	pcpResultSuccess = 0
+	pcpMapLen        = 60 // request and response: 24 byte header + 36 byte MAP payload
+	pcpUDPProto      = 17
+)
+
+// pcpMap asks the router with PCP to map localPort to externalPort
+// (a preference only) for lifetime. A zero lifetime deletes the
+// mapping made with the same nonce.
+func (c *Client) pcpMap(ctx context.Context, gw, myIP netaddr.IP, localPort, externalPort uint16, lifetime time.Duration, nonce [12]byte) (pxpResult, error) {
+	var res pxpResult
+	b, err := c.pxpExchange(ctx, gw, pcpMapRequest(myIP, localPort, externalPort, lifetime, nonce), func(b []byte) bool {
+		return len(b) >= pcpMapLen && b[0] == pcpVersion && b[1] == pcpOpReply|pcpOpMap &&
+			string(b[24:36]) == string(nonce[:])
+	})
+	if err != nil {
+		return res, err
+	}
+	if code := b[3]; code != pcpResultSuccess {
+		return res, fmt.Errorf("PCP map request failed with result code %d", code)
+	}
+	var ip16 [16]byte
+	copy(ip16[:], b[44:60])
+	res.external = netaddr.IPPort{IP: netaddr.IPFrom16(ip16).Unmap(), Port: binary.BigEndian.Uint16(b[42:44])}
+	res.lifetime = time.Duration(binary.BigEndian.Uint32(b[4:8])) * time.Second
+	return res, nil
+}
+
+func pcpMapRequest(myIP netaddr.IP, localPort, externalPort uint16, lifetime time.Duration, nonce [12]byte) []byte {
+	b := make([]byte, pcpMapLen)
+	// Common request header.
+	b[0] = pcpVersion
+	b[1] = pcpOpMap
+	binary.BigEndian.PutUint32(b[4:8], uint32(lifetime/time.Second))
+	myIP16 := myIP.As16()
+	copy(b[8:24], myIP16[:])
+	// MAP opcode payload.
+	copy(b[24:36], nonce[:])
+	b[36] = pcpUDPProto
+	binary.BigEndian.PutUint16(b[40:42], localPort)
+	binary.BigEndian.PutUint16(b[42:44], externalPort)
+	b[54], b[55] = 0xff, 0xff // suggested external address ::ffff:0.0.0.0, meaning no preference
+	return b
+}
@@ -0,0 +1,376 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portmapper
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+var (
+	localhost  = netaddr.IPv4(127, 0, 0, 1)
+	externalIP = netaddr.IPv4(203, 0, 113, 5)
+)
+
+// testRouter is a fake router speaking NAT-PMP or PCP.
+type testRouter struct {
+	pc   net.PacketConn
+	pcp  bool // whether to speak PCP rather than NAT-PMP
+	port uint16
+
+	mu       sync.Mutex
+	gotReq   chan struct{}     // if hold is non-nil, the next request is sent here
+	hold     chan struct{}     // if non-nil, the next request is answered once it's closed
+	mapped   map[uint16]uint16 // local port => external port
+	offset   uint16            // external port minus local port; 1000 if zero
+	lifetime uint32            // if non-zero, the lifetime in seconds granted to NAT-PMP mappings
+}
+
+func newTestRouter(t *testing.T, pcp bool) *testRouter {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &testRouter{
+		pc:     pc,
+		pcp:    pcp,
+		port:   uint16(pc.LocalAddr().(*net.UDPAddr).Port),
+		mapped: map[uint16]uint16{},
+	}
+	go r.serve()
+	return r
+}
+
+func (r *testRouter) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, src, err := r.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := append([]byte(nil), buf[:n]...)
+		r.mu.Lock()
+		hold := r.hold
+		r.hold = nil
+		r.mu.Unlock()
+		if hold != nil {
+			r.gotReq <- struct{}{}
+			<-hold
+		}
+		r.mu.Lock()
+		var res []byte
+		switch {
+		case r.pcp && n == pcpMapLen && req[0] == pcpVersion:
+			res = make([]byte, pcpMapLen)
+			copy(res, req)
+			res[1] = pcpOpReply | pcpOpMap
+			res[3] = pcpResultSuccess
+			local := binary.BigEndian.Uint16(req[40:42])
+			r.noteLocked(local, binary.BigEndian.Uint32(req[4:8]) != 0)
+			ext16 := externalIP.As16()
+			copy(res[44:60], ext16[:])
+			binary.BigEndian.PutUint16(res[42:44], r.mapped[local])
+		case !r.pcp && n == 2 && req[0] == pmpVersion && req[1] == pmpOpExternalAddr:
+			res = make([]byte, pmpAddrResponseLen)
+			res[1] = pmpOpReply | pmpOpExternalAddr
+			ext4 := externalIP.As4()
+			copy(res[8:12], ext4[:])
+		case !r.pcp && n == pmpMapRequestLen && req[0] == pmpVersion && req[1] == pmpOpMapUDP:
+			local := binary.BigEndian.Uint16(req[4:6])
+			lifetime := binary.BigEndian.Uint32(req[8:12])
+			r.noteLocked(local, lifetime != 0)
+			res = make([]byte, pmpMapResponseLen)
+			res[1] = pmpOpReply | pmpOpMapUDP
+			binary.BigEndian.PutUint16(res[8:10], local)
+			binary.BigEndian.PutUint16(res[10:12], r.mapped[local])
+			if r.lifetime != 0 && lifetime != 0 {
+				lifetime = r.lifetime
+			}
+			binary.BigEndian.PutUint32(res[12:16], lifetime)
+		}
+		r.mu.Unlock()
+		if res != nil {
+			r.pc.WriteTo(res, src)
+		}
+	}
+}
+
+// noteLocked records that local was mapped (or unmapped, if !add),
+// to external port local+r.offset.
+func (r *testRouter) noteLocked(local uint16, add bool) {
+	if add {
+		offset := r.offset
+		if offset == 0 {
+			offset = 1000
+		}
+		r.mapped[local] = local + offset
+	} else {
+		delete(r.mapped, local)
+	}
+}
+
+func (r *testRouter) numMapped() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.mapped)
+}
+
+func newTestClient(t *testing.T) *Client {
+	c := NewClient(t.Logf, nil)
+	c.ipAndGateway = func() (gw, myIP netaddr.IP, ok bool) {
+		return localhost, localhost, true
+	}
+	return c
+}
+
+func TestPxPMapping(t *testing.T) {
+	for _, pcp := range []bool{true, false} {
+		name := "pmp"
+		if pcp {
+			name = "pcp"
+		}
+		t.Run(name, func(t *testing.T) {
+			r := newTestRouter(t, pcp)
+			defer r.pc.Close()
+
+			c := newTestClient(t)
+			c.testPxPPort = r.port
+			c.testSSDPPort = 1 // nothing there
+			c.SetLocalPort(41641)
+
+			ext, err := c.CreateOrGetMapping(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := netaddr.IPPort{IP: externalIP, Port: 41641 + 1000}
+			if ext != want {
+				t.Errorf("mapped to %v; want %v", ext, want)
+			}
+			if got := c.mapping.proto; got != name {
+				t.Errorf("mapped with %q; want %q", got, name)
+			}
+			if !c.HaveMapping() || r.numMapped() != 1 {
+				t.Fatalf("HaveMapping = %v, router has %d mappings; want a mapping", c.HaveMapping(), r.numMapped())
+			}
+
+			c.Close()
+			if c.HaveMapping() || r.numMapped() != 0 {
+				t.Errorf("after Close, HaveMapping = %v, router has %d mappings; want none", c.HaveMapping(), r.numMapped())
+			}
+		})
+	}
+}
+
+func TestCloseWhileMapping(t *testing.T) {
+	r := newTestRouter(t, true)
+	defer r.pc.Close()
+	hold := make(chan struct{})
+	r.mu.Lock()
+	r.gotReq = make(chan struct{}, 1)
+	r.hold = hold
+	r.mu.Unlock()
+
+	c := newTestClient(t)
+	c.testPxPPort = r.port
+	c.testSSDPPort = 1 // nothing there
+	c.SetLocalPort(41641)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := c.CreateOrGetMapping(context.Background())
+		errc <- err
+	}()
+	<-r.gotReq
+
+	// Close mustn't wait for the router to answer the request.
+	start := time.Now()
+	c.Close()
+	if d := time.Since(start); d > pxpTimeout/2 {
+		t.Errorf("Close took %v while mapping", d)
+	}
+
+	// The mapping made despite Close is released.
+	close(hold)
+	if err := <-errc; err != errStale {
+		t.Errorf("CreateOrGetMapping = %v; want %v", err, errStale)
+	}
+	if c.HaveMapping() || r.numMapped() != 0 {
+		t.Errorf("HaveMapping = %v, router has %d mappings; want none", c.HaveMapping(), r.numMapped())
+	}
+}
+
+func TestRenewOnTimer(t *testing.T) {
+	r := newTestRouter(t, false)
+	defer r.pc.Close()
+	r.mu.Lock()
+	r.lifetime = 2 // seconds, so renewed after one
+	r.mu.Unlock()
+
+	c := newTestClient(t)
+	defer c.Close()
+	changed := make(chan bool, 1)
+	c.onChange = func() { changed <- true }
+	c.testPxPPort = r.port
+	c.testSSDPPort = 1 // nothing there
+	c.SetLocalPort(41641)
+	if _, err := c.CreateOrGetMapping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The router now maps the port elsewhere. The renewal notices,
+	// without CreateOrGetMapping being called again.
+	r.mu.Lock()
+	r.offset = 2000
+	r.mu.Unlock()
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("mapping not renewed")
+	}
+	c.mu.Lock()
+	ext := c.mapping.external
+	c.mu.Unlock()
+	if want := (netaddr.IPPort{IP: externalIP, Port: 41641 + 2000}); ext != want {
+		t.Errorf("renewed mapping to %v; want %v", ext, want)
+	}
+}
+
+func TestNoPortMappingServices(t *testing.T) {
+	// Something that won't answer.
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	port := uint16(pc.LocalAddr().(*net.UDPAddr).Port)
+
+	c := newTestClient(t)
+	c.testPxPPort = port
+	c.testSSDPPort = port
+	c.SetLocalPort(41641)
+	if _, err := c.CreateOrGetMapping(context.Background()); err != ErrNoPortMappingServices {
+		t.Errorf("err = %v; want ErrNoPortMappingServices", err)
+	}
+}
+
+const testDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+ <device>
+  <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+  <deviceList>
+   <device>
+    <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+    <deviceList>
+     <device>
+      <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+      <serviceList>
+       <service>
+        <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+        <controlURL>/ctl/IPConn</controlURL>
+       </service>
+      </serviceList>
+     </device>
+    </deviceList>
+   </device>
+  </deviceList>
+ </device>
+</root>`
+
+func TestUPnPMapping(t *testing.T) {
+	var mu sync.Mutex
+	var actions []string
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/desc.xml":
+			fmt.Fprint(w, testDescription)
+		case "/ctl/IPConn":
+			body, _ := ioutil.ReadAll(r.Body)
+			action := r.Header.Get("SOAPAction")
+			mu.Lock()
+			actions = append(actions, action)
+			mu.Unlock()
+			switch {
+			case strings.HasSuffix(action, `#AddPortMapping"`):
+				if !strings.Contains(string(body), "<NewInternalPort>41641</NewInternalPort>") {
+					http.Error(w, "bad request", 500)
+					return
+				}
+				fmt.Fprint(w, `<s:Envelope><s:Body><u:AddPortMappingResponse/></s:Body></s:Envelope>`)
+			case strings.HasSuffix(action, `#GetExternalIPAddress"`):
+				fmt.Fprintf(w, `<s:Envelope><s:Body><u:GetExternalIPAddressResponse>`+
+					`<NewExternalIPAddress>%v</NewExternalIPAddress>`+
+					`</u:GetExternalIPAddressResponse></s:Body></s:Envelope>`, externalIP)
+			case strings.HasSuffix(action, `#DeletePortMapping"`):
+				fmt.Fprint(w, `<s:Envelope><s:Body><u:DeletePortMappingResponse/></s:Body></s:Envelope>`)
+			default:
+				http.Error(w, "unknown action", 500)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer hs.Close()
+
+	// An SSDP responder pointing at the HTTP server.
+	ssdp, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ssdp.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			_, src, err := ssdp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(ssdpWriter{ssdp, src}, "HTTP/1.1 200 OK\r\nLOCATION: %s/desc.xml\r\n"+
+				"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n\r\n", hs.URL)
+		}
+	}()
+
+	c := newTestClient(t)
+	c.testPxPPort = 1 // nothing there
+	c.testSSDPPort = uint16(ssdp.LocalAddr().(*net.UDPAddr).Port)
+	c.SetLocalPort(41641)
+
+	ext, err := c.CreateOrGetMapping(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (netaddr.IPPort{IP: externalIP, Port: 41641}); ext != want {
+		t.Errorf("mapped to %v; want %v", ext, want)
+	}
+	c.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"AddPortMapping", "GetExternalIPAddress", "DeletePortMapping"}
+	if len(actions) != len(want) {
+		t.Fatalf("actions = %q; want %q", actions, want)
+	}
+	for i, a := range actions {
+		if !strings.HasSuffix(a, "#"+want[i]+`"`) {
+			t.Errorf("action %d = %q; want %q", i, a, want[i])
+		}
+	}
+}
+
+type ssdpWriter struct {
+	pc  net.PacketConn
+	dst net.Addr
+}
+
+func (w ssdpWriter) Write(b []byte) (int, error) { return w.pc.WriteTo(b, w.dst) }
@@ -0,0 +1,290 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package portmapper
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/netns"
+)
+
+// upnpTimeout bounds each step of talking UPnP IGD to the router.
+const upnpTimeout = 2 * time.Second
+
+// upnpHTTPClient is the HTTP client for talking to the router. It
+// never goes through an HTTP proxy.
+var upnpHTTPClient = &http.Client{
+	Transport: &http.Transport{DisableKeepAlives: true},
+}
+
+// upnpService is the WAN connection service of a UPnP Internet
+// Gateway Device, which is what adds port mappings.
+type upnpService struct {
+	serviceType string // e.g. "urn:schemas-upnp-org:service:WANIPConnection:1"
+	controlURL  string // where to POST SOAP requests
+}
+
+var ssdpSearch = []byte("M-SEARCH * HTTP/1.1\r\n" +
+	"HOST: 239.255.255.250:1900\r\n" +
+	"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+	"MAN: \"ssdp:discover\"\r\n" +
+	"MX: 2\r\n\r\n")
+
+// discoverUPnP finds the router's WAN connection service: it asks
+// the router for its device description URL with SSDP, then looks
+// through the description for the service.
+func (c *Client) discoverUPnP(ctx context.Context, gw netaddr.IP) (*upnpService, error) {
+	ctx, cancel := context.WithTimeout(ctx, upnpTimeout)
+	defer cancel()
+
+	location, err := c.ssdpLocation(ctx, gw)
+	if err != nil {
+		return nil, err
+	}
+	// Only talk to the router, whatever it says.
+	if location.Hostname() != gw.String() {
+		return nil, fmt.Errorf("UPnP device description at %v is not on the gateway %v", location, gw)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", location.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := upnpHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching UPnP device description: %v", res.Status)
+	}
+	svc, err := parseUPnPDescription(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	control, err := location.Parse(svc.controlURL)
+	if err != nil {
+		return nil, err
+	}
+	if control.Hostname() != gw.String() {
+		return nil, fmt.Errorf("UPnP control URL %v is not on the gateway %v", control, gw)
+	}
+	svc.controlURL = control.String()
+	return svc, nil
+}
+
+// ssdpLocation sends an SSDP search to the router and returns the
+// URL of its device description from the reply.
+func (c *Client) ssdpLocation(ctx context.Context, gw netaddr.IP) (*url.URL, error) {
+	uc, err := netns.Listener().ListenPacket(ctx, "udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer uc.Close()
+	if d, ok := ctx.Deadline(); ok {
+		uc.SetReadDeadline(d)
+	}
+
+	port := uint16(ssdpPort)
+	if c.testSSDPPort != 0 {
+		port = c.testSSDPPort
+	}
+	dst := netaddr.IPPort{IP: gw, Port: port}.UDPAddr()
+	if _, err := uc.WriteTo(ssdpSearch, dst); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, src, err := uc.ReadFrom(buf)
+		if err != nil {
+			return nil, err
+		}
+		if !src.(*net.UDPAddr).IP.Equal(dst.IP) {
+			continue
+		}
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil || res.StatusCode != http.StatusOK {
+			continue
+		}
+		if loc := res.Header.Get("Location"); loc != "" {
+			return url.Parse(loc)
+		}
+	}
+}
+
+// upnpDevice is the part of a UPnP device description we need.
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// parseUPnPDescription returns the WAN connection service from a
+// UPnP device description.
+func parseUPnPDescription(r io.Reader) (*upnpService, error) {
+	var root struct {
+		Device upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(r).Decode(&root); err != nil {
+		return nil, fmt.Errorf("parsing UPnP device description: %v", err)
+	}
+	var find func(d *upnpDevice) *upnpService
+	find = func(d *upnpDevice) *upnpService {
+		for _, s := range d.Services {
+			if strings.HasPrefix(s.ServiceType, "urn:schemas-upnp-org:service:WANIPConnection:") ||
+				strings.HasPrefix(s.ServiceType, "urn:schemas-upnp-org:service:WANPPPConnection:") {
+				return &upnpService{serviceType: s.ServiceType, controlURL: s.ControlURL}
+			}
+		}
+		for i := range d.Devices {
+			if svc := find(&d.Devices[i]); svc != nil {
+				return svc
+			}
+		}
+		return nil
+	}
+	svc := find(&root.Device)
+	if svc == nil {
+		return nil, errors.New("no WAN connection service in UPnP device description")
+	}
+	return svc, nil
+}
+
+// addPortMapping maps localPort on myIP to externalPort on the
+// router for lifetime, and returns the mapped external address and
+// the lifetime granted. A zero lifetime means the mapping is
+// permanent, which some routers insist on.
+func (s *upnpService) addPortMapping(ctx context.Context, myIP netaddr.IP, localPort, externalPort uint16, lifetime time.Duration) (netaddr.IPPort, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, upnpTimeout)
+	defer cancel()
+
+	args := func(lifetime time.Duration) []soapArg {
+		return []soapArg{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", fmt.Sprint(externalPort)},
+			{"NewProtocol", "UDP"},
+			{"NewInternalPort", fmt.Sprint(localPort)},
+			{"NewInternalClient", myIP.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", "tailscale"},
+			{"NewLeaseDuration", fmt.Sprint(int64(lifetime / time.Second))},
+		}
+	}
+	_, err := s.call(ctx, "AddPortMapping", args(lifetime))
+	if err != nil && strings.Contains(err.Error(), "OnlyPermanentLeasesSupported") {
+		lifetime = 0
+		_, err = s.call(ctx, "AddPortMapping", args(lifetime))
+	}
+	if err != nil {
+		return netaddr.IPPort{}, 0, err
+	}
+
+	res, err := s.call(ctx, "GetExternalIPAddress", nil)
+	if err != nil {
+		return netaddr.IPPort{}, 0, err
+	}
+	ip, err := netaddr.ParseIP(res["NewExternalIPAddress"])
+	if err != nil {
+		return netaddr.IPPort{}, 0, fmt.Errorf("UPnP external address: %v", err)
+	}
+	return netaddr.IPPort{IP: ip, Port: externalPort}, lifetime, nil
+}
+
+func (s *upnpService) deletePortMapping(ctx context.Context, externalPort uint16) error {
+	_, err := s.call(ctx, "DeletePortMapping", []soapArg{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", fmt.Sprint(externalPort)},
+		{"NewProtocol", "UDP"},
+	})
+	return err
+}
+
+type soapArg struct {
+	name, value string
+}
+
+// call calls a SOAP action on the service and returns the values in
+// the response, by element name.
+func (s *upnpService) call(ctx context.Context, action string, args []soapArg) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, s.serviceType)
+	for _, a := range args {
+		fmt.Fprintf(&body, "<%s>", a.name)
+		xml.EscapeText(&body, []byte(a.value))
+		fmt.Fprintf(&body, "</%s>", a.name)
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, s.serviceType, action))
+	res, err := upnpHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err != nil {
+		return nil, err
+	}
+	vals, err := soapValues(resBody)
+	if err != nil {
+		return nil, fmt.Errorf("UPnP %s: %v", action, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("UPnP %s: %v: %s", action, res.Status, vals["errorDescription"])
+	}
+	return vals, nil
+}
+
+// soapValues returns the text of the leaf elements of a SOAP
+// response, by local name.
+func soapValues(b []byte) (map[string]string, error) {
+	vals := map[string]string{}
+	d := xml.NewDecoder(bytes.NewReader(b))
+	var name string
+	var text []byte
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return vals, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			name, text = tok.Name.Local, nil
+		case xml.CharData:
+			text = append(text, tok...)
+		case xml.EndElement:
+			if tok.Name.Local == name {
+				vals[name] = strings.TrimSpace(string(text))
+			}
+			name = ""
+		}
+	}
+}
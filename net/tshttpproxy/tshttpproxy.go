@@ -0,0 +1,166 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package tshttpproxy contains Tailscale's HTTP proxy support.
+//
+// The proxy to use comes from the environment (HTTPS_PROXY,
+// HTTP_PROXY and NO_PROXY, and their lowercase versions), unless
+// overridden with SetProxy. HTTP clients use it via Proxy; code
+// dialing raw TCP connections, such as DERP, uses NewDialer to
+// tunnel through it with CONNECT.
+package tshttpproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"golang.org/x/net/http/httpproxy"
+	"tailscale.com/net/netns"
+)
+
+var (
+	mu       sync.Mutex
+	override *url.URL // set by SetProxy; nil means use the environment
+)
+
+// SetProxy sets the proxy to use for all outbound HTTP and TCP
+// connections, except those to hosts listed in NO_PROXY, overriding
+// HTTPS_PROXY and HTTP_PROXY. A nil u reverts to using the
+// environment.
+func SetProxy(u *url.URL) {
+	mu.Lock()
+	defer mu.Unlock()
+	override = u
+}
+
+func config() *httpproxy.Config {
+	cfg := httpproxy.FromEnvironment()
+	mu.Lock()
+	defer mu.Unlock()
+	if override != nil {
+		cfg.HTTPProxy = override.String()
+		cfg.HTTPSProxy = override.String()
+	}
+	return cfg
+}
+
+// ProxyURL returns the URL of the proxy to use for a request to u,
+// or nil if u should be reached directly.
+func ProxyURL(u *url.URL) (*url.URL, error) {
+	return config().ProxyFunc()(u)
+}
+
+// Proxy is an http.Transport.Proxy func that uses the configured
+// proxy.
+func Proxy(req *http.Request) (*url.URL, error) {
+	return ProxyURL(req.URL)
+}
+
+// NewDialer returns a dialer that connects through the configured
+// proxy, using HTTP CONNECT, to those addresses for which one is
+// configured, and with d to all others. d is also used to dial the
+// proxy.
+//
+// The addresses dialed are assumed to be for TLS, so HTTPS_PROXY is
+// the one consulted.
+func NewDialer(d netns.Dialer) netns.Dialer {
+	return &dialer{d}
+}
+
+type dialer struct {
+	fwd netns.Dialer
+}
+
+func (d *dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+func (d *dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxyURL, err := ProxyURL(&url.URL{Scheme: "https", Host: addr})
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return d.fwd.DialContext(ctx, network, addr)
+	}
+	return dialConnect(ctx, d.fwd, proxyURL, addr)
+}
+
+// dialConnect returns a connection to addr tunneled through the HTTP
+// proxy at proxyURL with the CONNECT method. Credentials in
+// proxyURL's userinfo are sent with basic auth.
+func dialConnect(ctx context.Context, d netns.Dialer, proxyURL *url.URL, addr string) (_ net.Conn, err error) {
+	if proxyURL.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxyURL.Scheme)
+	}
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	nc, err := d.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("dial proxy %v: %v", proxyAddr, err)
+	}
+	defer func() {
+		if err != nil {
+			nc.Close()
+		}
+	}()
+
+	// Abort the exchange with the proxy if ctx is done first.
+	done := make(chan bool) // unbuffered
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			nc.Close()
+		}
+	}()
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxyURL.User; u != nil {
+		pass, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(nc); err != nil {
+		return nil, fmt.Errorf("proxy CONNECT: %v", err)
+	}
+	// The proxy doesn't send anything after its response until we
+	// do, so there's nothing buffered in br to lose once it's
+	// read the response header.
+	br := bufio.NewReader(nc)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("proxy CONNECT: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("proxy CONNECT to %v: %v", addr, res.Status)
+	}
+	if br.Buffered() > 0 {
+		return nil, fmt.Errorf("proxy CONNECT to %v: unexpected data after response", addr)
+	}
+	select {
+	case done <- true:
+		return nc, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
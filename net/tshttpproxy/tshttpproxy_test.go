@@ -0,0 +1,112 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tshttpproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestProxyURL(t *testing.T) {
+	override, _ := url.Parse("http://proxy.example:3128")
+	SetProxy(override)
+	defer SetProxy(nil)
+
+	got, err := ProxyURL(&url.URL{Scheme: "https", Host: "derp.example.com:443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.String() != override.String() {
+		t.Errorf("ProxyURL = %v; want %v", got, override)
+	}
+
+	// Loopback addresses are never proxied.
+	got, err = ProxyURL(&url.URL{Scheme: "https", Host: "127.0.0.1:443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Errorf("ProxyURL for loopback = %v; want nil", got)
+	}
+}
+
+func TestDialConnect(t *testing.T) {
+	// An echo server to tunnel to.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		user, pass, ok := (&http.Request{Header: http.Header{
+			"Authorization": r.Header["Proxy-Authorization"],
+		}}).BasicAuth()
+		if !ok || user != "alice" || pass != "secret" {
+			http.Error(w, "bad auth", http.StatusProxyAuthRequired)
+			return
+		}
+		dst, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer dst.Close()
+		w.WriteHeader(http.StatusOK)
+		src, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer src.Close()
+		go io.Copy(dst, brw)
+		io.Copy(src, dst)
+	}))
+	defer proxy.Close()
+
+	d := new(net.Dialer)
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	if _, err := dialConnect(context.Background(), d, proxyURL, ln.Addr().String()); err == nil {
+		t.Error("CONNECT without credentials succeeded")
+	}
+
+	proxyURL.User = url.UserPassword("alice", "secret")
+	c, err := dialConnect(context.Background(), d, proxyURL, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("read %q; want %q", buf, "hello")
+	}
+}
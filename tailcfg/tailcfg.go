@@ -475,11 +475,29 @@ type NetPortRange struct {
 	Ports PortRange
 }
 
+// ICMPTypeCode identifies ICMP or ICMPv6 messages by type and,
+// optionally, code.
+type ICMPTypeCode struct {
+	Type uint8
+	Code *uint8 `json:",omitempty"` // if missing, means all codes
+}
+
 // FilterRule represents one rule in a packet filter.
 type FilterRule struct {
 	SrcIPs   []string
 	SrcBits  []int
 	DstPorts []NetPortRange
+
+	// IPProto is the list of IP protocol numbers the rule applies
+	// to, such as 1 (ICMP), 6 (TCP), 17 (UDP), 58 (ICMPv6) or
+	// 132 (SCTP). If empty, it means TCP, UDP, ICMP and ICMPv6, as
+	// before the field existed. The ports in DstPorts are ignored
+	// for protocols without ports.
+	IPProto []int `json:",omitempty"`
+
+	// ICMPTypes, if non-empty, limits the ICMP and ICMPv6
+	// messages the rule allows to those listed.
+	ICMPTypes []ICMPTypeCode `json:",omitempty"`
 }
 
 var FilterAllowAll = []FilterRule{
@@ -500,6 +518,29 @@ type DNSConfig struct {
 	Domains     []string     `json:",omitempty"`
 	PerDomain   bool
 	Proxied     bool
+	// Routes maps DNS name suffixes to the nameservers that should
+	// resolve names under them, instead of Nameservers.
+	// A suffix like "corp.example.com" matches that name and all its
+	// subdomains; a suffix like "*.internal" matches only subdomains.
+	// The longest matching suffix wins. Routes only apply when
+	// Proxied is set, as otherwise queries never reach Tailscale.
+	Routes map[string][]netaddr.IP `json:",omitempty"`
+	// ExtraRecords are DNS records, other than the addresses of nodes,
+	// that Tailscale's resolver should serve for names in the tailnet.
+	ExtraRecords []DNSRecord `json:",omitempty"`
+}
+
+// DNSRecord is a DNS record for a name in the tailnet.
+type DNSRecord struct {
+	// Name is the fully qualified domain name of the record,
+	// such as "alias.user.domain".
+	Name string
+	// Type is the record type: "CNAME", "TXT" or "SRV".
+	Type string
+	// Value is the record data as in a zone file: the target
+	// name for CNAME, the text for TXT, and
+	// "priority weight port target" for SRV.
+	Value string
 }
 
 type MapResponse struct {
@@ -0,0 +1,707 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package controltest contains a fake control server for tests.
+//
+// It implements enough of the control protocol (the /key endpoint,
+// node registration and the map long-poll) for a
+// controlclient.Direct to log in and receive network maps, and it
+// lets tests mutate the tailnet while clients are connected.
+package controltest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"golang.org/x/crypto/nacl/box"
+	"tailscale.com/smallzstd"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+)
+
+// keepAliveInterval is how often a streaming map poll that asked
+// for keep-alives is sent one.
+const keepAliveInterval = 60 * time.Second
+
+// Server is a fake control server.
+//
+// It implements http.Handler. The zero value is ready for use; the
+// server's key is generated on first use.
+//
+// All nodes belong to a single user and are automatically
+// authorized on registration.
+type Server struct {
+	// Logf, if non-nil, is used for logging. Otherwise log.Printf is used.
+	Logf logger.Logf
+
+	// DERPMap, if non-nil, is sent to clients in each MapResponse.
+	// It must not be modified after the Server is first used.
+	DERPMap *tailcfg.DERPMap
+
+	// Domain is the tailnet domain sent to clients.
+	// If empty, "example.com" is used.
+	Domain string
+
+	initMuxOnce sync.Once
+	mux         *http.ServeMux
+
+	mu           sync.Mutex
+	privKey      wgcfg.PrivateKey
+	pubKey       wgcfg.Key
+	lastNodeID   tailcfg.NodeID
+	nodes        map[tailcfg.NodeKey]*tailcfg.Node
+	packetFilter []tailcfg.FilterRule
+	updates      map[tailcfg.NodeID]chan struct{} // map poll streams, woken on change
+	msgToSend    map[tailcfg.NodeKey][]*tailcfg.MapResponse
+}
+
+// User is the user that owns every node registered with a Server.
+var User = tailcfg.User{
+	ID:          1,
+	LoginName:   "user@example.com",
+	DisplayName: "Test User",
+	Domain:      "example.com",
+	Logins:      []tailcfg.LoginID{1},
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func (s *Server) initMux() {
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/", s.serveUnhandled)
+	s.mux.HandleFunc("/key", s.serveKey)
+	s.mux.HandleFunc("/machine/", s.serveMachine)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.initMuxOnce.Do(s.initMux)
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) serveUnhandled(w http.ResponseWriter, r *http.Request) {
+	s.logf("controltest: unhandled %s %s", r.Method, r.URL.Path)
+	http.NotFound(w, r)
+}
+
+// publicKey returns the server's public key, generating the
+// server's key pair if needed.
+func (s *Server) publicKey() wgcfg.Key {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ensureKeyLocked()
+	return s.pubKey
+}
+
+func (s *Server) privateKey() wgcfg.PrivateKey {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ensureKeyLocked()
+	return s.privKey
+}
+
+func (s *Server) ensureKeyLocked() {
+	if !s.privKey.IsZero() {
+		return
+	}
+	k, err := wgcfg.NewPrivateKey()
+	if err != nil {
+		panic(err)
+	}
+	s.privKey = k
+	s.pubKey = k.Public()
+}
+
+func (s *Server) serveKey(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, s.publicKey().HexString())
+}
+
+func (s *Server) serveMachine(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	mkeyStr := strings.TrimPrefix(r.URL.Path, "/machine/")
+	rest := ""
+	if i := strings.IndexByte(mkeyStr, '/'); i != -1 {
+		rest = mkeyStr[i:]
+		mkeyStr = mkeyStr[:i]
+	}
+	key, err := wgcfg.ParseHexKey(mkeyStr)
+	if err != nil {
+		http.Error(w, "bad machine key hex", http.StatusBadRequest)
+		return
+	}
+	mkey := tailcfg.MachineKey(key)
+
+	switch rest {
+	case "":
+		s.serveRegister(w, r, mkey)
+	case "/map":
+		s.serveMap(w, r, mkey)
+	default:
+		s.serveUnhandled(w, r)
+	}
+}
+
+// Node returns a copy of the node with the given node key, or nil if
+// no such node is registered.
+func (s *Server) Node(nodeKey tailcfg.NodeKey) *tailcfg.Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nodes[nodeKey].Clone()
+}
+
+// AllNodes returns copies of all registered nodes, sorted by ID.
+func (s *Server) AllNodes() []*tailcfg.Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret []*tailcfg.Node
+	for _, n := range s.nodes {
+		ret = append(ret, n.Clone())
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+	return ret
+}
+
+// AddNode adds n to the tailnet, or replaces the node with the same
+// Key, and notifies all connected clients.
+//
+// If n.ID is zero, a new ID is assigned. If n.Addresses is empty, an
+// address is assigned from 100.64.0.0/10. The server retains n.
+func (s *Server) AddNode(n *tailcfg.Node) {
+	if n.Key.IsZero() {
+		panic("controltest: AddNode with zero node key")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.nodes[n.Key]; ok && n.ID == 0 {
+		n.ID = old.ID
+	}
+	s.addNodeLocked(n)
+	s.updateLocked(nil)
+}
+
+func (s *Server) addNodeLocked(n *tailcfg.Node) {
+	if s.nodes == nil {
+		s.nodes = make(map[tailcfg.NodeKey]*tailcfg.Node)
+	}
+	if n.ID == 0 {
+		s.lastNodeID++
+		n.ID = s.lastNodeID
+	} else if n.ID > s.lastNodeID {
+		s.lastNodeID = n.ID
+	}
+	if len(n.Addresses) == 0 {
+		id := uint32(n.ID)
+		n.Addresses = []wgcfg.CIDR{{
+			IP:   wgcfg.IPv4(100, 64|byte(id>>16&0x3f), byte(id>>8), byte(id)),
+			Mask: 32,
+		}}
+	}
+	if len(n.AllowedIPs) == 0 {
+		n.AllowedIPs = n.Addresses
+	}
+	if n.User == 0 {
+		n.User = User.ID
+	}
+	if n.Created.IsZero() {
+		n.Created = time.Now()
+	}
+	s.nodes[n.Key] = n
+}
+
+// RemoveNode removes the node with the given node key from the
+// tailnet and notifies all connected clients.
+// It reports whether the node was present.
+func (s *Server) RemoveNode(nodeKey tailcfg.NodeKey) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.nodes[nodeKey]; !ok {
+		return false
+	}
+	delete(s.nodes, nodeKey)
+	s.updateLocked(nil)
+	return true
+}
+
+// ExpireNodeKey marks the key of the node with the given node key as
+// expired and notifies all connected clients.
+// The node's next registration will be told to generate a new key.
+// It reports whether the node was present.
+func (s *Server) ExpireNodeKey(nodeKey tailcfg.NodeKey) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.nodes[nodeKey]
+	if !ok {
+		return false
+	}
+	n.KeyExpiry = time.Now().Add(-time.Minute)
+	s.updateLocked(nil)
+	return true
+}
+
+// SetPacketFilter sets the packet filter sent to all clients and
+// notifies connected clients. A nil filter means to allow all
+// traffic.
+func (s *Server) SetPacketFilter(rules []tailcfg.FilterRule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.packetFilter = rules
+	s.updateLocked(nil)
+}
+
+// AddRawMapResponse queues mr to be sent verbatim (apart from
+// encryption) to the node with the given node key on its current or
+// next streaming map poll. It reports whether the node is currently
+// streaming.
+//
+// It is meant for tests that want to send deltas (such as
+// PeersChanged or PeersRemoved) that don't follow from the server's
+// own state. If mr.Node is nil, it's filled in with the node's
+// current state before sending.
+func (s *Server) AddRawMapResponse(nodeKey tailcfg.NodeKey, mr *tailcfg.MapResponse) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.msgToSend == nil {
+		s.msgToSend = make(map[tailcfg.NodeKey][]*tailcfg.MapResponse)
+	}
+	s.msgToSend[nodeKey] = append(s.msgToSend[nodeKey], mr)
+	n, ok := s.nodes[nodeKey]
+	if !ok {
+		return false
+	}
+	ch, ok := s.updates[n.ID]
+	if !ok {
+		return false
+	}
+	sendUpdate(ch)
+	return true
+}
+
+// takeRawMapMessages returns and clears the queued raw MapResponses
+// for nodeKey.
+func (s *Server) takeRawMapMessages(nodeKey tailcfg.NodeKey) []*tailcfg.MapResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := s.msgToSend[nodeKey]
+	delete(s.msgToSend, nodeKey)
+	return msgs
+}
+
+// updateLocked wakes up all streaming map polls, except the one of
+// the node with ID skip (if non-nil).
+func (s *Server) updateLocked(skip *tailcfg.NodeID) {
+	for id, ch := range s.updates {
+		if skip != nil && id == *skip {
+			continue
+		}
+		sendUpdate(ch)
+	}
+}
+
+// sendUpdate sends a wake-up to ch without blocking.
+func sendUpdate(ch chan<- struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+		// A wake-up is already pending.
+	}
+}
+
+func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey tailcfg.MachineKey) {
+	var req tailcfg.RegisterRequest
+	if err := s.decode(mkey, r.Body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Version != 1 {
+		http.Error(w, "unsupported register request version", http.StatusBadRequest)
+		return
+	}
+	if req.NodeKey.IsZero() {
+		http.Error(w, "missing node key", http.StatusBadRequest)
+		return
+	}
+	s.logf("controltest: register: mkey=%x node=%v old=%v", mkey[:4], req.NodeKey.ShortString(), req.OldNodeKey.ShortString())
+
+	res := &tailcfg.RegisterResponse{
+		User: User,
+		Login: tailcfg.Login{
+			ID:          1,
+			Provider:    "controltest",
+			LoginName:   User.LoginName,
+			DisplayName: User.DisplayName,
+			Domain:      User.Domain,
+		},
+		MachineAuthorized: true,
+	}
+
+	s.mu.Lock()
+	n, ok := s.nodes[req.NodeKey]
+	switch {
+	case ok && n.Machine != mkey:
+		s.mu.Unlock()
+		http.Error(w, "node key registered to a different machine", http.StatusBadRequest)
+		return
+	case ok && !n.KeyExpiry.IsZero() && n.KeyExpiry.Before(time.Now()):
+		res.NodeKeyExpired = true
+	case ok:
+		// Key refresh of an existing node.
+		if req.Hostinfo != nil {
+			n.Hostinfo = *req.Hostinfo.Clone()
+		}
+	default:
+		n = &tailcfg.Node{
+			Key:               req.NodeKey,
+			Machine:           mkey,
+			MachineAuthorized: true,
+		}
+		if old, ok := s.nodes[req.OldNodeKey]; ok && !req.OldNodeKey.IsZero() && old.Machine == mkey {
+			// Key rotation: keep the node's identity.
+			delete(s.nodes, req.OldNodeKey)
+			n.ID = old.ID
+			n.Addresses = old.Addresses
+			n.AllowedIPs = old.AllowedIPs
+			n.Created = old.Created
+		}
+		if req.Hostinfo != nil {
+			n.Hostinfo = *req.Hostinfo.Clone()
+		}
+		n.Name = n.Hostinfo.Hostname
+		s.addNodeLocked(n)
+		s.updateLocked(&n.ID)
+	}
+	s.mu.Unlock()
+
+	s.writeResponse(w, mkey, res)
+}
+
+func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey tailcfg.MachineKey) {
+	ctx := r.Context()
+
+	req := new(tailcfg.MapRequest)
+	if err := s.decode(mkey, r.Body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Version < 4 {
+		http.Error(w, "unsupported map request version", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	n, ok := s.nodes[req.NodeKey]
+	if !ok || n.Machine != mkey {
+		s.mu.Unlock()
+		http.Error(w, "node not found", http.StatusBadRequest)
+		return
+	}
+	nodeID := n.ID
+	updated := n.Clone()
+	updated.DiscoKey = req.DiscoKey
+	updated.Endpoints = append([]string(nil), req.Endpoints...)
+	if req.Hostinfo != nil {
+		updated.Hostinfo = *req.Hostinfo.Clone()
+		if ni := req.Hostinfo.NetInfo; ni != nil && ni.PreferredDERP != 0 {
+			updated.DERP = fmt.Sprintf("127.3.3.40:%d", ni.PreferredDERP)
+		}
+	}
+	changed := !updated.Equal(n)
+	now := time.Now()
+	updated.LastSeen = &now
+	s.nodes[req.NodeKey] = updated
+	if changed {
+		s.updateLocked(&nodeID)
+	}
+	var updatesCh chan struct{}
+	if req.Stream {
+		if s.updates == nil {
+			s.updates = make(map[tailcfg.NodeID]chan struct{})
+		}
+		if old, ok := s.updates[nodeID]; ok {
+			// A newer poll replaces the old one; wake it so it can notice.
+			sendUpdate(old)
+		}
+		updatesCh = make(chan struct{}, 1)
+		s.updates[nodeID] = updatesCh
+	}
+	s.mu.Unlock()
+
+	if req.Stream {
+		defer func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.updates[nodeID] == updatesCh {
+				delete(s.updates, nodeID)
+			}
+		}()
+	}
+
+	var compress bool
+	switch req.Compress {
+	case "":
+	case "zstd":
+		compress = true
+	default:
+		http.Error(w, "unsupported compression", http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(200)
+	var enc *zstd.Encoder
+	if compress {
+		var err error
+		enc, err = smallzstd.NewEncoder(nil)
+		if err != nil {
+			s.logf("controltest: zstd encoder: %v", err)
+			return
+		}
+		defer enc.Close()
+	}
+
+	var keepAlive <-chan time.Time
+	if req.Stream && req.KeepAlive {
+		t := time.NewTicker(keepAliveInterval)
+		defer t.Stop()
+		keepAlive = t.C
+	}
+
+	var prevPeers []*tailcfg.Node // as last sent, for computing deltas
+	for {
+		res, err := s.MapResponse(req)
+		if err != nil {
+			s.logf("controltest: map response for %v: %v", req.NodeKey.ShortString(), err)
+			return
+		}
+		if res == nil {
+			// Node was removed.
+			return
+		}
+		peers := res.Peers
+		if prevPeers != nil && req.DeltaPeers {
+			res.Peers = nil
+			res.PeersChanged, res.PeersRemoved = diffPeers(prevPeers, peers)
+		}
+		prevPeers = peers
+		if err := s.sendMapMsg(w, mkey, enc, res); err != nil {
+			s.logf("controltest: sending map response: %v", err)
+			return
+		}
+		for _, raw := range s.takeRawMapMessages(req.NodeKey) {
+			if raw.Node == nil {
+				raw.Node = res.Node
+			}
+			if err := s.sendMapMsg(w, mkey, enc, raw); err != nil {
+				s.logf("controltest: sending raw map response: %v", err)
+				return
+			}
+		}
+		if !req.Stream {
+			return
+		}
+
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-keepAlive:
+				if err := s.sendMapMsg(w, mkey, enc, &tailcfg.MapResponse{KeepAlive: true}); err != nil {
+					s.logf("controltest: sending keep-alive: %v", err)
+					return
+				}
+			case <-updatesCh:
+				break wait
+			}
+		}
+
+		s.mu.Lock()
+		replaced := s.updates[nodeID] != updatesCh
+		s.mu.Unlock()
+		if replaced {
+			return
+		}
+	}
+}
+
+// diffPeers returns the peers that were changed or added in cur
+// relative to prev, and the IDs of the peers that were removed.
+// Both prev and cur must be sorted by ID.
+func diffPeers(prev, cur []*tailcfg.Node) (changed []*tailcfg.Node, removed []tailcfg.NodeID) {
+	for len(prev) > 0 || len(cur) > 0 {
+		switch {
+		case len(cur) == 0 || (len(prev) > 0 && prev[0].ID < cur[0].ID):
+			removed = append(removed, prev[0].ID)
+			prev = prev[1:]
+		case len(prev) == 0 || cur[0].ID < prev[0].ID:
+			changed = append(changed, cur[0])
+			cur = cur[1:]
+		default:
+			if !prev[0].Equal(cur[0]) {
+				changed = append(changed, cur[0])
+			}
+			prev, cur = prev[1:], cur[1:]
+		}
+	}
+	return changed, removed
+}
+
+// MapResponse returns the full MapResponse (with all peers) that the
+// server would send to the node in req. It returns nil if the node
+// isn't registered.
+func (s *Server) MapResponse(req *tailcfg.MapRequest) (*tailcfg.MapResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.nodes[req.NodeKey]
+	if !ok {
+		return nil, nil
+	}
+	domain := s.Domain
+	if domain == "" {
+		domain = "example.com"
+	}
+	res := &tailcfg.MapResponse{
+		Node:         n.Clone(),
+		DERPMap:      s.DERPMap,
+		Domain:       domain,
+		PacketFilter: s.packetFilter,
+		UserProfiles: []tailcfg.UserProfile{{
+			ID:          User.ID,
+			LoginName:   User.LoginName,
+			DisplayName: User.DisplayName,
+		}},
+	}
+	if res.PacketFilter == nil {
+		res.PacketFilter = tailcfg.FilterAllowAll
+	}
+	for _, p := range s.nodes {
+		if p.ID == n.ID {
+			continue
+		}
+		p = p.Clone()
+		if !req.IncludeIPv6 {
+			p.Endpoints = filterIPv4Endpoints(p.Endpoints)
+		}
+		res.Peers = append(res.Peers, p)
+	}
+	sort.Slice(res.Peers, func(i, j int) bool { return res.Peers[i].ID < res.Peers[j].ID })
+	return res, nil
+}
+
+func filterIPv4Endpoints(eps []string) []string {
+	var ret []string
+	for _, ep := range eps {
+		if !strings.HasPrefix(ep, "[") {
+			ret = append(ret, ep)
+		}
+	}
+	return ret
+}
+
+// sendMapMsg writes res to w in the framing used by the map
+// long-poll: a little-endian uint32 length followed by the
+// (optionally compressed) encrypted JSON message.
+func (s *Server) sendMapMsg(w http.ResponseWriter, mkey tailcfg.MachineKey, enc *zstd.Encoder, res *tailcfg.MapResponse) error {
+	j, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	if enc != nil {
+		j = enc.EncodeAll(j, nil)
+	}
+	msg := s.encrypt(mkey, j)
+	var siz [4]byte
+	binary.LittleEndian.PutUint32(siz[:], uint32(len(msg)))
+	if _, err := w.Write(siz[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func (s *Server) writeResponse(w http.ResponseWriter, mkey tailcfg.MachineKey, v interface{}) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(200)
+	w.Write(s.encrypt(mkey, j))
+}
+
+// decode reads a nacl box-encrypted JSON message from the machine
+// with key mkey and unmarshals it into v.
+func (s *Server) decode(mkey tailcfg.MachineKey, r io.Reader, v interface{}) error {
+	msg, err := ioutil.ReadAll(io.LimitReader(r, 1<<20))
+	if err != nil {
+		return err
+	}
+	var nonce [24]byte
+	if len(msg) < len(nonce)+1 {
+		return errors.New("request missing nonce")
+	}
+	copy(nonce[:], msg)
+	msg = msg[len(nonce):]
+
+	priv := s.privateKey()
+	pub, pri := (*[32]byte)(&mkey), (*[32]byte)(&priv)
+	decrypted, ok := box.Open(nil, msg, &nonce, pub, pri)
+	if !ok {
+		return errors.New("can't decrypt request")
+	}
+	return json.NewDecoder(bytes.NewReader(decrypted)).Decode(v)
+}
+
+// encrypt seals msg for the machine with key mkey.
+func (s *Server) encrypt(mkey tailcfg.MachineKey, msg []byte) []byte {
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		panic(err)
+	}
+	priv := s.privateKey()
+	pub, pri := (*[32]byte)(&mkey), (*[32]byte)(&priv)
+	return box.Seal(nonce[:], msg, &nonce, pub, pri)
+}
+
+// WaitForNode blocks until a node with the given node key has
+// registered, or until ctx is done.
+func (s *Server) WaitForNode(ctx context.Context, nodeKey tailcfg.NodeKey) (*tailcfg.Node, error) {
+	for {
+		if n := s.Node(nodeKey); n != nil {
+			return n, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
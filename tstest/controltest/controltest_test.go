@@ -0,0 +1,196 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package controltest
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/tailcfg"
+)
+
+func newClient(t *testing.T, ts *httptest.Server, hostname string) *controlclient.Direct {
+	t.Helper()
+	hi := controlclient.NewHostinfo()
+	hi.Hostname = hostname
+	hi.BackendLogID = "test-" + hostname
+	c, err := controlclient.NewDirect(controlclient.Options{
+		ServerURL:      ts.URL,
+		Hostinfo:       hi,
+		Logf:           t.Logf,
+		HTTPTestClient: ts.Client(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	url, err := c.TryLogin(ctx, nil, controlclient.LoginDefault)
+	if err != nil {
+		t.Fatalf("%s: TryLogin: %v", hostname, err)
+	}
+	if url != "" {
+		t.Fatalf("%s: unexpected auth URL %q", hostname, url)
+	}
+	return c
+}
+
+func nodeKeyOf(c *controlclient.Direct) tailcfg.NodeKey {
+	return tailcfg.NodeKey(c.GetPersist().PrivateNodeKey.Public())
+}
+
+func TestLoginAndPoll(t *testing.T) {
+	s := &Server{Logf: t.Logf}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	c1 := newClient(t, ts, "one")
+	c2 := newClient(t, ts, "two")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var nm *controlclient.NetworkMap
+	if err := c1.PollNetMap(ctx, 1, func(m *controlclient.NetworkMap) { nm = m }); err != nil {
+		t.Fatalf("PollNetMap: %v", err)
+	}
+	if nm == nil {
+		t.Fatal("no netmap")
+	}
+	if nm.NodeKey != nodeKeyOf(c1) {
+		t.Errorf("NodeKey = %v; want %v", nm.NodeKey.ShortString(), nodeKeyOf(c1).ShortString())
+	}
+	if nm.MachineStatus != tailcfg.MachineAuthorized {
+		t.Errorf("MachineStatus = %v; want authorized", nm.MachineStatus)
+	}
+	if len(nm.Addresses) != 1 {
+		t.Errorf("Addresses = %v; want 1", nm.Addresses)
+	}
+	if len(nm.Peers) != 1 || nm.Peers[0].Key != nodeKeyOf(c2) {
+		t.Fatalf("Peers = %v; want just %v", nm.Peers, nodeKeyOf(c2).ShortString())
+	}
+	if got := nm.Peers[0].Name; got != "two" {
+		t.Errorf("peer name = %q; want %q", got, "two")
+	}
+}
+
+func TestStreamingDeltas(t *testing.T) {
+	s := &Server{Logf: t.Logf}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	c1 := newClient(t, ts, "one")
+	c2 := newClient(t, ts, "two")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	nms := make(chan *controlclient.NetworkMap, 10)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c1.PollNetMap(ctx, -1, func(nm *controlclient.NetworkMap) {
+			select {
+			case nms <- nm:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	next := func() *controlclient.NetworkMap {
+		t.Helper()
+		select {
+		case nm := <-nms:
+			return nm
+		case err := <-errc:
+			t.Fatalf("PollNetMap returned early: %v", err)
+		case <-ctx.Done():
+			t.Fatal("timeout waiting for netmap")
+		}
+		return nil
+	}
+
+	if nm := next(); len(nm.Peers) != 1 {
+		t.Fatalf("initial peers = %v; want 1", nm.Peers)
+	}
+
+	s.SetPacketFilter([]tailcfg.FilterRule{{
+		SrcIPs: []string{"100.64.0.2"},
+		DstPorts: []tailcfg.NetPortRange{{
+			IP:    "*",
+			Ports: tailcfg.PortRange{First: 22, Last: 22},
+		}},
+	}})
+	if nm := next(); len(nm.PacketFilter) != 1 || len(nm.Peers) != 1 {
+		t.Errorf("after SetPacketFilter: filter=%v, peers=%v", nm.PacketFilter, nm.Peers)
+	}
+
+	extra := &tailcfg.Node{Key: tailcfg.NodeKey{1: 1}, Name: "extra"}
+	s.AddNode(extra)
+	if nm := next(); len(nm.Peers) != 2 {
+		t.Errorf("after AddNode: peers = %v; want 2", nm.Peers)
+	}
+
+	if !s.RemoveNode(nodeKeyOf(c2)) {
+		t.Fatal("RemoveNode: node not found")
+	}
+	nm := next()
+	if len(nm.Peers) != 1 || nm.Peers[0].Name != "extra" {
+		t.Errorf("after RemoveNode: peers = %v; want just extra", nm.Peers)
+	}
+
+	if !s.AddRawMapResponse(nodeKeyOf(c1), &tailcfg.MapResponse{
+		PeersRemoved: []tailcfg.NodeID{extra.ID},
+	}) {
+		t.Fatal("AddRawMapResponse: node not streaming")
+	}
+	// The raw message follows a regular (unchanged) map response.
+	next()
+	if nm := next(); len(nm.Peers) != 0 {
+		t.Errorf("after raw PeersRemoved: peers = %v; want none", nm.Peers)
+	}
+
+	if !s.ExpireNodeKey(nodeKeyOf(c1)) {
+		t.Fatal("ExpireNodeKey: node not found")
+	}
+	if nm := next(); nm.Expiry.IsZero() || time.Until(nm.Expiry) > 0 {
+		t.Errorf("after ExpireNodeKey: Expiry = %v; want in the past", nm.Expiry)
+	}
+}
+
+func TestExpiredKeyRotation(t *testing.T) {
+	s := &Server{Logf: t.Logf}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	c := newClient(t, ts, "one")
+	oldKey := nodeKeyOf(c)
+	oldNode := s.Node(oldKey)
+	s.ExpireNodeKey(oldKey)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.PollNetMap(ctx, 1, func(*controlclient.NetworkMap) {}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.TryLogin(ctx, nil, controlclient.LoginDefault); err != nil {
+		t.Fatalf("TryLogin: %v", err)
+	}
+	newKey := nodeKeyOf(c)
+	if newKey == oldKey {
+		t.Fatal("node key wasn't rotated")
+	}
+	if s.Node(oldKey) != nil {
+		t.Error("old node key still registered")
+	}
+	n := s.Node(newKey)
+	if n == nil {
+		t.Fatal("new node key not registered")
+	}
+	if n.ID != oldNode.ID {
+		t.Errorf("node ID changed from %v to %v", oldNode.ID, n.ID)
+	}
+}
@@ -36,19 +36,21 @@ const (
 // 4-tuple ({src,dst} {ip,port}), some FirewallTypes will zero out
 // some fields, so in practice the key is either a 2-tuple (src only),
 // 3-tuple (src ip+port and dst ip) or 4-tuple (src+dst ip+port).
+// Sessions of different protocols are always distinct.
 type fwKey struct {
-	src netaddr.IPPort
-	dst netaddr.IPPort
+	proto Proto
+	src   netaddr.IPPort
+	dst   netaddr.IPPort
 }
 
-// key returns an fwKey for the given src and dst, trimmed according
-// to the FirewallType. fwKeys are always constructed from the
+// key returns an fwKey for the given proto, src and dst, trimmed
+// according to the FirewallType. fwKeys are always constructed from the
 // "outbound" point of view (i.e. src is the "trusted" side of the
 // world), it's the caller's responsibility to swap src and dst in the
 // call to key when processing packets inbound from the "untrusted"
 // world.
-func (s FirewallType) key(src, dst netaddr.IPPort) fwKey {
-	k := fwKey{src: src}
+func (s FirewallType) key(proto Proto, src, dst netaddr.IPPort) fwKey {
+	k := fwKey{proto: proto, src: src}
 	switch s {
 	case EndpointIndependentFirewall:
 	case AddressDependentFirewall:
@@ -112,7 +114,7 @@ func (f *Firewall) HandleOut(p *Packet, oif *Interface) *Packet {
 	defer f.mu.Unlock()
 	f.init()
 
-	k := f.Type.key(p.Src, p.Dst)
+	k := f.Type.key(p.Proto, p.Src, p.Dst)
 	f.seen[k] = f.timeNow().Add(f.sessionTimeoutLocked())
 	p.Trace("firewall out ok")
 	return p
@@ -125,7 +127,7 @@ func (f *Firewall) HandleIn(p *Packet, iif *Interface) *Packet {
 
 	// reverse src and dst because the session table is from the POV
 	// of outbound packets.
-	k := f.Type.key(p.Dst, p.Src)
+	k := f.Type.key(p.Proto, p.Dst, p.Src)
 	now := f.timeNow()
 	if now.After(f.seen[k]) {
 		p.Trace("firewall drop")
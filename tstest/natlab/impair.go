@@ -0,0 +1,207 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package natlab
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// An Impairment makes a link behave more like a real one: it delays,
+// loses, reorders and duplicates packets, and caps bandwidth. It can
+// be attached to a Network, where it affects every packet crossing
+// the network like a shared medium, or to an Interface with
+// SetImpairment, where it affects every packet the interface sends.
+//
+// The zero value impairs nothing. Fields must not be changed once
+// packets are flowing.
+type Impairment struct {
+	// Latency is the base one-way delay of every packet.
+	Latency time.Duration
+	// Jitter is the range of random extra delay added to Latency,
+	// uniformly distributed in [0, Jitter). Packets with different
+	// delays may arrive out of order, as on a real link.
+	Jitter time.Duration
+	// DelayFunc, if non-nil, returns the delay of each packet,
+	// instead of Latency and Jitter. It can be used to model other
+	// delay distributions, like NormalDelay.
+	DelayFunc func(r *rand.Rand) time.Duration
+
+	// Loss is the probability, in [0, 1], of each packet being lost.
+	Loss float64
+	// BurstLoss is the probability, in [0, 1], of each packet starting
+	// a burst of BurstLen lost packets.
+	BurstLoss float64
+	// BurstLen is the number of packets lost in a row, including the
+	// first, once a burst starts. If zero, DefaultBurstLen is used.
+	BurstLen int
+
+	// Reorder is the probability, in [0, 1], of each packet being
+	// held back an extra ReorderDelay, letting packets sent after it
+	// overtake it.
+	Reorder float64
+	// ReorderDelay is how long reordered packets are held back. If
+	// zero, DefaultReorderDelay is used.
+	ReorderDelay time.Duration
+
+	// Duplicate is the probability, in [0, 1], of each packet being
+	// delivered twice. The copy is delayed independently.
+	Duplicate float64
+
+	// Bandwidth is the link's capacity, in bytes of payload per
+	// second. Packets queue behind each other until the link can
+	// carry them. If zero, bandwidth is unlimited.
+	Bandwidth int
+
+	// Seed seeds the random decisions. The same Seed and the same
+	// sequence of packets yield the same losses, delays and
+	// duplicates, so tests are reproducible.
+	Seed int64
+
+	// TimeNow is a function returning the current time, which the
+	// Bandwidth limit is measured against. If nil, time.Now is used.
+	TimeNow func() time.Time
+
+	mu        sync.Mutex
+	rnd       *rand.Rand
+	burstLeft int       // packets left to lose in the current burst
+	busyUntil time.Time // when the link is done sending queued packets
+}
+
+// DefaultBurstLen is the default length of a loss burst.
+const DefaultBurstLen = 3
+
+// DefaultReorderDelay is the default extra delay of reordered
+// packets.
+const DefaultReorderDelay = 10 * time.Millisecond
+
+// NormalDelay returns an Impairment.DelayFunc for delays normally
+// distributed around mean, with standard deviation stddev. Negative
+// samples are treated as zero delay.
+func NormalDelay(mean, stddev time.Duration) func(*rand.Rand) time.Duration {
+	return func(r *rand.Rand) time.Duration {
+		d := mean + time.Duration(r.NormFloat64()*float64(stddev))
+		if d < 0 {
+			return 0
+		}
+		return d
+	}
+}
+
+func (im *Impairment) timeNow() time.Time {
+	if im.TimeNow != nil {
+		return im.TimeNow()
+	}
+	return time.Now()
+}
+
+func (im *Impairment) burstLen() int {
+	if im.BurstLen == 0 {
+		return DefaultBurstLen
+	}
+	return im.BurstLen
+}
+
+func (im *Impairment) reorderDelay() time.Duration {
+	if im.ReorderDelay == 0 {
+		return DefaultReorderDelay
+	}
+	return im.ReorderDelay
+}
+
+// chanceLocked reports true with probability prob.
+//
+// im.mu must be held.
+func (im *Impairment) chanceLocked(prob float64) bool {
+	return prob > 0 && im.rnd.Float64() < prob
+}
+
+// im.mu must be held.
+func (im *Impairment) delayLocked() time.Duration {
+	if im.DelayFunc != nil {
+		return im.DelayFunc(im.rnd)
+	}
+	d := im.Latency
+	if im.Jitter > 0 {
+		d += time.Duration(im.rnd.Int63n(int64(im.Jitter)))
+	}
+	return d
+}
+
+// delays decides the fate of p: it returns the delay before each
+// copy of p is delivered, which is empty if p is lost.
+func (im *Impairment) delays(p *Packet) []time.Duration {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	if im.rnd == nil {
+		im.rnd = rand.New(rand.NewSource(im.Seed))
+	}
+
+	if im.burstLeft > 0 {
+		im.burstLeft--
+		p.Trace("impairment: lost in burst")
+		return nil
+	}
+	if im.chanceLocked(im.BurstLoss) {
+		im.burstLeft = im.burstLen() - 1
+		p.Trace("impairment: lost, burst starts")
+		return nil
+	}
+	if im.chanceLocked(im.Loss) {
+		p.Trace("impairment: lost")
+		return nil
+	}
+
+	// Time spent waiting for, and then on, the link.
+	var queued time.Duration
+	if im.Bandwidth > 0 {
+		now := im.timeNow()
+		start := now
+		if im.busyUntil.After(now) {
+			start = im.busyUntil
+		}
+		im.busyUntil = start.Add(time.Duration(len(p.Payload)) * time.Second / time.Duration(im.Bandwidth))
+		queued = im.busyUntil.Sub(now)
+	}
+	d := queued + im.delayLocked()
+	if im.chanceLocked(im.Reorder) {
+		p.Trace("impairment: reordered")
+		d += im.reorderDelay()
+	}
+	ds := []time.Duration{d}
+	if im.chanceLocked(im.Duplicate) {
+		p.Trace("impairment: duplicated")
+		ds = append(ds, queued+im.delayLocked())
+	}
+	return ds
+}
+
+// apply calls deliver in a new goroutine with p, or copies of it,
+// after the delays im decides on. It doesn't call deliver if p is
+// lost. A nil im delivers p right away.
+func (im *Impairment) apply(p *Packet, deliver func(*Packet)) {
+	if im == nil {
+		go deliver(p)
+		return
+	}
+	ds := im.delays(p)
+	ps := make([]*Packet, len(ds))
+	for i := range ds {
+		if i == 0 {
+			ps[i] = p
+		} else {
+			ps[i] = p.Clone()
+		}
+	}
+	for i, d := range ds {
+		p := ps[i]
+		if d <= 0 {
+			go deliver(p)
+		} else {
+			time.AfterFunc(d, func() { deliver(p) })
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package natlab
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/tstest"
+)
+
+// fates returns whether each of n packets survives im.
+func fates(im *Impairment, n int) []bool {
+	ret := make([]bool, n)
+	for i := range ret {
+		ret[i] = len(im.delays(&Packet{Payload: make([]byte, 100)})) > 0
+	}
+	return ret
+}
+
+func TestImpairmentSeed(t *testing.T) {
+	newIm := func(seed int64) *Impairment {
+		return &Impairment{Loss: 0.2, BurstLoss: 0.05, Jitter: time.Millisecond, Seed: seed}
+	}
+	a, b, c := fates(newIm(1), 1000), fates(newIm(1), 1000), fates(newIm(2), 1000)
+	same := true
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("packet %d: fates differ with the same seed", i)
+		}
+		same = same && a[i] == c[i]
+	}
+	if same {
+		t.Errorf("fates are the same with different seeds")
+	}
+}
+
+func TestImpairmentLoss(t *testing.T) {
+	const n = 10000
+	lost := 0
+	for _, ok := range fates(&Impairment{Loss: 0.05, Seed: 1}, n) {
+		if !ok {
+			lost++
+		}
+	}
+	if lost < n*4/100 || lost > n*6/100 {
+		t.Errorf("lost %d of %d packets; want about 5%%", lost, n)
+	}
+}
+
+func TestImpairmentBurstLoss(t *testing.T) {
+	const burstLen = 4
+	run, runs := 0, 0
+	for _, ok := range fates(&Impairment{BurstLoss: 0.02, BurstLen: burstLen, Seed: 1}, 10000) {
+		if !ok {
+			run++
+			continue
+		}
+		if run > 0 {
+			runs++
+			if run%burstLen != 0 {
+				t.Errorf("lost %d packets in a row; want a multiple of %d", run, burstLen)
+			}
+		}
+		run = 0
+	}
+	if runs == 0 {
+		t.Errorf("no loss bursts")
+	}
+}
+
+func TestImpairmentDelays(t *testing.T) {
+	im := &Impairment{
+		Latency:   10 * time.Millisecond,
+		Jitter:    5 * time.Millisecond,
+		Duplicate: 0.5,
+		Seed:      1,
+	}
+	dups := 0
+	for i := 0; i < 1000; i++ {
+		ds := im.delays(&Packet{})
+		if len(ds) == 2 {
+			dups++
+		}
+		for _, d := range ds {
+			if d < im.Latency || d >= im.Latency+im.Jitter {
+				t.Fatalf("delay %v out of range [%v, %v)", d, im.Latency, im.Latency+im.Jitter)
+			}
+		}
+	}
+	if dups < 400 || dups > 600 {
+		t.Errorf("%d of 1000 packets duplicated; want about half", dups)
+	}
+
+	im = &Impairment{Reorder: 1, Seed: 1}
+	if ds := im.delays(&Packet{}); len(ds) != 1 || ds[0] != DefaultReorderDelay {
+		t.Errorf("reordered packet delays = %v; want [%v]", ds, DefaultReorderDelay)
+	}
+}
+
+func TestImpairmentBandwidth(t *testing.T) {
+	clock := &tstest.Clock{}
+	im := &Impairment{Bandwidth: 100000, Seed: 1, TimeNow: clock.Now} // 100 KB/s
+	var last time.Duration
+	for i := 0; i < 10; i++ {
+		ds := im.delays(&Packet{Payload: make([]byte, 1000)})
+		last = ds[0]
+	}
+	// 10 KB at 100 KB/s takes 100ms.
+	if last != 100*time.Millisecond {
+		t.Errorf("last packet delayed %v; want 100ms", last)
+	}
+
+	// Once the link has drained, packets go right through again.
+	clock.Advance(time.Second)
+	if ds := im.delays(&Packet{Payload: make([]byte, 1000)}); ds[0] != 10*time.Millisecond {
+		t.Errorf("packet on idle link delayed %v; want 10ms", ds[0])
+	}
+}
+
+// impairTestPair returns two machines on net, each listening on a
+// PacketConn.
+func impairTestPair(t *testing.T, net *Network) (fooIf *Interface, fooPC net.PacketConn, barAddr netaddr.IPPort, barPC net.PacketConn) {
+	foo := &Machine{Name: "foo"}
+	bar := &Machine{Name: "bar"}
+	fooIf = foo.Attach("eth0", net)
+	barIf := bar.Attach("eth0", net)
+
+	ctx := context.Background()
+	fooPC, err := foo.ListenPacket(ctx, "udp4", ":123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	barAddr = netaddr.IPPort{IP: barIf.V4(), Port: 456}
+	barPC, err = bar.ListenPacket(ctx, "udp4", barAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fooIf, fooPC, barAddr, barPC
+}
+
+// readWithin reads a packet from pc, or returns false if none arrives
+// within d.
+func readWithin(pc net.PacketConn, d time.Duration) bool {
+	got := make(chan bool, 1)
+	go func() {
+		_, _, err := pc.ReadFrom(make([]byte, 1500))
+		got <- err == nil
+	}()
+	select {
+	case ok := <-got:
+		return ok
+	case <-time.After(d):
+		pc.SetReadDeadline(time.Now().Add(-time.Second))
+		<-got
+		pc.SetReadDeadline(time.Time{})
+		return false
+	}
+}
+
+func TestNetworkImpairment(t *testing.T) {
+	internet := NewInternet()
+	internet.Impairment = &Impairment{Latency: 50 * time.Millisecond, Duplicate: 1}
+	_, fooPC, barAddr, barPC := impairTestPair(t, internet)
+
+	start := time.Now()
+	if _, err := fooPC.WriteTo([]byte("hello"), barAddr.UDPAddr()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if !readWithin(barPC, time.Second) {
+			t.Fatalf("copy %d of packet not received", i)
+		}
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("packets arrived after %v; want at least 50ms", d)
+	}
+	if readWithin(barPC, 100*time.Millisecond) {
+		t.Errorf("got a third copy of packet")
+	}
+}
+
+func TestInterfaceImpairment(t *testing.T) {
+	fooIf, fooPC, barAddr, barPC := impairTestPair(t, NewInternet())
+
+	fooIf.SetImpairment(&Impairment{Loss: 1})
+	if _, err := fooPC.WriteTo([]byte("hello"), barAddr.UDPAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if readWithin(barPC, 100*time.Millisecond) {
+		t.Errorf("packet received over lossy interface")
+	}
+
+	fooIf.SetImpairment(nil)
+	if _, err := fooPC.WriteTo([]byte("hello"), barAddr.UDPAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if !readWithin(barPC, time.Second) {
+		t.Errorf("packet not received after impairment removed")
+	}
+}
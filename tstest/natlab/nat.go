@@ -7,6 +7,7 @@ package natlab
 import (
 	"context"
 	"fmt"
+	"math/rand"
 	"net"
 	"sync"
 	"time"
@@ -16,6 +17,7 @@ import (
 
 // mapping is the state of an allocated NAT session.
 type mapping struct {
+	proto    Proto
 	lanSrc   netaddr.IPPort
 	lanDst   netaddr.IPPort
 	wanSrc   netaddr.IPPort
@@ -53,12 +55,14 @@ const (
 // 4-tuple ({src,dst} {ip,port}), some NATTypes will zero out some
 // fields, so in practice the key is either a 2-tuple (src only),
 // 3-tuple (src ip+port and dst ip) or 4-tuple (src+dst ip+port).
+// Sessions of different protocols are always distinct.
 type natKey struct {
+	proto    Proto
 	src, dst netaddr.IPPort
 }
 
-func (t NATType) key(src, dst netaddr.IPPort) natKey {
-	k := natKey{src: src}
+func (t NATType) key(proto Proto, src, dst netaddr.IPPort) natKey {
+	k := natKey{proto: proto, src: src}
 	switch t {
 	case EndpointIndependentNAT:
 	case AddressDependentNAT:
@@ -89,6 +93,25 @@ type SNAT44 struct {
 	// a session expires, the mapped port effectively "closes" to new
 	// traffic. If MappingTimeout is 0, DefaultMappingTimeout is used.
 	MappingTimeout time.Duration
+	// InboundRefresh is whether inbound traffic resets a session's
+	// lifetime to MappingTimeout, like outbound traffic does. RFC 4787
+	// leaves that up to the NAT, and many only count outbound traffic.
+	InboundRefresh bool
+	// PreservePorts is whether new mappings try to use the same WAN
+	// port as the LAN port they're for. If that port is taken, a
+	// random one is used, as when PreservePorts is false.
+	PreservePorts bool
+	// WANPorts, if non-zero, is the inclusive range of WAN ports that
+	// new mappings are allocated from, instead of Machine's
+	// ephemeral ports. Narrowing it makes mappings easier to guess.
+	WANPorts [2]uint16
+	// Hairpin is whether LAN hosts can reach each other through their
+	// WAN mappings. Packets from the LAN to a mapped WAN ip:port are
+	// translated back into the LAN, with their source translated to
+	// the sender's own mapping, as RFC 4787 section 6 describes.
+	// Otherwise, such packets are handled as if addressed to the
+	// NAT's own WAN address.
+	Hairpin bool
 	// Firewall is an optional packet handler that will be invoked as
 	// a firewall during NAT translation. The firewall always sees
 	// packets in their "LAN form", i.e. before translation in the
@@ -138,6 +161,11 @@ func (n *SNAT44) HandleOut(p *Packet, oif *Interface) *Packet {
 
 func (n *SNAT44) HandleIn(p *Packet, iif *Interface) *Packet {
 	if iif != n.ExternalInterface {
+		if n.Hairpin && p.Dst.IP == n.ExternalInterface.V4() && n.hairpin(p) {
+			// Like in the inbound case below, the packet is now to
+			// be forwarded, and HandleForward will see it again.
+			return p
+		}
 		// NAT can't apply, defer to firewall.
 		if n.Firewall != nil {
 			return n.Firewall.HandleIn(p, iif)
@@ -151,7 +179,7 @@ func (n *SNAT44) HandleIn(p *Packet, iif *Interface) *Packet {
 
 	now := n.timeNow()
 	mapping := n.byWAN[p.Dst]
-	if mapping == nil || now.After(mapping.deadline) {
+	if mapping == nil || mapping.proto != p.Proto || now.After(mapping.deadline) {
 		// NAT didn't hit, defer to firewall or allow in for local
 		// socket handling.
 		if n.Firewall != nil {
@@ -159,6 +187,9 @@ func (n *SNAT44) HandleIn(p *Packet, iif *Interface) *Packet {
 		}
 		return p
 	}
+	if n.InboundRefresh {
+		mapping.deadline = now.Add(n.mappingTimeout())
+	}
 
 	p.Dst = mapping.lanSrc
 	p.Trace("dnat to %v", p.Dst)
@@ -193,21 +224,7 @@ func (n *SNAT44) HandleForward(p *Packet, iif, oif *Interface) *Packet {
 		defer n.mu.Unlock()
 		n.initLocked()
 
-		k := n.Type.key(p.Src, p.Dst)
-		now := n.timeNow()
-		m := n.byLAN[k]
-		if m == nil || now.After(m.deadline) {
-			pc, wanAddr := n.allocateMappedPort()
-			m = &mapping{
-				lanSrc: p.Src,
-				lanDst: p.Dst,
-				wanSrc: wanAddr,
-				pc:     pc,
-			}
-			n.byLAN[k] = m
-			n.byWAN[wanAddr] = m
-		}
-		m.deadline = now.Add(n.mappingTimeout())
+		m := n.mappingLocked(p)
 		p.Src = m.wanSrc
 		p.Trace("snat from %v", p.Src)
 		return p
@@ -223,17 +240,81 @@ func (n *SNAT44) HandleForward(p *Packet, iif, oif *Interface) *Packet {
 		if n.Firewall != nil {
 			return n.Firewall.HandleForward(p, iif, oif)
 		}
+		if n.Hairpin && p.Src.IP == n.ExternalInterface.V4() {
+			// Already hairpinned by HandleIn.
+			return p
+		}
 		return nil
 	}
 }
 
-func (n *SNAT44) allocateMappedPort() (net.PacketConn, netaddr.IPPort) {
+// mappingLocked returns the mapping for the outbound packet p,
+// allocating a new one if needed, and refreshes its lifetime.
+//
+// n.mu must be held.
+func (n *SNAT44) mappingLocked(p *Packet) *mapping {
+	k := n.Type.key(p.Proto, p.Src, p.Dst)
+	now := n.timeNow()
+	m := n.byLAN[k]
+	if m == nil || now.After(m.deadline) {
+		pc, wanAddr := n.allocateMappedPort(p.Src.Port)
+		m = &mapping{
+			proto:  p.Proto,
+			lanSrc: p.Src,
+			lanDst: p.Dst,
+			wanSrc: wanAddr,
+			pc:     pc,
+		}
+		n.byLAN[k] = m
+		n.byWAN[wanAddr] = m
+	}
+	m.deadline = now.Add(n.mappingTimeout())
+	return m
+}
+
+// hairpin translates p, sent from the LAN to the WAN ip:port of a
+// mapping, to go to that mapping's LAN ip:port instead. It reports
+// whether p matched a mapping.
+func (n *SNAT44) hairpin(p *Packet) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.initLocked()
+
+	to := n.byWAN[p.Dst]
+	if to == nil || to.proto != p.Proto || n.timeNow().After(to.deadline) {
+		return false
+	}
+	from := n.mappingLocked(p)
+	p.Src = from.wanSrc
+	p.Dst = to.lanSrc
+	p.Trace("hairpin to %v", p.Dst)
+	return true
+}
+
+// allocateMappedPort reserves a WAN port for a new mapping from
+// lanPort.
+func (n *SNAT44) allocateMappedPort(lanPort uint16) (net.PacketConn, netaddr.IPPort) {
 	// Clean up old entries before trying to allocate, to free up any
 	// expired ports.
 	n.gc()
 
 	ip := n.ExternalInterface.V4()
-	pc, err := n.Machine.ListenPacket(context.Background(), "udp", net.JoinHostPort(ip.String(), "0"))
+	var pc net.PacketConn
+	var err error
+	inRange := n.WANPorts[1] == 0 || lanPort >= n.WANPorts[0] && lanPort <= n.WANPorts[1]
+	if n.PreservePorts && inRange {
+		pc, err = n.Machine.ListenPacket(context.Background(), "udp", net.JoinHostPort(ip.String(), fmt.Sprint(lanPort)))
+	}
+	if pc == nil && n.WANPorts[1] != 0 {
+		lo, size := int(n.WANPorts[0]), int(n.WANPorts[1]-n.WANPorts[0])+1
+		start := rand.Intn(size)
+		for i := 0; i < size && pc == nil; i++ {
+			port := lo + (start+i)%size
+			pc, err = n.Machine.ListenPacket(context.Background(), "udp", net.JoinHostPort(ip.String(), fmt.Sprint(port)))
+		}
+	} else if pc == nil {
+		pc, err = n.Machine.ListenPacket(context.Background(), "udp", net.JoinHostPort(ip.String(), "0"))
+	}
 	if err != nil {
 		panic(fmt.Sprintf("ran out of NAT ports: %v", err))
 	}
@@ -251,7 +332,7 @@ func (n *SNAT44) gc() {
 			continue
 		}
 		m.pc.Close()
-		delete(n.byLAN, n.Type.key(m.lanSrc, m.lanDst))
+		delete(n.byLAN, n.Type.key(m.proto, m.lanSrc, m.lanDst))
 		delete(n.byWAN, m.wanSrc)
 	}
 }
@@ -31,20 +31,51 @@ import (
 
 var traceOn, _ = strconv.ParseBool(os.Getenv("NATLAB_TRACE"))
 
-// Packet represents a UDP packet flowing through the virtual network.
+// Proto is the transport protocol of a Packet.
+type Proto uint8
+
+const (
+	// UDP is the protocol of packets sent by PacketConns.
+	UDP Proto = iota
+	// TCP is the protocol of stream segments, see Machine.Dial.
+	TCP
+)
+
+func (p Proto) String() string {
+	switch p {
+	case UDP:
+		return "udp"
+	case TCP:
+		return "tcp"
+	default:
+		return fmt.Sprintf("<unknown proto %d>", p)
+	}
+}
+
+// Packet represents a UDP packet or TCP segment flowing through the
+// virtual network.
 type Packet struct {
 	Src, Dst netaddr.IPPort
 	Payload  []byte
 
+	// Proto is the packet's transport protocol. The zero value is UDP.
+	Proto Proto
+	// Flags, Seq and Ack are the header of a TCP segment. They're
+	// unused for UDP.
+	Flags    TCPFlags
+	Seq, Ack uint32
+
 	// Prefix set by various internal methods of natlab, to locate
 	// where in the network a trace occured.
 	locator string
 }
 
-// Equivalent returns true if Src, Dst and Payload are the same in p
-// and p2.
+// Equivalent returns true if the headers and Payload are the same in
+// p and p2.
 func (p *Packet) Equivalent(p2 *Packet) bool {
-	return p.Src == p2.Src && p.Dst == p2.Dst && bytes.Equal(p.Payload, p2.Payload)
+	return p.Src == p2.Src && p.Dst == p2.Dst && p.Proto == p2.Proto &&
+		p.Flags == p2.Flags && p.Seq == p2.Seq && p.Ack == p2.Ack &&
+		bytes.Equal(p.Payload, p2.Payload)
 }
 
 // Clone returns a copy of p that shares nothing with p.
@@ -53,6 +84,10 @@ func (p *Packet) Clone() *Packet {
 		Src:     p.Src,
 		Dst:     p.Dst,
 		Payload: append([]byte(nil), p.Payload...),
+		Proto:   p.Proto,
+		Flags:   p.Flags,
+		Seq:     p.Seq,
+		Ack:     p.Ack,
 		locator: p.locator,
 	}
 }
@@ -73,9 +108,9 @@ func (p *Packet) Trace(msg string, args ...interface{}) {
 	if !traceOn {
 		return
 	}
-	allArgs := []interface{}{p.short(), p.locator, p.Src, p.Dst}
+	allArgs := []interface{}{p.short(), p.locator, p.Proto, p.Src, p.Dst}
 	allArgs = append(allArgs, args...)
-	fmt.Fprintf(os.Stderr, "[%s]%s src=%s dst=%s "+msg+"\n", allArgs...)
+	fmt.Fprintf(os.Stderr, "[%s]%s %s src=%s dst=%s "+msg+"\n", allArgs...)
 }
 
 func (p *Packet) setLocator(msg string, args ...interface{}) {
@@ -105,6 +140,16 @@ type Network struct {
 	Prefix4 netaddr.IPPrefix
 	Prefix6 netaddr.IPPrefix
 
+	// Impairment, if non-nil, impairs every packet crossing the
+	// network. It must be set before traffic starts flowing.
+	Impairment *Impairment
+
+	// Pcap, if non-nil, captures every packet crossing the network
+	// as it enters the network, so packets the network's Impairment
+	// loses are still captured. It must be set before traffic
+	// starts flowing.
+	Pcap *PcapWriter
+
 	mu        sync.Mutex
 	machine   map[netaddr.IP]*Interface
 	defaultGW *Interface // optional
@@ -178,35 +223,42 @@ func addOne(a *[16]byte, index int) {
 	}
 }
 
-func (n *Network) write(p *Packet) (num int, err error) {
-	p.setLocator("net=%s", n.Name)
-
+// route returns the interface that packets to ip are delivered to on
+// n, or nil if there's no route to ip.
+func (n *Network) route(ip netaddr.IP) *Interface {
 	n.mu.Lock()
 	defer n.mu.Unlock()
-	iface, ok := n.machine[p.Dst.IP]
-	if !ok {
-		// If the destination is within the network's authoritative
-		// range, no route to host.
-		if p.Dst.IP.Is4() && n.Prefix4.Contains(p.Dst.IP) {
-			p.Trace("no route to %v", p.Dst.IP)
-			return len(p.Payload), nil
-		}
-		if p.Dst.IP.Is6() && n.Prefix6.Contains(p.Dst.IP) {
-			p.Trace("no route to %v", p.Dst.IP)
-			return len(p.Payload), nil
-		}
+	if iface, ok := n.machine[ip]; ok {
+		return iface
+	}
+	// If the destination is within the network's authoritative
+	// range, no route to host.
+	if ip.Is4() && n.Prefix4.Contains(ip) {
+		return nil
+	}
+	if ip.Is6() && n.Prefix6.Contains(ip) {
+		return nil
+	}
+	return n.defaultGW
+}
 
-		if n.defaultGW == nil {
-			p.Trace("no route to %v", p.Dst.IP)
-			return len(p.Payload), nil
-		}
-		iface = n.defaultGW
+// write sends p, sent by from, across n.
+func (n *Network) write(p *Packet, from *Interface) (num int, err error) {
+	p.setLocator("net=%s", n.Name)
+
+	iface := n.route(p.Dst.IP)
+	n.Pcap.capture(p, from, iface)
+	if iface == nil {
+		p.Trace("no route to %v", p.Dst.IP)
+		return len(p.Payload), nil
 	}
 
 	// Pretend it went across the network. Make a copy so nobody
 	// can later mess with caller's memory.
 	p.Trace("-> mach=%s if=%s", iface.machine.Name, iface.name)
-	go iface.machine.deliverIncomingPacket(p, iface)
+	n.Impairment.apply(p, func(p *Packet) {
+		iface.machine.deliverIncomingPacket(p, iface)
+	})
 	return len(p.Payload), nil
 }
 
@@ -215,6 +267,9 @@ type Interface struct {
 	net     *Network
 	name    string       // optional
 	ips     []netaddr.IP // static; not mutated once created
+
+	impairment *Impairment // guarded by machine.mu
+	linkType   LinkType    // in packet captures; guarded by machine.mu
 }
 
 func (f *Interface) Machine() *Machine {
@@ -225,6 +280,27 @@ func (f *Interface) Network() *Network {
 	return f.net
 }
 
+// SetImpairment sets the impairment of packets sent on f, or removes
+// it if im is nil. To impair both directions of a link, impair the
+// interfaces at both ends, or their Network.
+func (f *Interface) SetImpairment(im *Impairment) {
+	f.machine.mu.Lock()
+	defer f.machine.mu.Unlock()
+	f.impairment = im
+}
+
+// transmit sends p onto f's network, after f's impairment.
+func (f *Interface) transmit(p *Packet) {
+	f.machine.mu.Lock()
+	im := f.impairment
+	f.machine.mu.Unlock()
+	if im == nil {
+		f.net.write(p, f)
+		return
+	}
+	im.apply(p, func(p *Packet) { f.net.write(p, f) })
+}
+
 // V4 returns the machine's first IPv4 address, or the zero value if none.
 func (f *Interface) V4() netaddr.IP { return f.pickIP(netaddr.IP.Is4) }
 
@@ -345,6 +421,10 @@ type Machine struct {
 
 	conns4 map[netaddr.IPPort]*conn // conns that want IPv4 packets
 	conns6 map[netaddr.IPPort]*conn // conns that want IPv6 packets
+
+	listeners   map[netaddr.IPPort]*listener // stream listeners, by local ip:port
+	streams     map[streamKey]*streamConn    // open streams
+	streamPorts map[uint16]int               // refcount of local ports used by streams
 }
 
 func (m *Machine) isLocalIP(ip netaddr.IP) bool {
@@ -387,6 +467,11 @@ func (m *Machine) deliverLocalPacket(p *Packet, iface *Interface) {
 		}
 	}
 
+	if p.Proto == TCP {
+		m.deliverSegment(p)
+		return
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -442,7 +527,7 @@ func (m *Machine) forwardPacket(p *Packet, iif *Interface) {
 	}
 
 	p.Trace("-> net=%s oif=%s", oif.net.Name, oif)
-	oif.net.write(p)
+	oif.transmit(p)
 }
 
 func unspecOf(ip netaddr.IP) netaddr.IP {
@@ -561,7 +646,8 @@ func (m *Machine) writePacket(p *Packet) (n int, err error) {
 	}
 
 	p.Trace("-> net=%s if=%s", iface.net.Name, iface)
-	return iface.net.write(p)
+	iface.transmit(p)
+	return len(p.Payload), nil
 }
 
 func (m *Machine) interfaceForIP(ip netaddr.IP) (*Interface, error) {
@@ -611,7 +697,7 @@ func (m *Machine) portInUseLocked(port uint16) bool {
 			return true
 		}
 	}
-	return false
+	return m.streamPorts[port] > 0
 }
 
 func (m *Machine) registerConn4(c *conn) error {
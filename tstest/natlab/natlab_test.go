@@ -507,3 +507,129 @@ func testNAT(t *testing.T, n *SNAT44, lanIf, wanIf *Interface, tests []natTest)
 		}
 	}
 }
+
+// newTestNAT returns a NAT machine between a LAN and the internet,
+// and its interfaces.
+func newTestNAT() (m *Machine, lanIf, wanIf *Interface) {
+	internet := NewInternet()
+	lan := &Network{
+		Name:    "LAN",
+		Prefix4: mustPrefix("192.168.0.0/24"),
+	}
+	m = &Machine{Name: "NAT"}
+	wanIf = m.Attach("wan", internet)
+	lanIf = m.Attach("lan", lan)
+	return m, lanIf, wanIf
+}
+
+func TestNATPreservePorts(t *testing.T) {
+	m, lanIf, wanIf := newTestNAT()
+	n := &SNAT44{
+		Machine:           m,
+		ExternalInterface: wanIf,
+		Type:              AddressAndPortDependentNAT,
+		PreservePorts:     true,
+	}
+
+	p := n.HandleForward(&Packet{Src: ipp("192.168.0.20:1234"), Dst: ipp("2.2.2.2:5678")}, lanIf, wanIf)
+	if want := (netaddr.IPPort{IP: wanIf.V4(), Port: 1234}); p.Src != want {
+		t.Errorf("first mapping is %v; want %v", p.Src, want)
+	}
+	// The port's taken now, so the next mapping gets another.
+	p = n.HandleForward(&Packet{Src: ipp("192.168.0.20:1234"), Dst: ipp("7.7.7.7:5678")}, lanIf, wanIf)
+	if p.Src.Port == 1234 {
+		t.Errorf("second mapping is %v; want a different port", p.Src)
+	}
+}
+
+func TestNATWANPorts(t *testing.T) {
+	m, lanIf, wanIf := newTestNAT()
+	n := &SNAT44{
+		Machine:           m,
+		ExternalInterface: wanIf,
+		Type:              AddressAndPortDependentNAT,
+		PreservePorts:     true,
+		WANPorts:          [2]uint16{40000, 40001},
+	}
+
+	seen := map[uint16]bool{}
+	for _, dst := range []string{"2.2.2.2:5678", "7.7.7.7:5678"} {
+		p := n.HandleForward(&Packet{Src: ipp("192.168.0.20:1234"), Dst: ipp(dst)}, lanIf, wanIf)
+		if p.Src.Port < 40000 || p.Src.Port > 40001 || seen[p.Src.Port] {
+			t.Errorf("mapping to %v is %v; want an unused port in 40000-40001", dst, p.Src)
+		}
+		seen[p.Src.Port] = true
+	}
+}
+
+func TestNATHairpin(t *testing.T) {
+	for _, hairpin := range []bool{false, true} {
+		t.Run(fmt.Sprintf("hairpin_%v", hairpin), func(t *testing.T) {
+			m, lanIf, wanIf := newTestNAT()
+			n := &SNAT44{
+				Machine:           m,
+				ExternalInterface: wanIf,
+				Hairpin:           hairpin,
+			}
+			a := ipp("192.168.0.20:1234")
+			b := ipp("192.168.0.30:2345")
+			aWAN := n.HandleForward(&Packet{Src: a, Dst: ipp("2.2.2.2:5678")}, lanIf, wanIf).Src
+
+			// b sends to a's mapping.
+			p := n.HandleIn(&Packet{Src: b, Dst: aWAN}, lanIf)
+			if !hairpin {
+				if p == nil || p.Dst != aWAN {
+					t.Errorf("packet to %v translated to %v without hairpinning", aWAN, p)
+				}
+				return
+			}
+			if p == nil {
+				t.Fatal("hairpin packet dropped")
+			}
+			if p.Dst != a {
+				t.Errorf("hairpin packet to %v; want %v", p.Dst, a)
+			}
+			if p.Src.IP != wanIf.V4() {
+				t.Errorf("hairpin packet from %v; want from %v", p.Src, wanIf.V4())
+			}
+			if n.HandleForward(p, lanIf, lanIf) == nil {
+				t.Errorf("hairpin packet not forwarded")
+			}
+		})
+	}
+}
+
+func TestNATMappingTimeout(t *testing.T) {
+	for _, refresh := range []bool{false, true} {
+		t.Run(fmt.Sprintf("inbound_refresh_%v", refresh), func(t *testing.T) {
+			m, lanIf, wanIf := newTestNAT()
+			clock := &tstest.Clock{}
+			n := &SNAT44{
+				Machine:           m,
+				ExternalInterface: wanIf,
+				MappingTimeout:    10 * time.Second,
+				InboundRefresh:    refresh,
+				TimeNow:           clock.Now,
+			}
+			lan := ipp("192.168.0.20:1234")
+			server := ipp("2.2.2.2:5678")
+			wan := n.HandleForward(&Packet{Src: lan, Dst: server}, lanIf, wanIf).Src
+
+			// Keep receiving for longer than the timeout.
+			for i := 0; i < 3; i++ {
+				clock.Advance(6 * time.Second)
+				p := n.HandleIn(&Packet{Src: server, Dst: wan}, wanIf)
+				gotIn := p != nil && p.Dst == lan
+				if wantIn := refresh || i == 0; gotIn != wantIn {
+					t.Errorf("after %v, packet got in = %v; want %v", time.Duration(i+1)*6*time.Second, gotIn, wantIn)
+				}
+			}
+
+			// Once expired, the mapping is replaced.
+			clock.Advance(time.Minute)
+			if got := n.HandleForward(&Packet{Src: lan, Dst: server}, lanIf, wanIf).Src; got == wan {
+				t.Errorf("mapping %v reused after expiring", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package natlab
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// LinkType is the link-layer header type of an Interface in a packet
+// capture, as registered at https://www.tcpdump.org/linktypes.html.
+type LinkType uint16
+
+const (
+	// LinkTypeRaw captures bare IPv4 and IPv6 packets. It's the
+	// default.
+	LinkTypeRaw LinkType = 101
+	// LinkTypeEthernet captures Ethernet frames, with MAC addresses
+	// derived from the names of the sending and receiving
+	// interfaces.
+	LinkTypeEthernet LinkType = 1
+)
+
+// pcapng block types and option codes.
+const (
+	pcapngSectionHeader    = 0x0a0d0d0a
+	pcapngInterfaceDesc    = 1
+	pcapngEnhancedPacket   = 6
+	pcapngByteOrderMagic   = 0x1a2b3c4d
+	pcapngOptEnd           = 0
+	pcapngOptIfName        = 2
+	pcapngOptIfDescription = 3
+	pcapngSnapLen          = 262144
+)
+
+// A PcapWriter writes the packets crossing Networks to a pcapng file,
+// which Wireshark and tcpdump can read. Set it as the Pcap of one or
+// more Networks to capture them all in the same file.
+//
+// natlab packets have no IP headers, so PcapWriter synthesizes IPv4
+// or IPv6 headers, and UDP or TCP headers, around each payload. Each
+// sending Interface is recorded as its own interface in the capture,
+// with the LinkType set by Interface.SetLinkType.
+type PcapWriter struct {
+	mu   sync.Mutex
+	w    io.Writer
+	ifID map[*Interface]uint32 // capture interface ID of each sender
+	err  error                 // first write error, if any
+}
+
+// NewPcapWriter returns a PcapWriter that writes a pcapng capture to
+// w. The caller is responsible for closing w once no more packets
+// are flowing.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	pw := &PcapWriter{
+		w:    w,
+		ifID: map[*Interface]uint32{},
+	}
+	var b []byte
+	b = appendUint32(b, pcapngByteOrderMagic)
+	b = appendUint16(b, 1) // major version
+	b = appendUint16(b, 0) // minor version
+	b = appendUint32(b, 0xffffffff)
+	b = appendUint32(b, 0xffffffff) // section length: unknown
+	if err := pw.writeBlock(pcapngSectionHeader, b); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// Err returns the first error encountered writing packets, if any.
+func (pw *PcapWriter) Err() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	return pw.err
+}
+
+// capture writes p, sent by from and routed to to, to pw. to is nil
+// if p has nowhere to go. A nil pw captures nothing.
+func (pw *PcapWriter) capture(p *Packet, from, to *Interface) {
+	if pw == nil || from == nil {
+		return
+	}
+	now := time.Now()
+	from.machine.mu.Lock()
+	lt := from.linkType
+	from.machine.mu.Unlock()
+	if lt == 0 {
+		lt = LinkTypeRaw
+	}
+
+	data := p.ipPacket()
+	if lt == LinkTypeEthernet {
+		dst := [6]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+		if to != nil {
+			dst = to.mac()
+		}
+		src := from.mac()
+		etherType := uint16(0x0800)
+		if p.Src.IP.Is6() {
+			etherType = 0x86dd
+		}
+		frame := make([]byte, 0, 14+len(data))
+		frame = append(frame, dst[:]...)
+		frame = append(frame, src[:]...)
+		frame = appendUint16(frame, etherType)
+		data = append(frame, data...)
+	}
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.err != nil {
+		return
+	}
+	id, ok := pw.ifID[from]
+	if !ok {
+		id = uint32(len(pw.ifID))
+		pw.ifID[from] = id
+		if pw.err = pw.writeInterfaceDesc(from, lt); pw.err != nil {
+			return
+		}
+	}
+
+	us := uint64(now.UnixNano() / int64(time.Microsecond))
+	var b []byte
+	b = appendUint32(b, id)
+	b = appendUint32(b, uint32(us>>32))
+	b = appendUint32(b, uint32(us))
+	b = appendUint32(b, uint32(len(data))) // captured length
+	b = appendUint32(b, uint32(len(data))) // original length
+	b = appendPadded(b, data)
+	pw.err = pw.writeBlock(pcapngEnhancedPacket, b)
+}
+
+// writeInterfaceDesc describes f, whose link type is lt, in the
+// capture. Later packets refer to it by the order it was written in.
+//
+// pw.mu must be held.
+func (pw *PcapWriter) writeInterfaceDesc(f *Interface, lt LinkType) error {
+	var b []byte
+	b = appendUint16(b, uint16(lt))
+	b = appendUint16(b, 0) // reserved
+	b = appendUint32(b, pcapngSnapLen)
+	b = appendOption(b, pcapngOptIfName, fmt.Sprintf("%s/%s", f.machine.Name, f))
+	b = appendOption(b, pcapngOptIfDescription, "net="+f.net.Name)
+	b = appendUint32(b, pcapngOptEnd) // opt_endofopt: code and length 0
+	return pw.writeBlock(pcapngInterfaceDesc, b)
+}
+
+// writeBlock writes a pcapng block of type typ with body b, which
+// must be padded to 32 bits.
+func (pw *PcapWriter) writeBlock(typ uint32, body []byte) error {
+	n := uint32(12 + len(body))
+	b := make([]byte, 0, n)
+	b = appendUint32(b, typ)
+	b = appendUint32(b, n)
+	b = append(b, body...)
+	b = appendUint32(b, n)
+	_, err := pw.w.Write(b)
+	return err
+}
+
+// SetLinkType sets the link-layer header type of packets sent on f
+// in packet captures. It must be set before f sends its first
+// captured packet.
+func (f *Interface) SetLinkType(lt LinkType) {
+	f.machine.mu.Lock()
+	defer f.machine.mu.Unlock()
+	f.linkType = lt
+}
+
+// mac returns a locally administered MAC address for f, derived from
+// its machine, interface and network names so that it's stable
+// across runs.
+func (f *Interface) mac() [6]byte {
+	s := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%s", f.machine.Name, f, f.net.Name)))
+	var mac [6]byte
+	copy(mac[:], s[:])
+	mac[0] = 0x02 // locally administered, unicast
+	return mac
+}
+
+// IP protocol numbers.
+const (
+	ipProtoTCP = 6
+	ipProtoUDP = 17
+)
+
+// ipPacket returns p as an IPv4 or IPv6 packet, with a synthesized
+// IP header and UDP or TCP header in front of its payload.
+func (p *Packet) ipPacket() []byte {
+	var l4 []byte
+	proto := uint8(ipProtoUDP)
+	switch p.Proto {
+	case TCP:
+		proto = ipProtoTCP
+		l4 = appendUint16(l4, p.Src.Port)
+		l4 = appendUint16(l4, p.Dst.Port)
+		l4 = appendUint32(l4, p.Seq)
+		l4 = appendUint32(l4, p.Ack)
+		l4 = append(l4, 5<<4, tcpHeaderFlags(p.Flags)) // data offset 5 words
+		l4 = appendUint16(l4, 0xffff)                  // window
+		l4 = appendUint16(l4, 0)                       // checksum
+		l4 = appendUint16(l4, 0)                       // urgent pointer
+	default:
+		l4 = appendUint16(l4, p.Src.Port)
+		l4 = appendUint16(l4, p.Dst.Port)
+		l4 = appendUint16(l4, uint16(8+len(p.Payload)))
+		l4 = appendUint16(l4, 0) // checksum
+	}
+	l4 = append(l4, p.Payload...)
+
+	var ip, pseudo []byte
+	if p.Src.IP.Is4() {
+		src, dst := p.Src.IP.As4(), p.Dst.IP.As4()
+		ip = append(ip, 0x45, 0) // version 4, 5 words; DSCP
+		ip = appendUint16(ip, uint16(20+len(l4)))
+		ip = appendUint16(ip, 0)      // ID
+		ip = appendUint16(ip, 0x4000) // don't fragment
+		ip = append(ip, 64, proto)    // TTL, protocol
+		ip = appendUint16(ip, 0)      // checksum
+		ip = append(ip, src[:]...)
+		ip = append(ip, dst[:]...)
+		binary.BigEndian.PutUint16(ip[10:], checksum(ip))
+
+		pseudo = append(pseudo, src[:]...)
+		pseudo = append(pseudo, dst[:]...)
+		pseudo = append(pseudo, 0, proto)
+		pseudo = appendUint16(pseudo, uint16(len(l4)))
+	} else {
+		src, dst := p.Src.IP.As16(), p.Dst.IP.As16()
+		ip = appendUint32(ip, 6<<28) // version 6, no traffic class or flow label
+		ip = appendUint16(ip, uint16(len(l4)))
+		ip = append(ip, proto, 64) // next header, hop limit
+		ip = append(ip, src[:]...)
+		ip = append(ip, dst[:]...)
+
+		pseudo = append(pseudo, src[:]...)
+		pseudo = append(pseudo, dst[:]...)
+		pseudo = appendUint32(pseudo, uint32(len(l4)))
+		pseudo = appendUint32(pseudo, uint32(proto))
+	}
+
+	sumOff := 6 // UDP
+	if p.Proto == TCP {
+		sumOff = 16
+	}
+	sum := checksum(append(pseudo, l4...))
+	if sum == 0 && p.Proto != TCP {
+		sum = 0xffff // zero means no checksum in UDP
+	}
+	binary.BigEndian.PutUint16(l4[sumOff:], sum)
+	return append(ip, l4...)
+}
+
+// tcpHeaderFlags returns f as the flags byte of a real TCP header.
+func tcpHeaderFlags(f TCPFlags) uint8 {
+	var b uint8
+	if f&FlagFIN != 0 {
+		b |= 0x01
+	}
+	if f&FlagSYN != 0 {
+		b |= 0x02
+	}
+	if f&FlagRST != 0 {
+		b |= 0x04
+	}
+	if f&FlagACK != 0 {
+		b |= 0x10
+	}
+	return b
+}
+
+// checksum returns the Internet checksum (RFC 1071) of b.
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for len(b) >= 2 {
+		sum += uint32(b[0])<<8 | uint32(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint32(b[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// appendOption appends a pcapng option with a string value.
+func appendOption(b []byte, code uint16, v string) []byte {
+	b = appendUint16(b, code)
+	b = appendUint16(b, uint16(len(v)))
+	return appendPadded(b, []byte(v))
+}
+
+// appendPadded appends v to b, zero padded to 32 bits.
+func appendPadded(b, v []byte) []byte {
+	b = append(b, v...)
+	for n := len(v); n%4 != 0; n++ {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// appendUint16 and appendUint32 append big endian integers. Captures
+// are written in big endian too, which the byte order magic in the
+// section header tells readers.
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
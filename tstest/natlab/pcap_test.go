@@ -0,0 +1,187 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package natlab
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+type pcapBlock struct {
+	typ  uint32
+	body []byte
+}
+
+// readPcapBlocks splits a pcapng capture into its blocks.
+func readPcapBlocks(t *testing.T, b []byte) []pcapBlock {
+	var ret []pcapBlock
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated block: %x", b)
+		}
+		n := binary.BigEndian.Uint32(b[4:])
+		if n < 12 || int(n) > len(b) || n%4 != 0 || binary.BigEndian.Uint32(b[n-4:]) != n {
+			t.Fatalf("bad block length %d", n)
+		}
+		ret = append(ret, pcapBlock{binary.BigEndian.Uint32(b), b[8 : n-4]})
+		b = b[n:]
+	}
+	return ret
+}
+
+// checkIPv4 checks that ip is a valid IPv4 UDP packet from src to dst
+// carrying payload.
+func checkIPv4(t *testing.T, ip []byte, src, dst netaddr.IPPort, payload string) {
+	t.Helper()
+	if len(ip) != 20+8+len(payload) {
+		t.Fatalf("packet length %d; want %d", len(ip), 20+8+len(payload))
+	}
+	if checksum(ip[:20]) != 0 {
+		t.Errorf("bad IP header checksum")
+	}
+	if ip[9] != ipProtoUDP {
+		t.Errorf("protocol = %d; want UDP", ip[9])
+	}
+	gotSrc := netaddr.IPPort{IP: netaddr.IPv4(ip[12], ip[13], ip[14], ip[15]), Port: binary.BigEndian.Uint16(ip[20:])}
+	gotDst := netaddr.IPPort{IP: netaddr.IPv4(ip[16], ip[17], ip[18], ip[19]), Port: binary.BigEndian.Uint16(ip[22:])}
+	if gotSrc != src || gotDst != dst {
+		t.Errorf("packet is %v -> %v; want %v -> %v", gotSrc, gotDst, src, dst)
+	}
+	pseudo := append([]byte(nil), ip[12:20]...)
+	pseudo = append(pseudo, 0, ipProtoUDP, 0, byte(len(ip)-20))
+	if checksum(append(pseudo, ip[20:]...)) != 0 {
+		t.Errorf("bad UDP checksum")
+	}
+	if got := string(ip[28:]); got != payload {
+		t.Errorf("payload = %q; want %q", got, payload)
+	}
+}
+
+func TestPcap(t *testing.T) {
+	var buf bytes.Buffer
+	pw, err := NewPcapWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	internet := NewInternet()
+	internet.Pcap = pw
+	foo := &Machine{Name: "foo"}
+	bar := &Machine{Name: "bar"}
+	fooIf := foo.Attach("eth0", internet)
+	barIf := bar.Attach("eth0", internet)
+	barIf.SetLinkType(LinkTypeEthernet)
+
+	ctx := context.Background()
+	fooAddr := netaddr.IPPort{IP: fooIf.V4(), Port: 123}
+	barAddr := netaddr.IPPort{IP: barIf.V4(), Port: 456}
+	fooPC, err := foo.ListenPacket(ctx, "udp4", fooAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	barPC, err := bar.ListenPacket(ctx, "udp4", barAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fooPC.WriteTo([]byte("hello"), barAddr.UDPAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if !readWithin(barPC, time.Second) {
+		t.Fatal("hello not received")
+	}
+	if _, err := barPC.WriteTo([]byte("world"), fooAddr.UDPAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if !readWithin(fooPC, time.Second) {
+		t.Fatal("world not received")
+	}
+	if err := pw.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := readPcapBlocks(t, buf.Bytes())
+	wantTypes := []uint32{pcapngSectionHeader, pcapngInterfaceDesc, pcapngEnhancedPacket, pcapngInterfaceDesc, pcapngEnhancedPacket}
+	if len(blocks) != len(wantTypes) {
+		t.Fatalf("got %d blocks; want %d", len(blocks), len(wantTypes))
+	}
+	for i, b := range blocks {
+		if b.typ != wantTypes[i] {
+			t.Fatalf("block %d has type %#x; want %#x", i, b.typ, wantTypes[i])
+		}
+	}
+	if got := binary.BigEndian.Uint32(blocks[0].body); got != pcapngByteOrderMagic {
+		t.Errorf("byte order magic = %#x", got)
+	}
+
+	for i, want := range []struct {
+		lt   LinkType
+		name string
+	}{
+		{LinkTypeRaw, "foo/eth0"},
+		{LinkTypeEthernet, "bar/eth0"},
+	} {
+		idb := blocks[1+2*i].body
+		if got := LinkType(binary.BigEndian.Uint16(idb)); got != want.lt {
+			t.Errorf("interface %d link type = %d; want %d", i, got, want.lt)
+		}
+		if !bytes.Contains(idb, []byte(want.name)) {
+			t.Errorf("interface %d isn't named %q", i, want.name)
+		}
+		epb := blocks[2+2*i].body
+		if id := binary.BigEndian.Uint32(epb); id != uint32(i) {
+			t.Errorf("packet %d is on interface %d; want %d", i, id, i)
+		}
+	}
+
+	epb := blocks[2].body
+	data := epb[20 : 20+binary.BigEndian.Uint32(epb[12:])]
+	checkIPv4(t, data, fooAddr, barAddr, "hello")
+
+	epb = blocks[4].body
+	data = epb[20 : 20+binary.BigEndian.Uint32(epb[12:])]
+	fooMAC, barMAC := fooIf.mac(), barIf.mac()
+	if !bytes.Equal(data[:6], fooMAC[:]) || !bytes.Equal(data[6:12], barMAC[:]) {
+		t.Errorf("Ethernet addresses are %x -> %x; want %x -> %x", data[6:12], data[:6], barMAC, fooMAC)
+	}
+	if et := binary.BigEndian.Uint16(data[12:]); et != 0x0800 {
+		t.Errorf("EtherType = %#x; want IPv4", et)
+	}
+	checkIPv4(t, data[14:], barAddr, fooAddr, "world")
+}
+
+func TestPcapTCP6(t *testing.T) {
+	p := &Packet{
+		Src:     netaddr.IPPort{IP: netaddr.IPFrom16([16]byte{0x11, 0x11, 15: 1}), Port: 1000},
+		Dst:     netaddr.IPPort{IP: netaddr.IPFrom16([16]byte{0x11, 0x11, 15: 2}), Port: 80},
+		Payload: []byte("abc"),
+		Proto:   TCP,
+		Flags:   FlagSYN | FlagACK,
+		Seq:     1,
+		Ack:     2,
+	}
+	ip := p.ipPacket()
+	if len(ip) != 40+20+3 {
+		t.Fatalf("packet length %d; want %d", len(ip), 40+20+3)
+	}
+	if ip[0]>>4 != 6 || ip[6] != ipProtoTCP {
+		t.Errorf("version %d, next header %d; want IPv6 TCP", ip[0]>>4, ip[6])
+	}
+	tcp := ip[40:]
+	if seq, ack := binary.BigEndian.Uint32(tcp[4:]), binary.BigEndian.Uint32(tcp[8:]); seq != 1 || ack != 2 {
+		t.Errorf("seq, ack = %d, %d; want 1, 2", seq, ack)
+	}
+	if tcp[13] != 0x12 {
+		t.Errorf("TCP flags = %#x; want SYN|ACK (0x12)", tcp[13])
+	}
+	pseudo := append([]byte(nil), ip[8:40]...)
+	pseudo = append(pseudo, 0, 0, 0, byte(len(tcp)), 0, 0, 0, ipProtoTCP)
+	if checksum(append(pseudo, tcp...)) != 0 {
+		t.Errorf("bad TCP checksum")
+	}
+}
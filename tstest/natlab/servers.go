@@ -0,0 +1,151 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package natlab
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	"inet.af/netaddr"
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+// STUNServer is a STUN server running on a Machine.
+type STUNServer struct {
+	pc   net.PacketConn
+	addr netaddr.IPPort
+	done chan struct{}
+}
+
+// ServeSTUN runs a STUN server on m, on its address ip and a random
+// port, until it's closed.
+func ServeSTUN(m *Machine, ip netaddr.IP) (*STUNServer, error) {
+	network := "udp4"
+	if ip.Is6() {
+		network = "udp6"
+	}
+	pc, err := m.ListenPacket(context.Background(), network, net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return nil, err
+	}
+	s := &STUNServer{
+		pc:   pc,
+		addr: netaddr.IPPort{IP: ip, Port: uint16(pc.LocalAddr().(*net.UDPAddr).Port)},
+		done: make(chan struct{}),
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *STUNServer) serve() {
+	defer close(s.done)
+	buf := make([]byte, 64<<10)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		txid, err := stun.ParseBindingRequest(buf[:n])
+		if err != nil {
+			continue
+		}
+		ua := addr.(*net.UDPAddr)
+		s.pc.WriteTo(stun.Response(txid, ua.IP, uint16(ua.Port)), addr)
+	}
+}
+
+// Addr returns the address the STUN server is listening on.
+func (s *STUNServer) Addr() netaddr.IPPort { return s.addr }
+
+// Close stops the STUN server.
+func (s *STUNServer) Close() error {
+	err := s.pc.Close()
+	<-s.done
+	return err
+}
+
+// DERPServer is a DERP relay running on a Machine, serving the DERP
+// protocol over HTTPS, with a STUN server alongside it.
+type DERPServer struct {
+	Server *derp.Server
+	HTTPS  *httptest.Server
+	STUN   *STUNServer
+
+	ip netaddr.IP
+}
+
+// ServeDERP runs a new DERP relay and STUN server on m, on its
+// address ip, until it's closed.
+//
+// Clients reach it with derphttp.Client.DialContext set to the Dial
+// method of their own Machine, using a DERPMap made with Node.
+func ServeDERP(logf logger.Logf, m *Machine, ip netaddr.IP) (*DERPServer, error) {
+	network := "tcp4"
+	if ip.Is6() {
+		network = "tcp6"
+	}
+	ln, err := m.Listen(network, net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return nil, err
+	}
+	st, err := ServeSTUN(m, ip)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	s := derp.NewServer(key.NewPrivate(), logf)
+	hs := httptest.NewUnstartedServer(derphttp.Handler(s))
+	hs.Listener.Close()
+	hs.Listener = ln
+	hs.Config.ErrorLog = logger.StdLogger(logf)
+	// DERP needs HTTP/1.1 for its connection upgrade.
+	hs.Config.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	hs.StartTLS()
+
+	return &DERPServer{
+		Server: s,
+		HTTPS:  hs,
+		STUN:   st,
+		ip:     ip,
+	}, nil
+}
+
+// Node returns a DERPNode describing s, for use in a DERPMap.
+func (s *DERPServer) Node(regionID int, name string) *tailcfg.DERPNode {
+	n := &tailcfg.DERPNode{
+		Name:         name,
+		RegionID:     regionID,
+		HostName:     fmt.Sprintf("%s.natlab.invalid", name),
+		IPv4:         "none",
+		IPv6:         "none",
+		STUNPort:     int(s.STUN.Addr().Port),
+		STUNTestIP:   s.ip.String(),
+		DERPTestPort: s.HTTPS.Listener.Addr().(*net.TCPAddr).Port,
+	}
+	if s.ip.Is4() {
+		n.IPv4 = s.ip.String()
+	} else {
+		n.IPv6 = s.ip.String()
+	}
+	return n
+}
+
+// Close stops the DERP relay and its STUN server.
+func (s *DERPServer) Close() error {
+	s.HTTPS.CloseClientConnections()
+	s.HTTPS.Close()
+	s.Server.Close()
+	return s.STUN.Close()
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package natlab
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func TestServeSTUN(t *testing.T) {
+	internet := NewInternet()
+	sm := &Machine{Name: "stun"}
+	cm := &Machine{Name: "client"}
+	sif := sm.Attach("eth0", internet)
+	cif := cm.Attach("eth0", internet)
+
+	s, err := ServeSTUN(sm, sif.V4())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	pc, err := cm.ListenPacket(context.Background(), "udp4", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	txid := stun.NewTxID()
+	if _, err := pc.WriteTo(stun.Request(txid), s.Addr().UDPAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotTxID, addr, port, err := stun.ParseResponse(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotTxID != txid {
+		t.Errorf("txid = %x; want %x", gotTxID, txid)
+	}
+	wantPort := pc.LocalAddr().(*net.UDPAddr).Port
+	if !net.IP(addr).Equal(cif.V4().IPAddr().IP) || int(port) != wantPort {
+		t.Errorf("STUN says we're %v:%v; want %v:%v", net.IP(addr), port, cif.V4(), wantPort)
+	}
+}
+
+func TestServeDERP(t *testing.T) {
+	internet := NewInternet()
+	dm := &Machine{Name: "derp"}
+	m1 := &Machine{Name: "m1"}
+	m2 := &Machine{Name: "m2"}
+	dif := dm.Attach("eth0", internet)
+	m1.Attach("eth0", internet)
+	m2.Attach("eth0", internet)
+
+	ds, err := ServeDERP(t.Logf, dm, dif.V4())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	region := &tailcfg.DERPRegion{
+		RegionID: 1,
+		Nodes:    []*tailcfg.DERPNode{ds.Node(1, "1a")},
+	}
+
+	newClient := func(m *Machine) (*derphttp.Client, key.Public) {
+		k := key.NewPrivate()
+		c := derphttp.NewRegionClient(k, t.Logf, func() *tailcfg.DERPRegion { return region })
+		c.DialContext = m.Dial
+		if err := c.Connect(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return c, k.Public()
+	}
+	c1, _ := newClient(m1)
+	defer c1.Close()
+	c2, k2 := newClient(m2)
+	defer c2.Close()
+
+	recvc := make(chan derp.ReceivedPacket, 1)
+	go func() {
+		for {
+			m, err := c2.Recv()
+			if err != nil {
+				return
+			}
+			if p, ok := m.(derp.ReceivedPacket); ok {
+				recvc <- p
+				return
+			}
+		}
+	}()
+	// c2 may not be registered with the server yet, so keep sending
+	// until the packet gets through.
+	deadline := time.After(5 * time.Second)
+	for {
+		if err := c1.Send(k2, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case p := <-recvc:
+			if string(p.Data) != "hello" {
+				t.Errorf("got %q; want %q", p.Data, "hello")
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("packet not relayed")
+		}
+	}
+}
@@ -0,0 +1,822 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package natlab
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+// Streams are natlab's stand-in for TCP: reliable, ordered
+// connections between Machines, made with Machine.Listen and
+// Machine.Dial.
+//
+// A stream is carried by Packets with Proto TCP, which go through the
+// same routing, PacketHandlers, Firewalls, NATs and Impairments as
+// UDP packets do. It's a much simplified TCP: segments are numbered
+// and acknowledged, and lost segments are retransmitted until the
+// stream times out, but there's no congestion control, no receive
+// window and no half-close.
+
+// TCPFlags are the control bits of a TCP segment.
+type TCPFlags uint8
+
+const (
+	FlagSYN TCPFlags = 1 << iota // opens a stream
+	FlagACK                      // Ack is valid
+	FlagFIN                      // sender is done sending
+	FlagRST                      // stream is refused or aborted
+)
+
+func (f TCPFlags) String() string {
+	var s []string
+	for _, v := range []struct {
+		flag TCPFlags
+		name string
+	}{{FlagSYN, "SYN"}, {FlagACK, "ACK"}, {FlagFIN, "FIN"}, {FlagRST, "RST"}} {
+		if f&v.flag != 0 {
+			s = append(s, v.name)
+		}
+	}
+	return strings.Join(s, "|")
+}
+
+const (
+	// streamMSS is the largest payload of a stream segment.
+	streamMSS = 1200
+	// streamWindow is how many bytes a stream may have unacknowledged
+	// before writes block.
+	streamWindow = 64 << 10
+	// streamMaxOOO is how many out-of-order segments a stream buffers
+	// while waiting for a missing one.
+	streamMaxOOO = 128
+	// streamInitialRTO is the initial retransmission timeout, which
+	// doubles at each retransmission, up to streamMaxRTO.
+	streamInitialRTO = 200 * time.Millisecond
+	streamMaxRTO     = 2 * time.Second
+	// streamTimeout is how long a stream keeps retransmitting without
+	// getting an acknowledgement before giving up.
+	streamTimeout = 10 * time.Second
+	// listenBacklog is how many streams a listener holds for Accept.
+	// SYNs beyond that are dropped, and retransmitted by the dialer.
+	listenBacklog = 16
+)
+
+var (
+	errRefused  = errors.New("connection refused")
+	errReset    = errors.New("connection reset by peer")
+	errTimedOut = errors.New("connection timed out")
+	errClosed   = errors.New("use of closed network connection") // same text as the net package
+)
+
+// timeoutError is returned by stream reads and writes that exceed
+// their deadline.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// segLen returns how much sequence space p uses. SYN and FIN use one
+// each, like in TCP.
+func segLen(p *Packet) uint32 {
+	n := uint32(len(p.Payload))
+	if p.Flags&FlagSYN != 0 {
+		n++
+	}
+	if p.Flags&FlagFIN != 0 {
+		n++
+	}
+	return n
+}
+
+// seqLT reports whether sequence number a is before b, allowing for
+// wraparound.
+func seqLT(a, b uint32) bool { return int32(a-b) < 0 }
+
+// parseStreamAddr parses a "tcp", "tcp4" or "tcp6" address to listen
+// on or dial, returning the unspecified address of the network's
+// family if address has no host.
+func parseStreamAddr(network, address string) (netaddr.IPPort, error) {
+	var ip netaddr.IP
+	switch network {
+	case "tcp":
+		ip = v6unspec
+	case "tcp4":
+		ip = v4unspec
+	case "tcp6":
+		ip = v6unspec
+	default:
+		return netaddr.IPPort{}, fmt.Errorf("unsupported network type %q", network)
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return netaddr.IPPort{}, err
+	}
+	if host != "" {
+		ip, err = netaddr.ParseIP(host)
+		if err != nil {
+			return netaddr.IPPort{}, err
+		}
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return netaddr.IPPort{}, err
+	}
+	return netaddr.IPPort{IP: ip, Port: uint16(port)}, nil
+}
+
+// Listen announces on the local Machine address for stream
+// connections, like net.Listen. The network must be "tcp", "tcp4" or
+// "tcp6".
+func (m *Machine) Listen(network, address string) (net.Listener, error) {
+	ipp, err := parseStreamAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if ipp.Port == 0 {
+		if ipp.Port, err = m.pickEphemPort(); err != nil {
+			return nil, err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.listeners[ipp]; ok {
+		return nil, fmt.Errorf("duplicate listener on %v", ipp)
+	}
+	ln := &listener{
+		m:      m,
+		ipp:    ipp,
+		connc:  make(chan *streamConn, listenBacklog),
+		closed: make(chan struct{}),
+	}
+	if m.listeners == nil {
+		m.listeners = map[netaddr.IPPort]*listener{}
+	}
+	m.listeners[ipp] = ln
+	m.useStreamPortLocked(ipp.Port)
+	return ln, nil
+}
+
+// useStreamPortLocked notes that a stream uses port.
+//
+// m.mu must be held.
+func (m *Machine) useStreamPortLocked(port uint16) {
+	if m.streamPorts == nil {
+		m.streamPorts = map[uint16]int{}
+	}
+	m.streamPorts[port]++
+}
+
+// releaseStreamPortLocked notes that a stream no longer uses port.
+//
+// m.mu must be held.
+func (m *Machine) releaseStreamPortLocked(port uint16) {
+	if m.streamPorts[port]--; m.streamPorts[port] <= 0 {
+		delete(m.streamPorts, port)
+	}
+}
+
+// listenerFor returns the listener accepting streams to dst, if any.
+func (m *Machine) listenerFor(dst netaddr.IPPort) *listener {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, ipp := range []netaddr.IPPort{
+		dst,
+		{IP: v6unspec, Port: dst.Port},
+		{IP: unspecOf(dst.IP), Port: dst.Port},
+	} {
+		if ln, ok := m.listeners[ipp]; ok {
+			return ln
+		}
+	}
+	return nil
+}
+
+// Dial connects to address over the simulated networks, like
+// net.Dialer.DialContext. The network must be "tcp", "tcp4" or
+// "tcp6", and the address's host must be an IP address.
+func (m *Machine) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	dst, err := parseStreamAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if dst.IP == v4unspec || dst.IP == v6unspec {
+		return nil, fmt.Errorf("dial %v: no host", address)
+	}
+	oif, err := m.interfaceForIP(dst.IP)
+	if err != nil {
+		return nil, fmt.Errorf("dial %v: %v", dst, err)
+	}
+	srcIP := oif.V4()
+	if dst.IP.Is6() {
+		srcIP = oif.V6()
+	}
+	if srcIP.IsZero() {
+		return nil, fmt.Errorf("dial %v: no matching address for address family", dst)
+	}
+	srcPort, err := m.pickEphemPort()
+	if err != nil {
+		return nil, err
+	}
+
+	c := newStreamConn(m, netaddr.IPPort{IP: srcIP, Port: srcPort}, dst)
+	c.ownPort = true
+	m.mu.Lock()
+	if m.streams == nil {
+		m.streams = map[streamKey]*streamConn{}
+	}
+	m.streams[c.key()] = c
+	m.useStreamPortLocked(srcPort)
+	m.mu.Unlock()
+
+	// Wake up the wait below if ctx is done first.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.mu.Lock()
+			c.cond.Broadcast()
+			c.mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.sendLocked(FlagSYN, nil); err != nil {
+		c.failLocked(err)
+		return nil, fmt.Errorf("dial %v: %v", dst, err)
+	}
+	for !c.established && c.err == nil && ctx.Err() == nil {
+		c.cond.Wait()
+	}
+	switch {
+	case c.established:
+		return c, nil
+	case c.err != nil:
+		return nil, fmt.Errorf("dial %v: %v", dst, c.err)
+	default:
+		c.failLocked(ctx.Err())
+		return nil, ctx.Err()
+	}
+}
+
+// deliverSegment delivers a TCP segment addressed to m to its stream,
+// or to a listener if it opens a new stream.
+func (m *Machine) deliverSegment(p *Packet) {
+	m.mu.Lock()
+	c := m.streams[streamKey{local: p.Dst, remote: p.Src}]
+	m.mu.Unlock()
+	if c != nil {
+		c.handleSegment(p)
+		return
+	}
+	if p.Flags&FlagRST != 0 || segLen(p) == 0 {
+		// Don't answer resets, or late acknowledgements for a stream
+		// we've finished.
+		p.Trace("dropped, no stream")
+		return
+	}
+	if p.Flags == FlagSYN {
+		if ln := m.listenerFor(p.Dst); ln != nil {
+			ln.handleSYN(p)
+			return
+		}
+	}
+	p.Trace("no stream or listener, resetting")
+	m.sendReset(p)
+}
+
+// sendReset answers p with a RST.
+func (m *Machine) sendReset(p *Packet) {
+	m.writePacket(&Packet{
+		Proto: TCP,
+		Src:   p.Dst,
+		Dst:   p.Src,
+		Flags: FlagRST | FlagACK,
+		Seq:   p.Ack,
+		Ack:   p.Seq + segLen(p),
+	})
+}
+
+// listener is our net.Listener implementation.
+type listener struct {
+	m   *Machine
+	ipp netaddr.IPPort
+
+	connc  chan *streamConn
+	closed chan struct{}
+
+	mu       sync.Mutex
+	isClosed bool
+}
+
+// handleSYN opens a new stream for the SYN p, and queues it for
+// Accept.
+func (ln *listener) handleSYN(p *Packet) {
+	c := newStreamConn(ln.m, p.Dst, p.Src)
+	c.established = true
+	c.rcvNxt = p.Seq + 1
+
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if ln.isClosed {
+		ln.m.sendReset(p)
+		return
+	}
+	if len(ln.connc) == cap(ln.connc) {
+		p.Trace("dropped, listen backlog full")
+		return
+	}
+
+	ln.m.mu.Lock()
+	if ln.m.streams == nil {
+		ln.m.streams = map[streamKey]*streamConn{}
+	}
+	ln.m.streams[c.key()] = c
+	ln.m.mu.Unlock()
+
+	c.mu.Lock()
+	c.sendLocked(FlagSYN|FlagACK, nil)
+	c.mu.Unlock()
+	ln.connc <- c
+}
+
+func (ln *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ln.connc:
+		return c, nil
+	case <-ln.closed:
+		return nil, errClosed
+	}
+}
+
+func (ln *listener) Close() error {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if ln.isClosed {
+		return nil
+	}
+	ln.isClosed = true
+	close(ln.closed)
+
+	ln.m.mu.Lock()
+	delete(ln.m.listeners, ln.ipp)
+	ln.m.releaseStreamPortLocked(ln.ipp.Port)
+	ln.m.mu.Unlock()
+
+	// Reset the streams nobody accepted.
+	for {
+		select {
+		case c := <-ln.connc:
+			c.reset()
+		default:
+			return nil
+		}
+	}
+}
+
+func (ln *listener) Addr() net.Addr {
+	return &net.TCPAddr{IP: ln.ipp.IP.IPAddr().IP, Port: int(ln.ipp.Port)}
+}
+
+// streamKey identifies a stream on a Machine.
+type streamKey struct {
+	local, remote netaddr.IPPort
+}
+
+// streamConn is our net.Conn implementation, one end of a stream.
+type streamConn struct {
+	m       *Machine
+	local   netaddr.IPPort
+	remote  netaddr.IPPort
+	ownPort bool // local port was reserved by Dial
+
+	mu            sync.Mutex
+	cond          *sync.Cond // broadcast on any state change
+	established   bool
+	closed        bool  // Close was called
+	err           error // if non-nil, the stream is dead
+	unregistered  bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	deadlineTimer *time.Timer // wakes blocked reads and writes at the next deadline; nil until one is set
+
+	// Sending side.
+	sndNxt       uint32    // sequence number of the next segment
+	unacked      []*Packet // sent segments not yet acknowledged, in order
+	rto          time.Duration
+	rtxTimer     *time.Timer // non-nil while unacked is non-empty
+	lastProgress time.Time   // when unacked last shrank or started filling
+
+	// Receiving side.
+	rcvNxt  uint32             // sequence number expected next
+	ooo     map[uint32]*Packet // out-of-order segments, by Seq
+	rbuf    []byte             // received data not yet read
+	finRcvd bool
+}
+
+func newStreamConn(m *Machine, local, remote netaddr.IPPort) *streamConn {
+	c := &streamConn{
+		m:      m,
+		local:  local,
+		remote: remote,
+		rto:    streamInitialRTO,
+		ooo:    map[uint32]*Packet{},
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *streamConn) key() streamKey {
+	return streamKey{local: c.local, remote: c.remote}
+}
+
+// sendLocked sends a new segment with flags and payload, and keeps it
+// for retransmission until it's acknowledged.
+//
+// c.mu must be held.
+func (c *streamConn) sendLocked(flags TCPFlags, payload []byte) error {
+	p := &Packet{
+		Proto:   TCP,
+		Src:     c.local,
+		Dst:     c.remote,
+		Flags:   flags,
+		Seq:     c.sndNxt,
+		Payload: append([]byte(nil), payload...),
+	}
+	c.sndNxt += segLen(p)
+	if len(c.unacked) == 0 {
+		c.lastProgress = time.Now()
+		c.rtxTimer = time.AfterFunc(c.rto, c.retransmit)
+	}
+	c.unacked = append(c.unacked, p)
+	return c.transmitLocked(p)
+}
+
+// transmitLocked puts a copy of p on the network, acknowledging
+// everything received so far.
+//
+// c.mu must be held.
+func (c *streamConn) transmitLocked(p *Packet) error {
+	p = p.Clone()
+	if c.established {
+		p.Flags |= FlagACK
+		p.Ack = c.rcvNxt
+	}
+	_, err := c.m.writePacket(p)
+	return err
+}
+
+// sendAckLocked sends a bare acknowledgement.
+//
+// c.mu must be held.
+func (c *streamConn) sendAckLocked() {
+	c.transmitLocked(&Packet{
+		Proto: TCP,
+		Src:   c.local,
+		Dst:   c.remote,
+		Seq:   c.sndNxt,
+	})
+}
+
+// retransmit resends all unacknowledged segments, when the
+// retransmission timer fires.
+func (c *streamConn) retransmit() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil || len(c.unacked) == 0 {
+		return
+	}
+	if time.Since(c.lastProgress) > streamTimeout {
+		c.failLocked(errTimedOut)
+		return
+	}
+	for _, p := range c.unacked {
+		p.Trace("retransmit")
+		c.transmitLocked(p)
+	}
+	if c.rto *= 2; c.rto > streamMaxRTO {
+		c.rto = streamMaxRTO
+	}
+	c.rtxTimer = time.AfterFunc(c.rto, c.retransmit)
+}
+
+// handleSegment processes a segment received for c.
+func (c *streamConn) handleSegment(p *Packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+
+	if p.Flags&FlagRST != 0 {
+		p.Trace("stream reset")
+		if c.established {
+			c.failLocked(errReset)
+		} else {
+			c.failLocked(errRefused)
+		}
+		return
+	}
+	if !c.established {
+		// We dialed and are waiting for the SYN-ACK.
+		if p.Flags&(FlagSYN|FlagACK) != FlagSYN|FlagACK || p.Ack != c.sndNxt {
+			p.Trace("dropped, stream not established")
+			return
+		}
+		c.established = true
+		c.rcvNxt = p.Seq + 1
+		c.ackLocked(p.Ack)
+		c.sendAckLocked()
+		return
+	}
+
+	if p.Flags&FlagACK != 0 {
+		c.ackLocked(p.Ack)
+	}
+	if p.Flags&FlagSYN != 0 {
+		// A retransmitted SYN or SYN-ACK: our answer to it got lost.
+		c.sendAckLocked()
+		return
+	}
+	if segLen(p) > 0 {
+		c.receiveLocked(p)
+		c.sendAckLocked()
+	}
+	c.maybeFinishLocked()
+}
+
+// ackLocked drops the segments that ack acknowledges from the
+// retransmission queue.
+//
+// c.mu must be held.
+func (c *streamConn) ackLocked(ack uint32) {
+	n := 0
+	for n < len(c.unacked) {
+		p := c.unacked[n]
+		if seqLT(ack, p.Seq+segLen(p)) {
+			break
+		}
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	c.unacked = c.unacked[n:]
+	c.rto = streamInitialRTO
+	c.lastProgress = time.Now()
+	if c.rtxTimer != nil {
+		c.rtxTimer.Stop()
+	}
+	if len(c.unacked) > 0 {
+		c.rtxTimer = time.AfterFunc(c.rto, c.retransmit)
+	} else {
+		c.rtxTimer = nil
+	}
+	c.cond.Broadcast()
+}
+
+// receiveLocked takes in the data of p, and of any buffered segments
+// that p makes in-order.
+//
+// c.mu must be held.
+func (c *streamConn) receiveLocked(p *Packet) {
+	if seqLT(p.Seq, c.rcvNxt) {
+		p.Trace("duplicate segment")
+		return
+	}
+	if p.Seq != c.rcvNxt {
+		if len(c.ooo) < streamMaxOOO {
+			p.Trace("out of order segment, buffered")
+			c.ooo[p.Seq] = p
+		}
+		return
+	}
+	for p != nil {
+		delete(c.ooo, p.Seq)
+		c.rbuf = append(c.rbuf, p.Payload...)
+		c.rcvNxt += segLen(p)
+		if p.Flags&FlagFIN != 0 {
+			c.finRcvd = true
+		}
+		p = c.ooo[c.rcvNxt]
+	}
+	c.cond.Broadcast()
+}
+
+// maybeFinishLocked forgets the stream once it's been closed and
+// everything it sent is acknowledged.
+//
+// c.mu must be held.
+func (c *streamConn) maybeFinishLocked() {
+	if c.closed && len(c.unacked) == 0 {
+		c.unregisterLocked()
+	}
+}
+
+// failLocked kills the stream with err.
+//
+// c.mu must be held.
+func (c *streamConn) failLocked(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.unregisterLocked()
+	c.cond.Broadcast()
+}
+
+// unregisterLocked removes c from its Machine, so it gets no more
+// segments.
+//
+// c.mu must be held.
+func (c *streamConn) unregisterLocked() {
+	if c.unregistered {
+		return
+	}
+	c.unregistered = true
+	if c.rtxTimer != nil {
+		c.rtxTimer.Stop()
+		c.rtxTimer = nil
+	}
+	c.m.mu.Lock()
+	defer c.m.mu.Unlock()
+	delete(c.m.streams, c.key())
+	if c.ownPort {
+		c.m.releaseStreamPortLocked(c.local.Port)
+	}
+}
+
+// reset aborts the stream, telling the peer.
+func (c *streamConn) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.transmitLocked(&Packet{
+		Proto: TCP,
+		Src:   c.local,
+		Dst:   c.remote,
+		Flags: FlagRST,
+		Seq:   c.sndNxt,
+	})
+	c.failLocked(errClosed)
+}
+
+// deadlinePassed reports whether the deadline t is set and passed.
+func deadlinePassed(t time.Time) bool {
+	return !t.IsZero() && !time.Now().Before(t)
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.rbuf) == 0 && !c.finRcvd && c.err == nil && !c.closed && !deadlinePassed(c.readDeadline) {
+		c.cond.Wait()
+	}
+	switch {
+	case c.closed:
+		return 0, errClosed
+	case len(c.rbuf) > 0:
+		n := copy(b, c.rbuf)
+		c.rbuf = c.rbuf[n:]
+		return n, nil
+	case c.finRcvd:
+		return 0, io.EOF
+	case c.err != nil:
+		return 0, c.err
+	default:
+		return 0, timeoutError{}
+	}
+}
+
+func (c *streamConn) Write(b []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(b) > 0 {
+		for c.err == nil && !c.closed && !deadlinePassed(c.writeDeadline) && c.inFlightLocked() >= streamWindow {
+			c.cond.Wait()
+		}
+		switch {
+		case c.closed:
+			return n, errClosed
+		case c.err != nil:
+			return n, c.err
+		case deadlinePassed(c.writeDeadline):
+			return n, timeoutError{}
+		}
+		chunk := b
+		if len(chunk) > streamMSS {
+			chunk = chunk[:streamMSS]
+		}
+		c.sendLocked(0, chunk)
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// inFlightLocked returns how many bytes are sent and unacknowledged.
+//
+// c.mu must be held.
+func (c *streamConn) inFlightLocked() uint32 {
+	if len(c.unacked) == 0 {
+		return 0
+	}
+	return c.sndNxt - c.unacked[0].Seq
+}
+
+// Close closes the stream, sending a FIN after any data still
+// unacknowledged.
+func (c *streamConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.err == nil {
+		c.sendLocked(FlagFIN, nil)
+	}
+	c.maybeFinishLocked()
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: c.local.IP.IPAddr().IP, Port: int(c.local.Port)}
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: c.remote.IP.IPAddr().IP, Port: int(c.remote.Port)}
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.resetDeadlineTimerLocked()
+	return nil
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.resetDeadlineTimerLocked()
+	return nil
+}
+
+// resetDeadlineTimerLocked wakes up blocked reads and writes now,
+// and sets c.deadlineTimer to wake them again at the earliest
+// deadline still in the future, so they can check their deadlines.
+//
+// c.mu must be held.
+func (c *streamConn) resetDeadlineTimerLocked() {
+	c.cond.Broadcast()
+	now := time.Now()
+	var next time.Time
+	for _, t := range []time.Time{c.readDeadline, c.writeDeadline} {
+		if t.After(now) && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	switch {
+	case next.IsZero():
+		if c.deadlineTimer != nil {
+			c.deadlineTimer.Stop()
+		}
+	case c.deadlineTimer == nil:
+		c.deadlineTimer = time.AfterFunc(next.Sub(now), c.deadlineExpired)
+	default:
+		c.deadlineTimer.Reset(next.Sub(now))
+	}
+}
+
+// deadlineExpired is called by c.deadlineTimer when a deadline
+// passes.
+func (c *streamConn) deadlineExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resetDeadlineTimerLocked()
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package natlab
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveEcho echoes back everything sent to streams accepted by ln.
+func serveEcho(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			io.Copy(c, c)
+		}()
+	}
+}
+
+func TestStream(t *testing.T) {
+	internet := NewInternet()
+	lan := &Network{
+		Name:    "lan",
+		Prefix4: mustPrefix("192.168.0.0/24"),
+	}
+	server := &Machine{Name: "server"}
+	client := &Machine{Name: "client"}
+	nat := &Machine{Name: "nat"}
+	serverIf := server.Attach("eth0", internet)
+	natWAN := nat.Attach("wan", internet)
+	natLAN := nat.Attach("lan", lan)
+	clientIf := client.Attach("eth0", lan)
+	lan.SetDefaultGateway(natLAN)
+	nat.PacketHandler = &SNAT44{
+		Machine:           nat,
+		ExternalInterface: natWAN,
+		Firewall:          &Firewall{TrustedInterface: natLAN},
+	}
+
+	ln, err := server.Listen("tcp4", ":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveEcho(ln)
+
+	ctx := context.Background()
+	addr := net.JoinHostPort(serverIf.V4().String(), "80")
+	c, err := client.Dial(ctx, "tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got, want := c.LocalAddr().(*net.TCPAddr).IP.String(), clientIf.V4().String(); got != want {
+		t.Errorf("local IP = %v; want %v", got, want)
+	}
+	if _, err := io.WriteString(c, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("read %q; want %q", buf, "hello")
+	}
+
+	if _, err := client.Dial(ctx, "tcp4", net.JoinHostPort(serverIf.V4().String(), "81")); err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Errorf("dial to port without listener: err = %v; want connection refused", err)
+	}
+	ln.Close()
+	if _, err := client.Dial(ctx, "tcp4", addr); err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Errorf("dial to closed listener: err = %v; want connection refused", err)
+	}
+}
+
+func TestStreamFirewall(t *testing.T) {
+	internet := NewInternet()
+	server := &Machine{
+		Name:          "server",
+		PacketHandler: &Firewall{},
+	}
+	client := &Machine{Name: "client"}
+	serverIf := server.Attach("eth0", internet)
+	client.Attach("eth0", internet)
+
+	ln, err := server.Listen("tcp4", ":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveEcho(ln)
+
+	// The firewall drops the SYN, so the dial can only time out.
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if _, err := client.Dial(ctx, "tcp4", net.JoinHostPort(serverIf.V4().String(), "80")); err != context.DeadlineExceeded {
+		t.Errorf("dial through firewall: err = %v; want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestStreamImpaired(t *testing.T) {
+	internet := NewInternet()
+	internet.Impairment = &Impairment{
+		Latency:   5 * time.Millisecond,
+		Jitter:    5 * time.Millisecond,
+		Loss:      0.1,
+		Duplicate: 0.05,
+		Seed:      1,
+	}
+	server := &Machine{Name: "server"}
+	client := &Machine{Name: "client"}
+	serverIf := server.Attach("eth0", internet)
+	client.Attach("eth0", internet)
+
+	ln, err := server.Listen("tcp4", ":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveEcho(ln)
+
+	c, err := client.Dial(context.Background(), "tcp4", net.JoinHostPort(serverIf.V4().String(), "80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	want := make([]byte, 200<<10)
+	rand.New(rand.NewSource(1)).Read(want)
+	go func() {
+		c.Write(want)
+	}()
+	c.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got, err := ioutil.ReadAll(io.LimitReader(c, int64(len(want))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("echoed data differs from data sent")
+	}
+}
+
+func TestStreamClose(t *testing.T) {
+	internet := NewInternet()
+	server := &Machine{Name: "server"}
+	client := &Machine{Name: "client"}
+	serverIf := server.Attach("eth0", internet)
+	client.Attach("eth0", internet)
+
+	ln, err := server.Listen("tcp4", ":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	c, err := client.Dial(context.Background(), "tcp4", net.JoinHostPort(serverIf.V4().String(), "80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	io.WriteString(c, "bye")
+	c.Close()
+	got, err := ioutil.ReadAll(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "bye" {
+		t.Errorf("read %q before EOF; want %q", got, "bye")
+	}
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	internet := NewInternet()
+	server := &Machine{Name: "server"}
+	client := &Machine{Name: "client"}
+	serverIf := server.Attach("eth0", internet)
+	client.Attach("eth0", internet)
+
+	ln, err := server.Listen("tcp4", ":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveEcho(ln)
+
+	c, err := client.Dial(context.Background(), "tcp4", net.JoinHostPort(serverIf.V4().String(), "80"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Moving the deadline later reuses the conn's timer, and the
+	// read times out at the last deadline set.
+	start := time.Now()
+	for i := 1; i <= 5; i++ {
+		c.SetReadDeadline(start.Add(time.Duration(i) * 20 * time.Millisecond))
+	}
+	c.SetWriteDeadline(start.Add(time.Hour))
+	_, err = c.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("Read err = %v; want timeout", err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Errorf("Read timed out after %v; want at least 100ms", d)
+	}
+}
@@ -20,9 +20,12 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"inet.af/netaddr"
 	"tailscale.com/metrics"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/types/logger"
@@ -60,6 +63,35 @@ func IsProd443(addr string) bool {
 	return port == "443" || port == "https"
 }
 
+var (
+	debugNetsMu sync.Mutex
+	debugNets   []netaddr.IPPrefix
+)
+
+// SetAllowDebugAccessNets sets networks whose hosts AllowDebugAccess
+// permits, in addition to the ones it permits by default.
+// It may be called while serving.
+func SetAllowDebugAccessNets(nets []netaddr.IPPrefix) {
+	debugNetsMu.Lock()
+	defer debugNetsMu.Unlock()
+	debugNets = append([]netaddr.IPPrefix(nil), nets...)
+}
+
+func inDebugNets(ip net.IP) bool {
+	nip, ok := netaddr.FromStdIP(ip)
+	if !ok {
+		return false
+	}
+	debugNetsMu.Lock()
+	defer debugNetsMu.Unlock()
+	for _, n := range debugNets {
+		if n.Contains(nip) {
+			return true
+		}
+	}
+	return false
+}
+
 // AllowDebugAccess reports whether r should be permitted to access
 // various debug endpoints.
 func AllowDebugAccess(r *http.Request) bool {
@@ -72,7 +104,7 @@ func AllowDebugAccess(r *http.Request) bool {
 		return false
 	}
 	ip := net.ParseIP(ipStr)
-	if interfaces.IsTailscaleIP(ip) || ip.IsLoopback() || ipStr == os.Getenv("TS_ALLOW_DEBUG_IP") {
+	if interfaces.IsTailscaleIP(ip) || ip.IsLoopback() || ipStr == os.Getenv("TS_ALLOW_DEBUG_IP") || inDebugNets(ip) {
 		return true
 	}
 	if r.Method == "GET" {
@@ -347,6 +379,7 @@ func Error(code int, msg string, err error) HTTPError {
 //     underscores. So use underscores as your metric names.
 //   * an expvar named starting with "gauge_" or "counter_" is of that
 //     Prometheus type, and has that prefix stripped.
+//   * a *tailscale/metrics.Histogram is a histogram.
 //   * anything else is untyped and thus not exported.
 //   * expvar.Func can return an int or int64 (for now) and anything else
 //     is not exported.
@@ -382,6 +415,9 @@ func varzHandler(w http.ResponseWriter, r *http.Request) {
 				dump(name+"_", kv)
 			})
 			return
+		case *metrics.Histogram:
+			writeHistogram(w, name, v)
+			return
 		}
 
 		if typ == "" {
@@ -422,6 +458,22 @@ func varzHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// writeHistogram writes h in the Prometheus histogram format, as
+// cumulative name_bucket series plus name_sum and name_count.
+func writeHistogram(w io.Writer, name string, h *metrics.Histogram) {
+	bounds, cumulative, sum := h.Snapshot()
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	for i, n := range cumulative {
+		le := "+Inf"
+		if i < len(bounds) {
+			le = strconv.FormatFloat(bounds[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, le, n)
+	}
+	fmt.Fprintf(w, "%s_sum %v\n", name, sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, cumulative[len(cumulative)-1])
+}
+
 func writeMemstats(w io.Writer, ms *runtime.MemStats) {
 	out := func(name, typ string, v uint64, help string) {
 		if help != "" {
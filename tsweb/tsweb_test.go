@@ -6,6 +6,7 @@ package tsweb
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"net"
@@ -15,6 +16,7 @@ import (
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"tailscale.com/metrics"
 	"tailscale.com/tstest"
 )
 
@@ -301,3 +303,23 @@ func BenchmarkLog(b *testing.B) {
 		h.ServeHTTP(rw, req)
 	}
 }
+
+func TestWriteHistogram(t *testing.T) {
+	h := metrics.NewHistogram([]float64{0.5, 1})
+	h.Observe(0.25)
+	h.Observe(0.75)
+	h.Observe(2)
+
+	var buf bytes.Buffer
+	writeHistogram(&buf, "delay_seconds", h)
+	want := `# TYPE delay_seconds histogram
+delay_seconds_bucket{le="0.5"} 1
+delay_seconds_bucket{le="1"} 2
+delay_seconds_bucket{le="+Inf"} 3
+delay_seconds_sum 3
+delay_seconds_count 3
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/packet"
+	"tailscale.com/wgengine/tsdns"
+	"tailscale.com/wgengine/tstun"
+)
+
+const (
+	// dnsTCPMaxConns is the maximum number of concurrent
+	// DNS over TCP connections to the magic DNS IP.
+	dnsTCPMaxConns = 64
+	// dnsTCPIdleTimeout is how long a DNS over TCP connection
+	// may be idle before it is forgotten.
+	dnsTCPIdleTimeout = 30 * time.Second
+	// dnsTCPMSS is the maximum segment size used for responses.
+	// It is the default MSS for IPv4, which needs no negotiation.
+	dnsTCPMSS = 536
+	// dnsTCPWindow is the receive window advertised to clients.
+	dnsTCPWindow = 65535
+)
+
+// dnsTCP is a minimal TCP responder for DNS queries sent to the magic DNS IP.
+//
+// The packets it handles never leave the machine, so it does not
+// retransmit or do congestion control: it is just enough TCP to carry
+// queries to the resolver and responses back, as RFC 7766 requires.
+type dnsTCP struct {
+	logf     logger.Logf
+	resolver *tsdns.Resolver
+	// inject sends a packet starting at buf[offset] to the local network stack.
+	inject func(buf []byte, offset int) error
+
+	mu    sync.Mutex
+	conns map[netaddr.IPPort]*dnsTCPConn
+}
+
+// dnsTCPConn is the state of a single DNS over TCP connection.
+type dnsTCPConn struct {
+	sndNxt uint32 // next sequence number to send
+	rcvNxt uint32 // next sequence number expected from the client
+
+	buf        []byte // received bytes not yet forming a complete query
+	pending    int    // queries passed to the resolver and not yet answered
+	finRcvd    bool   // whether the client has closed its side
+	lastActive time.Time
+}
+
+func newDNSTCP(logf logger.Logf, resolver *tsdns.Resolver, inject func(buf []byte, offset int) error) *dnsTCP {
+	return &dnsTCP{
+		logf:     logf,
+		resolver: resolver,
+		inject:   inject,
+		conns:    make(map[netaddr.IPPort]*dnsTCPConn),
+	}
+}
+
+// handle processes a TCP segment sent by the local network stack to the magic DNS IP.
+func (d *dnsTCP) handle(p *packet.ParsedPacket) {
+	h := p.TCPHeader()
+	addr := netaddr.IPPort{IP: p.SrcIP.Netaddr(), Port: p.SrcPort}
+	payload := p.Payload()
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.pruneLocked(now)
+	c := d.conns[addr]
+
+	if h.Flags&packet.TCPRst != 0 {
+		delete(d.conns, addr)
+		return
+	}
+
+	if p.IsTCPSyn() {
+		if c == nil && len(d.conns) >= dnsTCPMaxConns {
+			d.logf("tsdns: too many TCP connections, refusing %v", addr)
+			d.sendLocked(addr, h.Ack, h.Seq+1, packet.TCPRst|packet.TCPAck, nil)
+			return
+		}
+		// A retransmitted SYN gets the same SYN-ACK as the original.
+		if c == nil {
+			c = &dnsTCPConn{sndNxt: rand.Uint32() + 1}
+			d.conns[addr] = c
+		}
+		c.rcvNxt = h.Seq + 1
+		c.lastActive = now
+		d.sendLocked(addr, c.sndNxt-1, c.rcvNxt, packet.TCPSynAck, nil)
+		return
+	}
+
+	if c == nil {
+		// Nothing to reset in response to a stray ACK.
+		if len(payload) > 0 || h.Flags&packet.TCPFin != 0 {
+			d.sendLocked(addr, h.Ack, h.Seq+uint32(len(payload)), packet.TCPRst|packet.TCPAck, nil)
+		}
+		return
+	}
+	c.lastActive = now
+
+	if len(payload) == 0 && h.Flags&packet.TCPFin == 0 {
+		// A pure ACK of data we sent.
+		return
+	}
+	if h.Seq != c.rcvNxt {
+		// Out of order or retransmitted; re-acknowledge what we have.
+		d.sendLocked(addr, c.sndNxt, c.rcvNxt, packet.TCPAck, nil)
+		return
+	}
+
+	c.rcvNxt += uint32(len(payload))
+	c.buf = append(c.buf, payload...)
+	for len(c.buf) >= 2 {
+		n := int(binary.BigEndian.Uint16(c.buf))
+		if len(c.buf) < 2+n {
+			break
+		}
+		request := tsdns.Packet{
+			Payload: append([]byte(nil), c.buf[2:2+n]...),
+			Addr:    addr,
+			TCP:     true,
+		}
+		c.buf = c.buf[2+n:]
+		if err := d.resolver.EnqueueRequest(request); err != nil {
+			d.logf("tsdns: enqueue: %v", err)
+			continue
+		}
+		c.pending++
+	}
+	if len(c.buf) == 0 {
+		c.buf = nil
+	}
+
+	if h.Flags&packet.TCPFin != 0 {
+		c.rcvNxt++
+		c.finRcvd = true
+	}
+	d.sendLocked(addr, c.sndNxt, c.rcvNxt, packet.TCPAck, nil)
+	d.maybeCloseLocked(addr, c)
+}
+
+// writeResponse sends a resolver response for a query received over TCP.
+func (d *dnsTCP) writeResponse(resp tsdns.Packet) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c := d.conns[resp.Addr]
+	if c == nil {
+		// The connection was reset or timed out while the query was in flight.
+		return
+	}
+	c.pending--
+	c.lastActive = time.Now()
+
+	msg := make([]byte, 2+len(resp.Payload))
+	binary.BigEndian.PutUint16(msg, uint16(len(resp.Payload)))
+	copy(msg[2:], resp.Payload)
+	for len(msg) > 0 {
+		n := len(msg)
+		if n > dnsTCPMSS {
+			n = dnsTCPMSS
+		}
+		d.sendLocked(resp.Addr, c.sndNxt, c.rcvNxt, packet.TCPPsh|packet.TCPAck, msg[:n])
+		c.sndNxt += uint32(n)
+		msg = msg[n:]
+	}
+	d.maybeCloseLocked(resp.Addr, c)
+}
+
+// queryFailed notes that the resolver failed to answer a query
+// received over TCP from addr.
+func (d *dnsTCP) queryFailed(addr netaddr.IPPort) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c := d.conns[addr]
+	if c == nil {
+		return
+	}
+	c.pending--
+	d.maybeCloseLocked(addr, c)
+}
+
+// maybeCloseLocked closes c once the client has closed its side
+// and all of its queries have been answered.
+func (d *dnsTCP) maybeCloseLocked(addr netaddr.IPPort, c *dnsTCPConn) {
+	if !c.finRcvd || c.pending > 0 {
+		return
+	}
+	d.sendLocked(addr, c.sndNxt, c.rcvNxt, packet.TCPFin|packet.TCPAck, nil)
+	delete(d.conns, addr)
+}
+
+// pruneLocked forgets connections that have been idle for too long.
+func (d *dnsTCP) pruneLocked(now time.Time) {
+	for addr, c := range d.conns {
+		if now.Sub(c.lastActive) > dnsTCPIdleTimeout {
+			delete(d.conns, addr)
+		}
+	}
+}
+
+// sendLocked injects a segment from the magic DNS IP to addr.
+func (d *dnsTCP) sendLocked(addr netaddr.IPPort, seq, ack uint32, flags uint8, payload []byte) {
+	h := packet.TCPHeader{
+		IPHeader: packet.IPHeader{
+			SrcIP: packet.IP(magicDNSIP),
+			DstIP: packet.IPFromNetaddr(addr.IP),
+		},
+		SrcPort: magicDNSPort,
+		DstPort: addr.Port,
+		Seq:     seq,
+		Ack:     ack,
+		Flags:   flags,
+		Window:  dnsTCPWindow,
+	}
+	hlen := h.Len()
+
+	const offset = tstun.PacketStartOffset
+	buf := make([]byte, offset+hlen+len(payload))
+	copy(buf[offset+hlen:], payload)
+	h.Marshal(buf[offset:])
+
+	if err := d.inject(buf, offset); err != nil {
+		d.logf("tsdns: TCP inject: %v", err)
+	}
+}
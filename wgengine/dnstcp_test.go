@@ -0,0 +1,123 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/wgengine/packet"
+	"tailscale.com/wgengine/tsdns"
+)
+
+func TestDNSTCP(t *testing.T) {
+	r := tsdns.NewResolver(t.Logf, "ipn.dev.")
+	r.SetMap(tsdns.NewMap(map[string]netaddr.IP{
+		"test1.ipn.dev.": netaddr.IPv4(100, 101, 102, 103),
+	}))
+	r.Start()
+	defer r.Close()
+
+	var sent []packet.ParsedPacket
+	d := newDNSTCP(t.Logf, r, func(buf []byte, offset int) error {
+		var p packet.ParsedPacket
+		p.Decode(buf[offset:])
+		sent = append(sent, p)
+		return nil
+	})
+	next := func() packet.TCPHeader {
+		t.Helper()
+		if len(sent) == 0 {
+			t.Fatal("no segment sent")
+		}
+		p := sent[0]
+		sent = sent[1:]
+		if p.IPProto != packet.TCP || p.SrcPort != magicDNSPort || p.DstPort != 40000 {
+			t.Fatalf("unexpected segment %v", p.String())
+		}
+		return p.TCPHeader()
+	}
+
+	client := packet.IPFromNetaddr(netaddr.IPv4(100, 64, 0, 1))
+	seq := uint32(1000)
+	send := func(flags uint8, payload []byte) {
+		h := packet.TCPHeader{
+			IPHeader: packet.IPHeader{SrcIP: client, DstIP: packet.IP(magicDNSIP)},
+			SrcPort:  40000,
+			DstPort:  magicDNSPort,
+			Seq:      seq,
+			Flags:    flags,
+		}
+		var p packet.ParsedPacket
+		p.Decode(packet.Generate(&h, payload))
+		d.handle(&p)
+	}
+
+	send(packet.TCPSyn, nil)
+	synack := next()
+	if synack.Flags != packet.TCPSynAck || synack.Ack != seq+1 {
+		t.Fatalf("SYN reply = %+v; want SYN-ACK of %d", synack, seq+1)
+	}
+	seq++
+
+	query := []byte{
+		0x00, 0x00, // length, set below
+		0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x05, 't', 'e', 's', 't', '1', 0x03, 'i', 'p', 'n', 0x03, 'd', 'e', 'v', 0x00,
+		0x00, 0x01, 0x00, 0x01,
+	}
+	binary.BigEndian.PutUint16(query, uint16(len(query)-2))
+	send(packet.TCPPsh|packet.TCPAck, query)
+	seq += uint32(len(query))
+	if ack := next(); ack.Ack != seq {
+		t.Fatalf("data ACK = %d; want %d", ack.Ack, seq)
+	}
+
+	resp, err := r.NextResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.TCP {
+		t.Fatal("response not marked TCP")
+	}
+	d.writeResponse(resp)
+	data := next()
+	if data.Seq != synack.Seq+1 || data.Flags != packet.TCPPsh|packet.TCPAck {
+		t.Errorf("response segment = %+v", data)
+	}
+
+	send(packet.TCPFin|packet.TCPAck, nil)
+	if ack := next(); ack.Ack != seq+1 {
+		t.Errorf("FIN ACK = %d; want %d", ack.Ack, seq+1)
+	}
+	if fin := next(); fin.Flags != packet.TCPFin|packet.TCPAck {
+		t.Errorf("close flags = %#x; want FIN-ACK", fin.Flags)
+	}
+	if len(d.conns) != 0 {
+		t.Errorf("%d connections left open", len(d.conns))
+	}
+}
+
+func TestDNSTCPQueryFailed(t *testing.T) {
+	var sent []packet.ParsedPacket
+	d := newDNSTCP(t.Logf, nil, func(buf []byte, offset int) error {
+		var p packet.ParsedPacket
+		p.Decode(buf[offset:])
+		sent = append(sent, p)
+		return nil
+	})
+	addr := netaddr.IPPort{IP: netaddr.IPv4(100, 101, 102, 104), Port: 4321}
+	d.conns[addr] = &dnsTCPConn{pending: 1, finRcvd: true}
+
+	// The client is gone once its last query fails.
+	d.queryFailed(addr)
+	if len(sent) != 1 || sent[0].TCPHeader().Flags != packet.TCPFin|packet.TCPAck {
+		t.Errorf("sent %d segments; want a FIN-ACK", len(sent))
+	}
+	if len(d.conns) != 0 {
+		t.Errorf("%d connections left open", len(d.conns))
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"expvar"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/metrics"
+	"tailscale.com/wgengine/packet"
+)
+
+// dropsByReason counts dropped packets, labeled with why they were
+// dropped.
+var dropsByReason = &metrics.LabelMap{Label: "reason"}
+
+func init() {
+	expvar.Publish("counter_filter_drops_by_reason", dropsByReason)
+}
+
+// RuleAccepts returns the number of packets accepted by each of f's
+// rules so far, indexed like the Matches f was created with.
+func (f *Filter) RuleAccepts() []int64 {
+	ret := make([]int64, len(f.ruleAccepts))
+	for i := range f.ruleAccepts {
+		ret[i] = f.ruleAccepts[i].Value()
+	}
+	return ret
+}
+
+// decisionLogSize is the number of decisions kept in a filter's
+// decision log.
+const decisionLogSize = 256
+
+// decisionLog is a ring buffer of the most recent decisions. Adding
+// to it doesn't lock, so that recording doesn't contend with the
+// packets being filtered.
+type decisionLog struct {
+	n   uint64                        // atomic; number of decisions ever added
+	buf [decisionLogSize]atomic.Value // of *ipnstate.FilterDecision
+}
+
+func (l *decisionLog) add(d *ipnstate.FilterDecision) {
+	i := atomic.AddUint64(&l.n, 1) - 1
+	l.buf[i%decisionLogSize].Store(d)
+}
+
+// decisions returns a copy of the log's contents, oldest first.
+func (l *decisionLog) decisions() []ipnstate.FilterDecision {
+	n := atomic.LoadUint64(&l.n)
+	var start uint64
+	if n > decisionLogSize {
+		start = n - decisionLogSize
+	}
+	ret := make([]ipnstate.FilterDecision, 0, n-start)
+	for i := start; i < n; i++ {
+		if d, ok := l.buf[i%decisionLogSize].Load().(*ipnstate.FilterDecision); ok {
+			ret = append(ret, *d)
+		}
+	}
+	// Concurrent adds may have stored slots out of order.
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Time.Before(ret[j].Time) })
+	return ret
+}
+
+// dropCounters caches the drop counters for the reasons the filter
+// uses, so that counting a drop doesn't allocate.
+var dropCounters = map[string]*expvar.Int{}
+
+func init() {
+	for _, why := range []string{
+		"too short",
+		"unknown",
+		"destination not allowed",
+		"no rules matched",
+		"protocol not allowed",
+	} {
+		dropCounters[why] = dropsByReason.Get(why)
+	}
+}
+
+// countDrop records a packet dropped for reason why.
+func countDrop(why string) {
+	if c, ok := dropCounters[why]; ok {
+		c.Add(1)
+		return
+	}
+	dropsByReason.Get(why).Add(1)
+}
+
+// record adds the verdict r on q to the decision log, if runflags
+// ask for it.
+func (f *Filter) record(runflags RunFlags, q *packet.ParsedPacket, dir direction, r Response, why string, rule int) {
+	if r == Drop && runflags&RecordDrops == 0 || r == Accept && runflags&RecordAccepts == 0 {
+		return
+	}
+	if r == Drop && omitDropLogging(q, dir) {
+		return
+	}
+	d := &ipnstate.FilterDecision{
+		Time:      time.Now(),
+		Direction: dir.String(),
+		Proto:     q.IPProto.String(),
+		Verdict:   r.String(),
+		Reason:    why,
+		Rule:      rule,
+	}
+	if q.IPVersion == 6 {
+		d.Src = netaddr.IPPort{IP: q.SrcIP6.Netaddr(), Port: q.SrcPort}
+		d.Dst = netaddr.IPPort{IP: q.DstIP6.Netaddr(), Port: q.DstPort}
+	} else {
+		d.Src = netaddr.IPPort{IP: q.SrcIP.Netaddr(), Port: q.SrcPort}
+		d.Dst = netaddr.IPPort{IP: q.DstIP.Netaddr(), Port: q.DstPort}
+	}
+	if rule >= 0 {
+		d.RuleText = f.ruleText[rule]
+	}
+	f.state.log.add(d)
+}
+
+// Decisions returns the most recent decisions recorded by f, and by
+// the filters it shares state with, oldest first.
+func (f *Filter) Decisions() []ipnstate.FilterDecision {
+	return f.state.log.decisions()
+}
@@ -6,6 +6,7 @@
 package filter
 
 import (
+	"expvar"
 	"fmt"
 	"sync"
 	"time"
@@ -17,6 +18,8 @@ import (
 )
 
 type filterState struct {
+	log decisionLog // first, so its atomic counter is 64-bit aligned
+
 	mu  sync.Mutex
 	lru *lru.Cache // of tuple
 }
@@ -29,6 +32,8 @@ type Filter struct {
 	// destination within localNets, regardless of the policy filter
 	// below. A nil localNets rejects all incoming traffic.
 	localNets []Net
+	// localNets6 is the IPv6 counterpart of localNets.
+	localNets6 []Net6
 	// matches is a list of match->action rules applied to all packets
 	// arriving over tailscale tunnels. Matches are checked in order,
 	// and processing stops at the first matching rule. The default
@@ -39,6 +44,11 @@ type Filter struct {
 	// to an outbound connection that this node made, even if those
 	// incoming packets don't get accepted by matches above.
 	state *filterState
+	// ruleAccepts and ruleText are the accept counter and the
+	// String form of each of matches, by index. The counters start
+	// at zero in each new filter.
+	ruleAccepts []expvar.Int
+	ruleText    []string
 }
 
 // Response is a verdict: either a Drop, Accept, or noVerdict skip to
@@ -72,39 +82,60 @@ const (
 	LogAccepts
 	HexdumpDrops
 	HexdumpAccepts
+	// RecordDrops and RecordAccepts add drops and accepts,
+	// respectively, to the filter's decision log.
+	RecordDrops
+	RecordAccepts
 )
 
+// tuple identifies a flow of a protocol with ports.
 type tuple struct {
+	Proto   packet.IPProto
 	SrcIP   packet.IP
 	DstIP   packet.IP
 	SrcPort uint16
 	DstPort uint16
 }
 
-const lruMax = 512 // max entries in UDP LRU cache
+// tuple6 is the IPv6 counterpart of tuple. Both share the same LRU.
+type tuple6 struct {
+	Proto   packet.IPProto
+	SrcIP   packet.IP6
+	DstIP   packet.IP6
+	SrcPort uint16
+	DstPort uint16
+}
+
+const lruMax = 4096 // max entries in LRU cache of UDP, TCP and SCTP flows
 
 // MatchAllowAll matches all packets.
 var MatchAllowAll = Matches{
-	Match{[]NetPortRange{NetPortRangeAny}, []Net{NetAny}},
+	Match{
+		Dsts:  []NetPortRange{NetPortRangeAny},
+		Srcs:  []Net{NetAny},
+		Dsts6: []NetPortRange6{NetPortRangeAny6},
+		Srcs6: []Net6{NetAny6},
+	},
 }
 
 // NewAllowAll returns a packet filter that accepts everything to and
-// from localNets.
-func NewAllowAll(localNets []Net, logf logger.Logf) *Filter {
-	return New(MatchAllowAll, localNets, nil, logf)
+// from localNets and localNets6.
+func NewAllowAll(localNets []Net, localNets6 []Net6, logf logger.Logf) *Filter {
+	return New(MatchAllowAll, localNets, localNets6, nil, logf)
 }
 
 // NewAllowNone returns a packet filter that rejects everything.
 func NewAllowNone(logf logger.Logf) *Filter {
-	return New(nil, nil, nil, logf)
+	return New(nil, nil, nil, nil, logf)
 }
 
 // New creates a new packet filter. The filter enforces that incoming
-// packets must be destined to an IP in localNets, and must be allowed
-// by matches. If shareStateWith is non-nil, the returned filter
-// shares state with the previous one, to enable rules to be changed
-// at runtime without breaking existing flows.
-func New(matches Matches, localNets []Net, shareStateWith *Filter, logf logger.Logf) *Filter {
+// packets must be destined to an IP in localNets (or localNets6 for
+// IPv6), and must be allowed by matches. If shareStateWith is
+// non-nil, the returned filter shares state with the previous one,
+// to enable rules to be changed at runtime without breaking existing
+// flows.
+func New(matches Matches, localNets []Net, localNets6 []Net6, shareStateWith *Filter, logf logger.Logf) *Filter {
 	var state *filterState
 	if shareStateWith != nil {
 		state = shareStateWith.state
@@ -114,10 +145,15 @@ func New(matches Matches, localNets []Net, shareStateWith *Filter, logf logger.L
 		}
 	}
 	f := &Filter{
-		logf:      logf,
-		matches:   matches,
-		localNets: localNets,
-		state:     state,
+		logf:       logf,
+		matches:    matches,
+		localNets:  localNets,
+		localNets6: localNets6,
+		state:      state,
+	}
+	f.ruleAccepts = make([]expvar.Int, len(matches))
+	for _, m := range matches {
+		f.ruleText = append(f.ruleText, m.String())
 	}
 	return f
 }
@@ -169,8 +205,8 @@ func (f *Filter) RunIn(q *packet.ParsedPacket, rf RunFlags) Response {
 		return r
 	}
 
-	r, why := f.runIn(q)
-	f.logRateLimit(rf, q, dir, r, why)
+	r, why, rule := f.runIn(q)
+	f.noteVerdict(rf, q, dir, r, why, rule)
 	return r
 }
 
@@ -183,21 +219,34 @@ func (f *Filter) RunOut(q *packet.ParsedPacket, rf RunFlags) Response {
 		return r
 	}
 	r, why := f.runOut(q)
-	f.logRateLimit(rf, q, dir, r, why)
+	f.noteVerdict(rf, q, dir, r, why, -1)
 	return r
 }
 
-func (f *Filter) runIn(q *packet.ParsedPacket) (r Response, why string) {
+// noteVerdict logs, counts and records the verdict r on q.
+// rule is the index of the rule that accepted q, or -1.
+func (f *Filter) noteVerdict(rf RunFlags, q *packet.ParsedPacket, dir direction, r Response, why string, rule int) {
+	f.logRateLimit(rf, q, dir, r, why)
+	if r == Drop {
+		countDrop(why)
+	} else if rule >= 0 {
+		f.ruleAccepts[rule].Add(1)
+	}
+	f.record(rf, q, dir, r, why, rule)
+}
+
+// runIn returns the verdict on q, why, and the index of the rule that
+// accepted it, or -1 if no rule did.
+func (f *Filter) runIn(q *packet.ParsedPacket) (r Response, why string, rule int) {
+	if q.IPVersion == 6 {
+		return f.runIn6(q)
+	}
+
 	// A compromised peer could try to send us packets for
 	// destinations we didn't explicitly advertise. This check is to
 	// prevent that.
 	if !ipInList(q.DstIP, f.localNets) {
-		return Drop, "destination not allowed"
-	}
-
-	if q.IPVersion == 6 {
-		// TODO: support IPv6.
-		return Drop, "no rules matched"
+		return Drop, "destination not allowed", -1
 	}
 
 	switch q.IPProto {
@@ -208,53 +257,144 @@ func (f *Filter) runIn(q *packet.ParsedPacket) (r Response, why string) {
 			//  We could choose to reject all packets that aren't
 			//  related to an existing ICMP-Echo, TCP, or UDP
 			//  session.
-			return Accept, "icmp response ok"
-		} else if matchIPWithoutPorts(f.matches, q) {
+			return Accept, "icmp response ok", -1
+		} else if i := matchIPWithoutPorts(f.matches, q); i >= 0 {
 			// If any port is open to an IP, allow ICMP to it.
-			return Accept, "icmp ok"
+			return Accept, "icmp ok", i
 		}
 	case packet.TCP:
-		// For TCP, we want to allow *outgoing* connections,
-		// which means we want to allow return packets on those
-		// connections. To make this restriction work, we need to
-		// allow non-SYN packets (continuation of an existing session)
-		// to arrive. This should be okay since a new incoming session
-		// can't be initiated without first sending a SYN.
-		// It happens to also be much faster.
-		// TODO(apenwarr): Skip the rest of decoding in this path?
-		if q.IPProto == packet.TCP && !q.IsTCPSyn() {
-			return Accept, "tcp non-syn"
+		// A SYN opens a new connection, so it must be allowed by
+		// the rules. Other packets are also allowed if they belong
+		// to a connection this node opened.
+		if !q.IsTCPSyn() {
+			t := tuple{q.IPProto, q.SrcIP, q.DstIP, q.SrcPort, q.DstPort}
+
+			f.state.mu.Lock()
+			_, ok := f.state.lru.Get(t)
+			f.state.mu.Unlock()
+
+			if ok {
+				return Accept, "tcp cached", -1
+			}
 		}
-		if matchIPPorts(f.matches, q) {
-			return Accept, "tcp ok"
+		if i := matchIPPorts(f.matches, q); i >= 0 {
+			return Accept, "tcp ok", i
 		}
-	case packet.UDP:
-		t := tuple{q.SrcIP, q.DstIP, q.SrcPort, q.DstPort}
+	case packet.UDP, packet.SCTP:
+		t := tuple{q.IPProto, q.SrcIP, q.DstIP, q.SrcPort, q.DstPort}
 
 		f.state.mu.Lock()
 		_, ok := f.state.lru.Get(t)
 		f.state.mu.Unlock()
 
 		if ok {
-			return Accept, "udp cached"
+			return Accept, "cached", -1
 		}
-		if matchIPPorts(f.matches, q) {
-			return Accept, "udp ok"
+		if i := matchIPPorts(f.matches, q); i >= 0 {
+			return Accept, "ok", i
 		}
 	default:
-		return Drop, "Unknown proto"
+		// Other protocols, like GRE, have no ports. Only rules
+		// that list them in IPProto allow them.
+		if i := matchIPWithoutPorts(f.matches, q); i >= 0 {
+			return Accept, "ok", i
+		}
 	}
-	return Drop, "no rules matched"
+	return Drop, "no rules matched", -1
+}
+
+// runIn6 is the IPv6 counterpart of runIn.
+func (f *Filter) runIn6(q *packet.ParsedPacket) (r Response, why string, rule int) {
+	if !ipInList6(q.DstIP6, f.localNets6) {
+		return Drop, "destination not allowed", -1
+	}
+
+	switch q.IPProto {
+	case packet.ICMPv6:
+		if q.IsEchoResponse() || q.IsError() {
+			return Accept, "icmp response ok", -1
+		} else if i := matchIPWithoutPorts6(f.matches, q); i >= 0 {
+			return Accept, "icmp ok", i
+		}
+	case packet.TCP:
+		// See runIn for which non-SYN packets are accepted.
+		if !q.IsTCPSyn() {
+			t := tuple6{q.IPProto, q.SrcIP6, q.DstIP6, q.SrcPort, q.DstPort}
+
+			f.state.mu.Lock()
+			_, ok := f.state.lru.Get(t)
+			f.state.mu.Unlock()
+
+			if ok {
+				return Accept, "tcp cached", -1
+			}
+		}
+		if i := matchIPPorts6(f.matches, q); i >= 0 {
+			return Accept, "tcp ok", i
+		}
+	case packet.UDP, packet.SCTP:
+		t := tuple6{q.IPProto, q.SrcIP6, q.DstIP6, q.SrcPort, q.DstPort}
+
+		f.state.mu.Lock()
+		_, ok := f.state.lru.Get(t)
+		f.state.mu.Unlock()
+
+		if ok {
+			return Accept, "cached", -1
+		}
+		if i := matchIPPorts6(f.matches, q); i >= 0 {
+			return Accept, "ok", i
+		}
+	default:
+		if i := matchIPWithoutPorts6(f.matches, q); i >= 0 {
+			return Accept, "ok", i
+		}
+	}
+	return Drop, "no rules matched", -1
 }
 
 func (f *Filter) runOut(q *packet.ParsedPacket) (r Response, why string) {
-	if q.IPProto == packet.UDP {
-		t := tuple{q.DstIP, q.SrcIP, q.DstPort, q.SrcPort}
-		var ti interface{} = t // allocate once, rather than twice inside mutex
+	switch q.IPProto {
+	case packet.TCP:
+		if !q.IsTCPSyn() {
+			// Keep the connection fresh in the LRU. Only add it
+			// again, which allocates, if other flows evicted it
+			// while it was open.
+			f.state.mu.Lock()
+			if q.IPVersion == 6 {
+				t := tuple6{q.IPProto, q.DstIP6, q.SrcIP6, q.DstPort, q.SrcPort}
+				if _, ok := f.state.lru.Get(t); !ok {
+					f.state.lru.Add(t, t)
+				}
+			} else {
+				t := tuple{q.IPProto, q.DstIP, q.SrcIP, q.DstPort, q.SrcPort}
+				if _, ok := f.state.lru.Get(t); !ok {
+					f.state.lru.Add(t, t)
+				}
+			}
+			f.state.mu.Unlock()
+			break
+		}
+		fallthrough
+	case packet.UDP, packet.SCTP:
+		var ti interface{} // allocate once, rather than twice inside mutex
+		if q.IPVersion == 6 {
+			ti = tuple6{q.IPProto, q.DstIP6, q.SrcIP6, q.DstPort, q.SrcPort}
+		} else {
+			ti = tuple{q.IPProto, q.DstIP, q.SrcIP, q.DstPort, q.SrcPort}
+		}
 
 		f.state.mu.Lock()
 		f.state.lru.Add(ti, ti)
 		f.state.mu.Unlock()
+	case packet.ICMP, packet.ICMPv6:
+		// Always allowed out, like TCP and UDP.
+	default:
+		// Like inbound, other protocols are only allowed if a
+		// rule names them.
+		if !f.matches.namesProto(q.IPProto) {
+			return Drop, "protocol not allowed"
+		}
 	}
 	return Accept, "ok out"
 }
@@ -284,23 +424,20 @@ func (f *Filter) pre(q *packet.ParsedPacket, rf RunFlags, dir direction) Respons
 		return Accept
 	}
 	if len(q.Buffer()) < 20 {
-		f.logRateLimit(rf, q, dir, Drop, "too short")
+		f.noteVerdict(rf, q, dir, Drop, "too short", -1)
 		return Drop
 	}
 
-	if q.IPVersion == 6 {
-		f.logRateLimit(rf, q, dir, Drop, "ipv6")
-		return Drop
-	}
 	switch q.IPProto {
 	case packet.Unknown:
-		// Unknown packets are dangerous; always drop them.
-		f.logRateLimit(rf, q, dir, Drop, "unknown")
+		// Packets we couldn't make sense of, such as truncated
+		// or malformed ones, are dangerous; always drop them.
+		f.noteVerdict(rf, q, dir, Drop, "unknown", -1)
 		return Drop
 	case packet.Fragment:
 		// Fragments after the first always need to be passed through.
 		// Very small fragments are considered Junk by ParsedPacket.
-		f.logRateLimit(rf, q, dir, Accept, "fragment")
+		f.noteVerdict(rf, q, dir, Accept, "fragment", -1)
 		return Accept
 	}
 
@@ -324,14 +461,8 @@ func omitDropLogging(p *packet.ParsedPacket, dir direction) bool {
 	case out:
 		switch p.IPVersion {
 		case 4:
-			// ParsedPacket.Decode zeros out ParsedPacket.IPProtocol for protocols
-			// it doesn't know about, so parse it out ourselves if needed.
-			ipProto := p.IPProto
-			if ipProto == 0 && len(b) > 8 {
-				ipProto = packet.IPProto(b[9])
-			}
 			// Omit logging about outgoing IGMP.
-			if ipProto == packet.IGMP {
+			if p.IPProto == packet.IGMP {
 				return true
 			}
 		case 6:
@@ -8,9 +8,13 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"net"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/types/logger"
 	"tailscale.com/wgengine/packet"
 )
@@ -23,8 +27,15 @@ var Unknown = packet.Unknown
 var ICMP = packet.ICMP
 var TCP = packet.TCP
 var UDP = packet.UDP
+var SCTP = packet.SCTP
 var Fragment = packet.Fragment
 
+// IP protocols the packet package has no constants for.
+const (
+	gre = packet.IPProto(47)
+	esp = packet.IPProto(50)
+)
+
 func nets(ips []IP) []Net {
 	out := make([]Net, 0, len(ips))
 	for _, ip := range ips {
@@ -63,7 +74,7 @@ func newFilter(logf logger.Logf) *Filter {
 	localNets := nets([]IP{0x647a6232, 0x01020304, 0x05060708, 0x66666666, 0x77777777})
 	localNets = append(localNets, Net{IP(0x08010000), Netmask(16)})
 
-	return New(matches, localNets, nil, logf)
+	return New(matches, localNets, nil, nil, logf)
 }
 
 func TestMarshal(t *testing.T) {
@@ -116,7 +127,7 @@ func TestFilter(t *testing.T) {
 		{Accept, parsed(UDP, 0x77777777, 0x66666666, 4242, 4343)},
 	}
 	for i, test := range tests {
-		if got, _ := acl.runIn(&test.p); test.want != got {
+		if got, _, _ := acl.runIn(&test.p); test.want != got {
 			t.Errorf("#%d got=%v want=%v packet:%v\n", i, got, test.want, test.p)
 		}
 		// Update UDP state
@@ -124,6 +135,318 @@ func TestFilter(t *testing.T) {
 	}
 }
 
+func TestFilterProto(t *testing.T) {
+	mm := Matches{
+		// Allow ping only.
+		{
+			Srcs:      []Net{NetAny},
+			Dsts:      []NetPortRange{NetPortRangeAny},
+			IPProto:   []packet.IPProto{ICMP},
+			ICMPTypes: []ICMPType{{Type: uint8(packet.ICMPEchoRequest), AnyCode: true}},
+		},
+		// Allow SCTP to port 9999.
+		{
+			Srcs:    []Net{NetAny},
+			Dsts:    ippr(0x01020304, 9999, 9999),
+			IPProto: []packet.IPProto{SCTP},
+		},
+		// Allow GRE, which has no ports.
+		{
+			Srcs:    []Net{NetAny},
+			Dsts:    ippr(0x01020304, 9999, 9999),
+			IPProto: []packet.IPProto{gre},
+		},
+	}
+	acl := New(mm, nets([]IP{0x01020304}), nil, nil, t.Logf)
+
+	// ICMP type and code are where rawpacket puts the source port.
+	icmp := func(typ packet.ICMPType, code uint8) []byte {
+		return rawpacket(ICMP, 0x08010101, 0x01020304, uint16(typ)<<8|uint16(code), 0, 0)
+	}
+	tests := []struct {
+		name string
+		want Response
+		b    []byte
+	}{
+		{"echo_request", Accept, icmp(packet.ICMPEchoRequest, 0)},
+		{"echo_request_code", Accept, icmp(packet.ICMPEchoRequest, 1)},
+		{"timestamp", Drop, icmp(13, 0)},
+		{"tcp", Drop, rawpacket(TCP, 0x08010101, 0x01020304, 999, 9999, 0)},
+		{"udp", Drop, rawpacket(UDP, 0x08010101, 0x01020304, 999, 9999, 0)},
+		{"sctp", Accept, rawpacket(SCTP, 0x08010101, 0x01020304, 999, 9999, 0)},
+		{"sctp_other_port", Drop, rawpacket(SCTP, 0x08010101, 0x01020304, 999, 9998, 0)},
+		{"gre", Accept, rawpacket(gre, 0x08010101, 0x01020304, 0, 0, 0)},
+		{"esp", Drop, rawpacket(esp, 0x08010101, 0x01020304, 0, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &ParsedPacket{}
+			q.Decode(tt.b)
+			if got, why, _ := acl.runIn(q); got != tt.want {
+				t.Errorf("got=%v (%s) want=%v packet:%v", got, why, tt.want, q)
+			}
+		})
+	}
+
+	// Without AnyCode, only the given code matches.
+	acl = New(Matches{{
+		Srcs:      []Net{NetAny},
+		Dsts:      []NetPortRange{NetPortRangeAny},
+		ICMPTypes: []ICMPType{{Type: uint8(packet.ICMPEchoRequest), Code: 0}},
+	}}, nets([]IP{0x01020304}), nil, nil, t.Logf)
+	for code, want := range map[uint8]Response{0: Accept, 1: Drop} {
+		q := &ParsedPacket{}
+		q.Decode(icmp(packet.ICMPEchoRequest, code))
+		if got, why, _ := acl.runIn(q); got != want {
+			t.Errorf("code %d: got=%v (%s) want=%v", code, got, why, want)
+		}
+	}
+
+	// Rules without IPProto don't allow other protocols.
+	acl = newFilter(t.Logf)
+	q := &ParsedPacket{}
+	q.Decode(rawpacket(gre, 0x08010101, 0x01020304, 0, 0, 0))
+	if got, why, _ := acl.runIn(q); got != Drop {
+		t.Errorf("GRE with default rules: got=%v (%s) want=%v", got, why, Drop)
+	}
+
+	// Nor sending them.
+	q.Decode(rawpacket(gre, 0x01020304, 0x08010101, 0, 0, 0))
+	if got, why := acl.runOut(q); got != Drop {
+		t.Errorf("outbound GRE with default rules: got=%v (%s) want=%v", got, why, Drop)
+	}
+	acl = New(mm, nets([]IP{0x01020304}), nil, nil, t.Logf)
+	if got, why := acl.runOut(q); got != Accept {
+		t.Errorf("outbound GRE with GRE rule: got=%v (%s) want=%v", got, why, Accept)
+	}
+}
+
+func TestStatefulTCP(t *testing.T) {
+	acl := newFilter(t.Logf)
+
+	syn := rawpacket(TCP, 0x77777777, 0x66666666, 4242, 4343, 0)
+	syn[33] = packet.TCPSyn
+	synack := rawpacket(TCP, 0x66666666, 0x77777777, 4343, 4242, 0)
+	synack[33] = packet.TCPSynAck
+	ack := rawpacket(TCP, 0x66666666, 0x77777777, 4343, 4242, 0)
+	ack[33] = packet.TCPAck
+	resyn := rawpacket(TCP, 0x66666666, 0x77777777, 4343, 4242, 0)
+	resyn[33] = packet.TCPSyn
+	udp := rawpacket(UDP, 0x66666666, 0x77777777, 4343, 4242, 0)
+
+	runIn := func(b []byte) (Response, string) {
+		q := &ParsedPacket{}
+		q.Decode(b)
+		r, why, _ := acl.runIn(q)
+		return r, why
+	}
+
+	// No rule allows these packets, so they are dropped
+	// until the connection is opened from this side.
+	if got, why := runIn(ack); got != Drop {
+		t.Fatalf("ACK before SYN = %v (%s); want Drop", got, why)
+	}
+
+	q := &ParsedPacket{}
+	q.Decode(syn)
+	acl.runOut(q)
+
+	for _, b := range [][]byte{synack, ack} {
+		if got, why := runIn(b); got != Accept {
+			t.Errorf("reply = %v (%s); want Accept", got, why)
+		}
+	}
+	// An open connection doesn't allow new ones, nor other protocols.
+	if got, why := runIn(resyn); got != Drop {
+		t.Errorf("SYN on open connection = %v (%s); want Drop", got, why)
+	}
+	if got, why := runIn(udp); got != Drop {
+		t.Errorf("UDP on open connection = %v (%s); want Drop", got, why)
+	}
+
+	// A long-lived connection survives other flows evicting it
+	// from the LRU, as long as this side keeps sending.
+	for i := 0; i < lruMax; i++ {
+		q.Decode(rawpacket(UDP, 0x77777777, 0x66666666, 1000, uint16(i), 0))
+		acl.runOut(q)
+	}
+	out := rawpacket(TCP, 0x77777777, 0x66666666, 4242, 4343, 0)
+	out[33] = packet.TCPAck
+	q.Decode(out)
+	acl.runOut(q)
+	if got, why := runIn(ack); got != Accept {
+		t.Errorf("reply after eviction = %v (%s); want Accept", got, why)
+	}
+}
+
+func TestDecisions(t *testing.T) {
+	acl := newFilter(t.Logf)
+	rf := RecordDrops | RecordAccepts
+
+	ruleText := matches[3].String()
+	drops := dropsByReason.Get("no rules matched")
+	drops0 := drops.Value()
+
+	for _, b := range [][]byte{
+		rawpacket(UDP, 0x08010101, 0x647a6232, 999, 53, 0),
+		rawpacket(UDP, 0x08010101, 0x05060708, 999, 53, 0),
+	} {
+		q := &ParsedPacket{}
+		q.Decode(b)
+		acl.RunIn(q, rf)
+	}
+	// Without the Record flags, nothing is recorded, but
+	// verdicts are still counted.
+	q := &ParsedPacket{}
+	q.Decode(rawpacket(UDP, 0x08010101, 0x05060708, 999, 53, 0))
+	acl.RunIn(q, 0)
+
+	for i, got := range acl.RuleAccepts() {
+		want := int64(0)
+		if i == 3 {
+			want = 1
+		}
+		if got != want {
+			t.Errorf("accepts by rule #%d = %d; want %d", i, got, want)
+		}
+	}
+	if got := drops.Value() - drops0; got != 2 {
+		t.Errorf("drops = %d; want 2", got)
+	}
+
+	dd := acl.Decisions()
+	if len(dd) != 2 {
+		t.Fatalf("got %d decisions; want 2: %v", len(dd), dd)
+	}
+	if d := dd[0]; d.Verdict != "Accept" || d.Rule != 3 || d.RuleText != ruleText || d.Direction != "in" ||
+		d.Src.String() != "8.1.1.1:999" || d.Dst.String() != "100.122.98.50:53" {
+		t.Errorf("decision 0 = %v", d)
+	}
+	if d := dd[1]; d.Verdict != "Drop" || d.Rule != -1 || d.Reason != "no rules matched" {
+		t.Errorf("decision 1 = %v", d)
+	}
+
+	// Filters sharing state share the log.
+	acl2 := New(nil, nil, nil, acl, t.Logf)
+	if got := len(acl2.Decisions()); got != 2 {
+		t.Errorf("shared filter has %d decisions; want 2", got)
+	}
+
+	// A new filter's counters start at zero.
+	acl3 := New(matches, nil, nil, acl, t.Logf)
+	if got := acl3.RuleAccepts()[3]; got != 0 {
+		t.Errorf("new filter's accepts by rule #3 = %d; want 0", got)
+	}
+}
+
+func TestDecisionLog(t *testing.T) {
+	var l decisionLog
+	for i := 0; i < decisionLogSize+10; i++ {
+		l.add(&ipnstate.FilterDecision{Time: time.Unix(int64(i), 0), Rule: i})
+	}
+	dd := l.decisions()
+	if len(dd) != decisionLogSize {
+		t.Fatalf("got %d decisions; want %d", len(dd), decisionLogSize)
+	}
+	if dd[0].Rule != 10 || dd[len(dd)-1].Rule != decisionLogSize+9 {
+		t.Errorf("decisions span %d..%d; want 10..%d", dd[0].Rule, dd[len(dd)-1].Rule, decisionLogSize+9)
+	}
+
+	// Adding and reading concurrently is safe.
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < decisionLogSize; i++ {
+				l.add(&ipnstate.FilterDecision{Time: time.Now()})
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if got := len(l.decisions()); got != decisionLogSize {
+			t.Errorf("got %d decisions while adding; want %d", got, decisionLogSize)
+		}
+	}
+	wg.Wait()
+}
+
+func ip6(s string) packet.IP6 {
+	return packet.NewIP6(net.ParseIP(s))
+}
+
+func TestFilter6(t *testing.T) {
+	mm := Matches{
+		{
+			Srcs6: []Net6{{ip6("fd7a::1"), Netmask6(128)}},
+			Dsts6: []NetPortRange6{{Net6{ip6("fd7a::2"), Netmask6(128)}, PortRange{22, 22}}},
+		},
+		{
+			Srcs6: []Net6{NetAny6},
+			Dsts6: []NetPortRange6{{Net6{ip6("fd7a:0:0:1::"), Netmask6(64)}, PortRange{443, 443}}},
+		},
+		{
+			// IPv4 rules never match IPv6 packets.
+			Srcs: []Net{NetAny},
+			Dsts: []NetPortRange{NetPortRangeAny},
+		},
+	}
+	localNets6 := []Net6{
+		{ip6("fd7a::2"), Netmask6(128)},
+		{ip6("fd7a::9"), Netmask6(128)},
+		{ip6("fd7a:0:0:1::"), Netmask6(64)},
+	}
+	acl := New(mm, nil, localNets6, nil, t.Logf)
+
+	tests := []struct {
+		want Response
+		p    ParsedPacket
+	}{
+		{Accept, parsed6(TCP, "fd7a::1", "fd7a::2", 999, 22)},
+		{Drop, parsed6(TCP, "fd7a::1", "fd7a::2", 999, 23)},
+		{Drop, parsed6(TCP, "fd7a::3", "fd7a::2", 999, 22)},
+		{Accept, parsed6(UDP, "fd7a::1", "fd7a::2", 999, 22)},
+		{Accept, parsed6(packet.ICMPv6, "fd7a::1", "fd7a::2", 0, 0)},
+		{Accept, parsed6(TCP, "2001:db8::1", "fd7a:0:0:1::5", 999, 443)},
+		{Drop, parsed6(TCP, "2001:db8::1", "fd7a:0:0:1::5", 999, 80)},
+
+		// Destination not in localNets6, even though the policy
+		// would allow it.
+		{Drop, parsed6(TCP, "2001:db8::1", "fd7a:0:0:2::5", 999, 443)},
+
+		// Stateful UDP, as in TestFilter.
+		{Drop, parsed6(UDP, "fd7a::9", "fd7a::2", 4242, 4343)},
+		{Accept, parsed6(UDP, "fd7a::2", "fd7a::9", 4343, 4242)},
+		{Accept, parsed6(UDP, "fd7a::9", "fd7a::2", 4242, 4343)},
+	}
+	for i, test := range tests {
+		got, why, _ := acl.runIn(&test.p)
+		if got != test.want {
+			t.Errorf("#%d got=%v (%s) want=%v packet:%v", i, got, why, test.want, &test.p)
+		}
+		_, _ = acl.runOut(&test.p)
+	}
+}
+
+func TestParseRaw6(t *testing.T) {
+	// IPv6 TCP SYN from fd7a::1 port 999 to fd7a::2 port 22,
+	// behind a hop-by-hop options header.
+	p := parseHexPkt(t, "60 00 00 00 00 1c 00 40"+
+		"fd7a0000000000000000000000000001 fd7a0000000000000000000000000002"+
+		"06 00 01 04 00 00 00 00"+
+		"03 e7 00 16 00 00 00 00 00 00 00 00 50 02 01 00 00 00 00 00")
+	acl := New(Matches{{
+		Srcs6: []Net6{NetAny6},
+		Dsts6: []NetPortRange6{{NetAny6, PortRange{22, 22}}},
+	}}, nil, []Net6{NetAny6}, nil, t.Logf)
+	if got := acl.RunIn(p, 0); got != Accept {
+		t.Errorf("RunIn(%v) = %v; want Accept", p, got)
+	}
+	if got := acl.RunOut(p, 0); got != Accept {
+		t.Errorf("RunOut(%v) = %v; want Accept", p, got)
+	}
+}
+
 func TestNoAllocs(t *testing.T) {
 	acl := newFilter(t.Logf)
 
@@ -170,7 +493,7 @@ func BenchmarkFilter(b *testing.B) {
 	icmpPacket := rawpacket(ICMP, 0x08010101, 0x01020304, 0, 0, 0)
 
 	tcpSynPacket := rawpacket(TCP, 0x08010101, 0x01020304, 999, 22, 0)
-	// TCP filtering is trivial (Accept) for non-SYN packets.
+	// SYN packets are always checked against the rules.
 	tcpSynPacket[33] = packet.TCPSyn
 
 	benches := []struct {
@@ -239,6 +562,18 @@ func parsed(proto packet.IPProto, src, dst packet.IP, sport, dport uint16) Parse
 	}
 }
 
+func parsed6(proto packet.IPProto, src, dst string, sport, dport uint16) ParsedPacket {
+	return ParsedPacket{
+		IPVersion: 6,
+		IPProto:   proto,
+		SrcIP6:    ip6(src),
+		DstIP6:    ip6(dst),
+		SrcPort:   sport,
+		DstPort:   dport,
+		TCPFlags:  packet.TCPSyn,
+	}
+}
+
 // rawpacket generates a packet with given source and destination ports and IPs
 // and resizes the header to trimLength if it is nonzero.
 func rawpacket(proto packet.IPProto, src, dst packet.IP, sport, dport uint16, trimLength int) []byte {
@@ -251,6 +586,8 @@ func rawpacket(proto packet.IPProto, src, dst packet.IP, sport, dport uint16, tr
 		headerLength = 40
 	case UDP:
 		headerLength = 28
+	case SCTP:
+		headerLength = 32
 	default:
 		headerLength = 24
 	}
@@ -279,13 +616,15 @@ func rawpacket(proto packet.IPProto, src, dst packet.IP, sport, dport uint16, tr
 		hdr[9] = 6
 	case UDP:
 		hdr[9] = 17
+	case SCTP:
+		hdr[9] = 132
 	case Fragment:
 		hdr[9] = 6
 		// flags + fragOff
 		bin.PutUint16(hdr[6:8], (1<<13)|1234)
 	case Unknown:
 	default:
-		panic("unknown protocol")
+		hdr[9] = byte(proto)
 	}
 
 	// Trim the header if requested
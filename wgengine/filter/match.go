@@ -49,6 +49,62 @@ func Netmask(bits int) packet.IP {
 	return packet.IP(b)
 }
 
+func NewIP6(ip net.IP) packet.IP6 {
+	return packet.NewIP6(ip)
+}
+
+// Net6 is the IPv6 counterpart of Net.
+type Net6 struct {
+	IP   packet.IP6
+	Mask packet.IP6
+}
+
+func (n Net6) Includes(ip packet.IP6) bool {
+	for i := range ip {
+		if n.IP[i]&n.Mask[i] != ip[i]&n.Mask[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (n Net6) Bits() int {
+	ones := 0
+	for _, b := range n.Mask {
+		ones += bits.OnesCount8(b)
+	}
+	return ones
+}
+
+func (n Net6) String() string {
+	b := n.Bits()
+	if b == 128 {
+		return n.IP.String()
+	} else if b == 0 {
+		return "*"
+	} else {
+		return fmt.Sprintf("%s/%d", n.IP, b)
+	}
+}
+
+var NetAny6 = Net6{}
+var NetNone6 = Net6{Netmask6(128), Netmask6(128)}
+
+func Netmask6(bits int) packet.IP6 {
+	var m packet.IP6
+	for i := range m {
+		switch {
+		case bits >= 8:
+			m[i] = 0xff
+			bits -= 8
+		case bits > 0:
+			m[i] = ^byte(0xff >> uint(bits))
+			bits = 0
+		}
+	}
+	return m
+}
+
 type PortRange struct {
 	First, Last uint16
 }
@@ -76,9 +132,61 @@ func (ipr NetPortRange) String() string {
 	return fmt.Sprintf("%v:%v", ipr.Net, ipr.Ports)
 }
 
+type NetPortRange6 struct {
+	Net   Net6
+	Ports PortRange
+}
+
+var NetPortRangeAny6 = NetPortRange6{NetAny6, PortRangeAny}
+
+func (ipr NetPortRange6) String() string {
+	if ipr.Net.Bits() == 0 {
+		return fmt.Sprintf("*:%v", ipr.Ports)
+	}
+	return fmt.Sprintf("[%v]:%v", ipr.Net, ipr.Ports)
+}
+
+// ICMPType matches ICMP or ICMPv6 messages of type Type
+// and, unless AnyCode is set, code Code.
+type ICMPType struct {
+	Type    uint8
+	Code    uint8
+	AnyCode bool
+}
+
+func (t ICMPType) String() string {
+	if t.AnyCode {
+		return fmt.Sprintf("%d/*", t.Type)
+	}
+	return fmt.Sprintf("%d/%d", t.Type, t.Code)
+}
+
+func (t ICMPType) matches(typ, code uint8) bool {
+	return t.Type == typ && (t.AnyCode || t.Code == code)
+}
+
+// defaultIPProto is the list of protocols a Match with
+// no IPProto applies to.
+var defaultIPProto = []packet.IPProto{packet.TCP, packet.UDP, packet.ICMP, packet.ICMPv6}
+
+// Match allows packets from any of Srcs to any of Dsts. IPv4
+// packets are matched against Srcs and Dsts, and IPv6 packets
+// against Srcs6 and Dsts6.
+//
+// IPProto limits the protocols the match applies to; if it is empty,
+// it applies to TCP, UDP, ICMP and ICMPv6. The ports in Dsts and Dsts6
+// are ignored for protocols without ports. ICMPTypes, if non-empty,
+// limits the ICMP and ICMPv6 messages the match applies to.
+//
+// Outbound packets are allowed for TCP, UDP, SCTP, ICMP and ICMPv6,
+// and for other protocols only if some Match lists them in IPProto.
 type Match struct {
-	Dsts []NetPortRange
-	Srcs []Net
+	Dsts      []NetPortRange
+	Srcs      []Net
+	Dsts6     []NetPortRange6
+	Srcs6     []Net6
+	IPProto   []packet.IPProto
+	ICMPTypes []ICMPType
 }
 
 func (m Match) Clone() (res Match) {
@@ -88,6 +196,18 @@ func (m Match) Clone() (res Match) {
 	if m.Srcs != nil {
 		res.Srcs = append([]Net{}, m.Srcs...)
 	}
+	if m.Dsts6 != nil {
+		res.Dsts6 = append([]NetPortRange6{}, m.Dsts6...)
+	}
+	if m.Srcs6 != nil {
+		res.Srcs6 = append([]Net6{}, m.Srcs6...)
+	}
+	if m.IPProto != nil {
+		res.IPProto = append([]packet.IPProto{}, m.IPProto...)
+	}
+	if m.ICMPTypes != nil {
+		res.ICMPTypes = append([]ICMPType{}, m.ICMPTypes...)
+	}
 	return res
 }
 
@@ -96,10 +216,16 @@ func (m Match) String() string {
 	for _, src := range m.Srcs {
 		srcs = append(srcs, src.String())
 	}
+	for _, src := range m.Srcs6 {
+		srcs = append(srcs, src.String())
+	}
 	dsts := []string{}
 	for _, dst := range m.Dsts {
 		dsts = append(dsts, dst.String())
 	}
+	for _, dst := range m.Dsts6 {
+		dsts = append(dsts, dst.String())
+	}
 
 	var ss, ds string
 	if len(srcs) == 1 {
@@ -112,11 +238,76 @@ func (m Match) String() string {
 	} else {
 		ds = "[" + strings.Join(dsts, ",") + "]"
 	}
-	return fmt.Sprintf("%v=>%v", ss, ds)
+	ret := fmt.Sprintf("%v=>%v", ss, ds)
+	if len(m.IPProto) > 0 {
+		protos := []string{}
+		for _, p := range m.IPProto {
+			protos = append(protos, ipProtoString(p))
+		}
+		ret += " proto=" + strings.Join(protos, ",")
+	}
+	if len(m.ICMPTypes) > 0 {
+		types := []string{}
+		for _, t := range m.ICMPTypes {
+			types = append(types, t.String())
+		}
+		ret += " icmp=" + strings.Join(types, ",")
+	}
+	return ret
+}
+
+// ipProtoString is like p.String, but uses the protocol number
+// for protocols the packet package doesn't know.
+func ipProtoString(p packet.IPProto) string {
+	if s := p.String(); s != "Unknown" {
+		return s
+	}
+	return fmt.Sprint(uint8(p))
+}
+
+// allowsProto reports whether m applies to packets of protocol p.
+func (m *Match) allowsProto(p packet.IPProto) bool {
+	protos := m.IPProto
+	if len(protos) == 0 {
+		protos = defaultIPProto
+	}
+	for _, mp := range protos {
+		if mp == p {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsICMP reports whether m applies to q, if it's an ICMP or
+// ICMPv6 packet. Packets of other protocols are always allowed.
+func (m *Match) allowsICMP(q *packet.ParsedPacket) bool {
+	if len(m.ICMPTypes) == 0 || (q.IPProto != packet.ICMP && q.IPProto != packet.ICMPv6) {
+		return true
+	}
+	typ, code := q.ICMPTypeCode()
+	for _, t := range m.ICMPTypes {
+		if t.matches(typ, code) {
+			return true
+		}
+	}
+	return false
 }
 
 type Matches []Match
 
+// namesProto reports whether any match in mm lists p in its IPProto.
+func (mm Matches) namesProto(p packet.IPProto) bool {
+	for _, m := range mm {
+		for _, mp := range m.IPProto {
+			if mp == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (m Matches) Clone() (res Matches) {
 	for _, match := range m {
 		res = append(res, match.Clone())
@@ -133,8 +324,14 @@ func ipInList(ip packet.IP, netlist []Net) bool {
 	return false
 }
 
-func matchIPPorts(mm Matches, q *packet.ParsedPacket) bool {
-	for _, acl := range mm {
+// matchIPPorts returns the index of the first match in mm that
+// allows q, taking its destination port into account, or -1 if
+// none does.
+func matchIPPorts(mm Matches, q *packet.ParsedPacket) int {
+	for i, acl := range mm {
+		if !acl.allowsProto(q.IPProto) {
+			continue
+		}
 		for _, dst := range acl.Dsts {
 			if !dst.Net.Includes(q.DstIP) {
 				continue
@@ -147,14 +344,19 @@ func matchIPPorts(mm Matches, q *packet.ParsedPacket) bool {
 				// the src will never match.
 				break
 			}
-			return true
+			return i
 		}
 	}
-	return false
+	return -1
 }
 
-func matchIPWithoutPorts(mm Matches, q *packet.ParsedPacket) bool {
-	for _, acl := range mm {
+// matchIPWithoutPorts is like matchIPPorts, for ICMP and other
+// protocols without ports.
+func matchIPWithoutPorts(mm Matches, q *packet.ParsedPacket) int {
+	for i, acl := range mm {
+		if !acl.allowsProto(q.IPProto) || !acl.allowsICMP(q) {
+			continue
+		}
 		for _, dst := range acl.Dsts {
 			if !dst.Net.Includes(q.DstIP) {
 				continue
@@ -164,8 +366,60 @@ func matchIPWithoutPorts(mm Matches, q *packet.ParsedPacket) bool {
 				// the src will never match.
 				break
 			}
+			return i
+		}
+	}
+	return -1
+}
+
+func ipInList6(ip packet.IP6, netlist []Net6) bool {
+	for _, net := range netlist {
+		if net.Includes(ip) {
 			return true
 		}
 	}
 	return false
 }
+
+func matchIPPorts6(mm Matches, q *packet.ParsedPacket) int {
+	for i, acl := range mm {
+		if !acl.allowsProto(q.IPProto) {
+			continue
+		}
+		for _, dst := range acl.Dsts6 {
+			if !dst.Net.Includes(q.DstIP6) {
+				continue
+			}
+			if q.DstPort < dst.Ports.First || q.DstPort > dst.Ports.Last {
+				continue
+			}
+			if !ipInList6(q.SrcIP6, acl.Srcs6) {
+				// Skip other dests in this acl, since
+				// the src will never match.
+				break
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+func matchIPWithoutPorts6(mm Matches, q *packet.ParsedPacket) int {
+	for i, acl := range mm {
+		if !acl.allowsProto(q.IPProto) || !acl.allowsICMP(q) {
+			continue
+		}
+		for _, dst := range acl.Dsts6 {
+			if !dst.Net.Includes(q.DstIP6) {
+				continue
+			}
+			if !ipInList6(q.SrcIP6, acl.Srcs6) {
+				// Skip other dests in this acl, since
+				// the src will never match.
+				break
+			}
+			return i
+		}
+	}
+	return -1
+}
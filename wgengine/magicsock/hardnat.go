@@ -0,0 +1,367 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/disco"
+	"tailscale.com/net/stun"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/types/key"
+)
+
+// Hard NAT traversal.
+//
+// When both we and a peer are behind NATs whose mappings vary by
+// destination (netcheck's MappingVariesByDestIP, a "hard" NAT), the
+// endpoints we each learn from STUN are mappings to the STUN server,
+// not to each other, and disco pings to them don't get through.
+//
+// Instead, both sides open hardNATPorts extra local ports and spray
+// disco pings from them at random ports on the other's public IPs.
+// Every ping opens a new mapping on the sender's NAT, and the pings
+// the other side sprays at random each stand a chance of landing on
+// one of them. By the birthday paradox, a few hundred pings each
+// make a hit very likely, if the NATs only filter by remote IP. NATs
+// that also filter by remote port need each side to guess the other's
+// mapping and the port that mapping was sent to, which is far less
+// likely. Whoever hears the pong to a hit learns a working address for
+// the peer and uses it like any other endpoint.
+//
+// Only the hard NAT port that made the hit has a mapping the peer's
+// NAT lets in, so everything sent to an address found this way,
+// including pongs to the peer's pings, goes out through that port.
+
+const (
+	// hardNATPorts is how many extra local ports are opened to spray
+	// from.
+	hardNATPorts = 64
+
+	// hardNATPings is the most pings sent to a peer in one spray.
+	hardNATPings = 1024
+
+	// hardNATPingsPerSecond bounds the rate of spray pings, across
+	// all peers.
+	hardNATPingsPerSecond = 250
+
+	// hardNATSprayInterval is the minimum time between sprays to a
+	// peer.
+	hardNATSprayInterval = 30 * time.Second
+
+	// hardNATPortsIdle is how long the extra ports are kept open
+	// after the last spray or packet received on them.
+	hardNATPortsIdle = sessionActiveTimeout
+)
+
+// hardNATSprayPorts is the inclusive range of ports that pings are
+// sprayed at. Tests narrow it to match their NATs.
+var hardNATSprayPorts = [2]uint16{1024, 65535}
+
+// hardNATPortSet is the set of extra local ports used for hard NAT
+// traversal.
+type hardNATPortSet struct {
+	// lastActiveUnixNano is when the ports were last sprayed from or
+	// received on. It's atomically accessed; declared first for
+	// alignment reasons.
+	lastActiveUnixNano int64
+
+	conns     []net.PacketConn
+	idleTimer *time.Timer
+}
+
+func (ps *hardNATPortSet) noteActive() {
+	atomic.StoreInt64(&ps.lastActiveUnixNano, time.Now().UnixNano())
+}
+
+// hardNATReadResult is a non-disco packet received on one of the
+// hard NAT ports.
+type hardNATReadResult struct {
+	ipp netaddr.IPPort
+	b   []byte // copied; ownership passed to receiver
+}
+
+// hardNATConnsLocked returns the extra local ports to spray from,
+// opening them if needed.
+//
+// c.mu must be held.
+func (c *Conn) hardNATConnsLocked() ([]net.PacketConn, error) {
+	if ps := c.hardNATPorts; ps != nil {
+		ps.noteActive()
+		return ps.conns, nil
+	}
+	host := ""
+	if inTest() {
+		host = "127.0.0.1"
+	}
+	ps := new(hardNATPortSet)
+	for i := 0; i < hardNATPorts; i++ {
+		pc, err := c.listenPacket(context.Background(), "udp4", host+":0")
+		if err != nil {
+			for _, pc := range ps.conns {
+				pc.Close()
+			}
+			return nil, err
+		}
+		ps.conns = append(ps.conns, pc)
+	}
+	ps.noteActive()
+	ps.idleTimer = time.AfterFunc(hardNATPortsIdle, c.closeIdleHardNATPorts)
+	for _, pc := range ps.conns {
+		go c.readHardNAT(ps, pc)
+	}
+	c.hardNATPorts = ps
+	return ps.conns, nil
+}
+
+// closeIdleHardNATPorts closes the hard NAT ports if they've been
+// idle for hardNATPortsIdle, and otherwise checks again later.
+func (c *Conn) closeIdleHardNATPorts() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ps := c.hardNATPorts
+	if ps == nil {
+		return
+	}
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&ps.lastActiveUnixNano)))
+	if idle < hardNATPortsIdle {
+		ps.idleTimer.Reset(hardNATPortsIdle - idle)
+		return
+	}
+	c.logf("magicsock: closing %d idle hard NAT ports", len(ps.conns))
+	c.closeHardNATPortsLocked()
+}
+
+// c.mu must be held.
+func (c *Conn) closeHardNATPortsLocked() {
+	ps := c.hardNATPorts
+	if ps == nil {
+		return
+	}
+	ps.idleTimer.Stop()
+	for _, pc := range ps.conns {
+		pc.Close()
+	}
+	c.hardNATPorts = nil
+	for _, de := range c.endpointOfDisco {
+		de.removeHardNATEndpoints()
+	}
+}
+
+// readHardNAT reads packets arriving on one of the hard NAT ports
+// until it's closed. Disco messages are handled directly; anything
+// else is passed on to ReceiveIPv4.
+func (c *Conn) readHardNAT(ps *hardNATPortSet, pc net.PacketConn) {
+	var ic ippCache
+	buf := make([]byte, 64<<10)
+	for {
+		n, pAddr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		ps.noteActive()
+		ipp, ok := ic.IPPort(pAddr.(*net.UDPAddr))
+		if !ok || stun.Is(buf[:n]) {
+			continue
+		}
+		if c.handleDiscoMessageFrom(buf[:n], ipp, pc) {
+			continue
+		}
+		select {
+		case c.hardNATRecvCh <- hardNATReadResult{ipp: ipp, b: append([]byte(nil), buf[:n]...)}:
+		case <-c.donec():
+			return
+		}
+	}
+}
+
+// hardNATSprayIPs returns the peer's public IPv4 addresses to spray
+// at, from its endpoints.
+//
+// de.mu must be held.
+func (de *discoEndpoint) hardNATSprayIPs() (ips []netaddr.IP) {
+	seen := map[netaddr.IP]bool{}
+	for ep, st := range de.endpointState {
+		if st.hardNAT || seen[ep.IP] || !isPublicIPv4(ep.IP) {
+			continue
+		}
+		seen[ep.IP] = true
+		ips = append(ips, ep.IP)
+	}
+	return ips
+}
+
+// wantHardNATSprayLocked reports whether we should spray pings at
+// the peer to traverse both our hard NATs.
+//
+// de.mu must be held.
+func (de *discoEndpoint) wantHardNATSprayLocked(now time.Time) bool {
+	if !de.peerHardNAT || !de.c.behindHardNAT.Get() || de.hardNATSpraying {
+		return false
+	}
+	if !de.bestAddr.IsZero() && now.Before(de.trustBestAddrUntil) {
+		return false
+	}
+	return de.lastHardNATSpray.IsZero() || now.Sub(de.lastHardNATSpray) >= hardNATSprayInterval
+}
+
+// startHardNATSprayLocked starts spraying pings at the peer in a new
+// goroutine.
+//
+// de.mu must be held.
+func (de *discoEndpoint) startHardNATSprayLocked(now time.Time) {
+	ips := de.hardNATSprayIPs()
+	if len(ips) == 0 {
+		return
+	}
+	de.hardNATSpraying = true
+	de.lastHardNATSpray = now
+
+	// Forget addresses found by earlier sprays; the mappings
+	// behind them have likely expired by now.
+	for ep, st := range de.endpointState {
+		if st.hardNAT && ep != de.bestAddr {
+			delete(de.endpointState, ep)
+		}
+	}
+
+	de.c.logf("magicsock: disco: both sides behind hard NATs; spraying pings at %v for %v (%v)", ips, de.publicKey.ShortString(), de.discoShort)
+	go de.sprayHardNAT(ips)
+}
+
+// sprayHardNAT sends up to hardNATPings disco pings, round robin from
+// the hard NAT ports, to random ports on ips. It stops early once a
+// pong gives us a trusted path or the endpoint is reset.
+func (de *discoEndpoint) sprayHardNAT(ips []netaddr.IP) {
+	c := de.c
+	defer func() {
+		de.mu.Lock()
+		de.hardNATSpraying = false
+		de.mu.Unlock()
+	}()
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	conns, err := c.hardNATConnsLocked()
+	c.mu.Unlock()
+	if err != nil {
+		c.logf("magicsock: disco: opening hard NAT ports: %v", err)
+		return
+	}
+
+	for i := 0; i < hardNATPings; i++ {
+		if err := c.hardNATLimiter.Wait(c.connCtx); err != nil {
+			return
+		}
+		now := time.Now()
+		de.mu.Lock()
+		if de.lastSend.IsZero() || (!de.bestAddr.IsZero() && now.Before(de.trustBestAddrUntil)) {
+			de.mu.Unlock()
+			return
+		}
+		lo, hi := hardNATSprayPorts[0], hardNATSprayPorts[1]
+		dst := netaddr.IPPort{
+			IP:   ips[i%len(ips)],
+			Port: lo + uint16(rand.Intn(int(hi-lo)+1)),
+		}
+		pc := conns[i%len(conns)]
+		txid := stun.NewTxID()
+		de.sentPing[txid] = sentPing{
+			to:      dst,
+			from:    pc,
+			at:      now,
+			timer:   time.AfterFunc(pingTimeoutDuration, func() { de.pingTimeout(txid) }),
+			purpose: pingHardNAT,
+		}
+		de.mu.Unlock()
+
+		sent, _ := c.sendDiscoMessageFrom(pc, dst, de.publicKey, de.discoKey, &disco.Ping{TxID: [12]byte(txid)}, discoVerboseLog)
+		if !sent {
+			// The ports were closed under us.
+			de.forgetPing(txid)
+			return
+		}
+	}
+	c.logf("magicsock: disco: no path found after spraying %d pings at %v for %v (%v)", hardNATPings, ips, de.publicKey.ShortString(), de.discoShort)
+}
+
+// addHardNATEndpointLocked records ep, which answered a spray ping
+// sent from pc or pinged us on pc, as an endpoint of the peer that's
+// reached through pc.
+//
+// de.mu must be held.
+func (de *discoEndpoint) addHardNATEndpointLocked(ep netaddr.IPPort, pc net.PacketConn) {
+	if _, ok := de.endpointState[ep]; ok {
+		return
+	}
+	de.c.logf("magicsock: disco: hard NAT spray found %v for %v (%v)", ep, de.publicKey.ShortString(), de.discoShort)
+	de.endpointState[ep] = &endpointState{index: -1, hardNAT: true, hardNATConn: pc}
+}
+
+// removeHardNATEndpoints forgets the endpoints found by spraying,
+// after the hard NAT ports they were reached through are closed.
+func (de *discoEndpoint) removeHardNATEndpoints() {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	for ep, st := range de.endpointState {
+		if !st.hardNAT {
+			continue
+		}
+		delete(de.endpointState, ep)
+		if de.bestAddr == ep {
+			de.bestAddr = netaddr.IPPort{}
+		}
+	}
+}
+
+// hardNATConnLocked returns the hard NAT port that ep is reached
+// through, or nil if ep wasn't found by spraying.
+//
+// de.mu must be held.
+func (de *discoEndpoint) hardNATConnLocked(ep netaddr.IPPort) net.PacketConn {
+	if st, ok := de.endpointState[ep]; ok {
+		return st.hardNATConn
+	}
+	return nil
+}
+
+// sendAddrFrom is like sendAddr, but if pc is non-nil, it sends b
+// from pc, one of the hard NAT ports, rather than from the Conn's own
+// sockets or DERP.
+func (c *Conn) sendAddrFrom(pc net.PacketConn, addr netaddr.IPPort, pubKey key.Public, b []byte) (sent bool, err error) {
+	if pc == nil {
+		return c.sendAddr(addr, pubKey, b)
+	}
+	ua := addr.UDPAddr()
+	defer netaddr.PutUDPAddr(ua)
+	_, err = pc.WriteTo(b, ua)
+	return err == nil, err
+}
+
+var (
+	private1 = netaddr.IPPrefix{IP: netaddr.IPv4(10, 0, 0, 0), Bits: 8}
+	private2 = netaddr.IPPrefix{IP: netaddr.IPv4(172, 16, 0, 0), Bits: 12}
+	private3 = netaddr.IPPrefix{IP: netaddr.IPv4(192, 168, 0, 0), Bits: 16}
+)
+
+// isPublicIPv4 reports whether ip is a global unicast IPv4 address
+// outside the private and CGNAT ranges.
+func isPublicIPv4(ip netaddr.IP) bool {
+	if !ip.Is4() || private1.Contains(ip) || private2.Contains(ip) || private3.Contains(ip) {
+		return false
+	}
+	if tsaddr.CGNATRange().Contains(ip) {
+		return false
+	}
+	return ip.IPAddr().IP.IsGlobalUnicast()
+}
@@ -44,6 +44,7 @@ import (
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/netcheck"
 	"tailscale.com/net/netns"
+	"tailscale.com/net/portmapper"
 	"tailscale.com/net/stun"
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
@@ -102,6 +103,7 @@ type Conn struct {
 	logf             logger.Logf
 	sendLogLimit     *rate.Limiter
 	netChecker       *netcheck.Client
+	portMapper       *portmapper.Client     // maps pconn4's port on the router, if it can
 	idleFunc         func() time.Duration   // nil means unknown
 	noteRecvActivity func(tailcfg.DiscoKey) // or nil, see Options.NoteRecvActivity
 
@@ -118,12 +120,21 @@ type Conn struct {
 	// Its Loaded value is always non-nil.
 	stunReceiveFunc atomic.Value // of func(p []byte, fromAddr *net.UDPAddr)
 
-	udpRecvCh  chan udpReadResult
-	derpRecvCh chan derpReadResult
+	udpRecvCh     chan udpReadResult
+	derpRecvCh    chan derpReadResult
+	hardNATRecvCh chan hardNATReadResult
+
+	// hardNATLimiter limits the rate of hard NAT spray pings; see
+	// hardnat.go.
+	hardNATLimiter *rate.Limiter
 
 	// packetListener optionally specifies a test hook to open a PacketConn.
 	packetListener nettype.PacketListener
 
+	// derpDialContext optionally specifies a test hook to dial DERP
+	// servers.
+	derpDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
 	// ============================================================
 	mu     sync.Mutex // guards all following fields; see userspaceEngine lock ordering rules
 	muCond *sync.Cond
@@ -193,6 +204,14 @@ type Conn struct {
 	// necessarily have a netcheck.Report and don't want to skip
 	// logging.
 	noV4, noV6 syncs.AtomicBool
+
+	// behindHardNAT is whether netcheck last found that our NAT's
+	// mappings vary by destination.
+	behindHardNAT syncs.AtomicBool
+
+	// hardNATPorts are the extra local ports used for hard NAT
+	// traversal, or nil if none are open.
+	hardNATPorts *hardNATPortSet
 }
 
 // derpRoute is a route entry for a public key, saying that a certain
@@ -275,6 +294,10 @@ type Options struct {
 	// It's meant for testing.
 	PacketListener nettype.PacketListener
 
+	// DERPDialContext optionally specifies how to dial DERP servers.
+	// It's meant for testing, alongside PacketListener.
+	DERPDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
 	// NoteRecvActivity, if provided, is a func for magicsock to
 	// call whenever it receives a packet from a a
 	// discovery-capable peer if it's been more than ~10 seconds
@@ -312,6 +335,8 @@ func newConn() *Conn {
 		addrsByKey:      make(map[key.Public]*AddrSet),
 		derpRecvCh:      make(chan derpReadResult),
 		udpRecvCh:       make(chan udpReadResult),
+		hardNATRecvCh:   make(chan hardNATReadResult),
+		hardNATLimiter:  rate.NewLimiter(hardNATPingsPerSecond, hardNATPingsPerSecond/10),
 		derpStarted:     make(chan struct{}),
 		peerLastDerp:    make(map[key.Public]int),
 		endpointOfDisco: make(map[tailcfg.DiscoKey]*discoEndpoint),
@@ -334,6 +359,7 @@ func NewConn(opts Options) (*Conn, error) {
 	c.epFunc = opts.endpointsFunc()
 	c.idleFunc = opts.IdleFunc
 	c.packetListener = opts.PacketListener
+	c.derpDialContext = opts.DERPDialContext
 	c.noteRecvActivity = opts.NoteRecvActivity
 
 	if err := c.initialBind(); err != nil {
@@ -342,12 +368,16 @@ func NewConn(opts Options) (*Conn, error) {
 
 	c.connCtx, c.connCtxCancel = context.WithCancel(context.Background())
 	c.netChecker = &netcheck.Client{
-		Logf:         logger.WithPrefix(c.logf, "netcheck: "),
-		GetSTUNConn4: func() netcheck.STUNConn { return c.pconn4 },
+		Logf:            logger.WithPrefix(c.logf, "netcheck: "),
+		GetSTUNConn4:    func() netcheck.STUNConn { return c.pconn4 },
+		PacketListener:  c.packetListener,
+		DERPDialContext: c.derpDialContext,
 	}
 	if c.pconn6 != nil {
 		c.netChecker.GetSTUNConn6 = func() netcheck.STUNConn { return c.pconn6 }
 	}
+	c.portMapper = portmapper.NewClient(c.logf, c.onPortMapChanged)
+	c.portMapper.SetLocalPort(c.LocalPort())
 
 	c.ignoreSTUNPackets()
 
@@ -444,6 +474,9 @@ func (c *Conn) updateNetInfo(ctx context.Context) (*netcheck.Report, error) {
 
 	c.noV4.Set(!report.IPv4)
 	c.noV6.Set(!report.IPv6)
+	if v, ok := report.MappingVariesByDestIP.Get(); ok {
+		c.behindHardNAT.Set(v)
+	}
 
 	ni := &tailcfg.NetInfo{
 		DERPLatency:           map[string]float64{},
@@ -673,6 +706,18 @@ func (c *Conn) determineEndpoints(ctx context.Context) (ipPorts []string, reason
 			}
 		}
 	}
+
+	// If netcheck found a port mapping service on the LAN, ask it
+	// to map our port. Even behind a hard NAT that's an endpoint
+	// peers can reach directly.
+	if nr.UPnP.EqualBool(true) || nr.PMP.EqualBool(true) || nr.PCP.EqualBool(true) {
+		if ext, err := c.portMapper.CreateOrGetMapping(ctx); err == nil {
+			addAddr(ext.String(), "portmap")
+		} else if err != portmapper.ErrNoPortMappingServices {
+			c.logf("magicsock: portmapper: %v", err)
+		}
+	}
+
 	if nr.GlobalV6 != "" {
 		addAddr(nr.GlobalV6, "stun")
 	}
@@ -1054,6 +1099,7 @@ func (c *Conn) derpWriteChanOfAddr(addr netaddr.IPPort, peer key.Public) chan<-
 
 	dc.NotePreferred(c.myDerp == regionID)
 	dc.DNSCache = dnscache.Get()
+	dc.DialContext = c.derpDialContext
 
 	ctx, cancel := context.WithCancel(c.connCtx)
 	ch := make(chan derpWriteRequest, bufferedDerpWritesBeforeDrop)
@@ -1216,6 +1262,16 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netaddr.IPPort, d
 				peerPresent[m.Source] = true
 				c.addDerpPeerRoute(m.Source, regionID, dc)
 			}
+		case derp.ServerRestartingMessage:
+			// The server hung up on us. Instead of our usual retry
+			// backoff, the next Recv waits as long as it asked
+			// before reconnecting.
+			c.logf("magicsock: derp-%d restarting; reconnecting in %v", regionID, m.ReconnectIn)
+			for peer := range peerPresent {
+				delete(peerPresent, peer)
+				c.removeDerpPeerRoute(peer, regionID, dc)
+			}
+			continue
 		default:
 			// Ignore.
 			// TODO: handle endpoint notification messages.
@@ -1396,25 +1452,7 @@ Top:
 
 	select {
 	case dm := <-c.derpRecvCh:
-		// Cancel the pconn read goroutine
-		c.pconn4.SetReadDeadline(aLongTimeAgo)
-		// Wait for the UDP-reading goroutine to be done, since it's currently
-		// the owner of the b []byte buffer:
-		select {
-		case um := <-c.udpRecvCh:
-			if um.err != nil {
-				// The normal case. The SetReadDeadline interrupted
-				// the read and we get an error which we now ignore.
-			} else {
-				// The pconn.ReadFrom succeeded and was about to send,
-				// but DERP sent first. So now we have both ready.
-				// Save the UDP packet away for use by the next
-				// ReceiveIPv4 call.
-				c.bufferedIPv4From = um.ipp
-				c.bufferedIPv4Packet = append(c.bufferedIPv4Packet[:0], b[:um.n]...)
-			}
-			c.pconn4.SetReadDeadline(time.Time{})
-		case <-c.donec():
+		if !c.stopAwaitUDP4(b) {
 			return 0, nil, nil, errors.New("Conn closed")
 		}
 		var regionID int
@@ -1469,6 +1507,13 @@ Top:
 		}
 		n, addr, ipp = um.n, um.addr, um.ipp
 
+	case hm := <-c.hardNATRecvCh:
+		if !c.stopAwaitUDP4(b) {
+			return 0, nil, nil, errors.New("Conn closed")
+		}
+		n, ipp = copy(b, hm.b), hm.ipp
+		addr = ipp.UDPAddr()
+
 	case <-c.donec():
 		// Socket has been shut down. All the producers of packets
 		// respond to the context cancellation and go away, so we have
@@ -1496,6 +1541,36 @@ Top:
 	return n, ep, wgRecvAddr(ep, ipp, addr), nil
 }
 
+// stopAwaitUDP4 interrupts the awaitUDP4 goroutine started by
+// ReceiveIPv4 and waits for it to give up ownership of b. A UDP
+// packet it had already read is saved for the next ReceiveIPv4 call.
+//
+// It reports false if the Conn was closed first.
+func (c *Conn) stopAwaitUDP4(b []byte) bool {
+	// Cancel the pconn read goroutine
+	c.pconn4.SetReadDeadline(aLongTimeAgo)
+	// Wait for the UDP-reading goroutine to be done, since it's currently
+	// the owner of the b []byte buffer:
+	select {
+	case um := <-c.udpRecvCh:
+		if um.err != nil {
+			// The normal case. The SetReadDeadline interrupted
+			// the read and we get an error which we now ignore.
+		} else {
+			// The pconn.ReadFrom succeeded and was about to send,
+			// but another packet arrived first. So now we have
+			// both ready. Save the UDP packet away for use by the
+			// next ReceiveIPv4 call.
+			c.bufferedIPv4From = um.ipp
+			c.bufferedIPv4Packet = append(c.bufferedIPv4Packet[:0], b[:um.n]...)
+		}
+		c.pconn4.SetReadDeadline(time.Time{})
+		return true
+	case <-c.donec():
+		return false
+	}
+}
+
 func (c *Conn) ReceiveIPv6(b []byte) (int, conn.Endpoint, *net.UDPAddr, error) {
 	if c.pconn6 == nil {
 		return 0, nil, nil, syscall.EAFNOSUPPORT
@@ -1537,6 +1612,13 @@ const (
 )
 
 func (c *Conn) sendDiscoMessage(dst netaddr.IPPort, dstKey tailcfg.NodeKey, dstDisco tailcfg.DiscoKey, m disco.Message, logLevel discoLogLevel) (sent bool, err error) {
+	return c.sendDiscoMessageFrom(nil, dst, dstKey, dstDisco, m, logLevel)
+}
+
+// sendDiscoMessageFrom is like sendDiscoMessage, but if pc is
+// non-nil, it sends the message from pc rather than from the Conn's
+// own sockets or DERP.
+func (c *Conn) sendDiscoMessageFrom(pc net.PacketConn, dst netaddr.IPPort, dstKey tailcfg.NodeKey, dstDisco tailcfg.DiscoKey, m disco.Message, logLevel discoLogLevel) (sent bool, err error) {
 	c.mu.Lock()
 	if c.closed {
 		c.mu.Unlock()
@@ -1554,7 +1636,7 @@ func (c *Conn) sendDiscoMessage(dst netaddr.IPPort, dstKey tailcfg.NodeKey, dstD
 	c.mu.Unlock()
 
 	pkt = box.SealAfterPrecomputation(pkt, m.AppendMarshal(nil), &nonce, sharedKey)
-	sent, err = c.sendAddr(dst, key.Public(dstKey), pkt)
+	sent, err = c.sendAddrFrom(pc, dst, key.Public(dstKey), pkt)
 	if sent {
 		if logLevel == discoLog || (logLevel == discoVerboseLog && debugDisco) {
 			c.logf("magicsock: disco: %v->%v (%v, %v) sent %v", c.discoShort, dstDisco.ShortString(), dstKey.ShortString(), derpStr(dst.String()), disco.MessageSummary(m))
@@ -1580,6 +1662,12 @@ func (c *Conn) sendDiscoMessage(dst netaddr.IPPort, dstKey tailcfg.NodeKey, dstD
 // For messages received over DERP, the addr will be derpMagicIP (with
 // port being the region)
 func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort) bool {
+	return c.handleDiscoMessageFrom(msg, src, nil)
+}
+
+// handleDiscoMessageFrom is like handleDiscoMessage, but if pc is
+// non-nil, msg arrived on pc, one of the hard NAT ports.
+func (c *Conn) handleDiscoMessageFrom(msg []byte, src netaddr.IPPort, pc net.PacketConn) bool {
 	const headerLen = len(disco.Magic) + len(tailcfg.DiscoKey{}) + disco.NonceLen
 	if len(msg) < headerLen || string(msg[:len(disco.Magic)]) != disco.Magic {
 		return false
@@ -1703,7 +1791,7 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort) bool {
 
 	switch dm := dm.(type) {
 	case *disco.Ping:
-		c.handlePingLocked(dm, de, src, sender, peerNode)
+		c.handlePingLocked(dm, de, src, pc, sender, peerNode)
 	case *disco.Pong:
 		if de == nil {
 			return true
@@ -1724,8 +1812,8 @@ func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort) bool {
 	return true
 }
 
-// de may be nil
-func (c *Conn) handlePingLocked(dm *disco.Ping, de *discoEndpoint, src netaddr.IPPort, sender tailcfg.DiscoKey, peerNode *tailcfg.Node) {
+// de may be nil. pc is the hard NAT port the ping arrived on, or nil.
+func (c *Conn) handlePingLocked(dm *disco.Ping, de *discoEndpoint, src netaddr.IPPort, pc net.PacketConn, sender tailcfg.DiscoKey, peerNode *tailcfg.Node) {
 	if peerNode == nil {
 		c.logf("magicsock: disco: [unexpected] ignoring ping from unknown peer Node")
 		return
@@ -1744,11 +1832,21 @@ func (c *Conn) handlePingLocked(dm *disco.Ping, de *discoEndpoint, src netaddr.I
 	}
 
 	// Remember this route if not present.
-	c.setAddrToDiscoLocked(src, sender, nil)
+	if src.IP != derpMagicIPAddr {
+		c.setAddrToDiscoLocked(src, sender, nil)
+	}
+	if pc != nil && de != nil {
+		// The peer's spray got through to one of our hard NAT
+		// ports. Only that port's mapping lets the peer in, so
+		// reach it from there.
+		de.mu.Lock()
+		de.addHardNATEndpointLocked(src, pc)
+		de.mu.Unlock()
+	}
 
 	ipDst := src
 	discoDest := sender
-	go c.sendDiscoMessage(ipDst, peerNode.Key, discoDest, &disco.Pong{
+	go c.sendDiscoMessageFrom(pc, ipDst, peerNode.Key, discoDest, &disco.Pong{
 		TxID: dm.TxID,
 		Src:  src,
 	}, discoVerboseLog)
@@ -2103,7 +2201,6 @@ func (c *Conn) Close() error {
 		c.mu.Unlock()
 		return nil
 	}
-	defer c.mu.Unlock()
 
 	for _, ep := range c.endpointOfDisco {
 		ep.stopAndReset()
@@ -2112,6 +2209,7 @@ func (c *Conn) Close() error {
 	c.closed = true
 	c.connCtxCancel()
 	c.closeAllDerpLocked("conn-close")
+	c.closeHardNATPortsLocked()
 	if c.pconn6 != nil {
 		c.pconn6.Close()
 	}
@@ -2124,6 +2222,11 @@ func (c *Conn) Close() error {
 	for c.goroutinesRunningLocked() {
 		c.muCond.Wait()
 	}
+	c.mu.Unlock()
+
+	// Release the port mapping, if any. That talks to the router,
+	// so it's done without holding c.mu.
+	c.portMapper.Close()
 	return err
 }
 
@@ -2228,6 +2331,11 @@ func (c *Conn) periodicDerpCleanup() {
 	}
 }
 
+// onPortMapChanged is called by the port mapper when renewing the
+// mapping changed its external address, which is one of our
+// endpoints.
+func (c *Conn) onPortMapChanged() { c.ReSTUN("portmap-changed") }
+
 // ReSTUN triggers an address discovery.
 // The provided why string is for debug logging only.
 func (c *Conn) ReSTUN(why string) {
@@ -2342,6 +2450,7 @@ func (c *Conn) Rebind() {
 		return
 	}
 	c.pconn4.Reset(packetConn.(*net.UDPConn))
+	c.portMapper.SetLocalPort(c.LocalPort())
 
 	c.mu.Lock()
 	c.closeAllDerpLocked("rebind")
@@ -2907,6 +3016,106 @@ func (c *Conn) derpRegionCodeOfIDLocked(regionID int) string {
 	return ""
 }
 
+// Ping handles a "tailscale ping" CLI query. The callback cb is
+// called (possibly synchronously) once with the result, which says
+// whether the peer answered via a direct path or via DERP.
+func (c *Conn) Ping(ip netaddr.IP, cb func(*ipnstate.PingResult)) {
+	res := &ipnstate.PingResult{IP: ip.String()}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.privateKey.IsZero() {
+		res.Err = "local tailscaled stopped"
+		cb(res)
+		return
+	}
+	peer, ok := peerForIP(c.netMap, ip)
+	if !ok {
+		res.Err = "no matching peer"
+		cb(res)
+		return
+	}
+	if len(peer.Addresses) > 0 {
+		res.NodeIP = peer.Addresses[0].IP.String()
+	}
+	res.NodeName = peer.Name // prefer DNS name
+	if res.NodeName == "" {
+		res.NodeName = peer.Hostinfo.Hostname // else hostname
+	} else if i := strings.Index(res.NodeName, "."); i != -1 {
+		res.NodeName = res.NodeName[:i]
+	}
+
+	dk, ok := c.discoOfNode[peer.Key]
+	if !ok {
+		res.Err = "no discovery key for peer (pre Tailscale 0.100 version?)"
+		cb(res)
+		return
+	}
+	de, ok := c.endpointOfDisco[dk]
+	if !ok {
+		// The peer is idle and not yet configured in wireguard-go.
+		// Like an incoming disco message, have the engine create
+		// the endpoint. That can't be done while holding c.mu.
+		c.mu.Unlock()
+		if c.noteRecvActivity != nil {
+			c.noteRecvActivity(dk)
+		}
+		c.mu.Lock()
+
+		if c.closed || c.privateKey.IsZero() {
+			res.Err = "local tailscaled stopped"
+			cb(res)
+			return
+		}
+		de, ok = c.endpointOfDisco[dk]
+		if !ok {
+			res.Err = "internal error: failed to create endpoint for discokey"
+			cb(res)
+			return
+		}
+		c.logf("magicsock: started peer %v for ping to %v", dk.ShortString(), peer.Key.ShortString())
+	}
+	de.cliPing(res, cb)
+}
+
+// populateCLIPingResponseLocked fills in res for a pong received
+// with the given latency from ep, which might be a DERP address.
+//
+// c.mu must be held.
+func (c *Conn) populateCLIPingResponseLocked(res *ipnstate.PingResult, latency time.Duration, ep netaddr.IPPort) {
+	res.LatencySeconds = latency.Seconds()
+	if ep.IP != derpMagicIPAddr {
+		res.Endpoint = ep.String()
+		return
+	}
+	regionID := int(ep.Port)
+	res.DERPRegionID = regionID
+	res.DERPRegionCode = c.derpRegionCodeOfIDLocked(regionID)
+}
+
+// peerForIP returns the peer in nm that handles traffic for ip,
+// either as one of its own addresses or as a subnet route.
+func peerForIP(nm *controlclient.NetworkMap, ip netaddr.IP) (n *tailcfg.Node, ok bool) {
+	if nm == nil {
+		return nil, false
+	}
+	for _, p := range nm.Peers {
+		for _, cidr := range p.Addresses {
+			if nip, ok := netaddr.FromStdIP(cidr.IP.IP()); ok && nip.Unmap() == ip {
+				return p, true
+			}
+		}
+	}
+	for _, p := range nm.Peers {
+		for _, cidr := range p.AllowedIPs {
+			if pfx, ok := netaddr.FromStdIPNet(cidr.IPNet()); ok && pfx.Contains(ip) {
+				return p, true
+			}
+		}
+	}
+	return nil, false
+}
+
 func (c *Conn) UpdateStatus(sb *ipnstate.StatusBuilder) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -2941,9 +3150,14 @@ func (c *Conn) UpdateStatus(sb *ipnstate.StatusBuilder) {
 		sb.AddPeer(k, ps)
 	}
 
-	c.foreachActiveDerpSortedLocked(func(node int, ad activeDerp) {
-		// TODO(bradfitz): add to ipnstate.StatusBuilder
-		//f("<li><b>derp-%v</b>: cr%v,wr%v</li>", node, simpleDur(now.Sub(ad.createTime)), simpleDur(now.Sub(*ad.lastWrite)))
+	c.foreachActiveDerpSortedLocked(func(regionID int, ad activeDerp) {
+		sb.AddDERP(ipnstate.DERPStatus{
+			RegionID:       regionID,
+			RegionCode:     c.derpRegionCodeOfIDLocked(regionID),
+			Home:           regionID == c.myDerp,
+			Created:        ad.createTime,
+			LatencySeconds: ad.c.RTT().Seconds(),
+		})
 	})
 }
 
@@ -2987,6 +3201,17 @@ type discoEndpoint struct {
 	trustBestAddrUntil time.Time // time when bestAddr expires
 	sentPing           map[stun.TxID]sentPing
 	endpointState      map[netaddr.IPPort]*endpointState
+
+	peerHardNAT      bool      // peer's netmap NetInfo says its NAT's mappings vary by destination
+	hardNATSpraying  bool      // a sprayHardNAT goroutine is running
+	lastHardNATSpray time.Time // last time we started spraying pings at the peer
+
+	pendingCLIPings []pendingCLIPing // any outstanding "tailscale ping" commands running
+}
+
+type pendingCLIPing struct {
+	res *ipnstate.PingResult
+	cb  func(*ipnstate.PingResult)
 }
 
 const (
@@ -3027,9 +3252,11 @@ const (
 type endpointState struct {
 	// all fields guarded by discoEndpoint.mu:
 	lastPing    time.Time
-	recentPongs []pongReply // ring buffer up to pongHistoryCount entries
-	recentPong  uint16      // index into recentPongs of most recent; older , wrapped
-	index       int16       // index in nodecfg.Node.Endpoints
+	recentPongs []pongReply    // ring buffer up to pongHistoryCount entries
+	recentPong  uint16         // index into recentPongs of most recent; older , wrapped
+	index       int16          // index in nodecfg.Node.Endpoints, or -1 if hardNAT
+	hardNAT     bool           // found by spraying pings, not from the netmap
+	hardNATConn net.PacketConn // if hardNAT, the hard NAT port to send from
 }
 
 // pongHistoryCount is how many pongReply values we keep per endpointState
@@ -3044,6 +3271,7 @@ type pongReply struct {
 
 type sentPing struct {
 	to      netaddr.IPPort
+	from    net.PacketConn // hard NAT port a spray ping was sent from; nil otherwise
 	at      time.Time
 	timer   *time.Timer // timeout timer
 	purpose discoPingPurpose
@@ -3195,6 +3423,7 @@ func (de *discoEndpoint) send(b []byte) error {
 		de.sendPingsLocked(now, true)
 	}
 	de.noteActiveLocked()
+	pc := de.hardNATConnLocked(udpAddr)
 	de.mu.Unlock()
 
 	if udpAddr.IsZero() && derpAddr.IsZero() {
@@ -3202,7 +3431,7 @@ func (de *discoEndpoint) send(b []byte) error {
 	}
 	var err error
 	if !udpAddr.IsZero() {
-		_, err = de.c.sendAddr(udpAddr, key.Public(de.publicKey), b)
+		_, err = de.c.sendAddrFrom(pc, udpAddr, key.Public(de.publicKey), b)
 	}
 	if !derpAddr.IsZero() {
 		if ok, _ := de.c.sendAddr(derpAddr, key.Public(de.publicKey), b); ok && err != nil {
@@ -3220,10 +3449,28 @@ func (de *discoEndpoint) pingTimeout(txid stun.TxID) {
 	if !ok {
 		return
 	}
-	if debugDisco || de.bestAddr.IsZero() || time.Now().After(de.trustBestAddrUntil) {
+	if sp.purpose != pingHardNAT && (debugDisco || de.bestAddr.IsZero() || time.Now().After(de.trustBestAddrUntil)) {
 		de.c.logf("magicsock: disco: timeout waiting for pong %x from %v (%v, %v)", txid[:6], sp.to, de.publicKey.ShortString(), de.discoShort)
 	}
 	de.removeSentPingLocked(txid, sp)
+	if sp.purpose == pingCLI && !de.hasCLIPingInFlightLocked() {
+		// No pong is coming for the pending CLI pings; the
+		// CLI has its own timeout, so just forget them.
+		de.pendingCLIPings = nil
+	}
+}
+
+// hasCLIPingInFlightLocked reports whether any pingCLI ping is
+// awaiting a pong.
+//
+// de.mu must be held.
+func (de *discoEndpoint) hasCLIPingInFlightLocked() bool {
+	for _, sp := range de.sentPing {
+		if sp.purpose == pingCLI {
+			return true
+		}
+	}
+	return false
 }
 
 // forgetPing is called by a timer when a ping either fails to send or
@@ -3243,12 +3490,13 @@ func (de *discoEndpoint) removeSentPingLocked(txid stun.TxID, sp sentPing) {
 	delete(de.sentPing, txid)
 }
 
-// sendDiscoPing sends a ping with the provided txid to ep.
+// sendDiscoPing sends a ping with the provided txid to ep, from pc
+// if it's one of the hard NAT ports.
 //
 // The caller (startPingLocked) should've already been recorded the ping in
 // sentPing and set up the timer.
-func (de *discoEndpoint) sendDiscoPing(ep netaddr.IPPort, txid stun.TxID, logLevel discoLogLevel) {
-	sent, _ := de.sendDiscoMessage(ep, &disco.Ping{TxID: [12]byte(txid)}, logLevel)
+func (de *discoEndpoint) sendDiscoPing(ep netaddr.IPPort, pc net.PacketConn, txid stun.TxID, logLevel discoLogLevel) {
+	sent, _ := de.c.sendDiscoMessageFrom(pc, ep, de.publicKey, de.discoKey, &disco.Ping{TxID: [12]byte(txid)}, logLevel)
 	if !sent {
 		de.forgetPing(txid)
 	}
@@ -3265,17 +3513,27 @@ const (
 	// pingHeartbeat means that purpose of a ping was whether a
 	// peer was still there.
 	pingHeartbeat
+
+	// pingCLI means that the user is running "tailscale ping"
+	// from the CLI. These types of pings can go over DERP.
+	pingCLI
+
+	// pingHardNAT means that the ping was sprayed at a guessed
+	// address to get through both our hard NATs.
+	pingHardNAT
 )
 
 func (de *discoEndpoint) startPingLocked(ep netaddr.IPPort, now time.Time, purpose discoPingPurpose) {
-	st, ok := de.endpointState[ep]
-	if !ok {
-		// Shouldn't happen. But don't ping an endpoint that's
-		// not active for us.
-		de.c.logf("magicsock: disco: [unexpected] attempt to ping no longer live endpoint %v", ep)
-		return
+	if purpose != pingCLI {
+		st, ok := de.endpointState[ep]
+		if !ok {
+			// Shouldn't happen. But don't ping an endpoint that's
+			// not active for us.
+			de.c.logf("magicsock: disco: [unexpected] attempt to ping no longer live endpoint %v", ep)
+			return
+		}
+		st.lastPing = now
 	}
-	st.lastPing = now
 
 	txid := stun.NewTxID()
 	de.sentPing[txid] = sentPing{
@@ -3288,7 +3546,7 @@ func (de *discoEndpoint) startPingLocked(ep netaddr.IPPort, now time.Time, purpo
 	if purpose == pingHeartbeat {
 		logLevel = discoVerboseLog
 	}
-	go de.sendDiscoPing(ep, txid, logLevel)
+	go de.sendDiscoPing(ep, de.hardNATConnLocked(ep), txid, logLevel)
 }
 
 func (de *discoEndpoint) sendPingsLocked(now time.Time, sendCallMeMaybe bool) {
@@ -3309,6 +3567,9 @@ func (de *discoEndpoint) sendPingsLocked(now time.Time, sendCallMeMaybe bool) {
 
 		de.startPingLocked(ep, now, pingDiscovery)
 	}
+	if de.wantHardNATSprayLocked(now) {
+		de.startHardNATSprayLocked(now)
+	}
 	derpAddr := de.derpAddr
 	if sentAny && sendCallMeMaybe && !derpAddr.IsZero() {
 		// In just a bit of a time (for goroutines above to schedule and run),
@@ -3338,6 +3599,7 @@ func (de *discoEndpoint) updateFromNode(n *tailcfg.Node) {
 	} else {
 		de.derpAddr, _ = netaddr.ParseIPPort(n.DERP)
 	}
+	de.peerHardNAT = n.Hostinfo.NetInfo != nil && n.Hostinfo.NetInfo.MappingVariesByDestIP.EqualBool(true)
 
 	for _, st := range de.endpointState {
 		st.index = -1 // assume deleted until updated in next loop
@@ -3360,7 +3622,7 @@ func (de *discoEndpoint) updateFromNode(n *tailcfg.Node) {
 	}
 	// Now delete anything that wasn't updated.
 	for ipp, st := range de.endpointState {
-		if st.index == -1 {
+		if st.index == -1 && !st.hardNAT {
 			delete(de.endpointState, ipp)
 			if de.bestAddr == ipp {
 				de.bestAddr = netaddr.IPPort{}
@@ -3385,14 +3647,7 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 	de.mu.Lock()
 	defer de.mu.Unlock()
 
-	if src.IP == derpMagicIPAddr {
-		// We might support pinging a node via DERP in the
-		// future to see if it's still there, but we don't
-		// yet. We shouldn't ever get here, but bail out early
-		// in case we do in the future. (In which case, hi!,
-		// you'll be modifying this code.)
-		return
-	}
+	isDerp := src.IP == derpMagicIPAddr
 
 	sp, ok := de.sentPing[m.TxID]
 	if !ok {
@@ -3401,23 +3656,31 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 	}
 	de.removeSentPingLocked(m.TxID, sp)
 
-	st, ok := de.endpointState[sp.to]
-	if !ok {
-		// This is no longer an endpoint we care about.
-		return
+	now := time.Now()
+	latency := now.Sub(sp.at)
+
+	if sp.purpose == pingHardNAT {
+		de.addHardNATEndpointLocked(sp.to, sp.from)
 	}
 
-	de.c.setAddrToDiscoLocked(src, de.discoKey, de)
+	if !isDerp {
+		st, ok := de.endpointState[sp.to]
+		if !ok && sp.purpose != pingCLI {
+			// This is no longer an endpoint we care about.
+			return
+		}
 
-	now := time.Now()
-	latency := now.Sub(sp.at)
+		de.c.setAddrToDiscoLocked(src, de.discoKey, de)
 
-	st.addPongReplyLocked(pongReply{
-		latency: latency,
-		pongAt:  now,
-		from:    src,
-		pongSrc: m.Src,
-	})
+		if st != nil {
+			st.addPongReplyLocked(pongReply{
+				latency: latency,
+				pongAt:  now,
+				from:    src,
+				pongSrc: m.Src,
+			})
+		}
+	}
 
 	if sp.purpose != pingHeartbeat {
 		de.c.logf("magicsock: disco: %v<-%v (%v, %v)  got pong tx=%x latency=%v pong.src=%v%v", de.c.discoShort, de.discoShort, de.publicKey.ShortString(), src, m.TxID[:6], latency.Round(time.Millisecond), m.Src, logger.ArgWriter(func(bw *bufio.Writer) {
@@ -3427,8 +3690,20 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 		}))
 	}
 
+	for _, pp := range de.pendingCLIPings {
+		de.c.populateCLIPingResponseLocked(pp.res, latency, sp.to)
+		go pp.cb(pp.res)
+	}
+	de.pendingCLIPings = nil
+
 	// Promote this pong response to our current best address if it's lower latency.
 	// TODO(bradfitz): decide how latency vs. preference order affects decision
+	if isDerp {
+		return
+	}
+	if _, ok := de.endpointState[sp.to]; !ok {
+		return
+	}
 	if de.bestAddr.IsZero() || latency < de.bestAddrLatency {
 		if de.bestAddr != sp.to {
 			de.c.logf("magicsock: disco: node %v %v now using %v", de.publicKey.ShortString(), de.discoShort, sp.to)
@@ -3457,6 +3732,35 @@ func (st *endpointState) addPongReplyLocked(r pongReply) {
 	st.recentPong = i
 }
 
+// cliPing starts a "tailscale ping" to the peer. cb is called with
+// res populated with the first pong received, over either DERP or a
+// direct UDP path.
+func (de *discoEndpoint) cliPing(res *ipnstate.PingResult, cb func(*ipnstate.PingResult)) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+
+	de.pendingCLIPings = append(de.pendingCLIPings, pendingCLIPing{res, cb})
+
+	now := time.Now()
+	udpAddr, derpAddr := de.addrForSendLocked(now)
+	if !derpAddr.IsZero() {
+		de.startPingLocked(derpAddr, now, pingCLI)
+	}
+	if !udpAddr.IsZero() && now.Before(de.trustBestAddrUntil) {
+		// Already have an active session, so just ping the
+		// address we're using. Otherwise the results to a node
+		// on the local network can look like they're bouncing
+		// between paths that are all about as fast, depending
+		// on which happens to reply first.
+		de.startPingLocked(udpAddr, now, pingCLI)
+	} else {
+		for ep := range de.endpointState {
+			de.startPingLocked(ep, now, pingCLI)
+		}
+	}
+	de.noteActiveLocked()
+}
+
 // handleCallMeMaybe handles a CallMeMaybe discovery message via
 // DERP. The contract for use of this message is that the peer has
 // already sent to us via UDP, so their stateful firewall should be
@@ -3506,6 +3810,7 @@ func (de *discoEndpoint) stopAndReset() {
 	de.bestAddrLatency = 0
 	de.bestAddrAt = time.Time{}
 	de.trustBestAddrUntil = time.Time{}
+	de.lastHardNATSpray = time.Time{}
 	for _, es := range de.endpointState {
 		es.lastPing = time.Time{}
 	}
@@ -3513,6 +3818,7 @@ func (de *discoEndpoint) stopAndReset() {
 	for txid, sp := range de.sentPing {
 		de.removeSentPingLocked(txid, sp)
 	}
+	de.pendingCLIPings = nil
 	if de.heartBeatTimer != nil {
 		de.heartBeatTimer.Stop()
 		de.heartBeatTimer = nil
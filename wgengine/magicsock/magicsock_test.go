@@ -34,6 +34,7 @@ import (
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
 	"tailscale.com/derp/derpmap"
+	"tailscale.com/disco"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/stun/stuntest"
 	"tailscale.com/tailcfg"
@@ -66,7 +67,17 @@ func (c *Conn) WaitReady(t *testing.T) {
 	}
 }
 
-func runDERPAndStun(t *testing.T, logf logger.Logf, l nettype.PacketListener, stunIP netaddr.IP) (derpMap *tailcfg.DERPMap, cleanup func()) {
+// runDERPAndStun runs a DERP server and two STUN servers on l. With
+// natlab, the second STUN server runs on stun2 instead, if it's
+// non-nil.
+func runDERPAndStun(t *testing.T, logf logger.Logf, l nettype.PacketListener, stunIP netaddr.IP, stun2 *natlab.Machine, stun2IP netaddr.IP) (derpMap *tailcfg.DERPMap, cleanup func()) {
+	if m, ok := l.(*natlab.Machine); ok {
+		if stun2 == nil {
+			stun2, stun2IP = m, stunIP
+		}
+		return runNatlabDERPAndStun(t, logf, m, stunIP, stun2, stun2IP)
+	}
+
 	var serverPrivateKey key.Private
 	if _, err := crand.Read(serverPrivateKey[:]); err != nil {
 		t.Fatal(err)
@@ -79,6 +90,9 @@ func runDERPAndStun(t *testing.T, logf logger.Logf, l nettype.PacketListener, st
 	httpsrv.StartTLS()
 
 	stunAddr, stunCleanup := stuntest.ServeWithPacketListener(t, l)
+	// A second STUN server lets netcheck tell whether NAT mappings
+	// vary by destination.
+	stunAddr2, stunCleanup2 := stuntest.ServeWithPacketListener(t, l)
 
 	m := &tailcfg.DERPMap{
 		Regions: map[int]*tailcfg.DERPRegion{
@@ -96,6 +110,16 @@ func runDERPAndStun(t *testing.T, logf logger.Logf, l nettype.PacketListener, st
 						DERPTestPort: httpsrv.Listener.Addr().(*net.TCPAddr).Port,
 						STUNTestIP:   stunIP.String(),
 					},
+					{
+						Name:         "t2",
+						RegionID:     1,
+						HostName:     "test-node.unused",
+						IPv4:         "127.0.0.1",
+						IPv6:         "none",
+						STUNPort:     stunAddr2.Port,
+						DERPTestPort: httpsrv.Listener.Addr().(*net.TCPAddr).Port,
+						STUNTestIP:   stunIP.String(),
+					},
 				},
 			},
 		},
@@ -106,11 +130,44 @@ func runDERPAndStun(t *testing.T, logf logger.Logf, l nettype.PacketListener, st
 		httpsrv.Close()
 		d.Close()
 		stunCleanup()
+		stunCleanup2()
 	}
 
 	return m, cleanup
 }
 
+// runNatlabDERPAndStun is runDERPAndStun for a simulated network: it
+// runs the DERP relay and both STUN servers on m, at ip.
+func runNatlabDERPAndStun(t *testing.T, logf logger.Logf, m *natlab.Machine, ip netaddr.IP, m2 *natlab.Machine, ip2 netaddr.IP) (derpMap *tailcfg.DERPMap, cleanup func()) {
+	ds, err := natlab.ServeDERP(logf, m, ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stun2, err := natlab.ServeSTUN(m2, ip2)
+	if err != nil {
+		ds.Close()
+		t.Fatal(err)
+	}
+
+	n2 := ds.Node(1, "t2")
+	n2.STUNPort = int(stun2.Addr().Port)
+	n2.STUNTestIP = ip2.String()
+	derpMap = &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: &tailcfg.DERPRegion{
+				RegionID:   1,
+				RegionCode: "test",
+				Nodes:      []*tailcfg.DERPNode{ds.Node(1, "t1"), n2},
+			},
+		},
+	}
+	cleanup = func() {
+		ds.Close()
+		stun2.Close()
+	}
+	return derpMap, cleanup
+}
+
 // magicStack is a magicsock, plus all the stuff around it that's
 // necessary to send and receive packets to test e2e wireguard
 // happiness.
@@ -121,6 +178,9 @@ type magicStack struct {
 	tun        *tuntest.ChannelTUN // tuntap device to send/receive packets
 	tsTun      *tstun.TUN          // wrapped tun that implements filtering and wgengine hooks
 	dev        *device.Device      // the wireguard-go Device that connects the previous things
+
+	mu      sync.Mutex
+	netInfo *tailcfg.NetInfo // last NetInfo reported by conn
 }
 
 // newMagicStack builds and initializes an idle magicsock and
@@ -135,16 +195,30 @@ func newMagicStack(t *testing.T, logf logger.Logf, l nettype.PacketListener, der
 	}
 
 	epCh := make(chan []string, 100) // arbitrary
-	conn, err := NewConn(Options{
+	opts := Options{
 		Logf:           logf,
 		PacketListener: l,
 		EndpointsFunc: func(eps []string) {
 			epCh <- eps
 		},
-	})
+	}
+	if m, ok := l.(*natlab.Machine); ok {
+		opts.DERPDialContext = m.Dial
+	}
+	conn, err := NewConn(opts)
 	if err != nil {
 		t.Fatalf("constructing magicsock: %v", err)
 	}
+	ms := &magicStack{
+		privateKey: privateKey,
+		epCh:       epCh,
+		conn:       conn,
+	}
+	conn.SetNetInfoCallback(func(ni *tailcfg.NetInfo) {
+		ms.mu.Lock()
+		defer ms.mu.Unlock()
+		ms.netInfo = ni
+	})
 	conn.Start()
 	conn.SetDERPMap(derpMap)
 	if err := conn.SetPrivateKey(privateKey); err != nil {
@@ -153,7 +227,7 @@ func newMagicStack(t *testing.T, logf logger.Logf, l nettype.PacketListener, der
 
 	tun := tuntest.NewChannelTUN()
 	tsTun := tstun.WrapTUN(logf, tun.TUN())
-	tsTun.SetFilter(filter.NewAllowAll([]filter.Net{filter.NetAny}, logf))
+	tsTun.SetFilter(filter.NewAllowAll([]filter.Net{filter.NetAny}, []filter.Net6{filter.NetAny6}, logf))
 
 	dev := device.NewDevice(tsTun, &device.DeviceOptions{
 		Logger: &device.Logger{
@@ -176,14 +250,10 @@ func newMagicStack(t *testing.T, logf logger.Logf, l nettype.PacketListener, der
 		time.Sleep(100 * time.Millisecond)
 	}
 
-	return &magicStack{
-		privateKey: privateKey,
-		epCh:       epCh,
-		conn:       conn,
-		tun:        tun,
-		tsTun:      tsTun,
-		dev:        dev,
-	}
+	ms.tun = tun
+	ms.tsTun = tsTun
+	ms.dev = dev
+	return ms
 }
 
 func (s *magicStack) String() string {
@@ -200,6 +270,14 @@ func (s *magicStack) Public() key.Public {
 	return key.Public(s.privateKey.Public())
 }
 
+// NetInfo returns the last NetInfo reported by the magicStack's
+// Conn, or nil if there hasn't been one yet.
+func (s *magicStack) NetInfo() *tailcfg.NetInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.netInfo
+}
+
 func (s *magicStack) Status() *ipnstate.Status {
 	var sb ipnstate.StatusBuilder
 	s.conn.UpdateStatus(&sb)
@@ -259,6 +337,7 @@ func meshStacks(logf logger.Logf, ms []*magicStack) (cleanup func()) {
 				AllowedIPs: addrs,
 				Endpoints:  eps[i],
 				DERP:       "127.3.3.40:1",
+				Hostinfo:   tailcfg.Hostinfo{NetInfo: peer.NetInfo()},
 			}
 			nm.Peers = append(nm.Peers, peer)
 		}
@@ -593,6 +672,35 @@ func TestActiveDiscovery(t *testing.T) {
 		testActiveDiscovery(t, n)
 	})
 
+	t.Run("lossy_internet", func(t *testing.T) {
+		mstun := &natlab.Machine{Name: "stun"}
+		m1 := &natlab.Machine{Name: "m1"}
+		m2 := &natlab.Machine{Name: "m2"}
+		inet := natlab.NewInternet()
+		inet.Impairment = &natlab.Impairment{
+			Latency: 20 * time.Millisecond,
+			Jitter:  10 * time.Millisecond,
+			Loss:    0.05,
+			Seed:    1,
+		}
+		sif := mstun.Attach("eth0", inet)
+		m1if := m1.Attach("eth0", inet)
+		m2if := m2.Attach("eth0", inet)
+
+		n := &devices{
+			m1:     m1,
+			m1IP:   m1if.V4(),
+			m2:     m2,
+			m2IP:   m2if.V4(),
+			stun:   mstun,
+			stunIP: sif.V4(),
+
+			directTimeout: 10 * time.Second,
+			maxPingLoss:   0.25,
+		}
+		testActiveDiscovery(t, n)
+	})
+
 	t.Run("facing_easy_firewalls", func(t *testing.T) {
 		mstun := &natlab.Machine{Name: "stun"}
 		m1 := &natlab.Machine{
@@ -681,6 +789,298 @@ func TestActiveDiscovery(t *testing.T) {
 		}
 		testActiveDiscovery(t, n)
 	})
+
+	t.Run("facing_hard_nats", func(t *testing.T) {
+		// Narrow the ports the NATs map from and the ports pings
+		// are sprayed at. A hit needs each side to guess the port
+		// of one of the other's mappings, and the one the other
+		// side's mapping was sent to; among all 64k ports, that
+		// would take far longer than a test should.
+		defer func(old [2]uint16) { hardNATSprayPorts = old }(hardNATSprayPorts)
+		hardNATSprayPorts = [2]uint16{40000, 40255}
+
+		mstun := &natlab.Machine{Name: "stun"}
+		mstun2 := &natlab.Machine{Name: "stun2"}
+		m1 := &natlab.Machine{Name: "m1"}
+		nat1 := &natlab.Machine{Name: "nat1"}
+		m2 := &natlab.Machine{Name: "m2"}
+		nat2 := &natlab.Machine{Name: "nat2"}
+
+		inet := natlab.NewInternet()
+		lan1 := &natlab.Network{
+			Name:    "lan1",
+			Prefix4: mustPrefix("192.168.0.0/24"),
+		}
+		lan2 := &natlab.Network{
+			Name:    "lan2",
+			Prefix4: mustPrefix("192.168.1.0/24"),
+		}
+
+		sif := mstun.Attach("eth0", inet)
+		sif2 := mstun2.Attach("eth0", inet)
+		nat1WAN := nat1.Attach("wan", inet)
+		nat1LAN := nat1.Attach("lan1", lan1)
+		nat2WAN := nat2.Attach("wan", inet)
+		nat2LAN := nat2.Attach("lan2", lan2)
+		m1if := m1.Attach("eth0", lan1)
+		m2if := m2.Attach("eth0", lan2)
+		lan1.SetDefaultGateway(nat1LAN)
+		lan2.SetDefaultGateway(nat2LAN)
+
+		nat1h := &addrFilteringNAT{
+			SNAT44: &natlab.SNAT44{
+				Machine:           nat1,
+				ExternalInterface: nat1WAN,
+				Type:              natlab.AddressDependentNAT,
+				WANPorts:          hardNATSprayPorts,
+			},
+			peerIP: nat2WAN.V4(),
+		}
+		nat2h := &addrFilteringNAT{
+			SNAT44: &natlab.SNAT44{
+				Machine:           nat2,
+				ExternalInterface: nat2WAN,
+				Type:              natlab.AddressDependentNAT,
+				WANPorts:          hardNATSprayPorts,
+			},
+			peerIP: nat1WAN.V4(),
+		}
+		nat1.PacketHandler = nat1h
+		nat2.PacketHandler = nat2h
+
+		n := &devices{
+			m1:      m1,
+			m1IP:    m1if.V4(),
+			m2:      m2,
+			m2IP:    m2if.V4(),
+			stun:    mstun,
+			stunIP:  sif.V4(),
+			stun2:   mstun2,
+			stun2IP: sif2.V4(),
+
+			// Finding each other by spraying pings takes a while.
+			directTimeout: 30 * time.Second,
+			dataIn: func() (int, int) {
+				return nat1h.dataPackets(), nat2h.dataPackets()
+			},
+		}
+		testActiveDiscovery(t, n)
+	})
+
+	t.Run("relay_only", func(t *testing.T) {
+		mstun := &natlab.Machine{Name: "stun"}
+		m1 := &natlab.Machine{Name: "m1"}
+		nat1 := &natlab.Machine{Name: "nat1"}
+		m2 := &natlab.Machine{Name: "m2"}
+		nat2 := &natlab.Machine{Name: "nat2"}
+
+		inet := natlab.NewInternet()
+		lan1 := &natlab.Network{
+			Name:    "lan1",
+			Prefix4: mustPrefix("192.168.0.0/24"),
+		}
+		lan2 := &natlab.Network{
+			Name:    "lan2",
+			Prefix4: mustPrefix("192.168.1.0/24"),
+		}
+
+		sif := mstun.Attach("eth0", inet)
+		nat1WAN := nat1.Attach("wan", inet)
+		nat1LAN := nat1.Attach("lan1", lan1)
+		nat2WAN := nat2.Attach("wan", inet)
+		nat2LAN := nat2.Attach("lan2", lan2)
+		m1if := m1.Attach("eth0", lan1)
+		m2if := m2.Attach("eth0", lan2)
+		lan1.SetDefaultGateway(nat1LAN)
+		lan2.SetDefaultGateway(nat2LAN)
+
+		nat1.PacketHandler = &relayOnlyNAT{
+			SNAT44: &natlab.SNAT44{
+				Machine:           nat1,
+				ExternalInterface: nat1WAN,
+				Firewall: &natlab.Firewall{
+					TrustedInterface: nat1LAN,
+				},
+			},
+			relayIP: sif.V4(),
+		}
+		nat2.PacketHandler = &relayOnlyNAT{
+			SNAT44: &natlab.SNAT44{
+				Machine:           nat2,
+				ExternalInterface: nat2WAN,
+				Firewall: &natlab.Firewall{
+					TrustedInterface: nat2LAN,
+				},
+			},
+			relayIP: sif.V4(),
+		}
+
+		n := &devices{
+			m1:     m1,
+			m1IP:   m1if.V4(),
+			m2:     m2,
+			m2IP:   m2if.V4(),
+			stun:   mstun,
+			stunIP: sif.V4(),
+
+			relayOnly: true,
+		}
+		testActiveDiscovery(t, n)
+	})
+
+	t.Run("udp_blocked", func(t *testing.T) {
+		mstun := &natlab.Machine{Name: "stun"}
+		m1 := &natlab.Machine{Name: "m1"}
+		nat1 := &natlab.Machine{Name: "nat1"}
+		m2 := &natlab.Machine{Name: "m2"}
+		nat2 := &natlab.Machine{Name: "nat2"}
+
+		inet := natlab.NewInternet()
+		lan1 := &natlab.Network{
+			Name:    "lan1",
+			Prefix4: mustPrefix("192.168.0.0/24"),
+		}
+		lan2 := &natlab.Network{
+			Name:    "lan2",
+			Prefix4: mustPrefix("192.168.1.0/24"),
+		}
+
+		sif := mstun.Attach("eth0", inet)
+		nat1WAN := nat1.Attach("wan", inet)
+		nat1LAN := nat1.Attach("lan1", lan1)
+		nat2WAN := nat2.Attach("wan", inet)
+		nat2LAN := nat2.Attach("lan2", lan2)
+		m1if := m1.Attach("eth0", lan1)
+		m2if := m2.Attach("eth0", lan2)
+		lan1.SetDefaultGateway(nat1LAN)
+		lan2.SetDefaultGateway(nat2LAN)
+
+		nat1.PacketHandler = &udpBlockingNAT{
+			SNAT44: &natlab.SNAT44{
+				Machine:           nat1,
+				ExternalInterface: nat1WAN,
+				Firewall: &natlab.Firewall{
+					TrustedInterface: nat1LAN,
+				},
+			},
+		}
+		nat2.PacketHandler = &udpBlockingNAT{
+			SNAT44: &natlab.SNAT44{
+				Machine:           nat2,
+				ExternalInterface: nat2WAN,
+				Firewall: &natlab.Firewall{
+					TrustedInterface: nat2LAN,
+				},
+			},
+		}
+
+		n := &devices{
+			m1:     m1,
+			m1IP:   m1if.V4(),
+			m2:     m2,
+			m2IP:   m2if.V4(),
+			stun:   mstun,
+			stunIP: sif.V4(),
+
+			relayOnly: true,
+		}
+		testActiveDiscovery(t, n)
+	})
+}
+
+// relayOnlyNAT is an SNAT44 that only lets packets out to one IP
+// address, where the DERP and STUN servers are, so peers behind it
+// can only reach each other through DERP.
+type relayOnlyNAT struct {
+	*natlab.SNAT44
+	relayIP netaddr.IP
+}
+
+func (n *relayOnlyNAT) HandleForward(p *natlab.Packet, iif, oif *natlab.Interface) *natlab.Packet {
+	if oif == n.ExternalInterface && p.Dst.IP != n.relayIP {
+		p.Trace("not to relay, drop")
+		return nil
+	}
+	return n.SNAT44.HandleForward(p, iif, oif)
+}
+
+// udpBlockingNAT is an SNAT44 that only lets TCP out, like some
+// corporate and public networks. Peers behind it can only talk
+// through DERP, and netcheck has to measure DERP latency over HTTPS.
+type udpBlockingNAT struct {
+	*natlab.SNAT44
+}
+
+func (n *udpBlockingNAT) HandleForward(p *natlab.Packet, iif, oif *natlab.Interface) *natlab.Packet {
+	if oif == n.ExternalInterface && p.Proto == natlab.UDP {
+		p.Trace("udp blocked, drop")
+		return nil
+	}
+	return n.SNAT44.HandleForward(p, iif, oif)
+}
+
+// addrFilteringNAT is an SNAT44 that only lets in packets from the
+// remote ip:ports each mapping has sent to. With mappings that vary
+// by destination, that's a "hard" NAT: a peer can't reach us at the
+// address a STUN server saw, only by luck at a mapping we made
+// towards the peer, and only from the port that mapping sent to.
+type addrFilteringNAT struct {
+	*natlab.SNAT44
+	// peerIP is the other peer's WAN IP. Non-disco packets let in
+	// from it are counted, to tell whether data flows directly.
+	peerIP netaddr.IP
+
+	mu     sync.Mutex
+	sent   map[natFlow]bool // flows that packets went out on
+	dataIn int              // non-disco packets let in from peerIP
+}
+
+// natFlow is a WAN ip:port of an addrFilteringNAT and a remote
+// ip:port.
+type natFlow struct {
+	wan, remote netaddr.IPPort
+}
+
+func (n *addrFilteringNAT) HandleIn(p *natlab.Packet, iif *natlab.Interface) *natlab.Packet {
+	if iif != n.ExternalInterface {
+		return n.SNAT44.HandleIn(p, iif)
+	}
+	n.mu.Lock()
+	ok := n.sent[natFlow{wan: p.Dst, remote: p.Src}]
+	n.mu.Unlock()
+	if !ok {
+		p.Trace("mapping filter drop")
+		return nil
+	}
+	data := p.Proto == natlab.UDP && p.Src.IP == n.peerIP && !strings.HasPrefix(string(p.Payload), disco.Magic)
+	p = n.SNAT44.HandleIn(p, iif)
+	if p != nil && data {
+		n.mu.Lock()
+		n.dataIn++
+		n.mu.Unlock()
+	}
+	return p
+}
+
+func (n *addrFilteringNAT) HandleForward(p *natlab.Packet, iif, oif *natlab.Interface) *natlab.Packet {
+	p2 := n.SNAT44.HandleForward(p, iif, oif)
+	if p2 != nil && oif == n.ExternalInterface {
+		n.mu.Lock()
+		if n.sent == nil {
+			n.sent = map[natFlow]bool{}
+		}
+		n.sent[natFlow{wan: p2.Src, remote: p2.Dst}] = true
+		n.mu.Unlock()
+	}
+	return p2
+}
+
+// dataPackets returns how many non-disco packets n has let in from
+// the peer.
+func (n *addrFilteringNAT) dataPackets() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.dataIn
 }
 
 func mustPrefix(s string) netaddr.IPPrefix {
@@ -700,14 +1100,46 @@ type devices struct {
 
 	stun   nettype.PacketListener
 	stunIP netaddr.IP
+
+	// stun2, if non-nil, runs the second STUN server, so that
+	// netcheck can tell whether NAT mappings vary by destination
+	// IP and not just port.
+	stun2   *natlab.Machine
+	stun2IP netaddr.IP
+
+	// directTimeout is how long testActiveDiscovery waits for a
+	// direct path. If zero, 5 seconds.
+	directTimeout time.Duration
+
+	// maxPingLoss is the fraction of test pings that may be lost, for
+	// lossy networks.
+	maxPingLoss float64
+
+	// relayOnly is whether the peers can only talk through DERP.
+	// testActiveDiscovery then checks that traffic keeps flowing
+	// without a direct path.
+	relayOnly bool
+
+	// dataIn, if non-nil, returns how many non-disco packets m1 and
+	// m2 have received directly from each other. testActiveDiscovery
+	// then checks that data flows over the direct path it finds.
+	dataIn func() (m1, m2 int)
 }
 
 // newPinger starts continuously sending test packets from srcM to
 // dstM, until cleanup is invoked to stop it. Each ping has 1 second
-// to transit the network. It is a test failure to lose a ping.
-func newPinger(t *testing.T, logf logger.Logf, src, dst *magicStack) (cleanup func()) {
+// to transit the network. It is a test failure to lose more than
+// maxLoss of the pings.
+func newPinger(t *testing.T, logf logger.Logf, src, dst *magicStack, maxLoss float64) (cleanup func()) {
 	ctx, cancel := context.WithCancel(context.Background())
 	done := make(chan struct{})
+	timeout := 10 * time.Second
+	if maxLoss > 0 {
+		// Don't wait for wireguard to retransmit; the ping was
+		// probably lost.
+		timeout = 2 * time.Second
+	}
+	var sent, lost int // only accessed by one, one at a time
 	one := func() bool {
 		// TODO(danderson): requiring exactly zero packet loss
 		// will probably be too strict for some tests we'd like to
@@ -718,13 +1150,18 @@ func newPinger(t *testing.T, logf logger.Logf, src, dst *magicStack) (cleanup fu
 		pkt := tuntest.Ping(dst.IP(t).IPAddr().IP, src.IP(t).IPAddr().IP)
 		select {
 		case src.tun.Outbound <- pkt:
+			sent++
 		case <-ctx.Done():
 			return false
 		}
 		select {
 		case <-dst.tun.Inbound:
 			return true
-		case <-time.After(10 * time.Second):
+		case <-time.After(timeout):
+			if maxLoss > 0 {
+				lost++
+				return true
+			}
 			// Very generous timeout here because depending on
 			// magicsock setup races, the first handshake might get
 			// eaten by the receiving end (if wireguard-go hasn't been
@@ -749,6 +1186,9 @@ func newPinger(t *testing.T, logf logger.Logf, src, dst *magicStack) (cleanup fu
 	cleanup = func() {
 		cancel()
 		<-done
+		if sent > 0 && float64(lost)/float64(sent) > maxLoss {
+			t.Errorf("lost %d of %d pings; want at most %v%%", lost, sent, maxLoss*100)
+		}
 	}
 
 	// Synchronously transit one ping to get things started. This is
@@ -787,7 +1227,7 @@ func testActiveDiscovery(t *testing.T, d *devices) {
 		tlogf(msg, args...)
 	}
 
-	derpMap, cleanup := runDERPAndStun(t, logf, d.stun, d.stunIP)
+	derpMap, cleanup := runDERPAndStun(t, logf, d.stun, d.stunIP, d.stun2, d.stun2IP)
 	defer cleanup()
 
 	m1 := newMagicStack(t, logger.WithPrefix(logf, "conn1: "), d.m1, derpMap)
@@ -802,16 +1242,20 @@ func testActiveDiscovery(t *testing.T, d *devices) {
 	m2IP := m2.IP(t)
 	logf("IPs: %s %s", m1IP, m2IP)
 
-	cleanup = newPinger(t, logf, m1, m2)
+	cleanup = newPinger(t, logf, m1, m2, d.maxPingLoss)
 	defer cleanup()
 
 	// Everything is now up and running, active discovery should find
 	// a direct path between our peers. Wait for it to switch away
 	// from DERP.
 
+	directTimeout := d.directTimeout
+	if directTimeout == 0 {
+		directTimeout = 5 * time.Second
+	}
 	mustDirect := func(m1, m2 *magicStack) {
 		lastLog := time.Now().Add(-time.Minute)
-		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for deadline := time.Now().Add(directTimeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
 			pst := m1.Status().Peer[m2.Public()]
 			if pst.CurAddr != "" {
 				logf("direct link %s->%s found with addr %s", m1, m2, pst.CurAddr)
@@ -825,8 +1269,40 @@ func testActiveDiscovery(t *testing.T, d *devices) {
 		t.Errorf("magicsock did not find a direct path from %s to %s", m1, m2)
 	}
 
-	mustDirect(m1, m2)
-	mustDirect(m2, m1)
+	mustRelay := func(m1, m2 *magicStack) {
+		for deadline := time.Now().Add(directTimeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if pst := m1.Status().Peer[m2.Public()]; pst.CurAddr != "" {
+				t.Errorf("magicsock found impossible direct path from %s to %s via %s", m1, m2, pst.CurAddr)
+				return
+			}
+		}
+		logf("%s->%s still relayed", m1, m2)
+	}
+
+	if d.relayOnly {
+		mustRelay(m1, m2)
+		mustRelay(m2, m1)
+	} else {
+		mustDirect(m1, m2)
+		mustDirect(m2, m1)
+	}
+
+	if d.dataIn != nil && !t.Failed() {
+		// The pinger keeps sending, so data should keep arriving
+		// over the direct path in both directions.
+		in1, in2 := d.dataIn()
+		for deadline := time.Now().Add(directTimeout); ; time.Sleep(10 * time.Millisecond) {
+			got1, got2 := d.dataIn()
+			if got1 > in1 && got2 > in2 {
+				logf("data flowing directly: %d, %d packets in", got1, got2)
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Errorf("no data over the direct path: %d, %d packets in; had %d, %d", got1, got2, in1, in2)
+				break
+			}
+		}
+	}
 
 	logf("starting cleanup")
 }
@@ -840,7 +1316,7 @@ func testTwoDevicePing(t *testing.T, d *devices) {
 	// all log using the "current" t.Logf function. Sigh.
 	logf, setT := makeNestable(t)
 
-	derpMap, cleanup := runDERPAndStun(t, logf, d.stun, d.stunIP)
+	derpMap, cleanup := runDERPAndStun(t, logf, d.stun, d.stunIP, d.stun2, d.stun2IP)
 	defer cleanup()
 
 	m1 := newMagicStack(t, logf, d.m1, derpMap)
@@ -1337,3 +1813,76 @@ func TestDiscoEndpointAlignment(t *testing.T) {
 		t.Error("expected false on second call")
 	}
 }
+
+func TestPeerForIP(t *testing.T) {
+	mustCIDR := func(s string) wgcfg.CIDR {
+		c, err := wgcfg.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	mustIP := func(s string) netaddr.IP {
+		ip, err := netaddr.ParseIP(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ip
+	}
+	nodeA := &tailcfg.Node{
+		Name:       "a.example.com",
+		Addresses:  []wgcfg.CIDR{mustCIDR("100.64.0.1/32")},
+		AllowedIPs: []wgcfg.CIDR{mustCIDR("100.64.0.1/32")},
+	}
+	nodeB := &tailcfg.Node{
+		Name:       "b.example.com",
+		Addresses:  []wgcfg.CIDR{mustCIDR("100.64.0.2/32")},
+		AllowedIPs: []wgcfg.CIDR{mustCIDR("100.64.0.2/32"), mustCIDR("10.0.0.0/8")},
+	}
+	nm := &controlclient.NetworkMap{Peers: []*tailcfg.Node{nodeA, nodeB}}
+
+	tests := []struct {
+		ip   string
+		want *tailcfg.Node
+	}{
+		{"100.64.0.1", nodeA},
+		{"100.64.0.2", nodeB},
+		{"10.1.2.3", nodeB},
+		{"192.168.0.1", nil},
+	}
+	for _, tt := range tests {
+		got, ok := peerForIP(nm, mustIP(tt.ip))
+		if ok != (tt.want != nil) || got != tt.want {
+			t.Errorf("peerForIP(%s) = %v, %v; want %v", tt.ip, got, ok, tt.want)
+		}
+	}
+	if _, ok := peerForIP(nil, mustIP("100.64.0.1")); ok {
+		t.Error("peerForIP with nil netmap found a peer")
+	}
+}
+
+func TestIsPublicIPv4(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"1.2.3.4", true},
+		{"10.1.2.3", false},
+		{"172.16.5.6", false},
+		{"192.168.1.1", false},
+		{"100.64.0.1", false},
+		{"100.127.255.254", false},
+		{"100.128.0.1", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+	}
+	for _, tt := range tests {
+		ip, err := netaddr.ParseIP(tt.ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isPublicIPv4(ip); got != tt.want {
+			t.Errorf("isPublicIPv4(%s) = %v; want %v", tt.ip, got, tt.want)
+		}
+	}
+}
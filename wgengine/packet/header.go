@@ -9,8 +9,6 @@ import (
 	"math"
 )
 
-const tcpHeaderLength = 20
-
 // maxPacketLength is the largest length that all headers support.
 // IPv4 headers using uint16 for this forces an upper bound of 64KB.
 const maxPacketLength = math.MaxUint16
@@ -28,6 +28,38 @@ func (t ICMPType) String() string {
 	}
 }
 
+// ICMP6Type is an ICMPv6 message type, as defined by RFC 4443.
+// ICMPv6 renumbered the message types, so they get their own type.
+type ICMP6Type uint8
+
+const (
+	ICMP6Unreachable  ICMP6Type = 0x01
+	ICMP6PacketTooBig ICMP6Type = 0x02
+	ICMP6TimeExceeded ICMP6Type = 0x03
+	ICMP6ParamProblem ICMP6Type = 0x04
+	ICMP6EchoRequest  ICMP6Type = 0x80
+	ICMP6EchoReply    ICMP6Type = 0x81
+)
+
+func (t ICMP6Type) String() string {
+	switch t {
+	case ICMP6Unreachable:
+		return "Unreachable"
+	case ICMP6PacketTooBig:
+		return "PacketTooBig"
+	case ICMP6TimeExceeded:
+		return "TimeExceeded"
+	case ICMP6ParamProblem:
+		return "ParamProblem"
+	case ICMP6EchoRequest:
+		return "EchoRequest"
+	case ICMP6EchoReply:
+		return "EchoReply"
+	default:
+		return "Unknown"
+	}
+}
+
 type ICMPCode uint8
 
 const (
@@ -51,6 +51,7 @@ const (
 	ICMPv6  IPProto = 0x3a
 	TCP     IPProto = 0x06
 	UDP     IPProto = 0x11
+	SCTP    IPProto = 0x84
 	// Fragment is a special value. It's not really an IPProto value
 	// so we're using the unassigned 0xFF value.
 	// TODO(dmytro): special values should be taken out of here.
@@ -63,10 +64,16 @@ func (p IPProto) String() string {
 		return "Frag"
 	case ICMP:
 		return "ICMP"
+	case ICMPv6:
+		return "ICMPv6"
+	case IGMP:
+		return "IGMP"
 	case UDP:
 		return "UDP"
 	case TCP:
 		return "TCP"
+	case SCTP:
+		return "SCTP"
 	default:
 		return "Unknown"
 	}
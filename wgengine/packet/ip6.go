@@ -0,0 +1,63 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"fmt"
+	"net"
+
+	"inet.af/netaddr"
+)
+
+// IP6 is an IPv6 address.
+type IP6 [16]byte
+
+// NewIP6 converts a standard library IP address into an IP6.
+// It panics if b is not an IPv6 address.
+func NewIP6(b net.IP) IP6 {
+	b16 := b.To16()
+	if b16 == nil || b.To4() != nil {
+		panic(fmt.Sprintf("%v is not an IPv6 address", b))
+	}
+	var ip IP6
+	copy(ip[:], b16)
+	return ip
+}
+
+// IP6FromNetaddr converts a netaddr.IP to an IP6.
+func IP6FromNetaddr(ip netaddr.IP) IP6 {
+	return IP6(ip.As16())
+}
+
+// Netaddr converts an IP6 to a netaddr.IP.
+func (ip IP6) Netaddr() netaddr.IP {
+	nip, _ := netaddr.FromStdIP(net.IP(ip[:]))
+	return nip
+}
+
+func (ip IP6) String() string {
+	return net.IP(ip[:]).String()
+}
+
+// IPv6 extension header types (values of the Next Header field)
+// that Decode knows how to skip over.
+const (
+	ip6HopByHop    = 0
+	ip6Routing     = 43
+	ip6Fragment    = 44
+	ip6AuthHeader  = 51
+	ip6DestOptions = 60
+	ip6NoNextHdr   = 59
+)
+
+const (
+	ip6HeaderLength         = 40
+	ip6FragmentHeaderLength = 8
+
+	// maxIP6ExtHeaders bounds the number of extension headers
+	// Decode walks, so that a malicious packet can't make it loop
+	// for a long time.
+	maxIP6ExtHeaders = 8
+)
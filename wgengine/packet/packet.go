@@ -15,8 +15,15 @@ import (
 // RFC1858: prevent overlapping fragment attacks.
 const minFrag = 60 + 20 // max IPv4 header + basic TCP header
 
+// sctpHeaderLength is the length of the SCTP common header,
+// which holds the ports; chunks follow it.
+const sctpHeaderLength = 12
+
 const (
+	TCPFin    = 0x01
 	TCPSyn    = 0x02
+	TCPRst    = 0x04
+	TCPPsh    = 0x08
 	TCPAck    = 0x10
 	TCPSynAck = TCPSyn | TCPAck
 )
@@ -30,8 +37,6 @@ var (
 )
 
 // ParsedPacket is a minimal decoding of a packet suitable for use in filters.
-//
-// In general, it only supports IPv4. The IPv6 parsing is very minimal.
 type ParsedPacket struct {
 	// b is the byte buffer that this decodes.
 	b []byte
@@ -44,11 +49,13 @@ type ParsedPacket struct {
 	length int
 
 	IPVersion uint8   // 4, 6, or 0
-	IPProto   IPProto // IP subprotocol (UDP, TCP, etc); the NextHeader field for IPv6
+	IPProto   IPProto // IP subprotocol (UDP, TCP, etc), or its number if not one of ours; for IPv6, the one after any extension headers
 	SrcIP     IP      // IP source address (not used for IPv6)
 	DstIP     IP      // IP destination address (not used for IPv6)
-	SrcPort   uint16  // TCP/UDP source port
-	DstPort   uint16  // TCP/UDP destination port
+	SrcIP6    IP6     // IPv6 source address (not used for IPv4)
+	DstIP6    IP6     // IPv6 destination address (not used for IPv4)
+	SrcPort   uint16  // TCP/UDP/SCTP source port
+	DstPort   uint16  // TCP/UDP/SCTP destination port
 	TCPFlags  uint8   // TCP flags (SYN, ACK, etc)
 }
 
@@ -56,9 +63,6 @@ type ParsedPacket struct {
 type NextHeader uint8
 
 func (p *ParsedPacket) String() string {
-	if p.IPVersion == 6 {
-		return fmt.Sprintf("IPv6{Proto=%d}", p.IPProto)
-	}
 	switch p.IPProto {
 	case Unknown:
 		return "Unknown{???}"
@@ -66,9 +70,15 @@ func (p *ParsedPacket) String() string {
 	sb := strbuilder.Get()
 	sb.WriteString(p.IPProto.String())
 	sb.WriteByte('{')
-	writeIPPort(sb, p.SrcIP, p.SrcPort)
-	sb.WriteString(" > ")
-	writeIPPort(sb, p.DstIP, p.DstPort)
+	if p.IPVersion == 6 {
+		writeIP6Port(sb, p.SrcIP6, p.SrcPort)
+		sb.WriteString(" > ")
+		writeIP6Port(sb, p.DstIP6, p.DstPort)
+	} else {
+		writeIPPort(sb, p.SrcIP, p.SrcPort)
+		sb.WriteString(" > ")
+		writeIPPort(sb, p.DstIP, p.DstPort)
+	}
 	sb.WriteByte('}')
 	return sb.String()
 }
@@ -85,6 +95,13 @@ func writeIPPort(sb *strbuilder.Builder, ip IP, port uint16) {
 	sb.WriteUint(uint64(port))
 }
 
+func writeIP6Port(sb *strbuilder.Builder, ip IP6, port uint16) {
+	sb.WriteByte('[')
+	sb.WriteString(ip.String())
+	sb.WriteString("]:")
+	sb.WriteUint(uint64(port))
+}
+
 // based on https://tools.ietf.org/html/rfc1071
 func ipChecksum(b []byte) uint16 {
 	var ac uint32
@@ -105,7 +122,8 @@ func ipChecksum(b []byte) uint16 {
 }
 
 // Decode extracts data from the packet in b into q.
-// It performs extremely simple packet decoding for basic IPv4 packet types.
+// It performs extremely simple packet decoding for basic IPv4 and IPv6
+// packet types.
 // It extracts only the subprotocol id, IP addresses, and (if any) ports,
 // and shouldn't need any memory allocation.
 func (q *ParsedPacket) Decode(b []byte) {
@@ -117,14 +135,13 @@ func (q *ParsedPacket) Decode(b []byte) {
 		return
 	}
 
-	// Check that it's IPv4.
-	// TODO(apenwarr): consider IPv6 support
 	q.IPVersion = (b[0] & 0xF0) >> 4
 	switch q.IPVersion {
 	case 4:
 		q.IPProto = IPProto(b[9])
+		q.SrcIP6, q.DstIP6 = IP6{}, IP6{}
 	case 6:
-		q.IPProto = IPProto(b[6]) // "Next Header" field
+		q.decode6(b)
 		return
 	default:
 		q.IPVersion = 0
@@ -201,8 +218,22 @@ func (q *ParsedPacket) Decode(b []byte) {
 			q.DstPort = get16(sub[2:4])
 			q.dataofs = q.subofs + udpHeaderLength
 			return
+		case SCTP:
+			if len(sub) < sctpHeaderLength {
+				q.IPProto = Unknown
+				return
+			}
+			q.SrcPort = get16(sub[0:2])
+			q.DstPort = get16(sub[2:4])
+			q.dataofs = q.subofs + sctpHeaderLength
+			return
 		default:
-			q.IPProto = Unknown
+			// A protocol whose header we don't parse, like GRE
+			// or ESP. Keep its number so that filters can match
+			// on it, as a protocol without ports.
+			q.SrcPort = 0
+			q.DstPort = 0
+			q.dataofs = q.subofs
 			return
 		}
 	} else {
@@ -224,6 +255,124 @@ func (q *ParsedPacket) Decode(b []byte) {
 	}
 }
 
+// decode6 is the IPv6 part of Decode.
+// It skips over any extension headers to find the subprotocol and
+// applies the same fragment rules as the IPv4 path.
+func (q *ParsedPacket) decode6(b []byte) {
+	q.SrcIP, q.DstIP = 0, 0
+
+	if len(b) < ip6HeaderLength {
+		q.IPProto = Unknown
+		return
+	}
+	q.length = ip6HeaderLength + int(get16(b[4:6]))
+	if len(b) < q.length {
+		// Packet was cut off before full IPv6 length.
+		q.IPProto = Unknown
+		return
+	}
+	copy(q.SrcIP6[:], b[8:24])
+	copy(q.DstIP6[:], b[24:40])
+
+	nextHdr := b[6]
+	ofs := ip6HeaderLength
+	moreFrags := false
+	for n := 0; isIP6ExtHeader(nextHdr); n++ {
+		if n == maxIP6ExtHeaders || q.length < ofs+8 {
+			q.IPProto = Unknown
+			return
+		}
+		hdr := b[ofs:]
+		switch nextHdr {
+		case ip6Fragment:
+			fragField := get16(hdr[2:4])
+			// The offset is in 8-byte units in the top 13 bits,
+			// so masking off the flags gives the offset in bytes.
+			fragOfs := fragField &^ 0x7
+			if fragOfs != 0 {
+				// This is a fragment other than the first one.
+				if fragOfs < minFrag {
+					q.IPProto = Unknown
+					return
+				}
+				q.IPProto = Fragment
+				return
+			}
+			moreFrags = (fragField & 0x1) != 0
+			ofs += ip6FragmentHeaderLength
+		case ip6AuthHeader:
+			ofs += (int(hdr[1]) + 2) * 4
+		default:
+			ofs += (int(hdr[1]) + 1) * 8
+		}
+		nextHdr = hdr[0]
+	}
+	if ofs > q.length {
+		q.IPProto = Unknown
+		return
+	}
+
+	q.IPProto = IPProto(nextHdr)
+	q.subofs = ofs
+	sub := b[ofs:q.length]
+	if moreFrags && len(sub) < minFrag {
+		// Suspiciously short first fragment, dump it.
+		q.IPProto = Unknown
+		return
+	}
+	switch q.IPProto {
+	case ICMPv6:
+		if len(sub) < icmpHeaderLength {
+			q.IPProto = Unknown
+			return
+		}
+		q.SrcPort = 0
+		q.DstPort = 0
+		q.dataofs = q.subofs + icmpHeaderLength
+	case TCP:
+		if len(sub) < tcpHeaderLength {
+			q.IPProto = Unknown
+			return
+		}
+		q.SrcPort = get16(sub[0:2])
+		q.DstPort = get16(sub[2:4])
+		q.TCPFlags = sub[13] & 0x3F
+		headerLength := (sub[12] & 0xF0) >> 2
+		q.dataofs = q.subofs + int(headerLength)
+	case UDP:
+		if len(sub) < udpHeaderLength {
+			q.IPProto = Unknown
+			return
+		}
+		q.SrcPort = get16(sub[0:2])
+		q.DstPort = get16(sub[2:4])
+		q.dataofs = q.subofs + udpHeaderLength
+	case SCTP:
+		if len(sub) < sctpHeaderLength {
+			q.IPProto = Unknown
+			return
+		}
+		q.SrcPort = get16(sub[0:2])
+		q.DstPort = get16(sub[2:4])
+		q.dataofs = q.subofs + sctpHeaderLength
+	default:
+		// See the IPv4 case in Decode.
+		q.SrcPort = 0
+		q.DstPort = 0
+		q.dataofs = q.subofs
+	}
+}
+
+// isIP6ExtHeader reports whether nextHdr is an IPv6 extension
+// header that decode6 skips over.
+func isIP6ExtHeader(nextHdr uint8) bool {
+	switch nextHdr {
+	case ip6HopByHop, ip6Routing, ip6Fragment, ip6AuthHeader, ip6DestOptions:
+		return true
+	}
+	return false
+}
+
 func (q *ParsedPacket) IPHeader() IPHeader {
 	ipid := get16(q.b[4:6])
 	return IPHeader{
@@ -250,6 +399,19 @@ func (q *ParsedPacket) UDPHeader() UDPHeader {
 	}
 }
 
+func (q *ParsedPacket) TCPHeader() TCPHeader {
+	sub := q.b[q.subofs:]
+	return TCPHeader{
+		IPHeader: q.IPHeader(),
+		SrcPort:  q.SrcPort,
+		DstPort:  q.DstPort,
+		Seq:      get32(sub[4:8]),
+		Ack:      get32(sub[8:12]),
+		Flags:    q.TCPFlags,
+		Window:   get16(sub[14:16]),
+	}
+}
+
 // Buffer returns the entire packet buffer.
 // This is a read-only view; that is, q retains the ownership of the buffer.
 func (q *ParsedPacket) Buffer() []byte {
@@ -268,44 +430,72 @@ func (q *ParsedPacket) Payload() []byte {
 	return q.b[q.dataofs:q.length]
 }
 
-// Trim trims the buffer to its IPv4 length.
+// Trim trims the buffer to its IP length.
 // Sometimes packets arrive from an interface with extra bytes on the end.
 // This removes them.
 func (q *ParsedPacket) Trim() []byte {
 	return q.b[:q.length]
 }
 
+// ICMPTypeCode returns the type and code of an ICMP or ICMPv6 packet.
+// It returns zeros for other packets.
+func (q *ParsedPacket) ICMPTypeCode() (typ, code uint8) {
+	if (q.IPProto != ICMP && q.IPProto != ICMPv6) || len(q.b) < q.subofs+2 {
+		return 0, 0
+	}
+	return q.b[q.subofs], q.b[q.subofs+1]
+}
+
 // IsTCPSyn reports whether q is a TCP SYN packet
 // (i.e. the first packet in a new connection).
 func (q *ParsedPacket) IsTCPSyn() bool {
 	return (q.TCPFlags & TCPSynAck) == TCPSyn
 }
 
-// IsError reports whether q is an IPv4 ICMP "Error" packet.
+// IsError reports whether q is an ICMP or ICMPv6 "Error" packet.
 func (q *ParsedPacket) IsError() bool {
-	if q.IPProto == ICMP && len(q.b) >= q.subofs+8 {
+	if len(q.b) < q.subofs+8 {
+		return false
+	}
+	switch q.IPProto {
+	case ICMP:
 		switch ICMPType(q.b[q.subofs]) {
 		case ICMPUnreachable, ICMPTimeExceeded:
 			return true
 		}
+	case ICMPv6:
+		switch ICMP6Type(q.b[q.subofs]) {
+		case ICMP6Unreachable, ICMP6PacketTooBig, ICMP6TimeExceeded, ICMP6ParamProblem:
+			return true
+		}
 	}
 	return false
 }
 
-// IsEchoRequest reports whether q is an IPv4 ICMP Echo Request.
+// IsEchoRequest reports whether q is an ICMP or ICMPv6 Echo Request.
 func (q *ParsedPacket) IsEchoRequest() bool {
-	if q.IPProto == ICMP && len(q.b) >= q.subofs+8 {
-		return ICMPType(q.b[q.subofs]) == ICMPEchoRequest &&
-			ICMPCode(q.b[q.subofs+1]) == ICMPNoCode
+	if len(q.b) < q.subofs+8 || ICMPCode(q.b[q.subofs+1]) != ICMPNoCode {
+		return false
+	}
+	switch q.IPProto {
+	case ICMP:
+		return ICMPType(q.b[q.subofs]) == ICMPEchoRequest
+	case ICMPv6:
+		return ICMP6Type(q.b[q.subofs]) == ICMP6EchoRequest
 	}
 	return false
 }
 
-// IsEchoRequest reports whether q is an IPv4 ICMP Echo Response.
+// IsEchoResponse reports whether q is an ICMP or ICMPv6 Echo Response.
 func (q *ParsedPacket) IsEchoResponse() bool {
-	if q.IPProto == ICMP && len(q.b) >= q.subofs+8 {
-		return ICMPType(q.b[q.subofs]) == ICMPEchoReply &&
-			ICMPCode(q.b[q.subofs+1]) == ICMPNoCode
+	if len(q.b) < q.subofs+8 || ICMPCode(q.b[q.subofs+1]) != ICMPNoCode {
+		return false
+	}
+	switch q.IPProto {
+	case ICMP:
+		return ICMPType(q.b[q.subofs]) == ICMPEchoReply
+	case ICMPv6:
+		return ICMP6Type(q.b[q.subofs]) == ICMP6EchoReply
 	}
 	return false
 }
@@ -92,9 +92,76 @@ var ipv6PacketBuffer = []byte{
 }
 
 var ipv6PacketDecode = ParsedPacket{
-	b:         ipv6PacketBuffer,
+	b:       ipv6PacketBuffer,
+	subofs:  40,
+	dataofs: 44,
+	length:  len(ipv6PacketBuffer),
+
 	IPVersion: 6,
 	IPProto:   ICMPv6,
+	SrcIP6:    NewIP6(net.ParseIP("fe80::fb57:1dea:9c39:8fb7")),
+	DstIP6:    NewIP6(net.ParseIP("ff02::2")),
+}
+
+// IPv6 TCP SYN from fd7a::1 port 123 to fd7a::2 port 567, behind a
+// hop-by-hop options header and a destination options header.
+var tcp6PacketBuffer = []byte{
+	// IPv6 header, payload length 36, next header hop-by-hop
+	0x60, 0x00, 0x00, 0x00, 0x00, 0x24, 0x00, 0x40,
+	// source ip
+	0xfd, 0x7a, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+	// destination ip
+	0xfd, 0x7a, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+	// hop-by-hop options, next header destination options, PadN
+	0x3c, 0x00, 0x01, 0x04, 0x00, 0x00, 0x00, 0x00,
+	// destination options, next header TCP, PadN
+	0x06, 0x00, 0x01, 0x04, 0x00, 0x00, 0x00, 0x00,
+	// TCP header with SYN set
+	0x00, 0x7b, 0x02, 0x37, 0x00, 0x00, 0x12, 0x34, 0x00, 0x00, 0x00, 0x00,
+	0x50, 0x02, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+var tcp6PacketDecode = ParsedPacket{
+	b:       tcp6PacketBuffer,
+	subofs:  56,
+	dataofs: 76,
+	length:  len(tcp6PacketBuffer),
+
+	IPVersion: 6,
+	IPProto:   TCP,
+	SrcIP6:    NewIP6(net.ParseIP("fd7a::1")),
+	DstIP6:    NewIP6(net.ParseIP("fd7a::2")),
+	SrcPort:   123,
+	DstPort:   567,
+	TCPFlags:  TCPSyn,
+}
+
+// Non-first IPv6 fragment of a UDP packet.
+var frag6PacketBuffer = []byte{
+	// IPv6 header, payload length 16, next header fragment
+	0x60, 0x00, 0x00, 0x00, 0x00, 0x10, 0x2c, 0x40,
+	// source ip
+	0xfd, 0x7a, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+	// destination ip
+	0xfd, 0x7a, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+	// fragment header, next header UDP, offset 1232 bytes
+	0x11, 0x00, 0x04, 0xd0, 0xde, 0xad, 0xbe, 0xef,
+	// fragment payload
+	0x72, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x5f,
+}
+
+var frag6PacketDecode = ParsedPacket{
+	b:      frag6PacketBuffer,
+	length: len(frag6PacketBuffer),
+
+	IPVersion: 6,
+	IPProto:   Fragment,
+	SrcIP6:    NewIP6(net.ParseIP("fd7a::1")),
+	DstIP6:    NewIP6(net.ParseIP("fd7a::2")),
 }
 
 // This is a malformed IPv4 packet.
@@ -191,6 +258,57 @@ var udpReplyDecode = ParsedPacket{
 	DstPort: 123,
 }
 
+var sctpPacketBuffer = []byte{
+	// IP header up to checksum
+	0x45, 0x00, 0x00, 0x24, 0xde, 0xad, 0x00, 0x00, 0x40, 0x84, 0x00, 0x00,
+	// source ip
+	0x01, 0x02, 0x03, 0x04,
+	// destination ip
+	0x05, 0x06, 0x07, 0x08,
+	// SCTP common header: ports, verification tag, checksum
+	0x00, 0x7b, 0x02, 0x37, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+	// a chunk header
+	0x01, 0x00, 0x00, 0x04,
+}
+
+var sctpPacketDecode = ParsedPacket{
+	b:       sctpPacketBuffer,
+	subofs:  20,
+	dataofs: 32,
+	length:  len(sctpPacketBuffer),
+
+	IPVersion: 4,
+	IPProto:   SCTP,
+	SrcIP:     NewIP(net.ParseIP("1.2.3.4")),
+	DstIP:     NewIP(net.ParseIP("5.6.7.8")),
+	SrcPort:   123,
+	DstPort:   567,
+}
+
+// A protocol without ports that Decode doesn't parse, GRE.
+var grePacketBuffer = []byte{
+	// IP header up to checksum
+	0x45, 0x00, 0x00, 0x18, 0xde, 0xad, 0x00, 0x00, 0x40, 0x2f, 0x00, 0x00,
+	// source ip
+	0x01, 0x02, 0x03, 0x04,
+	// destination ip
+	0x05, 0x06, 0x07, 0x08,
+	// GRE header: flags and version, protocol type
+	0x00, 0x00, 0x08, 0x00,
+}
+
+var grePacketDecode = ParsedPacket{
+	b:       grePacketBuffer,
+	subofs:  20,
+	dataofs: 20,
+	length:  len(grePacketBuffer),
+
+	IPVersion: 4,
+	IPProto:   47,
+	SrcIP:     NewIP(net.ParseIP("1.2.3.4")),
+	DstIP:     NewIP(net.ParseIP("5.6.7.8")),
+}
+
 func TestParsedPacket(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -200,7 +318,8 @@ func TestParsedPacket(t *testing.T) {
 		{"tcp", tcpPacketDecode, "TCP{1.2.3.4:123 > 5.6.7.8:567}"},
 		{"icmp", icmpRequestDecode, "ICMP{1.2.3.4:0 > 5.6.7.8:0}"},
 		{"unknown", unknownPacketDecode, "Unknown{???}"},
-		{"ipv6", ipv6PacketDecode, "IPv6{Proto=58}"},
+		{"ipv6", ipv6PacketDecode, "ICMPv6{[fe80::fb57:1dea:9c39:8fb7]:0 > [ff02::2]:0}"},
+		{"tcp6", tcp6PacketDecode, "TCP{[fd7a::1]:123 > [fd7a::2]:567}"},
 	}
 
 	for _, tt := range tests {
@@ -230,9 +349,13 @@ func TestDecode(t *testing.T) {
 	}{
 		{"icmp", icmpRequestBuffer, icmpRequestDecode},
 		{"ipv6", ipv6PacketBuffer, ipv6PacketDecode},
+		{"tcp6", tcp6PacketBuffer, tcp6PacketDecode},
+		{"frag6", frag6PacketBuffer, frag6PacketDecode},
 		{"unknown", unknownPacketBuffer, unknownPacketDecode},
 		{"tcp", tcpPacketBuffer, tcpPacketDecode},
 		{"udp", udpRequestBuffer, udpRequestDecode},
+		{"sctp", sctpPacketBuffer, sctpPacketDecode},
+		{"gre", grePacketBuffer, grePacketDecode},
 	}
 
 	for _, tt := range tests {
@@ -262,6 +385,7 @@ func BenchmarkDecode(b *testing.B) {
 		{"icmp", icmpRequestBuffer},
 		{"unknown", unknownPacketBuffer},
 		{"tcp", tcpPacketBuffer},
+		{"tcp6", tcp6PacketBuffer},
 	}
 
 	for _, bench := range benches {
@@ -347,3 +471,51 @@ func TestMarshalResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestMarshalTCP(t *testing.T) {
+	h := TCPHeader{
+		IPHeader: IPHeader{
+			IPID:  1,
+			SrcIP: NewIP(net.ParseIP("100.100.100.100")),
+			DstIP: NewIP(net.ParseIP("100.64.0.1")),
+		},
+		SrcPort: 53,
+		DstPort: 40000,
+		Seq:     0x01020304,
+		Ack:     0x05060708,
+		Flags:   TCPPsh | TCPAck,
+		Window:  65535,
+	}
+	payload := []byte("tcp_payload")
+	buf := make([]byte, h.Len()+len(payload))
+	copy(buf[h.Len():], payload)
+	if err := h.Marshal(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var p ParsedPacket
+	p.Decode(buf)
+	if got, want := p.String(), "TCP{100.100.100.100:53 > 100.64.0.1:40000}"; got != want {
+		t.Errorf("String = %q; want %q", got, want)
+	}
+	if !bytes.Equal(p.Payload(), payload) {
+		t.Errorf("Payload = %q; want %q", p.Payload(), payload)
+	}
+	h.IPProto = TCP
+	if got := p.TCPHeader(); got != h {
+		t.Errorf("TCPHeader = %+v; want %+v", got, h)
+	}
+	if ipChecksum(buf[:20]) != 0 {
+		t.Errorf("bad IP checksum")
+	}
+	// The checksum over the pseudo-header and segment must verify.
+	pseudo := make([]byte, 12+len(buf)-20)
+	copy(pseudo[0:4], buf[12:16])
+	copy(pseudo[4:8], buf[16:20])
+	pseudo[9] = byte(TCP)
+	put16(pseudo[10:12], uint16(len(buf)-20))
+	copy(pseudo[12:], buf[20:])
+	if ipChecksum(pseudo) != 0 {
+		t.Errorf("bad TCP checksum")
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+// TCPHeader represents a TCP packet header without options.
+type TCPHeader struct {
+	IPHeader
+	SrcPort uint16
+	DstPort uint16
+	Seq     uint32
+	Ack     uint32
+	Flags   uint8
+	Window  uint16
+}
+
+const (
+	tcpHeaderLength = 20
+	// tcpTotalHeaderLength is the length of all headers in a TCP packet.
+	tcpTotalHeaderLength = ipHeaderLength + tcpHeaderLength
+)
+
+func (TCPHeader) Len() int {
+	return tcpTotalHeaderLength
+}
+
+func (h TCPHeader) Marshal(buf []byte) error {
+	if len(buf) < tcpTotalHeaderLength {
+		return errSmallBuffer
+	}
+	if len(buf) > maxPacketLength {
+		return errLargePacket
+	}
+	// The caller does not need to set this.
+	h.IPProto = TCP
+
+	put16(buf[20:22], h.SrcPort)
+	put16(buf[22:24], h.DstPort)
+	put32(buf[24:28], h.Seq)
+	put32(buf[28:32], h.Ack)
+	buf[32] = (tcpHeaderLength / 4) << 4 // data offset, no options
+	buf[33] = h.Flags
+	put16(buf[34:36], h.Window)
+	put16(buf[36:38], 0) // blank checksum
+	put16(buf[38:40], 0) // urgent pointer
+
+	h.IPHeader.MarshalPseudo(buf)
+
+	// TCP checksum with IP pseudo header.
+	put16(buf[36:38], ipChecksum(buf[8:]))
+
+	h.IPHeader.Marshal(buf)
+
+	return nil
+}
+
+func (h *TCPHeader) ToResponse() {
+	h.SrcPort, h.DstPort = h.DstPort, h.SrcPort
+	h.IPHeader.ToResponse()
+}
@@ -0,0 +1,240 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"container/list"
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+)
+
+// defaultCacheSize is the default maximum number of responses
+// a Resolver caches from upstream nameservers.
+const defaultCacheSize = 1024
+
+// maxCacheTTL bounds how long a response is cached,
+// regardless of the TTLs of the records in it.
+const maxCacheTTL = time.Hour
+
+var (
+	cacheHits      = expvar.NewInt("counter_tsdns_cache_hits")
+	cacheMisses    = expvar.NewInt("counter_tsdns_cache_misses")
+	cacheEvictions = expvar.NewInt("counter_tsdns_cache_evictions")
+)
+
+// cacheKey identifies the upstream responses that can be used
+// to answer a query.
+type cacheKey struct {
+	// name is the question name in lowercase.
+	name  string
+	typ   dns.Type
+	class dns.Class
+	// edns is whether the query carried an EDNS0 OPT record,
+	// as it determines whether the response does.
+	edns bool
+}
+
+type cacheEntry struct {
+	key cacheKey
+	// msg is the upstream response.
+	msg dns.Message
+	// stored is when the response was received.
+	stored time.Time
+	// expires is when the response must no longer be used.
+	expires time.Time
+}
+
+// cache is an LRU cache of upstream DNS responses that respects their TTLs.
+// It caches negative responses (NXDOMAIN and NODATA) too, for as long as
+// the SOA record accompanying them says, as described in RFC 2308.
+type cache struct {
+	now  func() time.Time // for tests
+	size int              // maximum number of entries; zero disables caching
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element // of *cacheEntry
+	lru     *list.List                 // of *cacheEntry, most recently used first
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		now:     time.Now,
+		size:    size,
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// keyFor returns the cache key for the query described by resp.
+func keyFor(resp *response) cacheKey {
+	return cacheKey{
+		name:  strings.ToLower(resp.Question.Name.String()),
+		typ:   resp.Question.Type,
+		class: resp.Question.Class,
+		edns:  resp.EDNS0,
+	}
+}
+
+// flush removes all entries.
+func (c *cache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[cacheKey]*list.Element)
+	c.lru.Init()
+}
+
+func (c *cache) removeLocked(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*cacheEntry).key)
+}
+
+// get returns a cached response for key, with the given ID
+// and TTLs reduced by the time it spent in the cache.
+func (c *cache) get(key cacheKey, id uint16) ([]byte, bool) {
+	now := c.now()
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		cacheMisses.Add(1)
+		return nil, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		c.removeLocked(e)
+		c.mu.Unlock()
+		cacheMisses.Add(1)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	msg := copyMessage(&entry.msg)
+	age := uint32(now.Sub(entry.stored) / time.Second)
+	c.mu.Unlock()
+
+	msg.Header.ID = id
+	forEachRecord(&msg, func(h *dns.ResourceHeader) {
+		if h.TTL > age {
+			h.TTL -= age
+		} else {
+			h.TTL = 0
+		}
+	})
+	out, err := msg.Pack()
+	if err != nil {
+		cacheMisses.Add(1)
+		return nil, false
+	}
+	cacheHits.Add(1)
+	return out, true
+}
+
+// put caches the upstream response out for key, if it is cacheable.
+func (c *cache) put(key cacheKey, out []byte) {
+	var msg dns.Message
+	if err := msg.Unpack(out); err != nil {
+		return
+	}
+	ttl, ok := cacheTTL(&msg)
+	if !ok {
+		return
+	}
+	now := c.now()
+	entry := &cacheEntry{
+		key:     key,
+		msg:     msg,
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= 0 {
+		return
+	}
+	if e, ok := c.entries[key]; ok {
+		c.removeLocked(e)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		c.removeLocked(c.lru.Back())
+		cacheEvictions.Add(1)
+	}
+}
+
+// cacheTTL returns how long msg may be cached,
+// and whether it may be cached at all.
+func cacheTTL(msg *dns.Message) (time.Duration, bool) {
+	if msg.Header.Truncated {
+		// Retrying over TCP will get the full response.
+		return 0, false
+	}
+
+	var ttl uint32
+	switch {
+	case msg.Header.RCode == dns.RCodeSuccess && len(msg.Answers) > 0:
+		ttl = ^uint32(0)
+		forEachRecord(msg, func(h *dns.ResourceHeader) {
+			if h.TTL < ttl {
+				ttl = h.TTL
+			}
+		})
+	case msg.Header.RCode == dns.RCodeSuccess || msg.Header.RCode == dns.RCodeNameError:
+		// A negative response is cached according to the SOA record
+		// in its authority section, and not at all without one.
+		for _, rr := range msg.Authorities {
+			soa, ok := rr.Body.(*dns.SOAResource)
+			if !ok {
+				continue
+			}
+			ttl = rr.Header.TTL
+			if soa.MinTTL < ttl {
+				ttl = soa.MinTTL
+			}
+			break
+		}
+	default:
+		// Server failures and the like are not worth remembering.
+		return 0, false
+	}
+
+	if ttl == 0 {
+		return 0, false
+	}
+	d := time.Duration(ttl) * time.Second
+	if d > maxCacheTTL {
+		d = maxCacheTTL
+	}
+	return d, true
+}
+
+// forEachRecord calls f with the header of each record in msg,
+// except for EDNS0 OPT records, which have no TTL.
+func forEachRecord(msg *dns.Message, f func(*dns.ResourceHeader)) {
+	for _, section := range [][]dns.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for i := range section {
+			if section[i].Header.Type == dns.TypeOPT {
+				continue
+			}
+			f(&section[i].Header)
+		}
+	}
+}
+
+// copyMessage returns a copy of msg whose record headers
+// can be modified without affecting msg.
+// The record bodies are shared, so they must not be modified.
+func copyMessage(msg *dns.Message) dns.Message {
+	ret := *msg
+	ret.Questions = append([]dns.Question(nil), msg.Questions...)
+	ret.Answers = append([]dns.Resource(nil), msg.Answers...)
+	ret.Authorities = append([]dns.Resource(nil), msg.Authorities...)
+	ret.Additionals = append([]dns.Resource(nil), msg.Additionals...)
+	return ret
+}
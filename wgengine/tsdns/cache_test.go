@@ -0,0 +1,149 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsdns
+
+import (
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+)
+
+// upstreamResponse builds a response from an upstream nameserver
+// with the given answer and SOA TTLs, omitting records with negative TTLs.
+func upstreamResponse(t *testing.T, rcode dns.RCode, answerTTL, soaTTL, soaMinTTL int) []byte {
+	t.Helper()
+	name := dns.MustNewName("example.com.")
+	b := dns.NewBuilder(nil, dns.Header{ID: 1, Response: true, RCode: rcode})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(dns.Question{Name: name, Type: dns.TypeA, Class: dns.ClassINET})
+	b.StartAnswers()
+	if answerTTL >= 0 {
+		h := dns.ResourceHeader{Name: name, Class: dns.ClassINET, TTL: uint32(answerTTL)}
+		b.AResource(h, dns.AResource{A: [4]byte{1, 2, 3, 4}})
+	}
+	b.StartAuthorities()
+	if soaTTL >= 0 {
+		h := dns.ResourceHeader{Name: name, Class: dns.ClassINET, TTL: uint32(soaTTL)}
+		b.SOAResource(h, dns.SOAResource{
+			NS:     dns.MustNewName("ns.example.com."),
+			MBox:   dns.MustNewName("hostmaster.example.com."),
+			MinTTL: uint32(soaMinTTL),
+		})
+	}
+	out, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestCacheTTL(t *testing.T) {
+	tests := []struct {
+		name      string
+		rcode     dns.RCode
+		answerTTL int
+		soaTTL    int
+		soaMinTTL int
+		want      time.Duration
+		wantOK    bool
+	}{
+		{"positive", dns.RCodeSuccess, 300, -1, 0, 300 * time.Second, true},
+		{"positive_min", dns.RCodeSuccess, 300, 60, 3600, 60 * time.Second, true},
+		{"positive_capped", dns.RCodeSuccess, 86400, -1, 0, maxCacheTTL, true},
+		{"positive_zero", dns.RCodeSuccess, 0, -1, 0, 0, false},
+		{"nxdomain", dns.RCodeNameError, -1, 3600, 30, 30 * time.Second, true},
+		{"nxdomain_soa_ttl", dns.RCodeNameError, -1, 20, 30, 20 * time.Second, true},
+		{"nxdomain_no_soa", dns.RCodeNameError, -1, -1, 0, 0, false},
+		{"nodata", dns.RCodeSuccess, -1, 3600, 30, 30 * time.Second, true},
+		{"servfail", dns.RCodeServerFailure, -1, 3600, 30, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var msg dns.Message
+			if err := msg.Unpack(upstreamResponse(t, tt.rcode, tt.answerTTL, tt.soaTTL, tt.soaMinTTL)); err != nil {
+				t.Fatal(err)
+			}
+			got, ok := cacheTTL(&msg)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("cacheTTL = %v, %v; want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCache(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := newCache(2)
+	c.now = func() time.Time { return now }
+
+	key := func(name string) cacheKey {
+		return cacheKey{name: name, typ: dns.TypeA, class: dns.ClassINET}
+	}
+	answerTTL := func(out []byte) uint32 {
+		t.Helper()
+		var msg dns.Message
+		if err := msg.Unpack(out); err != nil {
+			t.Fatal(err)
+		}
+		if len(msg.Answers) != 1 {
+			t.Fatalf("answers = %v; want 1", msg.Answers)
+		}
+		return msg.Answers[0].Header.TTL
+	}
+
+	if _, ok := c.get(key("a."), 42); ok {
+		t.Fatal("hit in empty cache")
+	}
+
+	c.put(key("a."), upstreamResponse(t, dns.RCodeSuccess, 300, -1, 0))
+	now = now.Add(100 * time.Second)
+	out, ok := c.get(key("a."), 42)
+	if !ok {
+		t.Fatal("miss after put")
+	}
+	var p dns.Parser
+	if h, _ := p.Start(out); h.ID != 42 {
+		t.Errorf("ID = %d; want 42", h.ID)
+	}
+	if ttl := answerTTL(out); ttl != 200 {
+		t.Errorf("TTL = %d; want 200", ttl)
+	}
+	// The entry itself is unchanged by get.
+	out, _ = c.get(key("a."), 42)
+	if ttl := answerTTL(out); ttl != 200 {
+		t.Errorf("TTL on second get = %d; want 200", ttl)
+	}
+
+	// Least recently used entries are evicted: a. was just used, so b. goes.
+	c.put(key("b."), upstreamResponse(t, dns.RCodeSuccess, 300, -1, 0))
+	c.get(key("a."), 0)
+	c.put(key("c."), upstreamResponse(t, dns.RCodeSuccess, 300, -1, 0))
+	if _, ok := c.get(key("b."), 0); ok {
+		t.Error("b. not evicted")
+	}
+	if _, ok := c.get(key("a."), 0); !ok {
+		t.Error("a. evicted")
+	}
+
+	now = now.Add(200 * time.Second)
+	if _, ok := c.get(key("a."), 0); ok {
+		t.Error("hit after expiry")
+	}
+
+	c.put(key("d."), upstreamResponse(t, dns.RCodeSuccess, 300, -1, 0))
+	c.flush()
+	if _, ok := c.get(key("d."), 0); ok {
+		t.Error("hit after flush")
+	}
+
+	c = newCache(0)
+	c.put(key("e."), upstreamResponse(t, dns.RCodeSuccess, 300, -1, 0))
+	if _, ok := c.get(key("e."), 0); ok {
+		t.Error("hit with caching disabled")
+	}
+}
@@ -5,6 +5,7 @@
 package tsdns
 
 import (
+	"bytes"
 	"fmt"
 	"sort"
 	"strings"
@@ -21,10 +22,89 @@ type Map struct {
 	ipToName map[netaddr.IP]string
 	// names are the keys of nameToIP in sorted order.
 	names []string
+	// routes are the split DNS routes, most specific first.
+	routes []route
+
+	// cnames maps alias names to their canonical names.
+	cnames map[string]string
+	// txts maps names to their TXT records.
+	txts map[string][]string
+	// srvs maps names to their SRV records.
+	srvs map[string][]SRV
+}
+
+// SRV is the data of an SRV record, as defined in RFC 2782.
+type SRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	// Target is the name of the host providing the service.
+	Target string
+}
+
+// MapConfig is the data from which NewMapFromConfig builds a Map.
+// All names may be given with or without the trailing period.
+type MapConfig struct {
+	// NameToIP is the mapping of Tailscale domain names to their IP addresses.
+	NameToIP map[string]netaddr.IP
+	// Routes are the split DNS routes.
+	// Queries for names under a suffix in Routes are delegated to the
+	// nameservers for that suffix, rather than the resolver's default ones.
+	// A suffix starting with "*." matches only proper subdomains of the rest.
+	// The most specific matching suffix wins.
+	// Like in Resolver.SetNameservers, the nameservers are strings of the form ip:port.
+	Routes map[string][]string
+	// CNAME maps alias names to the names they stand for.
+	CNAME map[string]string
+	// TXT maps names to their TXT records.
+	TXT map[string][]string
+	// SRV maps names, such as _ssh._tcp.host.domain, to their SRV records.
+	SRV map[string][]SRV
+}
+
+// canonicalName returns name with a trailing period.
+func canonicalName(name string) string {
+	if name == "" || name[len(name)-1] == '.' {
+		return name
+	}
+	return name + "."
+}
+
+// route directs queries for names under a suffix to specific nameservers.
+type route struct {
+	// suffix is the name suffix in canonical form (lowercase, with a trailing period).
+	suffix string
+	// subdomainsOnly is whether the route excludes suffix itself,
+	// as requested by a leading "*." in the configured suffix.
+	subdomainsOnly bool
+	// nameservers are the upstream nameservers for the route,
+	// as strings of the form ip:port.
+	nameservers []string
+}
+
+// matches reports whether the route applies to name,
+// which must be in canonical form, ignoring case.
+func (rt route) matches(name []byte) bool {
+	n, s := len(name), len(rt.suffix)
+	if n < s || !bytes.EqualFold(name[n-s:], []byte(rt.suffix)) {
+		return false
+	}
+	if n == s {
+		return !rt.subdomainsOnly
+	}
+	// Only match at label boundaries: corp.example.com. must not match notcorp.example.com.
+	return name[n-s-1] == '.'
 }
 
 // NewMap returns a new Map with name to address mapping given by nameToIP.
 func NewMap(initNameToIP map[string]netaddr.IP) *Map {
+	return NewMapFromConfig(MapConfig{NameToIP: initNameToIP})
+}
+
+// NewMapFromConfig returns a new Map with the names, routes and records in c.
+func NewMapFromConfig(c MapConfig) *Map {
+	initNameToIP, initRoutes := c.NameToIP, c.Routes
+
 	// TODO(dmytro): we have to allocate names and ipToName, but nameToIP can be avoided.
 	// It is here because control sends us names not in canonical form. Change this.
 	names := make([]string, 0, len(initNameToIP))
@@ -36,20 +116,173 @@ func NewMap(initNameToIP map[string]netaddr.IP) *Map {
 			// Nothing useful can be done with empty names.
 			continue
 		}
-		if name[len(name)-1] != '.' {
-			name += "."
-		}
+		name = canonicalName(name)
 		names = append(names, name)
 		nameToIP[name] = ip
 		ipToName[ip] = name
 	}
 	sort.Strings(names)
 
+	routes := make([]route, 0, len(initRoutes))
+	for suffix, nameservers := range initRoutes {
+		rt := route{suffix: strings.ToLower(suffix)}
+		if strings.HasPrefix(rt.suffix, "*.") {
+			rt.suffix = rt.suffix[2:]
+			rt.subdomainsOnly = true
+		}
+		rt.suffix = strings.TrimSuffix(rt.suffix, ".")
+		if rt.suffix == "" || len(nameservers) == 0 {
+			// A route for the root is just the default nameservers,
+			// and one without nameservers cannot do anything useful.
+			continue
+		}
+		rt.suffix += "."
+		rt.nameservers = append([]string(nil), nameservers...)
+		routes = append(routes, rt)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		ri, rj := routes[i], routes[j]
+		if len(ri.suffix) != len(rj.suffix) {
+			return len(ri.suffix) > len(rj.suffix)
+		}
+		if ri.suffix != rj.suffix {
+			return ri.suffix < rj.suffix
+		}
+		// "*.x" is more specific than "x" for the names both match.
+		return ri.subdomainsOnly && !rj.subdomainsOnly
+	})
+
+	var cnames map[string]string
+	for alias, target := range c.CNAME {
+		if alias == "" || target == "" {
+			continue
+		}
+		if cnames == nil {
+			cnames = make(map[string]string)
+		}
+		cnames[canonicalName(alias)] = canonicalName(target)
+	}
+	var txts map[string][]string
+	for name, txt := range c.TXT {
+		if name == "" || len(txt) == 0 {
+			continue
+		}
+		if txts == nil {
+			txts = make(map[string][]string)
+		}
+		name = canonicalName(name)
+		txts[name] = append(txts[name], txt...)
+	}
+	var srvs map[string][]SRV
+	for name, srv := range c.SRV {
+		if name == "" || len(srv) == 0 {
+			continue
+		}
+		if srvs == nil {
+			srvs = make(map[string][]SRV)
+		}
+		name = canonicalName(name)
+		for _, rec := range srv {
+			rec.Target = canonicalName(rec.Target)
+			srvs[name] = append(srvs[name], rec)
+		}
+	}
+
 	return &Map{
 		nameToIP: nameToIP,
 		ipToName: ipToName,
 		names:    names,
+		routes:   routes,
+		cnames:   cnames,
+		txts:     txts,
+		srvs:     srvs,
+	}
+}
+
+// hasName reports whether there are any records for name,
+// which must be in canonical form.
+func (m *Map) hasName(name string) bool {
+	if _, ok := m.nameToIP[name]; ok {
+		return true
+	}
+	if _, ok := m.cnames[name]; ok {
+		return true
+	}
+	if _, ok := m.txts[name]; ok {
+		return true
+	}
+	_, ok := m.srvs[name]
+	return ok
+}
+
+// PrettyRecords returns a human-readable description of the
+// CNAME, TXT and SRV records, sorted by name and type.
+func (m *Map) PrettyRecords() string {
+	if m == nil {
+		return ""
+	}
+	var lines []string
+	for alias, target := range m.cnames {
+		lines = append(lines, fmt.Sprintf("%s\tCNAME\t%s\n", alias, target))
+	}
+	for name, txts := range m.txts {
+		for _, txt := range txts {
+			lines = append(lines, fmt.Sprintf("%s\tTXT\t%q\n", name, txt))
+		}
+	}
+	for name, srvs := range m.srvs {
+		for _, srv := range srvs {
+			lines = append(lines, fmt.Sprintf("%s\tSRV\t%d %d %d %s\n", name, srv.Priority, srv.Weight, srv.Port, srv.Target))
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "")
+}
+
+// nameserversFor returns the nameservers of the most specific route
+// matching name, which must be in canonical form, or nil if none matches.
+func (m *Map) nameserversFor(name []byte) []string {
+	for _, rt := range m.routes {
+		if rt.matches(name) {
+			return rt.nameservers
+		}
+	}
+	return nil
+}
+
+// PrettyRoutes returns a human-readable description of the split DNS routes.
+func (m *Map) PrettyRoutes() string {
+	buf := new(strings.Builder)
+	for _, rt := range m.routes {
+		if rt.subdomainsOnly {
+			buf.WriteString("*.")
+		}
+		fmt.Fprintf(buf, "%s\t%s\n", rt.suffix, strings.Join(rt.nameservers, ","))
+	}
+	return buf.String()
+}
+
+// routesEqual reports whether m and m2 have the same split DNS routes.
+func (m *Map) routesEqual(m2 *Map) bool {
+	var r1, r2 []route
+	if m != nil {
+		r1 = m.routes
+	}
+	if m2 != nil {
+		r2 = m2.routes
+	}
+	if len(r1) != len(r2) {
+		return false
+	}
+	for i := range r1 {
+		if r1[i].suffix != r2[i].suffix || r1[i].subdomainsOnly != r2[i].subdomainsOnly {
+			return false
+		}
+		if strings.Join(r1[i].nameservers, ",") != strings.Join(r2[i].nameservers, ",") {
+			return false
+		}
 	}
+	return true
 }
 
 func printSingleNameIP(buf *strings.Builder, name string, ip netaddr.IP) {
@@ -136,3 +136,49 @@ func TestPrettyDiffFrom(t *testing.T) {
 		})
 	}
 }
+
+func TestRoutes(t *testing.T) {
+	m := NewMapFromConfig(MapConfig{Routes: map[string][]string{
+		"corp.example.com":     {"10.0.0.53:53"},
+		"dev.corp.example.com": {"10.0.1.53:53"},
+		"*.internal.":          {"10.1.0.53:53"},
+		"empty.example.com":    nil,
+		".":                    {"10.9.9.9:53"},
+	}})
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"corp.example.com.", "10.0.0.53:53"},
+		{"www.corp.example.com.", "10.0.0.53:53"},
+		{"WWW.Corp.Example.Com.", "10.0.0.53:53"},
+		{"host.dev.corp.example.com.", "10.0.1.53:53"},
+		{"notcorp.example.com.", ""},
+		{"example.com.", ""},
+		{"empty.example.com.", ""},
+		{"db.internal.", "10.1.0.53:53"},
+		{"a.b.internal.", "10.1.0.53:53"},
+		{"internal.", ""},
+		{"google.com.", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			if ns := m.nameserversFor([]byte(tt.name)); len(ns) > 0 {
+				got = ns[0]
+			}
+			if got != tt.want {
+				t.Errorf("nameserversFor(%q) = %q; want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+
+	const wantPretty = "dev.corp.example.com.\t10.0.1.53:53\n" +
+		"corp.example.com.\t10.0.0.53:53\n" +
+		"*.internal.\t10.1.0.53:53\n"
+	if got := m.PrettyRoutes(); got != wantPretty {
+		t.Errorf("PrettyRoutes = %q; want %q", got, wantPretty)
+	}
+}
@@ -9,8 +9,10 @@ package tsdns
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"io"
 	"sync"
 	"time"
 
@@ -20,9 +22,21 @@ import (
 	"tailscale.com/types/logger"
 )
 
-// maxResponseSize is the maximum size of a response from a Resolver.
+// maxResponseSize is the maximum size of a UDP response from a Resolver
+// to a query without an EDNS0 OPT record, as set by RFC 1035.
 const maxResponseSize = 512
 
+// ednsBufferSize is the maximum size of a UDP response from a Resolver
+// to a query with an EDNS0 OPT record, regardless of the size the querier
+// advertises, and the size the Resolver advertises in its own OPT records.
+// It is the value recommended by DNS Flag Day 2020, and keeps responses
+// within the Tailscale MTU.
+const ednsBufferSize = 1232
+
+// maxMessageSize is the maximum size of a DNS message,
+// which is also the limit for responses over TCP.
+const maxMessageSize = 65535
+
 // queueSize is the maximal number of DNS requests that can be pending at a time.
 // If EnqueueRequest is called when this many requests are already pending,
 // the request will be dropped to avoid blocking the caller.
@@ -55,6 +69,10 @@ type Packet struct {
 	Payload []byte
 	// Addr is the source address for a request and the destination address for a response.
 	Addr netaddr.IPPort
+	// TCP is whether the request was received over TCP, in which case the
+	// response is not limited to the UDP message size.
+	// Payload never includes the two-byte length prefix used over TCP.
+	TCP bool
 }
 
 // Resolver is a DNS resolver for nodes on the Tailscale network,
@@ -71,8 +89,9 @@ type Resolver struct {
 	queue chan Packet
 	// responses is an unbuffered channel to which responses are sent.
 	responses chan Packet
-	// errors is an unbuffered channel to which errors are sent.
-	errors chan error
+	// errors is an unbuffered channel to which errors are sent,
+	// with the requests that caused them.
+	errors chan requestError
 	// closed notifies the poll goroutines to stop.
 	closed chan struct{}
 	// pollGroup signals when all poll goroutines have stopped.
@@ -83,13 +102,16 @@ type Resolver struct {
 
 	// dialer is the netns.Dialer used for delegation.
 	dialer netns.Dialer
+	// cache holds responses from upstream nameservers.
+	cache *cache
 
 	// mu guards the following fields from being updated while used.
 	mu sync.Mutex
 	// dnsMap is the map most recently received from the control server.
 	dnsMap *Map
 	// nameservers is the list of nameserver addresses that should be used
-	// if the received query is not for a Tailscale node.
+	// if the received query is not for a Tailscale node
+	// and does not match any of dnsMap's routes.
 	// The addresses are strings of the form ip:port, as expected by Dial.
 	nameservers []string
 }
@@ -101,10 +123,11 @@ func NewResolver(logf logger.Logf, rootDomain string) *Resolver {
 		logf:       logger.WithPrefix(logf, "tsdns: "),
 		queue:      make(chan Packet, queueSize),
 		responses:  make(chan Packet),
-		errors:     make(chan error),
+		errors:     make(chan requestError),
 		closed:     make(chan struct{}),
 		rootDomain: []byte(rootDomain),
 		dialer:     netns.NewDialer(),
+		cache:      newCache(defaultCacheSize),
 	}
 
 	return r
@@ -136,16 +159,33 @@ func (r *Resolver) SetMap(m *Map) {
 	r.dnsMap = m
 	r.mu.Unlock()
 	r.logf("map diff:\n%s", m.PrettyDiffFrom(oldMap))
+	if !m.routesEqual(oldMap) {
+		r.logf("routes:\n%s", m.PrettyRoutes())
+		// Cached responses may be from nameservers no longer in use.
+		r.cache.flush()
+	}
+	if records := m.PrettyRecords(); records != oldMap.PrettyRecords() {
+		r.logf("records:\n%s", records)
+	}
 }
 
-// SetUpstreamNameservers sets the addresses of the resolver's
+// SetNameservers sets the addresses of the resolver's default
 // upstream nameservers, taking ownership of the argument.
+// They are used for queries not matching any route in the resolver's Map.
 // The addresses should be strings of the form ip:port,
 // matching what Dial("udp", addr) expects as addr.
 func (r *Resolver) SetNameservers(nameservers []string) {
 	r.mu.Lock()
 	r.nameservers = nameservers
 	r.mu.Unlock()
+	r.cache.flush()
+}
+
+// FlushCache discards all cached responses from upstream nameservers.
+// It should be called when the network changes, as the answers
+// upstream nameservers give may depend on it.
+func (r *Resolver) FlushCache() {
+	r.cache.flush()
 }
 
 // EnqueueRequest places the given DNS request in the resolver's queue.
@@ -160,14 +200,22 @@ func (r *Resolver) EnqueueRequest(request Packet) error {
 	}
 }
 
+// requestError is an error resolving a request.
+type requestError struct {
+	request Packet
+	err     error
+}
+
 // NextResponse returns a DNS response to a previously enqueued request.
 // It blocks until a response is available and gives up ownership of the response payload.
+// If resolving a request failed, the returned Packet has the request's
+// Addr and TCP, but no Payload, and the error says why.
 func (r *Resolver) NextResponse() (Packet, error) {
 	select {
 	case resp := <-r.responses:
 		return resp, nil
-	case err := <-r.errors:
-		return Packet{}, err
+	case re := <-r.errors:
+		return Packet{Addr: re.request.Addr, TCP: re.request.TCP}, re.err
 	case <-r.closed:
 		return Packet{}, ErrClosed
 	}
@@ -191,6 +239,46 @@ func (r *Resolver) Resolve(domain string) (netaddr.IP, dns.RCode, error) {
 	return addr, dns.RCodeSuccess, nil
 }
 
+// resolveRecords fills in resp with the records of the queried type for name,
+// which must be in canonical form, for types other than A, AAAA and ALL.
+// For those, it is only called when name has no address of its own,
+// and looks for an alias to follow.
+func (r *Resolver) resolveRecords(name string, resp *response) (dns.RCode, error) {
+	r.mu.Lock()
+	dnsMap := r.dnsMap
+	r.mu.Unlock()
+
+	if dnsMap == nil {
+		return dns.RCodeServerFailure, errMapNotSet
+	}
+
+	found := false
+	switch resp.Question.Type {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeALL:
+		// Aliases of aliases are not followed, as control has
+		// no reason to produce them.
+		resp.CNAME, found = dnsMap.cnames[name]
+		if found {
+			resp.IP = dnsMap.nameToIP[resp.CNAME]
+		}
+	case dns.TypeCNAME:
+		resp.CNAME, found = dnsMap.cnames[name]
+	case dns.TypeTXT:
+		resp.TXT, found = dnsMap.txts[name]
+	case dns.TypeSRV:
+		resp.SRV, found = dnsMap.srvs[name]
+	default:
+		return dns.RCodeNotImplemented, errNotImplemented
+	}
+
+	if !found && !dnsMap.hasName(name) {
+		return dns.RCodeNameError, nil
+	}
+	// Either records of the type were found, or the name exists
+	// without them, in which case the answer is empty (NODATA).
+	return dns.RCodeSuccess, nil
+}
+
 // ResolveReverse returns the unique domain name that maps to the given address.
 // The returned domain name is in canonical form (with a trailing period).
 func (r *Resolver) ResolveReverse(ip netaddr.IP) (string, dns.RCode, error) {
@@ -223,10 +311,10 @@ func (r *Resolver) poll() {
 			return
 		}
 
-		packet.Payload, err = r.respond(packet.Payload)
+		packet.Payload, err = r.respond(packet.Payload, packet.TCP)
 		if err != nil {
 			select {
-			case r.errors <- err:
+			case r.errors <- requestError{packet, err}:
 				// continue
 			case <-r.closed:
 				return
@@ -242,9 +330,14 @@ func (r *Resolver) poll() {
 	}
 }
 
-// queryServer obtains a DNS response by querying the given server.
-func (r *Resolver) queryServer(ctx context.Context, server string, query []byte) ([]byte, error) {
-	conn, err := r.dialer.DialContext(ctx, "udp", server)
+// queryServer obtains a DNS response by querying the given server
+// over UDP, or over TCP if tcp is set.
+func (r *Resolver) queryServer(ctx context.Context, server string, query []byte, tcp bool) ([]byte, error) {
+	network := "udp"
+	if tcp {
+		network = "tcp"
+	}
+	conn, err := r.dialer.DialContext(ctx, network, server)
 	if err != nil {
 		return nil, err
 	}
@@ -256,24 +349,84 @@ func (r *Resolver) queryServer(ctx context.Context, server string, query []byte)
 		conn.SetDeadline(time.Unix(1, 0))
 	}()
 
+	if tcp {
+		return exchangeTCP(conn, query)
+	}
+
 	_, err = conn.Write(query)
 	if err != nil {
 		return nil, err
 	}
 
-	out := make([]byte, maxResponseSize)
+	// The query may carry an EDNS0 OPT record advertising a large
+	// buffer, so make room for the largest possible response.
+	out := make([]byte, maxMessageSize)
 	n, err := conn.Read(out)
 	if err != nil {
 		return nil, err
 	}
 
-	return out[:n], nil
+	return append([]byte(nil), out[:n]...), nil
+}
+
+// exchangeTCP writes query to conn and reads the response,
+// using the two-byte length framing of DNS over TCP.
+func exchangeTCP(conn io.ReadWriter, query []byte) ([]byte, error) {
+	if len(query) > maxMessageSize {
+		return nil, errors.New("query too large")
+	}
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var lenbuf [2]byte
+	if _, err := io.ReadFull(conn, lenbuf[:]); err != nil {
+		return nil, err
+	}
+	out := make([]byte, binary.BigEndian.Uint16(lenbuf[:]))
+	if _, err := io.ReadFull(conn, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// delegate forwards the query to all upstream nameservers and returns the first response,
+// unless a cached response is available.
+// Queries received over TCP are forwarded over TCP. Responses to UDP queries
+// that exceed the querier's size limit are truncated, with the TC bit set,
+// so that the querier retries over TCP.
+func (r *Resolver) delegate(query []byte, resp *response) ([]byte, error) {
+	key := keyFor(resp)
+	out, ok := r.cache.get(key, resp.Header.ID)
+	if !ok {
+		name := resp.Question.Name.Data[:resp.Question.Name.Length]
+		var err error
+		out, err = r.delegateQuery(query, name, resp.TCP)
+		if err != nil {
+			return nil, err
+		}
+		r.cache.put(key, out)
+	}
+	if !resp.TCP && len(out) > resp.UDPSize {
+		return truncateResponse(out, resp)
+	}
+	return out, nil
 }
 
-// delegate forwards the query to all upstream nameservers and returns the first response.
-func (r *Resolver) delegate(query []byte) ([]byte, error) {
+// delegateQuery does the work of delegate, without enforcing size limits.
+// The query is sent to the nameservers routed for name, if any,
+// and to the default nameservers otherwise.
+func (r *Resolver) delegateQuery(query, name []byte, tcp bool) ([]byte, error) {
 	r.mu.Lock()
 	nameservers := r.nameservers
+	if r.dnsMap != nil {
+		if routed := r.dnsMap.nameserversFor(name); routed != nil {
+			nameservers = routed
+		}
+	}
 	r.mu.Unlock()
 
 	if len(nameservers) == 0 {
@@ -285,13 +438,13 @@ func (r *Resolver) delegate(query []byte) ([]byte, error) {
 
 	// Common case, don't spawn goroutines.
 	if len(nameservers) == 1 {
-		return r.queryServer(ctx, nameservers[0], query)
+		return r.queryServer(ctx, nameservers[0], query, tcp)
 	}
 
 	datach := make(chan []byte)
 	for _, server := range nameservers {
 		go func(s string) {
-			resp, err := r.queryServer(ctx, s, query)
+			resp, err := r.queryServer(ctx, s, query, tcp)
 			// Only print errors not due to cancelation after first response.
 			if err != nil && ctx.Err() != context.Canceled {
 				r.logf("querying %s: %v", s, err)
@@ -324,6 +477,21 @@ type response struct {
 	Name string
 	// IP is the response to an A, AAAA, or ANY query.
 	IP netaddr.IP
+	// CNAME is the response to a CNAME query, or the name an alias
+	// stands for in response to an A, AAAA, or ANY query.
+	CNAME string
+	// TXT is the response to a TXT query.
+	TXT []string
+	// SRV is the response to an SRV query.
+	SRV []SRV
+
+	// TCP is whether the query was received over TCP.
+	TCP bool
+	// EDNS0 is whether the query carried an EDNS0 OPT record,
+	// in which case the response carries one too.
+	EDNS0 bool
+	// UDPSize is the maximum size of a response to the query over UDP.
+	UDPSize int
 }
 
 // parseQuery parses the query in given packet into a response struct.
@@ -345,7 +513,84 @@ func (r *Resolver) parseQuery(query []byte, resp *response) error {
 		return err
 	}
 
-	return nil
+	resp.UDPSize = maxResponseSize
+	// A malformed additional section is not worth failing the query
+	// over: the worst case is answering as if EDNS0 were not in use.
+	if parser.SkipAllQuestions() != nil || parser.SkipAllAnswers() != nil || parser.SkipAllAuthorities() != nil {
+		return nil
+	}
+	for {
+		h, err := parser.AdditionalHeader()
+		if err != nil {
+			// Either dns.ErrSectionDone or a malformed record.
+			return nil
+		}
+		if h.Type == dns.TypeOPT {
+			resp.EDNS0 = true
+			// The OPT record's class is the querier's UDP payload size.
+			if size := int(h.Class); size > resp.UDPSize {
+				resp.UDPSize = size
+			}
+			if resp.UDPSize > ednsBufferSize {
+				resp.UDPSize = ednsBufferSize
+			}
+			return nil
+		}
+		if err := parser.SkipAdditional(); err != nil {
+			return nil
+		}
+	}
+}
+
+// marshalOPTRecord serializes an EDNS0 OPT record into an active builder.
+// The caller may continue using the builder following the call.
+func marshalOPTRecord(builder *dns.Builder) error {
+	var h dns.ResourceHeader
+	if err := h.SetEDNS0(ednsBufferSize, dns.RCodeSuccess, false); err != nil {
+		return err
+	}
+	return builder.OPTResource(h, dns.OPTResource{})
+}
+
+// truncateResponse returns a copy of the upstream response out with
+// all records removed and the TC bit set, telling the querier to retry
+// over TCP.
+func truncateResponse(out []byte, resp *response) ([]byte, error) {
+	var parser dns.Parser
+
+	h, err := parser.Start(out)
+	if err != nil {
+		return nil, err
+	}
+	h.Truncated = true
+
+	builder := dns.NewBuilder(nil, h)
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	for {
+		q, err := parser.Question()
+		if err == dns.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := builder.Question(q); err != nil {
+			return nil, err
+		}
+	}
+
+	if resp.EDNS0 {
+		if err := builder.StartAdditionals(); err != nil {
+			return nil, err
+		}
+		if err := marshalOPTRecord(&builder); err != nil {
+			return nil, err
+		}
+	}
+
+	return builder.Finish()
 }
 
 // marshalARecord serializes an A record into an active builder.
@@ -399,6 +644,68 @@ func marshalPTRRecord(queryName dns.Name, name string, builder *dns.Builder) err
 	return builder.PTRResource(answerHeader, answer)
 }
 
+// marshalCNAMERecord serializes a CNAME record into an active builder.
+// The caller may continue using the builder following the call.
+func marshalCNAMERecord(queryName dns.Name, name string, builder *dns.Builder) error {
+	var answer dns.CNAMEResource
+	var err error
+
+	answerHeader := dns.ResourceHeader{
+		Name:  queryName,
+		Type:  dns.TypeCNAME,
+		Class: dns.ClassINET,
+		TTL:   uint32(defaultTTL / time.Second),
+	}
+	answer.CNAME, err = dns.NewName(name)
+	if err != nil {
+		return err
+	}
+	return builder.CNAMEResource(answerHeader, answer)
+}
+
+// marshalTXTRecord serializes a TXT record into an active builder.
+// The caller may continue using the builder following the call.
+func marshalTXTRecord(queryName dns.Name, txt string, builder *dns.Builder) error {
+	var answer dns.TXTResource
+
+	answerHeader := dns.ResourceHeader{
+		Name:  queryName,
+		Type:  dns.TypeTXT,
+		Class: dns.ClassINET,
+		TTL:   uint32(defaultTTL / time.Second),
+	}
+	// Each character-string in a TXT record is at most 255 bytes long.
+	for len(txt) > 255 {
+		answer.TXT = append(answer.TXT, txt[:255])
+		txt = txt[255:]
+	}
+	answer.TXT = append(answer.TXT, txt)
+	return builder.TXTResource(answerHeader, answer)
+}
+
+// marshalSRVRecord serializes an SRV record into an active builder.
+// The caller may continue using the builder following the call.
+func marshalSRVRecord(queryName dns.Name, srv SRV, builder *dns.Builder) error {
+	var err error
+
+	answerHeader := dns.ResourceHeader{
+		Name:  queryName,
+		Type:  dns.TypeSRV,
+		Class: dns.ClassINET,
+		TTL:   uint32(defaultTTL / time.Second),
+	}
+	answer := dns.SRVResource{
+		Priority: srv.Priority,
+		Weight:   srv.Weight,
+		Port:     srv.Port,
+	}
+	answer.Target, err = dns.NewName(srv.Target)
+	if err != nil {
+		return err
+	}
+	return builder.SRVResource(answerHeader, answer)
+}
+
 // marshalResponse serializes the DNS response into a new buffer.
 func marshalResponse(resp *response) ([]byte, error) {
 	resp.Header.Response = true
@@ -420,27 +727,69 @@ func marshalResponse(resp *response) ([]byte, error) {
 	}
 
 	// Only successful responses contain answers.
-	if resp.Header.RCode != dns.RCodeSuccess {
-		return builder.Finish()
-	}
+	if resp.Header.RCode == dns.RCodeSuccess {
+		err = builder.StartAnswers()
+		if err != nil {
+			return nil, err
+		}
 
-	err = builder.StartAnswers()
-	if err != nil {
-		return nil, err
+		switch resp.Question.Type {
+		case dns.TypeA, dns.TypeAAAA, dns.TypeALL:
+			name := resp.Question.Name
+			if resp.CNAME != "" {
+				err = marshalCNAMERecord(name, resp.CNAME, &builder)
+				if err != nil {
+					return nil, err
+				}
+				// The address, if any, belongs to the canonical name.
+				name, err = dns.NewName(resp.CNAME)
+				if err != nil {
+					return nil, err
+				}
+			}
+			switch {
+			case resp.IP.IsZero():
+				// No address, as for an alias of a name outside the map.
+			case resp.IP.Is4():
+				err = marshalARecord(name, resp.IP, &builder)
+			default:
+				err = marshalAAAARecord(name, resp.IP, &builder)
+			}
+		case dns.TypePTR:
+			err = marshalPTRRecord(resp.Question.Name, resp.Name, &builder)
+		case dns.TypeCNAME:
+			if resp.CNAME != "" {
+				err = marshalCNAMERecord(resp.Question.Name, resp.CNAME, &builder)
+			}
+		case dns.TypeTXT:
+			for _, txt := range resp.TXT {
+				err = marshalTXTRecord(resp.Question.Name, txt, &builder)
+				if err != nil {
+					break
+				}
+			}
+		case dns.TypeSRV:
+			for _, srv := range resp.SRV {
+				err = marshalSRVRecord(resp.Question.Name, srv, &builder)
+				if err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	switch resp.Question.Type {
-	case dns.TypeA, dns.TypeAAAA, dns.TypeALL:
-		if resp.IP.Is4() {
-			err = marshalARecord(resp.Question.Name, resp.IP, &builder)
-		} else {
-			err = marshalAAAARecord(resp.Question.Name, resp.IP, &builder)
+	if resp.EDNS0 {
+		err = builder.StartAdditionals()
+		if err != nil {
+			return nil, err
+		}
+		err = marshalOPTRecord(&builder)
+		if err != nil {
+			return nil, err
 		}
-	case dns.TypePTR:
-		err = marshalPTRRecord(resp.Question.Name, resp.Name, &builder)
-	}
-	if err != nil {
-		return nil, err
 	}
 
 	return builder.Finish()
@@ -548,7 +897,7 @@ func (r *Resolver) respondReverse(query []byte, resp *response) ([]byte, error)
 	}
 
 	if shouldDelegate {
-		out, err := r.delegate(query)
+		out, err := r.delegate(query, resp)
 		if err != nil {
 			r.logf("delegating rdns: %v", err)
 			resp.Header.RCode = dns.RCodeServerFailure
@@ -560,9 +909,10 @@ func (r *Resolver) respondReverse(query []byte, resp *response) ([]byte, error)
 	return marshalResponse(resp)
 }
 
-// respond returns a DNS response to query.
-func (r *Resolver) respond(query []byte) ([]byte, error) {
+// respond returns a DNS response to query, which was received over TCP if tcp is set.
+func (r *Resolver) respond(query []byte, tcp bool) ([]byte, error) {
 	resp := new(response)
+	resp.TCP = tcp
 
 	// ParseQuery is sufficiently fast to run on every DNS packet.
 	// This is considerably simpler than extracting the name by hand
@@ -586,7 +936,7 @@ func (r *Resolver) respond(query []byte) ([]byte, error) {
 	// We do this on bytes because Name.String() allocates.
 	rawName := resp.Question.Name.Data[:resp.Question.Name.Length]
 	if !bytes.HasSuffix(rawName, r.rootDomain) {
-		out, err := r.delegate(query)
+		out, err := r.delegate(query, resp)
 		if err != nil {
 			r.logf("delegating: %v", err)
 			resp.Header.RCode = dns.RCodeServerFailure
@@ -599,9 +949,12 @@ func (r *Resolver) respond(query []byte) ([]byte, error) {
 	case dns.TypeA, dns.TypeAAAA, dns.TypeALL:
 		name := resp.Question.Name.String()
 		resp.IP, resp.Header.RCode, err = r.Resolve(name)
+		if err == nil && resp.Header.RCode == dns.RCodeNameError {
+			// The name may be an alias or only have other records.
+			resp.Header.RCode, err = r.resolveRecords(name, resp)
+		}
 	default:
-		resp.Header.RCode = dns.RCodeNotImplemented
-		err = errNotImplemented
+		resp.Header.RCode, err = r.resolveRecords(resp.Question.Name.String(), resp)
 	}
 	// We will not return this error: it is the sender's fault.
 	if err != nil {
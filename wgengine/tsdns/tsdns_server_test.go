@@ -5,6 +5,8 @@
 package tsdns
 
 import (
+	"sync/atomic"
+
 	"github.com/miekg/dns"
 	"inet.af/netaddr"
 )
@@ -19,6 +21,11 @@ var dnsHandleFunc = dns.HandleFunc
 // to queries of type A it receives with an A record containing ipv4
 // and to queries of type AAAA with an AAAA records containing ipv6.
 func resolveToIP(ipv4, ipv6 netaddr.IP) dns.HandlerFunc {
+	return resolveToIPWithTTL(ipv4, ipv6, 0)
+}
+
+// resolveToIPWithTTL is like resolveToIP, but the records have the given TTL.
+func resolveToIPWithTTL(ipv4, ipv6 netaddr.IP, ttl uint32) dns.HandlerFunc {
 	return func(w dns.ResponseWriter, req *dns.Msg) {
 		m := new(dns.Msg)
 		m.SetReply(req)
@@ -35,6 +42,7 @@ func resolveToIP(ipv4, ipv6 netaddr.IP) dns.HandlerFunc {
 					Name:   question.Name,
 					Rrtype: dns.TypeA,
 					Class:  dns.ClassINET,
+					Ttl:    ttl,
 				},
 				A: ipv4.IPAddr().IP,
 			}
@@ -44,6 +52,7 @@ func resolveToIP(ipv4, ipv6 netaddr.IP) dns.HandlerFunc {
 					Name:   question.Name,
 					Rrtype: dns.TypeAAAA,
 					Class:  dns.ClassINET,
+					Ttl:    ttl,
 				},
 				AAAA: ipv6.IPAddr().IP,
 			}
@@ -54,14 +63,38 @@ func resolveToIP(ipv4, ipv6 netaddr.IP) dns.HandlerFunc {
 	}
 }
 
+// resolveToManyIPs returns a handler function which responds
+// to queries of type A with n A records, making for a response
+// too large for UDP without EDNS0.
+func resolveToManyIPs(n int) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+
+		question := req.Question[0]
+		for i := 0; i < n; i++ {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   question.Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+				},
+				A: netaddr.IPv4(100, 64, 0, byte(i)).IPAddr().IP,
+			})
+		}
+
+		w.WriteMsg(m)
+	}
+}
+
 func resolveToNXDOMAIN(w dns.ResponseWriter, req *dns.Msg) {
 	m := new(dns.Msg)
 	m.SetRcode(req, dns.RcodeNameError)
 	w.WriteMsg(m)
 }
 
-func serveDNS(addr string) (*dns.Server, chan error) {
-	server := &dns.Server{Addr: addr, Net: "udp"}
+func serveDNS(network, addr string) (*dns.Server, chan error) {
+	server := &dns.Server{Addr: addr, Net: network}
 
 	waitch := make(chan struct{})
 	server.NotifyStartedFunc = func() { close(waitch) }
@@ -75,3 +108,11 @@ func serveDNS(addr string) (*dns.Server, chan error) {
 	<-waitch
 	return server, errch
 }
+
+// countingHandler wraps h, counting the queries it handles in *n.
+func countingHandler(n *int32, h dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(n, 1)
+		h(w, req)
+	}
+}
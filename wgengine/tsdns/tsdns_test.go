@@ -7,7 +7,11 @@ package tsdns
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 
 	dns "golang.org/x/net/dns/dnsmessage"
@@ -45,6 +49,28 @@ func dnspacket(domain string, tp dns.Type) []byte {
 	return payload
 }
 
+// dnspacketEDNS is like dnspacket, but the query includes
+// an EDNS0 OPT record advertising the given UDP payload size.
+func dnspacketEDNS(domain string, tp dns.Type, size uint16) []byte {
+	var dnsHeader dns.Header
+	question := dns.Question{
+		Name:  dns.MustNewName(domain),
+		Type:  tp,
+		Class: dns.ClassINET,
+	}
+
+	builder := dns.NewBuilder(nil, dnsHeader)
+	builder.StartQuestions()
+	builder.Question(question)
+	builder.StartAdditionals()
+	var opt dns.ResourceHeader
+	opt.SetEDNS0(int(size), dns.RCodeSuccess, false)
+	builder.OPTResource(opt, dns.OPTResource{})
+	payload, _ := builder.Finish()
+
+	return payload
+}
+
 func extractipcode(response []byte) (netaddr.IP, dns.RCode, error) {
 	var ip netaddr.IP
 	var parser dns.Parser
@@ -97,6 +123,47 @@ func syncRespond(r *Resolver, query []byte) ([]byte, error) {
 	return resp.Payload, err
 }
 
+func syncRespondTCP(r *Resolver, query []byte) ([]byte, error) {
+	request := Packet{Payload: query, TCP: true}
+	r.EnqueueRequest(request)
+	resp, err := r.NextResponse()
+	if !resp.TCP {
+		return nil, errors.New("response to TCP query not marked TCP")
+	}
+	return resp.Payload, err
+}
+
+// parseResponse returns the header of response, the number of answers in it,
+// and the UDP payload size of its OPT record, or zero if there is none.
+func parseResponse(response []byte) (h dns.Header, answers int, ednsSize int, err error) {
+	var parser dns.Parser
+
+	h, err = parser.Start(response)
+	if err != nil {
+		return h, 0, 0, err
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return h, 0, 0, err
+	}
+	ans, err := parser.AllAnswers()
+	if err != nil {
+		return h, 0, 0, err
+	}
+	if err := parser.SkipAllAuthorities(); err != nil {
+		return h, 0, 0, err
+	}
+	extra, err := parser.AllAdditionals()
+	if err != nil {
+		return h, 0, 0, err
+	}
+	for _, rr := range extra {
+		if rr.Header.Type == dns.TypeOPT {
+			ednsSize = int(rr.Header.Class)
+		}
+	}
+	return h, len(ans), ednsSize, nil
+}
+
 func mustIP(str string) netaddr.IP {
 	ip, err := netaddr.ParseIP(str)
 	if err != nil {
@@ -247,8 +314,8 @@ func TestDelegate(t *testing.T) {
 	dnsHandleFunc("test.site.", resolveToIP(testipv4, testipv6))
 	dnsHandleFunc("nxdomain.site.", resolveToNXDOMAIN)
 
-	v4server, v4errch := serveDNS("127.0.0.1:0")
-	v6server, v6errch := serveDNS("[::1]:0")
+	v4server, v4errch := serveDNS("udp", "127.0.0.1:0")
+	v6server, v6errch := serveDNS("udp", "[::1]:0")
 
 	defer func() {
 		if err := <-v4errch; err != nil {
@@ -311,6 +378,312 @@ func TestDelegate(t *testing.T) {
 	}
 }
 
+func TestDelegateLarge(t *testing.T) {
+	const numAnswers = 40
+	dnsHandleFunc("large.site.", resolveToManyIPs(numAnswers))
+
+	udpServer, udpErrch := serveDNS("udp", "127.0.0.1:0")
+	if udpServer == nil {
+		t.Fatal(<-udpErrch)
+	}
+	defer func() {
+		if err := <-udpErrch; err != nil {
+			t.Errorf("UDP server error: %v", err)
+		}
+	}()
+	defer udpServer.Shutdown()
+
+	// The TCP server shares the UDP server's port, like a real nameserver.
+	addr := udpServer.PacketConn.LocalAddr().String()
+	tcpServer, tcpErrch := serveDNS("tcp", addr)
+	if tcpServer == nil {
+		t.Fatal(<-tcpErrch)
+	}
+	defer func() {
+		if err := <-tcpErrch; err != nil {
+			t.Errorf("TCP server error: %v", err)
+		}
+	}()
+	defer tcpServer.Shutdown()
+
+	r := NewResolver(t.Logf, "ipn.dev")
+	r.SetNameservers([]string{addr})
+	r.Start()
+
+	tests := []struct {
+		name      string
+		query     []byte
+		tcp       bool
+		truncated bool
+		answers   int
+		ednsSize  int
+	}{
+		{"udp", dnspacket("large.site.", dns.TypeA), false, true, 0, 0},
+		{"udp_edns", dnspacketEDNS("large.site.", dns.TypeA, 4096), false, false, numAnswers, 0},
+		{"udp_edns_small", dnspacketEDNS("large.site.", dns.TypeA, 512), false, true, 0, ednsBufferSize},
+		{"tcp", dnspacket("large.site.", dns.TypeA), true, false, numAnswers, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp []byte
+			var err error
+			if tt.tcp {
+				resp, err = syncRespondTCP(r, tt.query)
+			} else {
+				resp, err = syncRespond(r, tt.query)
+			}
+			if err != nil {
+				t.Fatalf("err = %v; want nil", err)
+			}
+			if !tt.tcp && len(resp) > ednsBufferSize {
+				t.Errorf("UDP response size = %d; want at most %d", len(resp), ednsBufferSize)
+			}
+			h, answers, ednsSize, err := parseResponse(resp)
+			if err != nil {
+				t.Fatalf("parse: err = %v; want nil (in %x)", err, resp)
+			}
+			if h.Truncated != tt.truncated {
+				t.Errorf("truncated = %v; want %v", h.Truncated, tt.truncated)
+			}
+			if answers != tt.answers {
+				t.Errorf("answers = %d; want %d", answers, tt.answers)
+			}
+			// Upstream responses are passed through as-is unless truncated,
+			// so only truncated responses are known to carry our OPT record.
+			if tt.truncated && ednsSize != tt.ednsSize {
+				t.Errorf("EDNS0 size = %d; want %d", ednsSize, tt.ednsSize)
+			}
+		})
+	}
+}
+
+func TestEDNS0(t *testing.T) {
+	r := NewResolver(t.Logf, "ipn.dev.")
+	r.SetMap(dnsMap)
+	r.Start()
+
+	tests := []struct {
+		name     string
+		query    []byte
+		ednsSize int
+	}{
+		{"plain", dnspacket("test1.ipn.dev.", dns.TypeA), 0},
+		{"edns", dnspacketEDNS("test1.ipn.dev.", dns.TypeA, 4096), ednsBufferSize},
+		{"edns_nxdomain", dnspacketEDNS("test3.ipn.dev.", dns.TypeA, 4096), ednsBufferSize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := syncRespond(r, tt.query)
+			if err != nil {
+				t.Fatalf("err = %v; want nil", err)
+			}
+			_, _, ednsSize, err := parseResponse(resp)
+			if err != nil {
+				t.Fatalf("parse: err = %v; want nil (in %x)", err, resp)
+			}
+			if ednsSize != tt.ednsSize {
+				t.Errorf("EDNS0 size = %d; want %d", ednsSize, tt.ednsSize)
+			}
+		})
+	}
+}
+
+func TestDelegateSplit(t *testing.T) {
+	dnsHandleFunc("corp.example.com.", resolveToIP(testipv4, testipv6))
+	dnsHandleFunc("db.internal.", resolveToIP(testipv4, testipv6))
+
+	server, errch := serveDNS("udp", "127.0.0.1:0")
+	if server == nil {
+		t.Fatal(<-errch)
+	}
+	defer func() {
+		if err := <-errch; err != nil {
+			t.Errorf("server error: %v", err)
+		}
+	}()
+	defer server.Shutdown()
+
+	// There are no default nameservers, so only routed queries can succeed.
+	addr := server.PacketConn.LocalAddr().String()
+	r := NewResolver(t.Logf, "ipn.dev.")
+	r.SetMap(NewMapFromConfig(MapConfig{Routes: map[string][]string{
+		"corp.example.com": {addr},
+		"*.internal":       {addr},
+	}}))
+	r.Start()
+
+	tests := []struct {
+		name  string
+		query []byte
+		ip    netaddr.IP
+		code  dns.RCode
+	}{
+		{"routed", dnspacket("corp.example.com.", dns.TypeA), testipv4, dns.RCodeSuccess},
+		{"routed_wildcard", dnspacket("db.internal.", dns.TypeA), testipv4, dns.RCodeSuccess},
+		{"wildcard_parent", dnspacket("internal.", dns.TypeA), netaddr.IP{}, dns.RCodeServerFailure},
+		{"default", dnspacket("example.com.", dns.TypeA), netaddr.IP{}, dns.RCodeServerFailure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := syncRespond(r, tt.query)
+			if err != nil {
+				t.Fatalf("err = %v; want nil", err)
+			}
+			ip, code, err := extractipcode(resp)
+			if err != nil {
+				t.Fatalf("extract: err = %v; want nil (in %x)", err, resp)
+			}
+			if code != tt.code {
+				t.Errorf("code = %v; want %v", code, tt.code)
+			}
+			if ip != tt.ip {
+				t.Errorf("ip = %v; want %v", ip, tt.ip)
+			}
+		})
+	}
+}
+
+func TestDelegateCache(t *testing.T) {
+	var queries int32
+	dnsHandleFunc("cached.site.", countingHandler(&queries, resolveToIPWithTTL(testipv4, testipv6, 300)))
+	// resolveToIP answers with a zero TTL, which is not cached.
+	dnsHandleFunc("uncached.site.", countingHandler(&queries, resolveToIP(testipv4, testipv6)))
+
+	server, errch := serveDNS("udp", "127.0.0.1:0")
+	if server == nil {
+		t.Fatal(<-errch)
+	}
+	defer func() {
+		if err := <-errch; err != nil {
+			t.Errorf("server error: %v", err)
+		}
+	}()
+	defer server.Shutdown()
+
+	nameservers := []string{server.PacketConn.LocalAddr().String()}
+	r := NewResolver(t.Logf, "ipn.dev.")
+	r.SetNameservers(nameservers)
+	r.Start()
+
+	query := func(name string, want int32) {
+		t.Helper()
+		resp, err := syncRespond(r, dnspacket(name, dns.TypeA))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ip, _, err := extractipcode(resp); err != nil || ip != testipv4 {
+			t.Errorf("%s: ip = %v, %v; want %v", name, ip, err, testipv4)
+		}
+		if got := atomic.LoadInt32(&queries); got != want {
+			t.Errorf("%s: upstream queries = %d; want %d", name, got, want)
+		}
+	}
+
+	query("uncached.site.", 1)
+	query("uncached.site.", 2)
+
+	query("cached.site.", 3)
+	query("cached.site.", 3)
+	// Case does not matter to the cache.
+	query("CACHED.site.", 3)
+
+	// Changing nameservers flushes the cache.
+	r.SetNameservers(nameservers)
+	query("cached.site.", 4)
+	query("cached.site.", 4)
+
+	r.FlushCache()
+	query("cached.site.", 5)
+}
+
+func TestResolveRecords(t *testing.T) {
+	r := NewResolver(t.Logf, "ipn.dev.")
+	r.SetMap(NewMapFromConfig(MapConfig{
+		NameToIP: map[string]netaddr.IP{
+			"test1.ipn.dev": testipv4,
+		},
+		CNAME: map[string]string{
+			"alias.ipn.dev":    "test1.ipn.dev",
+			"external.ipn.dev": "example.com",
+		},
+		TXT: map[string][]string{
+			"test1.ipn.dev": {"hello", strings.Repeat("x", 300)},
+		},
+		SRV: map[string][]SRV{
+			"_ssh._tcp.test1.ipn.dev": {{Port: 22, Target: "test1.ipn.dev"}},
+		},
+	}))
+	r.Start()
+
+	tests := []struct {
+		name  string
+		query []byte
+		code  dns.RCode
+		want  []string
+	}{
+		{"cname", dnspacket("alias.ipn.dev.", dns.TypeCNAME), dns.RCodeSuccess,
+			[]string{"CNAME test1.ipn.dev."}},
+		{"cname_a", dnspacket("alias.ipn.dev.", dns.TypeA), dns.RCodeSuccess,
+			[]string{"CNAME test1.ipn.dev.", "A test1.ipn.dev. 1.2.3.4"}},
+		{"cname_external", dnspacket("external.ipn.dev.", dns.TypeA), dns.RCodeSuccess,
+			[]string{"CNAME example.com."}},
+		{"txt", dnspacket("test1.ipn.dev.", dns.TypeTXT), dns.RCodeSuccess,
+			[]string{"TXT hello", "TXT " + strings.Repeat("x", 255) + "," + strings.Repeat("x", 45)}},
+		{"srv", dnspacket("_ssh._tcp.test1.ipn.dev.", dns.TypeSRV), dns.RCodeSuccess,
+			[]string{"SRV 0 0 22 test1.ipn.dev."}},
+		{"nodata", dnspacket("test1.ipn.dev.", dns.TypeSRV), dns.RCodeSuccess, nil},
+		{"nodata_a", dnspacket("_ssh._tcp.test1.ipn.dev.", dns.TypeA), dns.RCodeSuccess, nil},
+		{"nxdomain", dnspacket("test3.ipn.dev.", dns.TypeTXT), dns.RCodeNameError, nil},
+		{"notimpl", dnspacket("test1.ipn.dev.", dns.TypeMX), dns.RCodeNotImplemented, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := syncRespond(r, tt.query)
+			if err != nil {
+				t.Fatalf("err = %v; want nil", err)
+			}
+
+			var parser dns.Parser
+			h, err := parser.Start(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.RCode != tt.code {
+				t.Errorf("code = %v; want %v", h.RCode, tt.code)
+			}
+			if err := parser.SkipAllQuestions(); err != nil {
+				t.Fatal(err)
+			}
+			answers, err := parser.AllAnswers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, ans := range answers {
+				switch body := ans.Body.(type) {
+				case *dns.CNAMEResource:
+					got = append(got, "CNAME "+body.CNAME.String())
+				case *dns.AResource:
+					got = append(got, "A "+ans.Header.Name.String()+" "+netaddr.IPv4(body.A[0], body.A[1], body.A[2], body.A[3]).String())
+				case *dns.TXTResource:
+					got = append(got, "TXT "+strings.Join(body.TXT, ","))
+				case *dns.SRVResource:
+					got = append(got, fmt.Sprintf("SRV %d %d %d %s", body.Priority, body.Weight, body.Port, body.Target))
+				default:
+					got = append(got, ans.Header.Type.String())
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("answers = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestConcurrentSetMap(t *testing.T) {
 	r := NewResolver(t.Logf, "ipn.dev.")
 	r.Start()
@@ -10,6 +10,7 @@ import (
 	"errors"
 	"io"
 	"os"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -32,6 +33,10 @@ const PacketStartOffset = device.MessageTransportHeaderSize
 // of a packet that can be injected into a tstun.TUN.
 const MaxPacketSize = device.MaxContentSize
 
+// debugFilterAccepts is whether accepted packets are recorded in the
+// filter's decision log, in addition to dropped ones.
+var debugFilterAccepts, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_FILTER_ACCEPTS"))
+
 var (
 	// ErrClosed is returned when attempting an operation on a closed TUN.
 	ErrClosed = errors.New("device closed")
@@ -121,7 +126,10 @@ func WrapTUN(logf logger.Logf, tdev tun.Device) *TUN {
 		errors:         make(chan error),
 		outbound:       make(chan []byte),
 		// TODO(dmytro): (highly rate-limited) hexdumps should happen on unknown packets.
-		filterFlags: filter.LogAccepts | filter.LogDrops,
+		filterFlags: filter.LogAccepts | filter.LogDrops | filter.RecordDrops,
+	}
+	if debugFilterAccepts {
+		tun.filterFlags |= filter.RecordAccepts
 	}
 
 	go tun.poll()
@@ -58,7 +58,7 @@ func setfilter(logf logger.Logf, tun *TUN) {
 	localNets := []filter.Net{
 		filterNet(packet.IP(0x01020304), filter.Netmask(16)),
 	}
-	tun.SetFilter(filter.New(matches, localNets, nil, logf))
+	tun.SetFilter(filter.New(matches, localNets, nil, nil, logf))
 }
 
 func newChannelTUN(logf logger.Logf, secure bool) (*tuntest.ChannelTUN, *TUN) {
@@ -92,6 +92,7 @@ type userspaceEngine struct {
 	wgdev     *device.Device
 	router    router.Router
 	resolver  *tsdns.Resolver
+	dnsTCP    *dnsTCP // serves DNS over TCP on the magic DNS IP using resolver
 	magicConn *magicsock.Conn
 	linkMon   *monitor.Mon
 
@@ -210,6 +211,7 @@ func newUserspaceEngineAdvanced(conf EngineConfig) (_ Engine, reterr error) {
 		resolver: tsdns.NewResolver(logf, magicDNSDomain),
 		pingers:  make(map[wgcfg.Key]*pinger),
 	}
+	e.dnsTCP = newDNSTCP(logf, e.resolver, e.tundev.InjectInboundDirect)
 	e.localAddrs.Store(map[packet.IP]bool{})
 	e.linkState, _ = getLinkState()
 
@@ -358,7 +360,9 @@ func newUserspaceEngineAdvanced(conf EngineConfig) (_ Engine, reterr error) {
 
 // echoRespondToAll is an inbound post-filter responding to all echo requests.
 func echoRespondToAll(p *packet.ParsedPacket, t *tstun.TUN) filter.Response {
-	if p.IsEchoRequest() {
+	// TODO: respond to ICMPv6 echo requests too; ICMPHeader only
+	// knows how to generate IPv4 packets.
+	if p.IPVersion == 4 && p.IsEchoRequest() {
 		header := p.ICMPHeader()
 		header.ToResponse()
 		packet := packet.Generate(&header, p.Payload())
@@ -414,6 +418,10 @@ func (e *userspaceEngine) handleDNS(p *packet.ParsedPacket, t *tstun.TUN) filter
 		}
 		return filter.Drop
 	}
+	if p.DstIP == magicDNSIP && p.DstPort == magicDNSPort && p.IPProto == packet.TCP {
+		e.dnsTCP.handle(p)
+		return filter.Drop
+	}
 	return filter.Accept
 }
 
@@ -426,6 +434,13 @@ func (e *userspaceEngine) pollResolver() {
 		}
 		if err != nil {
 			e.logf("tsdns: error: %v", err)
+			if resp.TCP {
+				e.dnsTCP.queryFailed(resp.Addr)
+			}
+			continue
+		}
+		if resp.TCP {
+			e.dnsTCP.writeResponse(resp)
 			continue
 		}
 
@@ -1107,6 +1122,9 @@ func (e *userspaceEngine) LinkChange(isExpensive bool) {
 
 	e.logf("LinkChange(isExpensive=%v); needsRebind=%v", isExpensive, needRebind)
 
+	// Upstream nameservers may answer differently on the new network.
+	e.resolver.FlushCache()
+
 	why := "link-change-minor"
 	if needRebind {
 		why = "link-change-major"
@@ -1154,9 +1172,19 @@ func (e *userspaceEngine) UpdateStatus(sb *ipnstate.StatusBuilder) {
 		})
 	}
 
+	if filt := e.tundev.GetFilter(); filt != nil {
+		for _, d := range filt.Decisions() {
+			sb.AddFilterDecision(d)
+		}
+	}
+
 	e.magicConn.UpdateStatus(sb)
 }
 
+func (e *userspaceEngine) Ping(ip netaddr.IP, cb func(*ipnstate.PingResult)) {
+	e.magicConn.Ping(ip, cb)
+}
+
 // diagnoseTUNFailure is called if tun.CreateTUN fails, to poke around
 // the system and log some diagnostic info that might help debug why
 // TUN failed. Because TUN's already failed and things the program's